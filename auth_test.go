@@ -3,18 +3,26 @@ package stunner
 import (
 	"crypto/hmac"
 	"crypto/sha1" //nolint:gosec,gci
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/pion/stun/v3"
 	"github.com/pion/transport/v4/test"
 	"github.com/pion/turn/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
 	"github.com/l7mp/stunner/pkg/logger"
 )
 
@@ -37,6 +45,26 @@ func longTermCredentials(username string, sharedSecret string) (string, error) {
 	return base64.StdEncoding.EncodeToString(password), nil
 }
 
+// testJWTKey is the HS256 key of testJWTKeySet.
+var testJWTKey = []byte("my-jwt-signing-key")
+
+var testJWTKeySet = fmt.Sprintf(`{"keys":[{"kty":"oct","kid":"test","alg":"HS256","k":%q}]}`,
+	base64.RawURLEncoding.EncodeToString(testJWTKey))
+
+// signTestJWT creates an HS256 signed JSON Web Token with the given claims.
+func signTestJWT(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, testJWTKey)
+	mac.Write([]byte(signed)) //nolint:errcheck
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// testWebhookURL is replaced with the URL of the test authorization webhook.
+const testWebhookURL = "http://webhook.invalid"
+
 type StunnerTestAuthWithVnet struct {
 	testName   string
 	conf       stnrv1.StunnerConfig
@@ -102,6 +130,35 @@ var testStunnerAuthWithVnet = []StunnerTestAuthWithVnet{
 		},
 		auth: func() (string, string) { return "user1", "passwd1" },
 	},
+	{
+		testName:   "static-multi",
+		clientAddr: "1.1.1.1",
+		conf: stnrv1.StunnerConfig{
+			ApiVersion: stnrv1.ApiVersion,
+			Admin: stnrv1.AdminConfig{
+				LogLevel: stunnerTestLoglevel,
+			},
+			Auth: stnrv1.AuthConfig{
+				Type: "static-multi",
+				Users: []stnrv1.UserCredential{
+					{Username: "user1", Password: "passwd1"},
+					{Username: "user2", Password: "passwd2"},
+				},
+			},
+			Listeners: []stnrv1.ListenerConfig{{
+				Name:     "udp",
+				Protocol: "turn-udp",
+				Addr:     "1.2.3.4",
+				Port:     3478,
+				Routes:   []string{"allow-any"},
+			}},
+			Clusters: []stnrv1.ClusterConfig{{
+				Name:      "allow-any",
+				Endpoints: []string{"0.0.0.0/0"},
+			}},
+		},
+		auth: func() (string, string) { return "user2", "passwd2" },
+	},
 	{
 		testName: "ephemeral - plain timestamp in username",
 		conf: stnrv1.StunnerConfig{
@@ -228,6 +285,103 @@ var testStunnerAuthWithVnet = []StunnerTestAuthWithVnet{
 			return u, p
 		},
 	},
+	{
+		testName: "jwt - password derived from shared secret",
+		conf: stnrv1.StunnerConfig{
+			ApiVersion: stnrv1.ApiVersion,
+			Admin: stnrv1.AdminConfig{
+				LogLevel: stunnerTestLoglevel,
+			},
+			Auth: stnrv1.AuthConfig{
+				Type: "jwt",
+				Credentials: map[string]string{
+					"secret": "my-secret",
+				},
+				JWT: &stnrv1.JWTConfig{KeySet: testJWTKeySet},
+			},
+			Listeners: []stnrv1.ListenerConfig{{
+				Name:     "udp",
+				Protocol: "turn-udp",
+				Addr:     "1.2.3.4",
+				Port:     3478,
+				Routes:   []string{"allow-any"},
+			}},
+			Clusters: []stnrv1.ClusterConfig{{
+				Name:      "allow-any",
+				Endpoints: []string{"0.0.0.0/0"},
+			}},
+		},
+		auth: func() (string, string) {
+			u := signTestJWT(map[string]any{
+				"sub": "dummy-user-id",
+				"exp": time.Now().Add(time.Minute).Unix(),
+			})
+			p, _ := longTermCredentials(u, "my-secret")
+			return u, p
+		},
+	},
+	{
+		testName: "jwt - password in claim",
+		conf: stnrv1.StunnerConfig{
+			ApiVersion: stnrv1.ApiVersion,
+			Admin: stnrv1.AdminConfig{
+				LogLevel: stunnerTestLoglevel,
+			},
+			Auth: stnrv1.AuthConfig{
+				Type: "jwt",
+				JWT: &stnrv1.JWTConfig{
+					KeySet:        testJWTKeySet,
+					Issuer:        "my-issuer",
+					PasswordClaim: "turn_password",
+				},
+			},
+			Listeners: []stnrv1.ListenerConfig{{
+				Name:     "udp",
+				Protocol: "turn-udp",
+				Addr:     "1.2.3.4",
+				Port:     3478,
+				Routes:   []string{"allow-any"},
+			}},
+			Clusters: []stnrv1.ClusterConfig{{
+				Name:      "allow-any",
+				Endpoints: []string{"0.0.0.0/0"},
+			}},
+		},
+		auth: func() (string, string) {
+			u := signTestJWT(map[string]any{
+				"sub":           "dummy-user-id",
+				"iss":           "my-issuer",
+				"exp":           time.Now().Add(time.Minute).Unix(),
+				"turn_password": "my-password",
+			})
+			return u, "my-password"
+		},
+	},
+	{
+		testName: "webhook",
+		conf: stnrv1.StunnerConfig{
+			ApiVersion: stnrv1.ApiVersion,
+			Admin: stnrv1.AdminConfig{
+				LogLevel: stunnerTestLoglevel,
+			},
+			Auth: stnrv1.AuthConfig{
+				Type:    "webhook",
+				Webhook: &stnrv1.WebhookConfig{URL: testWebhookURL},
+			},
+			Listeners: []stnrv1.ListenerConfig{{
+				Name:     "udp",
+				Protocol: "turn-udp",
+				Addr:     "1.2.3.4",
+				Port:     3478,
+				Routes:   []string{"allow-any"},
+			}},
+			Clusters: []stnrv1.ClusterConfig{{
+				Name:      "allow-any",
+				Endpoints: []string{"0.0.0.0/0"},
+			}},
+		},
+		auth: func() (string, string) { return "webhook-user", "webhook-passwd" },
+	},
 }
 
 func TestStunnerAuthServerVNet(t *testing.T) {
@@ -240,10 +394,25 @@ func TestStunnerAuthServerVNet(t *testing.T) {
 	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
 	log := loggerFactory.NewLogger("test")
 
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := a12n.WebhookRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username != "webhook-user" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(a12n.WebhookResponse{Password: "webhook-passwd"}) //nolint:errcheck
+	}))
+	defer webhook.Close()
+
 	for _, test := range testStunnerAuthWithVnet {
 		t.Run(test.testName, func(t *testing.T) {
 			log.Debugf("-------------- Running test: %s -------------", test.testName)
 			c := test.conf
+			if c.Auth.Webhook != nil && c.Auth.Webhook.URL == testWebhookURL {
+				w := *c.Auth.Webhook
+				w.URL = webhook.URL
+				c.Auth.Webhook = &w
+			}
 
 			// patch in the vnet
 			log.Debug("building virtual network")
@@ -277,3 +446,393 @@ func TestStunnerAuthServerVNet(t *testing.T) {
 		})
 	}
 }
+
+func TestStunnerUserClustersVNet(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	conf := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin:      stnrv1.AdminConfig{LogLevel: stunnerTestLoglevel},
+		Auth: stnrv1.AuthConfig{
+			Type: "static-multi",
+			Users: []stnrv1.UserCredential{
+				{Username: "user-a", Password: "passwd-a"},
+				{Username: "user-b", Password: "passwd-b", Clusters: []string{"tenant-b"}},
+			},
+			UserClusters: map[string][]string{"user-*": {"tenant-a"}},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "1.2.3.4",
+			Port:     3478,
+			Routes:   []string{"tenant-a", "tenant-b"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "tenant-a",
+			Endpoints: []string{"1.2.3.5"},
+		}, {
+			Name:      "tenant-b",
+			Endpoints: []string{"1.2.3.6"},
+		}},
+	}
+
+	for _, c := range []struct {
+		user, pass string
+		success    bool
+	}{
+		{"user-a", "passwd-a", true},
+		{"user-b", "passwd-b", false},
+	} {
+		t.Run(c.user, func(t *testing.T) {
+			v, err := buildVNet(loggerFactory)
+			assert.NoError(t, err, err)
+
+			stunner := NewStunner(Options{
+				LogOptions:       LogOptions{Level: stunnerTestLoglevel},
+				SuppressRollback: true,
+				Net:              v.podnet,
+			})
+			assert.NoError(t, stunner.Reconcile(&conf), "starting server")
+
+			// A client without an allocation has no known user and fails closed.
+			h := newPermissionHandler(stunner, stunner.GetListener("udp"))
+			assert.False(t, h(&net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 1}, net.ParseIP("1.2.3.5")),
+				"unknown user")
+
+			lconn, err := v.wan.ListenPacket("udp4", "0.0.0.0:0")
+			assert.NoError(t, err, "cannot create client listening socket")
+
+			log.Debugf("user %s reaching tenant-a: expected success: %t", c.user, c.success)
+			testConfig := echoTestConfig{t, v.podnet, v.wan, stunner,
+				"stunner.l7mp.io:3478", lconn, c.user, c.pass, net.IPv4(5, 6, 7, 8),
+				"1.2.3.5:5678", true, true, c.success, loggerFactory, ""}
+			stunnerEchoTest(testConfig)
+
+			assert.NoError(t, lconn.Close(), "cannot close TURN client connection")
+			stunner.Close()
+			assert.NoError(t, v.Close(), "cannot close VNet")
+		})
+	}
+}
+
+// TestStunnerTokenClustersVNet checks that the clusters claimed by the token of an allocation stick
+// to the allocation, even if another allocation of the same user presents a token without the
+// claim later.
+func TestStunnerTokenClustersVNet(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+
+	conf := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin:      stnrv1.AdminConfig{LogLevel: stunnerTestLoglevel},
+		Auth: stnrv1.AuthConfig{
+			Type:        "jwt",
+			Credentials: map[string]string{"secret": "my-secret"},
+			JWT:         &stnrv1.JWTConfig{KeySet: testJWTKeySet, ClustersClaim: "clusters"},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "1.2.3.4",
+			Port:     3478,
+			Routes:   []string{"tenant-a", "tenant-b"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "tenant-a",
+			Endpoints: []string{"1.2.3.5"},
+		}, {
+			Name:      "tenant-b",
+			Endpoints: []string{"1.2.3.6"},
+		}},
+	}
+
+	v, err := buildVNet(loggerFactory)
+	require.NoError(t, err)
+	defer v.Close() //nolint:errcheck
+	stunner := NewStunner(Options{
+		LogOptions:       LogOptions{Level: stunnerTestLoglevel},
+		SuppressRollback: true,
+		Net:              v.podnet,
+	})
+	defer stunner.Close()
+	require.NoError(t, stunner.Reconcile(&conf), "starting server")
+
+	allocate := func(claims map[string]any) (net.PacketConn, func()) {
+		claims["sub"] = "user"
+		claims["exp"] = time.Now().Add(time.Minute).Unix()
+		u := signTestJWT(claims)
+		p, err := longTermCredentials(u, "my-secret")
+		require.NoError(t, err)
+		lconn, err := v.wan.ListenPacket("udp4", "0.0.0.0:0")
+		require.NoError(t, err)
+		client, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: "stunner.l7mp.io:3478",
+			TURNServerAddr: "stunner.l7mp.io:3478",
+			Username:       u,
+			Password:       p,
+			Conn:           lconn,
+			Net:            v.wan,
+			LoggerFactory:  loggerFactory,
+		})
+		require.NoError(t, err)
+		require.NoError(t, client.Listen())
+		alloc, err := client.Allocate()
+		require.NoError(t, err)
+		return alloc, func() {
+			alloc.Close() //nolint:errcheck
+			client.Close()
+			lconn.Close() //nolint:errcheck
+		}
+	}
+
+	peer := &net.UDPAddr{IP: net.ParseIP("1.2.3.5"), Port: 5678}
+	restricted, closeRestricted := allocate(map[string]any{"clusters": []string{"tenant-b"}})
+	defer closeRestricted()
+	unrestricted, closeUnrestricted := allocate(map[string]any{})
+	defer closeUnrestricted()
+
+	_, err = unrestricted.WriteTo([]byte("Hello"), peer)
+	assert.NoError(t, err, "token without the clusters claim")
+	_, err = restricted.WriteTo([]byte("Hello"), peer)
+	assert.Error(t, err, "token restricted to another cluster")
+}
+
+func TestStunnerOAuthVNet(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+
+	key := make([]byte, 32)
+	conf := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin:      stnrv1.AdminConfig{LogLevel: stunnerTestLoglevel},
+		Auth: stnrv1.AuthConfig{
+			Type: "oauth",
+			OAuth: &stnrv1.OAuthConfig{
+				AuthorizationServer: "auth.example.com",
+				Keys: []stnrv1.OAuthKey{{
+					KID: "kid-1",
+					Key: base64.StdEncoding.EncodeToString(key),
+				}},
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "1.2.3.4",
+			Port:     3478,
+		}},
+	}
+
+	v, err := buildVNet(loggerFactory)
+	assert.NoError(t, err, err)
+	stunner := NewStunner(Options{
+		LogOptions:       LogOptions{Level: stunnerTestLoglevel},
+		SuppressRollback: true,
+		Net:              v.podnet,
+	})
+	assert.NoError(t, stunner.Reconcile(&conf), "starting server")
+
+	server := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 3478}
+	roundTrip := func(conn net.PacketConn, setters ...stun.Setter) *stun.Message {
+		setters = append([]stun.Setter{stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}},
+			setters...)
+		req, err := stun.Build(setters...)
+		assert.NoError(t, err)
+		_, err = conn.WriteTo(req.Raw, server)
+		assert.NoError(t, err)
+		buf := make([]byte, 1500)
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		assert.NoError(t, err)
+		res := &stun.Message{Raw: buf[:n]}
+		assert.NoError(t, res.Decode())
+		return res
+	}
+	token := func(key []byte) []byte {
+		raw, err := a12n.EncryptAccessToken(key, stnrv1.DefaultRealm, a12n.AccessToken{
+			MACKey:    []byte("0123456789abcdefghij"),
+			Timestamp: time.Now(),
+			Lifetime:  time.Hour,
+		})
+		assert.NoError(t, err)
+		return raw
+	}
+
+	for _, c := range []struct {
+		name    string
+		key     []byte
+		success bool
+	}{
+		{"valid token", key, true},
+		{"invalid token", []byte("0123456789abcdef0123456789abcdef"), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			lconn, err := v.wan.ListenPacket("udp4", "0.0.0.0:0")
+			assert.NoError(t, err, "cannot create client listening socket")
+
+			// The challenge advertises the authorization server.
+			res := roundTrip(lconn)
+			assert.Equal(t, stun.ClassErrorResponse, res.Type.Class)
+			tpa, err := res.Get(a12n.AttrThirdPartyAuthorization)
+			assert.NoError(t, err)
+			assert.Equal(t, "auth.example.com", string(tpa))
+			nonce := stun.Nonce{}
+			assert.NoError(t, nonce.GetFrom(res))
+
+			res = roundTrip(lconn, stun.NewUsername("kid-1"), stun.NewRealm(stnrv1.DefaultRealm),
+				nonce, stun.RawAttribute{Type: a12n.AttrAccessToken, Value: token(c.key)},
+				stun.MessageIntegrity([]byte("0123456789abcdefghij")))
+			if c.success {
+				assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+			} else {
+				assert.Equal(t, stun.ClassErrorResponse, res.Type.Class)
+			}
+
+			assert.NoError(t, lconn.Close(), "cannot close TURN client connection")
+		})
+	}
+
+	stunner.Close()
+	assert.NoError(t, v.Close(), "cannot close VNet")
+}
+
+func TestStunnerPasswordAlgorithmsVNet(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+
+	conf := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin:      stnrv1.AdminConfig{LogLevel: stunnerTestLoglevel},
+		Auth: stnrv1.AuthConfig{
+			Type:               "static",
+			Credentials:        map[string]string{"username": "user1", "password": "passwd1"},
+			PasswordAlgorithms: []string{"SHA-256", "MD5"},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "1.2.3.4",
+			Port:     3478,
+		}},
+	}
+
+	v, err := buildVNet(loggerFactory)
+	assert.NoError(t, err, err)
+	stunner := NewStunner(Options{
+		LogOptions:       LogOptions{Level: stunnerTestLoglevel},
+		SuppressRollback: true,
+		Net:              v.podnet,
+	})
+	assert.NoError(t, stunner.Reconcile(&conf), "starting server")
+
+	server := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 3478}
+	roundTrip := func(conn net.PacketConn, setters ...stun.Setter) *stun.Message {
+		setters = append([]stun.Setter{stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}},
+			setters...)
+		req, err := stun.Build(setters...)
+		assert.NoError(t, err)
+		_, err = conn.WriteTo(req.Raw, server)
+		assert.NoError(t, err)
+		buf := make([]byte, 1500)
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		assert.NoError(t, err)
+		res := &stun.Message{Raw: buf[:n]}
+		assert.NoError(t, res.Decode())
+		return res
+	}
+	// challenge returns the nonce and the password algorithms of a 401 challenge.
+	challenge := func(conn net.PacketConn) (stun.Nonce, a12n.PasswordAlgorithms) {
+		res := roundTrip(conn)
+		code := stun.ErrorCodeAttribute{}
+		assert.NoError(t, code.GetFrom(res))
+		assert.Equal(t, stun.CodeUnauthorized, code.Code)
+		nonce, algorithms := stun.Nonce{}, a12n.PasswordAlgorithms{}
+		assert.NoError(t, nonce.GetFrom(res))
+		assert.NoError(t, algorithms.GetFrom(res))
+		return nonce, algorithms
+	}
+	md5Key := a12n.GenerateAuthKey("user1", stnrv1.DefaultRealm, "passwd1")
+	shaKey := a12n.GenerateAuthKeySHA256("user1", stnrv1.DefaultRealm, "passwd1")
+	credentials := []stun.Setter{stun.NewUsername("user1"), stun.NewRealm(stnrv1.DefaultRealm)}
+
+	// The challenge advertises the password algorithms with a matching nonce.
+	lconn, err := v.wan.ListenPacket("udp4", "0.0.0.0:0")
+	assert.NoError(t, err, "cannot create client listening socket")
+	nonce, algorithms := challenge(lconn)
+	assert.True(t, strings.HasPrefix(nonce.String(), a12n.NonceCookie))
+	assert.Equal(t, a12n.PasswordAlgorithms{"SHA-256", "MD5"}, algorithms)
+
+	// A wrong password or a tampered algorithm list is challenged again.
+	res := roundTrip(lconn, append(credentials, nonce, algorithms,
+		a12n.PasswordAlgorithm(a12n.PasswordAlgorithmSHA256),
+		a12n.MessageIntegritySHA256(a12n.GenerateAuthKeySHA256("user1", stnrv1.DefaultRealm, "wrong")))...)
+	assert.Equal(t, stun.ClassErrorResponse, res.Type.Class)
+	assert.True(t, res.Contains(stun.AttrPasswordAlgorithms))
+	res = roundTrip(lconn, append(credentials, nonce, a12n.PasswordAlgorithms{"MD5"},
+		a12n.PasswordAlgorithm(a12n.PasswordAlgorithmMD5), stun.MessageIntegrity(md5Key))...)
+	assert.Equal(t, stun.ClassErrorResponse, res.Type.Class)
+	assert.True(t, res.Contains(stun.AttrPasswordAlgorithms))
+
+	// SHA-256 requests are verified and the response is signed with SHA-256.
+	res = roundTrip(lconn, append(credentials, nonce, algorithms,
+		a12n.PasswordAlgorithm(a12n.PasswordAlgorithmSHA256), a12n.MessageIntegritySHA256(shaKey))...)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+	assert.NoError(t, a12n.MessageIntegritySHA256(shaKey).Check(res))
+	assert.False(t, res.Contains(stun.AttrMessageIntegrity))
+	assert.NoError(t, lconn.Close(), "cannot close TURN client connection")
+
+	// Clients not supporting RFC 8489 fall back to MD5.
+	lconn, err = v.wan.ListenPacket("udp4", "0.0.0.0:0")
+	assert.NoError(t, err, "cannot create client listening socket")
+	nonce, _ = challenge(lconn)
+	res = roundTrip(lconn, append(credentials, nonce, stun.MessageIntegrity(md5Key))...)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+	assert.NoError(t, stun.MessageIntegrity(md5Key).Check(res))
+	assert.NoError(t, lconn.Close(), "cannot close TURN client connection")
+
+	// MD5 can be disabled.
+	conf.Auth.PasswordAlgorithms = []string{"SHA-256"}
+	assert.NoError(t, stunner.Reconcile(&conf), "reconcile")
+	lconn, err = v.wan.ListenPacket("udp4", "0.0.0.0:0")
+	assert.NoError(t, err, "cannot create client listening socket")
+	nonce, algorithms = challenge(lconn)
+	assert.Equal(t, a12n.PasswordAlgorithms{"SHA-256"}, algorithms)
+	res = roundTrip(lconn, append(credentials, nonce, stun.MessageIntegrity(md5Key))...)
+	assert.Equal(t, stun.ClassErrorResponse, res.Type.Class)
+	res = roundTrip(lconn, append(credentials, nonce, algorithms,
+		a12n.PasswordAlgorithm(a12n.PasswordAlgorithmSHA256), a12n.MessageIntegritySHA256(shaKey))...)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+	assert.NoError(t, a12n.MessageIntegritySHA256(shaKey).Check(res))
+	assert.NoError(t, lconn.Close(), "cannot close TURN client connection")
+
+	stunner.Close()
+	assert.NoError(t, v.Close(), "cannot close VNet")
+}
@@ -33,6 +33,7 @@ func main() {
 	var udpThreadNum = flag.IntP("udp-thread-num", "u", 0,
 		"Number of readloop threads (CPU cores) per UDP listener. Zero disables UDP multithreading (default: 0)")
 	var dryRun = flag.BoolP("dry-run", "d", false, "Suppress side-effects, intended for testing (default: false)")
+	var dnsServer = flag.String("dns-server", "", "Custom DNS server to resolve STRICT_DNS clusters (format: <host>[:<port>], default: system resolver)")
 	var forceReadyDuringTermination = flag.Bool("force-ready-status", false, "Prevent the server from failing the liveness probe during graceful shutdown as a workaround for buggy kube-proxy implementations (default: false)")
 	var verbose = flag.BoolP("verbose", "v", false, "Verbose logging, identical to <-l all:DEBUG>")
 
@@ -68,6 +69,11 @@ func main() {
 		nodeName = node
 	}
 
+	zone := ""
+	if z, ok := os.LookupEnv(stnrv1.DefaultEnvVarZone); ok {
+		zone = z
+	}
+
 	if *id == "" {
 		name, ok1 := os.LookupEnv(stnrv1.DefaultEnvVarName)
 		namespace, ok2 := os.LookupEnv(stnrv1.DefaultEnvVarNamespace)
@@ -81,7 +87,9 @@ func main() {
 		LogOptions:                  stunner.LogOptions{Level: logLevel, Format: *logFormat},
 		DryRun:                      *dryRun,
 		NodeName:                    nodeName,
+		Zone:                        zone,
 		UDPListenerThreadNum:        *udpThreadNum,
+		Nameserver:                  *dnsServer,
 		ForceReadyDuringTermination: *forceReadyDuringTermination,
 	})
 	defer st.Close()
@@ -283,6 +283,18 @@ func getAuth(config *stnrv1.StunnerConfig) (stunner.AuthGen, error) {
 
 		return func() (string, string, error) { return u, p, nil }, nil
 
+	case stnrv1.AuthTypeStaticMulti:
+		if len(auth.Users) == 0 {
+			return nil, fmt.Errorf("cannot find user for %s authentication", auth.Type)
+		}
+		u, p := auth.Users[0].Username, auth.Users[0].Password
+
+		return func() (string, string, error) { return u, p, nil }, nil
+
+	case stnrv1.AuthTypeJWT:
+		return nil, fmt.Errorf("%s authentication needs a token from the token issuer, "+
+			"specify the credentials explicitly in the TURN URI", auth.Type)
+
 	default:
 		return nil, fmt.Errorf("unknown authentication type %q",
 			auth.Type)
@@ -8,6 +8,7 @@ import (
 
 	"github.com/pion/transport/v4"
 
+	"github.com/l7mp/stunner/internal/endpointslice"
 	"github.com/l7mp/stunner/internal/resolver"
 	"github.com/l7mp/stunner/internal/runtime"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
@@ -30,6 +31,13 @@ type Options struct {
 	// Resolver swaps the internal DNS resolver with a custom implementation. Intended for
 	// testing.
 	Resolver resolver.DnsResolver
+	// Nameserver is the address of a custom DNS server, in the form "host" or "host:port", used
+	// by the internal DNS resolver to resolve the endpoints of STRICT_DNS clusters. Default is
+	// to use the system resolver configuration.
+	Nameserver string
+	// EndpointWatcher swaps the internal Kubernetes EndpointSlice watcher with a custom
+	// implementation. Intended for testing.
+	EndpointWatcher endpointslice.Watcher
 	// UDPListenerThreadNum determines the number of readloop threads spawned per UDP listener
 	// (default is 4, must be >0 integer). TURN allocations will be automatically load-balanced
 	// by the kernel UDP stack based on the client 5-tuple. This setting controls the maximum
@@ -39,6 +47,9 @@ type Options struct {
 	UDPListenerThreadNum int
 	// NodeName is the name of the Kubernetes node the TURN server is running on (if any).
 	NodeName string
+	// Zone is the zone of the Kubernetes node the TURN server is running on (if any), used with
+	// the topology-aware cluster modes.
+	Zone string
 	// ForceReadyDuringTermination is flag to prevent the server failing the readiness
 	// check during graceful shutdown. Normally an app should fail the readiness check once it
 	// has entered into the graceful shutdown phase. Unfortunately, this will cause some buggy
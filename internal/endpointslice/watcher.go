@@ -0,0 +1,302 @@
+// Package endpointslice tracks the ready endpoints of Kubernetes Services for ENDPOINT_SLICE
+// clusters by watching the EndpointSlices of each Service.
+package endpointslice
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pion/logging"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/l7mp/stunner/internal/util"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// defaultNamespace is the namespace of services given without a namespace if stunnerd does not
+// know its own namespace.
+const defaultNamespace = "default"
+
+// Watcher watches the EndpointSlices of Kubernetes Services in the background.
+type Watcher interface {
+	// Register starts watching a service, given as "namespace/name" or "name", on behalf of an
+	// owner. onChange is called each time the ready endpoints of the service change.
+	Register(service, owner string, onChange func()) error
+	// Unregister stops watching a service on behalf of an owner. The watch is stopped once the
+	// last owner unregisters.
+	Unregister(service, owner string)
+	// Lookup returns the ready endpoints of a service serving the given protocol, with the
+	// served ports.
+	Lookup(service, protocol string) ([]*util.Endpoint, error)
+	Start()
+	Close()
+}
+
+// endpoint is a ready address of a service with a served port and the node and the zone of the
+// address, if known. Port zero means all ports.
+type endpoint struct {
+	addr       net.IP
+	port       int
+	protocol   string
+	node, zone string
+}
+
+type serviceEntry struct {
+	lock      sync.RWMutex
+	namespace string
+	name      string
+	cancel    context.CancelFunc
+	factory   informers.SharedInformerFactory
+	informer  cache.SharedIndexInformer
+	handlers  map[string]func()
+	endpoints []endpoint
+}
+
+type watcherImpl struct {
+	lock      sync.RWMutex
+	client    kubernetes.Interface
+	namespace string
+	register  map[string]*serviceEntry
+	log       logging.LeveledLogger
+}
+
+// NewWatcher creates a new EndpointSlice watcher. If client is nil, the watcher connects to the
+// Kubernetes API server using the in-cluster config when the first service is registered.
+func NewWatcher(name string, client kubernetes.Interface, logger logging.LoggerFactory) Watcher {
+	log := logger.NewLogger(name)
+	log.Tracef("newWatcher")
+
+	namespace := os.Getenv(stnrv1.DefaultEnvVarNamespace)
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+
+	return &watcherImpl{
+		client:    client,
+		namespace: namespace,
+		register:  make(map[string]*serviceEntry),
+		log:       log,
+	}
+}
+
+// Register starts an informer for the EndpointSlices of a service.
+func (w *watcherImpl) Register(service, owner string, onChange func()) error {
+	w.log.Tracef("register: service %q, owner %q", service, owner)
+
+	key := w.serviceKey(service)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if e, found := w.register[key]; found {
+		e.lock.Lock()
+		e.handlers[owner] = onChange
+		e.lock.Unlock()
+		return nil
+	}
+
+	if w.client == nil {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return fmt.Errorf("cannot watch service %q: no Kubernetes API access: %w", key, err)
+		}
+		client, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return fmt.Errorf("cannot watch service %q: %w", key, err)
+		}
+		w.client = client
+	}
+
+	namespace, name, _ := strings.Cut(key, "/")
+	selector := labels.Set{discoveryv1.LabelServiceName: name}.String()
+	factory := informers.NewSharedInformerFactoryWithOptions(w.client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) { o.LabelSelector = selector }))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &serviceEntry{
+		namespace: namespace,
+		name:      name,
+		cancel:    cancel,
+		factory:   factory,
+		informer:  factory.Discovery().V1().EndpointSlices().Informer(),
+		handlers:  map[string]func(){owner: onChange},
+	}
+
+	update := func(any) { w.update(e) }
+	if _, err := e.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj any) { update(obj) },
+		DeleteFunc: update,
+	}); err != nil {
+		cancel()
+		return fmt.Errorf("cannot watch service %q: %w", key, err)
+	}
+	w.register[key] = e
+
+	w.log.Debugf("starting EndpointSlice watch for service %q", key)
+	factory.Start(ctx.Done())
+
+	return nil
+}
+
+// update recomputes the ready endpoints of a service from the informer cache and notifies the
+// owners.
+func (w *watcherImpl) update(e *serviceEntry) {
+	endpoints := []endpoint{}
+	for _, obj := range e.informer.GetStore().List() {
+		slice, ok := obj.(*discoveryv1.EndpointSlice)
+		if !ok || slice.Labels[discoveryv1.LabelServiceName] != e.name {
+			continue
+		}
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			// A nil ready condition should be interpreted as ready.
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			var node, zone string
+			if ep.NodeName != nil {
+				node = *ep.NodeName
+			}
+			if ep.Zone != nil {
+				zone = *ep.Zone
+			}
+			for _, a := range ep.Addresses {
+				addr := net.ParseIP(a)
+				if addr == nil {
+					continue
+				}
+				if len(slice.Ports) == 0 {
+					// No ports means all ports.
+					endpoints = append(endpoints, endpoint{addr: addr, node: node, zone: zone})
+					continue
+				}
+				for _, p := range slice.Ports {
+					port, protocol := 0, string(corev1.ProtocolTCP)
+					if p.Port != nil {
+						port = int(*p.Port)
+					}
+					if p.Protocol != nil {
+						protocol = string(*p.Protocol)
+					}
+					endpoints = append(endpoints, endpoint{addr: addr, port: port, protocol: protocol,
+						node: node, zone: zone})
+				}
+			}
+		}
+	}
+
+	e.lock.Lock()
+	e.endpoints = endpoints
+	handlers := make([]func(), 0, len(e.handlers))
+	for _, h := range e.handlers {
+		handlers = append(handlers, h)
+	}
+	e.lock.Unlock()
+
+	w.log.Tracef("update ready: service %s/%s, endpoints: %d", e.namespace, e.name, len(endpoints))
+
+	for _, h := range handlers {
+		if h != nil {
+			h()
+		}
+	}
+}
+
+// Unregister removes an owner of a service and stops the watch once the last owner is removed.
+func (w *watcherImpl) Unregister(service, owner string) {
+	w.log.Tracef("unregister: service %q, owner %q", service, owner)
+
+	key := w.serviceKey(service)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	e, found := w.register[key]
+	if !found {
+		w.log.Tracef("trying to unregister unknown service: %q", key)
+		return
+	}
+
+	e.lock.Lock()
+	delete(e.handlers, owner)
+	last := len(e.handlers) == 0
+	e.lock.Unlock()
+
+	if last {
+		e.cancel()
+		e.factory.Shutdown()
+		delete(w.register, key)
+		w.log.Infof("service %q successfully unregistered", key)
+	}
+}
+
+// Lookup returns the ready endpoints of a service for a protocol.
+func (w *watcherImpl) Lookup(service, protocol string) ([]*util.Endpoint, error) {
+	w.log.Tracef("lookup service: %q", service)
+
+	key := w.serviceKey(service)
+
+	w.lock.RLock()
+	e, found := w.register[key]
+	w.lock.RUnlock()
+	if !found {
+		return []*util.Endpoint{}, fmt.Errorf("unknown service: %q", key)
+	}
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	ret := []*util.Endpoint{}
+	for _, ep := range e.endpoints {
+		if ep.protocol != "" && !strings.EqualFold(ep.protocol, protocol) {
+			continue
+		}
+		ret = append(ret, util.NewEndpoint(ep.addr, ep.port, ep.port).WithTopology(ep.node, ep.zone))
+	}
+
+	w.log.Tracef("lookup ready: service %q, endpoints: %d", key, len(ret))
+
+	return ret, nil
+}
+
+// Start is a no-op: Register starts the watches.
+func (w *watcherImpl) Start() {
+	w.log.Debugf("starting")
+}
+
+// Close stops all watches.
+func (w *watcherImpl) Close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.log.Debugf("closing: active services: %d", len(w.register))
+	for key, e := range w.register {
+		e.cancel()
+		e.factory.Shutdown()
+		delete(w.register, key)
+	}
+}
+
+// serviceKey normalizes a service reference to "namespace/name".
+func (w *watcherImpl) serviceKey(service string) string {
+	if strings.Contains(service, "/") {
+		return service
+	}
+	return w.namespace + "/" + service
+}
@@ -0,0 +1,110 @@
+package endpointslice
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/l7mp/stunner/pkg/logger"
+)
+
+func testEndpointSlice(name, service string, ports []int32, addrs ...string) *discoveryv1.EndpointSlice {
+	proto := corev1.ProtocolUDP
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "media",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for i := range ports {
+		slice.Ports = append(slice.Ports, discoveryv1.EndpointPort{Port: &ports[i], Protocol: &proto})
+	}
+	for _, a := range addrs {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{Addresses: []string{a}})
+	}
+	return slice
+}
+
+func TestWatcher(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset()
+	slices := client.DiscoveryV1().EndpointSlices("media")
+	w := NewWatcher("endpointslice-watcher", client, logger.NewLoggerFactory("all:ERROR"))
+	defer w.Close()
+
+	matches := func(ip string, port int) bool {
+		eps, err := w.Lookup("media/media-server", "UDP")
+		require.NoError(t, err)
+		for _, e := range eps {
+			if e.Match(net.ParseIP(ip), port) {
+				return true
+			}
+		}
+		return false
+	}
+
+	_, err := w.Lookup("media/media-server", "UDP")
+	require.Error(t, err, "unknown service")
+
+	var changes atomic.Int32
+	require.NoError(t, w.Register("media/media-server", "cluster-a", func() { changes.Add(1) }))
+
+	_, err = slices.Create(ctx, testEndpointSlice("media-server-1", "media-server", []int32{5000}, "10.0.0.1", "10.0.0.2"), metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = slices.Create(ctx, testEndpointSlice("other-1", "other", nil, "10.0.0.9"), metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return matches("10.0.0.2", 5000) }, time.Second, 10*time.Millisecond)
+	require.True(t, changes.Load() > 0)
+	require.True(t, matches("10.0.0.1", 5000))
+	require.True(t, matches("10.0.0.1", 0))
+	require.False(t, matches("10.0.0.1", 5001))
+	require.False(t, matches("10.0.0.9", 0), "other service")
+	eps, err := w.Lookup("media/media-server", "TCP")
+	require.NoError(t, err)
+	require.Empty(t, eps, "protocol mismatch")
+
+	// Endpoints carry the node and the zone of the backing pod.
+	slice := testEndpointSlice("media-server-1", "media-server", []int32{5000}, "10.0.0.1", "10.0.0.2")
+	node, zone := "node-a", "zone-a"
+	slice.Endpoints[0].NodeName, slice.Endpoints[0].Zone = &node, &zone
+	_, err = slices.Update(ctx, slice, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		eps, err := w.Lookup("media/media-server", "UDP")
+		require.NoError(t, err)
+		for _, e := range eps {
+			if e.Match(net.ParseIP("10.0.0.1"), 5000) {
+				return e.Node() == node && e.Zone() == zone
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	// Not-ready endpoints are removed.
+	slice = testEndpointSlice("media-server-1", "media-server", []int32{5000}, "10.0.0.1", "10.0.0.2")
+	notReady := false
+	slice.Endpoints[1].Conditions.Ready = &notReady
+	_, err = slices.Update(ctx, slice, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return !matches("10.0.0.2", 5000) }, time.Second, 10*time.Millisecond)
+	require.True(t, matches("10.0.0.1", 5000))
+
+	// Services are refcounted per owner.
+	require.NoError(t, w.Register("media/media-server", "cluster-b", nil))
+	w.Unregister("media/media-server", "cluster-a")
+	require.True(t, matches("10.0.0.1", 5000))
+	w.Unregister("media/media-server", "cluster-b")
+	_, err = w.Lookup("media/media-server", "UDP")
+	require.Error(t, err)
+}
@@ -0,0 +1,296 @@
+// Package healthcheck implements the active health checking of cluster endpoints. A Checker
+// periodically probes the single-host endpoints of a cluster over UDP, TCP or HTTP and tracks
+// their health with hysteresis, notifying the owner each time the health of an endpoint flips.
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v4"
+
+	"github.com/l7mp/stunner/internal/util"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// udpProbePayload is the datagram sent by UDP probes.
+var udpProbePayload = []byte("stunner-health-check")
+
+// endpointState is the health state of a probed endpoint.
+type endpointState struct {
+	healthy             bool
+	successes, failures int
+	lastErr             string
+}
+
+// Checker probes the endpoints of a cluster in the background.
+type Checker struct {
+	name              string
+	conf              stnrv1.HealthCheckConfig
+	interval, timeout time.Duration
+	targets           func() []*util.Endpoint
+	onChange          func()
+	net               transport.Net
+
+	lock  sync.RWMutex
+	state map[string]*endpointState // endpoint -> state
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	log    logging.LeveledLogger
+}
+
+// New creates a health checker for a cluster. targets returns the current endpoints of the
+// cluster and onChange is called each time the health of an endpoint flips. The config must be
+// validated.
+func New(name string, conf *stnrv1.HealthCheckConfig, targets func() []*util.Endpoint, onChange func(), net transport.Net, log logging.LeveledLogger) *Checker {
+	c := &Checker{
+		name:     name,
+		conf:     *conf,
+		targets:  targets,
+		onChange: onChange,
+		net:      net,
+		state:    map[string]*endpointState{},
+		done:     make(chan struct{}),
+		log:      log,
+	}
+	// Validated by ClusterConfig.Validate.
+	c.interval, _ = time.ParseDuration(conf.Interval)
+	c.timeout, _ = time.ParseDuration(conf.Timeout)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+// Start starts probing the endpoints in the background.
+func (c *Checker) Start() {
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			c.probeAll()
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the checker and waits for the running probes to finish.
+func (c *Checker) Close() {
+	c.cancel()
+	<-c.done
+}
+
+// Healthy reports whether an endpoint admits peers. Endpoints that were not probed yet and
+// endpoints that cannot be probed are healthy.
+func (c *Checker) Healthy(ep *util.Endpoint) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	s, ok := c.state[ep.String()]
+	return !ok || s.healthy
+}
+
+// Status returns the health state of the probed endpoints.
+func (c *Checker) Status() []stnrv1.EndpointHealth {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	ret := make([]stnrv1.EndpointHealth, 0, len(c.state))
+	for ep, s := range c.state {
+		ret = append(ret, stnrv1.EndpointHealth{Endpoint: ep, Healthy: s.healthy, Error: s.lastErr})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Endpoint < ret[j].Endpoint })
+	return ret
+}
+
+// probeAll probes all endpoints concurrently and updates their health state. The state of the
+// endpoints removed from the cluster is dropped.
+func (c *Checker) probeAll() {
+	targets := map[string]string{} // endpoint -> probe address
+	for _, ep := range c.targets() {
+		if addr, ok := c.probeAddr(ep); ok {
+			targets[ep.String()] = addr
+		}
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	results := map[string]error{}
+	for ep, addr := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.probe(addr)
+			lock.Lock()
+			results[ep] = err
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if c.ctx.Err() != nil {
+		return
+	}
+
+	changed := false
+	c.lock.Lock()
+	for ep := range c.state {
+		if _, ok := targets[ep]; !ok {
+			delete(c.state, ep)
+		}
+	}
+	for ep, err := range results {
+		if c.update(ep, err) {
+			changed = true
+		}
+	}
+	c.lock.Unlock()
+
+	if changed && c.onChange != nil {
+		c.onChange()
+	}
+}
+
+// update records the result of a probe and reports whether the health of the endpoint flipped.
+// Must be called with the lock held.
+func (c *Checker) update(ep string, err error) bool {
+	s, ok := c.state[ep]
+	if !ok {
+		s = &endpointState{healthy: true}
+		c.state[ep] = s
+	}
+
+	if err == nil {
+		s.successes, s.failures, s.lastErr = s.successes+1, 0, ""
+		if !s.healthy && s.successes >= c.conf.HealthyThreshold {
+			c.log.Infof("cluster %q: endpoint %s is healthy", c.name, ep)
+			s.healthy = true
+			return true
+		}
+		return false
+	}
+
+	s.successes, s.failures, s.lastErr = 0, s.failures+1, err.Error()
+	c.log.Debugf("cluster %q: health check of endpoint %s failed: %s", c.name, ep, s.lastErr)
+	if s.healthy && s.failures >= c.conf.UnhealthyThreshold {
+		c.log.Infof("cluster %q: endpoint %s is unhealthy: %s", c.name, ep, s.lastErr)
+		s.healthy = false
+		return true
+	}
+	return false
+}
+
+// probeAddr returns the address to probe for an endpoint. Only endpoints that specify a single
+// host with a known port can be probed.
+func (c *Checker) probeAddr(ep *util.Endpoint) (string, bool) {
+	if ep.Negated() {
+		return "", false
+	}
+	prefix := ep.Prefix()
+	if ones, bits := prefix.Mask.Size(); ones != bits {
+		return "", false
+	}
+	port := c.conf.Port
+	if port == 0 && ep.HasPort() {
+		port, _ = ep.PortRange()
+	}
+	if port == 0 {
+		return "", false
+	}
+	return net.JoinHostPort(ep.IP().String(), strconv.Itoa(port)), true
+}
+
+// probe runs a single probe against an address.
+func (c *Checker) probe(addr string) error {
+	switch c.conf.Type {
+	case "UDP":
+		return c.probeUDP(addr)
+	case "TCP":
+		return c.probeTCP(addr)
+	case "HTTP":
+		return c.probeHTTP(addr)
+	default:
+		return fmt.Errorf("unknown health check type %q", c.conf.Type)
+	}
+}
+
+// probeUDP sends a datagram over a connected socket. The probe fails if the endpoint answers
+// with an ICMP port unreachable error within the timeout.
+func (c *Checker) probeUDP(addr string) error {
+	conn, err := c.net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(udpProbePayload); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	if _, err := conn.Read(buf); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return errors.New("port unreachable")
+		}
+		return err
+	}
+	return nil
+}
+
+// probeTCP opens a TCP connection.
+func (c *Checker) probeTCP(addr string) error {
+	d := c.net.CreateDialer(&net.Dialer{Timeout: c.timeout})
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeHTTP sends a GET request and expects a 2xx or 3xx response.
+func (c *Checker) probeHTTP(addr string) error {
+	d := c.net.CreateDialer(&net.Dialer{Timeout: c.timeout})
+	client := &http.Client{
+		Timeout: c.timeout,
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+				return d.Dial(network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+		// Do not follow redirects: a 3xx response passes.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, "http://"+addr+c.conf.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package healthcheck
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/v4/stdnet"
+	"github.com/stretchr/testify/require"
+
+	"github.com/l7mp/stunner/internal/util"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	"github.com/l7mp/stunner/pkg/logger"
+)
+
+func newTestChecker(t *testing.T, conf *stnrv1.HealthCheckConfig, endpoints []string, onChange func()) *Checker {
+	t.Helper()
+	conf.Interval, conf.Timeout = "20ms", "100ms"
+	require.NoError(t, (&stnrv1.ClusterConfig{Name: "test", HealthCheck: conf}).Validate())
+
+	eps := make([]*util.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		ep, err := util.ParseEndpoint(e)
+		require.NoError(t, err)
+		eps = append(eps, ep)
+	}
+	n, err := stdnet.NewNet()
+	require.NoError(t, err)
+	c := New("test", conf, func() []*util.Endpoint { return eps }, onChange, n,
+		logger.NewLoggerFactory("all:ERROR").NewLogger("health-check"))
+	c.Start()
+	t.Cleanup(c.Close)
+	return c
+}
+
+func healthy(c *Checker, endpoint string) bool {
+	ep, _ := util.ParseEndpoint(endpoint)
+	return c.Healthy(ep)
+}
+
+func TestCheckerUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	// A closed port answers with an ICMP port unreachable.
+	closed, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedPort := closed.LocalAddr().(*net.UDPAddr).Port
+	require.NoError(t, closed.Close())
+
+	alive := fmt.Sprintf("127.0.0.1:<%d-%d>", port, port)
+	dead := fmt.Sprintf("127.0.0.1:<%d-%d>", closedPort, closedPort)
+	var changes atomic.Int32
+	c := newTestChecker(t, &stnrv1.HealthCheckConfig{Type: "udp"},
+		[]string{alive, dead, "10.0.0.0/8"}, func() { changes.Add(1) })
+
+	require.Eventually(t, func() bool { return !healthy(c, dead) }, 2*time.Second, 10*time.Millisecond)
+	require.True(t, healthy(c, alive))
+	require.True(t, healthy(c, "10.0.0.0/8"), "prefixes are not probed")
+	require.Equal(t, int32(1), changes.Load())
+
+	status := c.Status()
+	require.Len(t, status, 2)
+	for _, s := range status {
+		require.Equal(t, s.Endpoint == alive, s.Healthy)
+		require.Equal(t, s.Endpoint == dead, s.Error != "")
+	}
+}
+
+func TestCheckerTCPAndHTTP(t *testing.T) {
+	var ok atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || !ok.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	_, p, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	port, err := strconv.Atoi(p)
+	require.NoError(t, err)
+
+	// The HTTP probe fails until the sidecar reports ready.
+	var changes atomic.Int32
+	c := newTestChecker(t, &stnrv1.HealthCheckConfig{Type: "HTTP", Port: port, Path: "/healthz"},
+		[]string{"127.0.0.1"}, func() { changes.Add(1) })
+	require.Eventually(t, func() bool { return !healthy(c, "127.0.0.1") }, 2*time.Second, 10*time.Millisecond)
+	ok.Store(true)
+	require.Eventually(t, func() bool { return healthy(c, "127.0.0.1") }, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(2), changes.Load())
+
+	// The TCP probe fails when the port is closed.
+	c = newTestChecker(t, &stnrv1.HealthCheckConfig{Type: "TCP", Port: port}, []string{"127.0.0.1"}, nil)
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, healthy(c, "127.0.0.1"))
+	server.Close()
+	require.Eventually(t, func() bool { return !healthy(c, "127.0.0.1") }, 2*time.Second, 10*time.Millisecond)
+}
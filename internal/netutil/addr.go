@@ -0,0 +1,61 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pion/transport/v4"
+)
+
+// ListenerIP resolves the address of a listener, given as an IP address, "localhost", or the name
+// of a network interface, to an IP address. An interface resolves to its first IPv4 address, or to
+// its first non-link-local IPv6 address if it has no IPv4 address.
+func ListenerIP(nw transport.Net, addr string) (net.IP, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip, nil
+	}
+	if addr == "localhost" {
+		return net.ParseIP("127.0.0.1"), nil
+	}
+
+	if nw == nil {
+		return nil, fmt.Errorf("invalid listener address: %s", addr)
+	}
+	iface, err := nw.InterfaceByName(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listener address %q: not an IP address or a network "+
+			"interface: %w", addr, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain the addresses of interface %q: %w", addr, err)
+	}
+	var ip6 net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		if ip6 == nil && !ipNet.IP.IsLinkLocalUnicast() {
+			ip6 = ipNet.IP
+		}
+	}
+	if ip6 == nil {
+		return nil, fmt.Errorf("no usable address on interface %q", addr)
+	}
+	return ip6, nil
+}
+
+// BindHost returns the host to bind a socket to for a listener IP. The unspecified address binds
+// the empty host: on dual-stack hosts (Linux default with net.ipv6.bindv6only=0) this is a single
+// socket reachable via both IPv4 and IPv6, while on single-family hosts it binds the available
+// family. Hardcoding "0.0.0.0" would be IPv4-only and fail on IPv6-only clusters.
+func BindHost(ip net.IP) string {
+	if ip == nil || ip.IsUnspecified() {
+		return ""
+	}
+	return ip.String()
+}
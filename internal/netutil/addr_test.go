@@ -0,0 +1,45 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/transport/v4/vnet"
+	"github.com/stretchr/testify/require"
+
+	"github.com/l7mp/stunner/pkg/logger"
+)
+
+func TestListenerIP(t *testing.T) {
+	nw, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"1.2.3.4"}})
+	require.NoError(t, err)
+	router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "1.2.3.0/24",
+		LoggerFactory: logger.NewLoggerFactory(connTestLoglevel)})
+	require.NoError(t, err)
+	require.NoError(t, router.AddNet(nw))
+
+	for addr, ip := range map[string]string{
+		"10.0.0.1":  "10.0.0.1",
+		"::1":       "::1",
+		"localhost": "127.0.0.1",
+		"eth0":      "1.2.3.4",
+	} {
+		got, err := ListenerIP(nw, addr)
+		require.NoError(t, err, addr)
+		require.Equal(t, ip, got.String(), addr)
+	}
+	_, err = ListenerIP(nw, "eth1")
+	require.Error(t, err)
+
+	require.Equal(t, "", BindHost(nil))
+	require.Equal(t, "", BindHost(mustListenerIP(t, "0.0.0.0")))
+	require.Equal(t, "", BindHost(mustListenerIP(t, "::")))
+	require.Equal(t, "10.0.0.1", BindHost(mustListenerIP(t, "10.0.0.1")))
+}
+
+func mustListenerIP(t *testing.T, addr string) net.IP {
+	t.Helper()
+	ip, err := ListenerIP(nil, addr)
+	require.NoError(t, err)
+	return ip
+}
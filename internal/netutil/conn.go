@@ -3,7 +3,9 @@ package netutil
 // code adopted from github.com/livekit/pkg/telemetry
 
 import (
+	"io"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 
@@ -16,6 +18,20 @@ import (
 // It returns the metric name label and true on success, or "" and false on denial.
 type AdmitFunc func(remote net.Addr) (name string, ok bool)
 
+// RemapFunc maps the remote address of an outgoing datagram admitted under a name, e.g., a virtual
+// address to a backend. The address the remote address is currently remapped to, if any, is passed
+// in current and should be returned as long as it is valid. It returns nil if no remapping applies.
+type RemapFunc func(name string, remote, current net.Addr) (net.Addr, error)
+
+// CrossZoneFunc reports whether the traffic exchanged with a remote address admitted under a name
+// crosses a zone boundary.
+type CrossZoneFunc func(name string, remote net.Addr) bool
+
+// TrackFunc registers a connection with a remote address admitted under a name, e.g., to close
+// the connection when the remote address is no longer admitted. It returns a function that
+// unregisters the connection.
+type TrackFunc func(name string, remote net.Addr, conn io.Closer) func()
+
 // Listener is a net.Listener that knows how to report to Prometheus with optional per-connection
 // admission control function.
 type Listener struct {
@@ -24,6 +40,9 @@ type Listener struct {
 	connType  telemetry.ConnType
 	telemetry *telemetry.Telemetry
 	admit     AdmitFunc
+	crossZone CrossZoneFunc
+	track     TrackFunc
+	onClose   func()
 	log       logging.LeveledLogger
 }
 
@@ -54,6 +73,9 @@ func (l *Listener) Accept() (net.Conn, error) {
 				l.log.Infof("dropping inbound relay connection from unadmitted peer %s",
 					conn.RemoteAddr().String())
 			}
+			if l.telemetry != nil {
+				l.telemetry.IncrementConnectDenials(l.name, telemetry.Incoming)
+			}
 			_ = conn.Close()
 			continue
 		}
@@ -61,17 +83,36 @@ func (l *Listener) Accept() (net.Conn, error) {
 		if name == "" {
 			name = l.name
 		}
+		if l.telemetry != nil && l.connType == telemetry.ClusterType {
+			l.telemetry.IncrementClusterFlows(name, l.name, "connection")
+		}
 
-		return NewConn(conn, name, l.connType, l.telemetry), nil
+		c := NewConn(conn, name, l.connType, l.telemetry)
+		c.crossZone = l.crossZone != nil && l.crossZone(name, conn.RemoteAddr())
+		if l.track != nil {
+			c.onClose = l.track(name, conn.RemoteAddr(), conn)
+		}
+		return c, nil
 	}
 }
 
+// Close closes the Listener.
+func (l *Listener) Close() error {
+	err := l.Listener.Close()
+	if l.onClose != nil {
+		l.onClose()
+	}
+	return err
+}
+
 // Conn is a net.Conn that knows how to report to Prometheus.
 type Conn struct {
 	net.Conn
 	name      string
 	connType  telemetry.ConnType
 	telemetry *telemetry.Telemetry
+	crossZone bool
+	onClose   func()
 }
 
 // NewConn allocates a conn that knows its name and type and reports to telemetry.
@@ -86,6 +127,9 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	if n > 0 {
 		c.telemetry.IncrementBytes(c.name, c.connType, telemetry.Incoming, uint64(n))
 		c.telemetry.IncrementPackets(c.name, c.connType, telemetry.Incoming, 1)
+		if c.crossZone {
+			c.telemetry.IncrementCrossZoneBytes(c.name, telemetry.Incoming, uint64(n))
+		}
 	}
 	return
 }
@@ -96,6 +140,9 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 	if n > 0 {
 		c.telemetry.IncrementBytes(c.name, c.connType, telemetry.Outgoing, uint64(n))
 		c.telemetry.IncrementPackets(c.name, c.connType, telemetry.Outgoing, 1)
+		if c.crossZone {
+			c.telemetry.IncrementCrossZoneBytes(c.name, telemetry.Outgoing, uint64(n))
+		}
 	}
 	return
 }
@@ -103,6 +150,9 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 // Close closes the Conn.
 func (c *Conn) Close() error {
 	c.telemetry.SubConnection(c.name, c.connType)
+	if c.onClose != nil {
+		c.onClose()
+	}
 	return c.Conn.Close()
 }
 
@@ -117,11 +167,24 @@ type PacketConn struct {
 	connType     telemetry.ConnType
 	telemetry    *telemetry.Telemetry
 	admit        AdmitFunc
+	remap        RemapFunc
+	crossZone    CrossZoneFunc
+	onClose      func()
+	pinned       map[netip.AddrPort]net.Addr  // original address -> remapped address
+	virtual      map[netip.AddrPort]net.Addr  // remapped address -> original address
+	zones        map[netip.AddrPort]zoneEntry // remote address -> cross-zone flag
 	readDeadline time.Time
 	mu           sync.Mutex
 	log          logging.LeveledLogger
 }
 
+// zoneEntry caches whether the traffic with a remote address admitted under a name crosses a zone
+// boundary.
+type zoneEntry struct {
+	name  string
+	cross bool
+}
+
 // NewPacketConn decorates a net.PacketConn with metric reporting and optional per-packet admission.
 func NewPacketConn(c net.PacketConn, n string, t telemetry.ConnType, tm *telemetry.Telemetry, admit AdmitFunc, log logging.LeveledLogger) *PacketConn {
 	if admit == nil {
@@ -159,12 +222,25 @@ func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 		if n > 0 {
 			c.telemetry.IncrementBytes(name, c.connType, telemetry.Incoming, uint64(n))
 			c.telemetry.IncrementPackets(name, c.connType, telemetry.Incoming, 1)
+			if c.isCrossZone(name, addr) {
+				c.telemetry.IncrementCrossZoneBytes(name, telemetry.Incoming, uint64(n))
+			}
+		}
+		c.mu.Lock()
+		if len(c.virtual) > 0 {
+			if v, ok := c.virtual[addrPort(addr)]; ok {
+				addr = v
+			}
 		}
+		c.mu.Unlock()
 		return n, addr, nil
 	}
 }
 
-// WriteTo admits the peer, writes, and accounts outgoing traffic under the admitted name.
+// WriteTo admits the peer, remaps the peer address, writes, and accounts outgoing traffic under
+// the admitted name. The remapped address is pinned and remapped again only when it is no longer
+// valid. Datagrams received from a remapped address are reported as received from the original
+// address.
 func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 	name, ok := c.admit(addr)
 	if !ok {
@@ -173,14 +249,76 @@ func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 	if name == "" {
 		name = c.name
 	}
-	n, err := c.PacketConn.WriteTo(p, addr)
+	dst := addr
+	if c.remap != nil {
+		key := addrPort(addr)
+		c.mu.Lock()
+		current := c.pinned[key]
+		c.mu.Unlock()
+		remapped, err := c.remap(name, addr, current)
+		if err != nil {
+			return 0, err
+		}
+		if remapped != current {
+			c.mu.Lock()
+			if remapped != nil {
+				c.pinned[key] = remapped
+				c.virtual[addrPort(remapped)] = addr
+			} else {
+				delete(c.pinned, key)
+			}
+			c.mu.Unlock()
+		}
+		if remapped != nil {
+			dst = remapped
+		}
+	}
+	n, err := c.PacketConn.WriteTo(p, dst)
 	if n > 0 {
 		c.telemetry.IncrementBytes(name, c.connType, telemetry.Outgoing, uint64(n))
 		c.telemetry.IncrementPackets(name, c.connType, telemetry.Outgoing, 1)
+		if c.isCrossZone(name, dst) {
+			c.telemetry.IncrementCrossZoneBytes(name, telemetry.Outgoing, uint64(n))
+		}
 	}
 	return n, err
 }
 
+// isCrossZone reports whether the traffic with a remote address admitted under a name crosses a
+// zone boundary. The result is computed once per remote address, like for a Conn.
+func (c *PacketConn) isCrossZone(name string, addr net.Addr) bool {
+	if c.crossZone == nil {
+		return false
+	}
+	key := addrPort(addr)
+	c.mu.Lock()
+	z, ok := c.zones[key]
+	c.mu.Unlock()
+	if ok && z.name == name {
+		return z.cross
+	}
+
+	cross := c.crossZone(name, addr)
+	c.mu.Lock()
+	if c.zones == nil {
+		c.zones = map[netip.AddrPort]zoneEntry{}
+	}
+	c.zones[key] = zoneEntry{name: name, cross: cross}
+	c.mu.Unlock()
+	return cross
+}
+
+// addrPort returns the IP address and the port of a UDP address, with IPv4-mapped IPv6 addresses
+// unmapped.
+func addrPort(addr net.Addr) netip.AddrPort {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	ap := a.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
 // SetReadDeadline stores the deadline applied by ReadFrom on each read attempt.
 func (c *PacketConn) SetReadDeadline(t time.Time) error {
 	c.mu.Lock()
@@ -192,5 +330,9 @@ func (c *PacketConn) SetReadDeadline(t time.Time) error {
 // Close closes the wrapped packet connection and drops its telemetry accounting.
 func (c *PacketConn) Close() error {
 	c.telemetry.SubConnection(c.name, c.connType)
-	return c.PacketConn.Close()
+	err := c.PacketConn.Close()
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return err
 }
@@ -0,0 +1,210 @@
+package netutil
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/l7mp/stunner/internal/telemetry"
+)
+
+var (
+	// ErrPortRangeExhausted is returned when all ports of a relay port range are in use.
+	ErrPortRangeExhausted = errors.New("relay port range exhausted")
+	// ErrPortOutOfRange is returned when a client requests a relay port outside the relay port
+	// range of the listener.
+	ErrPortOutOfRange = errors.New("requested relay port out of range")
+
+	errPortInUse = errors.New("requested relay port in use")
+)
+
+var (
+	// portReuseBackoff is the time a released port is withheld from the pool, so that late
+	// packets of a closed allocation do not reach the next allocation on the same port.
+	portReuseBackoff = 10 * time.Second
+	// portReservationTimeout is the time the port following an even port allocated for an
+	// EVEN-PORT request is reserved for the allocation with the RESERVATION-TOKEN. Matches the
+	// lifetime of the reservations of the TURN server.
+	portReservationTimeout = 30 * time.Second
+)
+
+// maxBindRetries is the number of ports tried when a port of the pool is taken by another
+// process.
+const maxBindRetries = 16
+
+type portKey struct {
+	proto string
+	port  int
+}
+
+// PortPool allocates the relay ports of a listener from a port range. UDP and TCP ports are
+// allocated independently.
+//
+// Released ports are withheld from the pool for a back-off period, unless there is no other free
+// port. An explicitly requested even UDP port, as allocated for EVEN-PORT requests, reserves the
+// next port for the allocation with the RESERVATION-TOKEN. The last port of the range has no next
+// port to reserve, so if it is even then it cannot be requested as a UDP port and it is picked as a
+// random UDP port only if there is no other free port: the TURN server selects the even ports from
+// random ports.
+type PortPool struct {
+	listener           string
+	minPort, maxPort   int
+	used               map[portKey]bool
+	released, reserved map[portKey]time.Time // port -> release time, resp., reservation expiry
+	lock               sync.Mutex
+	telemetry          *telemetry.Telemetry
+}
+
+// NewPortPool creates a relay port pool over the range [minPort, maxPort].
+func NewPortPool(listener string, minPort, maxPort int, tm *telemetry.Telemetry) *PortPool {
+	p := &PortPool{
+		listener:  listener,
+		minPort:   minPort,
+		maxPort:   maxPort,
+		used:      map[portKey]bool{},
+		released:  map[portKey]time.Time{},
+		reserved:  map[portKey]time.Time{},
+		telemetry: tm,
+	}
+	if tm != nil {
+		tm.AddRelayPortRange(listener, int64(p.Size()))
+	}
+	return p
+}
+
+// Size returns the number of ports in the range.
+func (p *PortPool) Size() int {
+	return p.maxPort - p.minPort + 1
+}
+
+// Close removes the pool from the telemetry.
+func (p *PortPool) Close() {
+	if p.telemetry != nil {
+		p.telemetry.AddRelayPortRange(p.listener, -int64(p.Size()))
+	}
+}
+
+// Acquire allocates a port for a protocol ("udp" or "tcp"). If requested is non-zero then the
+// requested port is allocated, otherwise a random free port.
+func (p *PortPool) Acquire(proto string, requested int) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	var port int
+	if requested != 0 {
+		if requested < p.minPort || requested > p.maxPort {
+			return 0, ErrPortOutOfRange
+		}
+		if proto == "udp" && requested%2 == 0 && requested == p.maxPort {
+			return 0, ErrPortOutOfRange
+		}
+		if p.used[portKey{proto, requested}] {
+			return 0, errPortInUse
+		}
+		port = requested
+		delete(p.reserved, portKey{proto, port})
+		if proto == "udp" && port%2 == 0 {
+			p.reserved[portKey{proto, port + 1}] = now.Add(portReservationTimeout)
+		}
+	} else {
+		port = p.pick(proto, now)
+		if port == 0 {
+			return 0, ErrPortRangeExhausted
+		}
+	}
+
+	key := portKey{proto, port}
+	p.used[key] = true
+	delete(p.released, key)
+	if p.telemetry != nil {
+		p.telemetry.AddRelayPorts(p.listener, proto, 1)
+	}
+	return port, nil
+}
+
+// pick returns a random free port, or zero if there is no free port. An even last UDP port is only
+// returned if there is no other free port, ports in back-off and reserved ports only if there is
+// no other free port at all, the port released the earliest first. Must be called with the lock
+// held.
+func (p *PortPool) pick(proto string, now time.Time) int {
+	size := p.Size()
+	start := rand.IntN(size) //nolint:gosec
+	fallback, fallbackSince, last := 0, time.Time{}, 0
+	for i := range size {
+		port := p.minPort + (start+i)%size
+		key := portKey{proto, port}
+		if p.used[key] {
+			continue
+		}
+
+		since, backoff := p.released[key]
+		if backoff && now.Sub(since) >= portReuseBackoff {
+			delete(p.released, key)
+			backoff = false
+		}
+		if expiry, ok := p.reserved[key]; ok {
+			if now.Before(expiry) {
+				since, backoff = now, true
+			} else {
+				delete(p.reserved, key)
+			}
+		}
+		if !backoff && proto == "udp" && port%2 == 0 && port == p.maxPort {
+			last = port
+			continue
+		}
+		if !backoff {
+			return port
+		}
+		if fallback == 0 || since.Before(fallbackSince) {
+			fallback, fallbackSince = port, since
+		}
+	}
+	if last != 0 {
+		return last
+	}
+	return fallback
+}
+
+// Release returns a port to the pool.
+func (p *PortPool) Release(proto string, port int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	key := portKey{proto, port}
+	if !p.used[key] {
+		return
+	}
+	delete(p.used, key)
+	p.released[key] = time.Now()
+	if p.telemetry != nil {
+		p.telemetry.AddRelayPorts(p.listener, proto, -1)
+	}
+}
+
+// bind binds a socket with bind at a port acquired from the pool, retrying with another port if
+// the port is taken by another process. The returned function releases the port. Without a pool
+// the socket is bound at the requested port, or at an ephemeral port if requested is zero.
+func (p *PortPool) bind(proto string, requested int, bind func(port int) error) (func(), error) {
+	if p == nil {
+		return func() {}, bind(requested)
+	}
+	for range maxBindRetries {
+		port, err := p.Acquire(proto, requested)
+		if err != nil {
+			return nil, err
+		}
+		if err := bind(port); err != nil {
+			p.Release(proto, port)
+			if requested != 0 {
+				return nil, err
+			}
+			continue
+		}
+		var once sync.Once
+		return func() { once.Do(func() { p.Release(proto, port) }) }, nil
+	}
+	return nil, ErrPortRangeExhausted
+}
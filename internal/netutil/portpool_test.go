@@ -0,0 +1,158 @@
+package netutil
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortPool(t *testing.T) {
+	p := NewPortPool("test", 10000, 10003, nil)
+	require.Equal(t, 4, p.Size())
+
+	// Random ports are drawn from the range until it is exhausted.
+	seen := map[int]bool{}
+	for range 4 {
+		port, err := p.Acquire("udp", 0)
+		require.NoError(t, err)
+		require.True(t, port >= 10000 && port <= 10003)
+		require.False(t, seen[port])
+		seen[port] = true
+	}
+	_, err := p.Acquire("udp", 0)
+	require.ErrorIs(t, err, ErrPortRangeExhausted)
+
+	// TCP ports are allocated independently.
+	_, err = p.Acquire("tcp", 0)
+	require.NoError(t, err)
+
+	// Requested ports must be in the range and free.
+	_, err = p.Acquire("tcp", 9999)
+	require.ErrorIs(t, err, ErrPortOutOfRange)
+	_, err = p.Acquire("udp", 10001)
+	require.ErrorIs(t, err, errPortInUse)
+
+	// A released port is reused only if there is no other free port, the earliest released first.
+	p.Release("udp", 10001)
+	p.Release("udp", 10002)
+	p.Release("udp", 10002) // idempotent
+	port, err := p.Acquire("udp", 0)
+	require.NoError(t, err)
+	require.Equal(t, 10001, port)
+	port, err = p.Acquire("udp", 0)
+	require.NoError(t, err)
+	require.Equal(t, 10002, port)
+}
+
+func TestPortPoolBackoff(t *testing.T) {
+	p := NewPortPool("test", 10000, 10002, nil)
+	port, err := p.Acquire("udp", 0)
+	require.NoError(t, err)
+	p.Release("udp", port)
+
+	// The released port is withheld while there are other free ports.
+	for range 2 {
+		next, err := p.Acquire("udp", 0)
+		require.NoError(t, err)
+		require.NotEqual(t, port, next, "released port reused during back-off")
+	}
+	next, err := p.Acquire("udp", 0)
+	require.NoError(t, err)
+	require.Equal(t, port, next)
+
+	// Ports whose back-off expired are free.
+	backoff := portReuseBackoff
+	portReuseBackoff = 0
+	defer func() { portReuseBackoff = backoff }()
+	p = NewPortPool("test", 10000, 10001, nil)
+	reused, last := false, 0
+	for range 64 {
+		port, err := p.Acquire("udp", 0)
+		require.NoError(t, err)
+		p.Release("udp", port)
+		reused = reused || port == last
+		last = port
+	}
+	require.True(t, reused)
+}
+
+func TestPortPoolEvenPort(t *testing.T) {
+	p := NewPortPool("test", 10000, 10003, nil)
+
+	// An even port reserves the next port for the allocation with the reservation token.
+	port, err := p.Acquire("udp", 10000)
+	require.NoError(t, err)
+	require.Equal(t, 10000, port)
+	for range 2 {
+		port, err := p.Acquire("udp", 0)
+		require.NoError(t, err)
+		require.NotEqual(t, 10001, port, "reserved port allocated")
+	}
+	port, err = p.Acquire("udp", 10001)
+	require.NoError(t, err)
+	require.Equal(t, 10001, port)
+
+	// Reserved ports are allocated if there is no other free port.
+	p = NewPortPool("test", 10000, 10001, nil)
+	_, err = p.Acquire("udp", 10000)
+	require.NoError(t, err)
+	port, err = p.Acquire("udp", 0)
+	require.NoError(t, err)
+	require.Equal(t, 10001, port)
+}
+
+func TestPortPoolEvenMaxPort(t *testing.T) {
+	p := NewPortPool("test", 10000, 10002, nil)
+
+	// The even last port has no next port to reserve: it cannot be requested for UDP.
+	_, err := p.Acquire("udp", 10002)
+	require.ErrorIs(t, err, ErrPortOutOfRange)
+	port, err := p.Acquire("tcp", 10002)
+	require.NoError(t, err)
+	require.Equal(t, 10002, port)
+
+	// It is picked as a random UDP port only if there is no other free port.
+	for range 2 {
+		port, err := p.Acquire("udp", 0)
+		require.NoError(t, err)
+		require.NotEqual(t, 10002, port)
+	}
+	port, err = p.Acquire("udp", 0)
+	require.NoError(t, err)
+	require.Equal(t, 10002, port)
+}
+
+func TestPortPoolBind(t *testing.T) {
+	p := NewPortPool("test", 10000, 10003, nil)
+
+	// Ports taken by another process are skipped.
+	taken := map[int]bool{10000: true, 10001: true, 10002: true}
+	var bound int
+	release, err := p.bind("udp", 0, func(port int) error {
+		if taken[port] {
+			return errors.New("address in use")
+		}
+		bound = port
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 10003, bound)
+
+	// The port is released once.
+	release()
+	release()
+	p.lock.Lock()
+	require.Empty(t, p.used)
+	p.lock.Unlock()
+
+	// A requested port is not retried.
+	_, err = p.bind("udp", 10000, func(int) error { return errors.New("address in use") })
+	require.Error(t, err)
+
+	// Without a pool the requested port is bound.
+	release, err = (*PortPool)(nil).bind("udp", 1234, func(port int) error { bound = port; return nil })
+	require.NoError(t, err)
+	require.Equal(t, 1234, bound)
+	release()
+}
@@ -8,14 +8,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/pion/transport/v4/stdnet"
 
 	"github.com/l7mp/stunner/internal/runtime"
 	"github.com/l7mp/stunner/internal/telemetry"
+	"github.com/l7mp/stunner/internal/util"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 )
 
@@ -24,21 +28,37 @@ var ErrPortProhibited = errors.New("peer endpoint administratively prohibited")
 
 var errNilConn = errors.New("cannot allocate relay connection")
 
+// UserFunc returns the user of the allocation of a relay socket. The user is recorded only once
+// the allocation is created, after the relay socket.
+type UserFunc func() runtime.User
+
 // NewRelayPacketConn creates the UDP relay socket for an allocation, wrapped so every datagram is
-// routed/admitted via the Router and accounted in telemetry. relayIP is the address advertised to
-// the client.
-func NewRelayPacketConn(rt *runtime.Runtime, listener string, relayIP net.IP, network string, requestedPort int) (net.PacketConn, net.Addr, error) {
-	// Empty host is the unspecified address: on dual-stack hosts this binds a
-	// socket reachable from both IPv4 and IPv6 peers, so relays work for
-	// IPv6-only peers (e.g. IPv6-only EKS pods). Hardcoding "0.0.0.0" would be
-	// IPv4-only.
-	conn, err := rt.Net.ListenPacket(network, net.JoinHostPort("", strconv.Itoa(sanitizePort(requestedPort))))
+// routed/admitted via the Router for the allocation's user and accounted in telemetry. relayIP is
+// the address advertised to the client. The socket is bound to relayIP, so that relayed traffic is
+// sourced from the interface of the listener, or to all addresses if relayIP is unspecified, so
+// that relays work for IPv6-only peers (e.g. IPv6-only EKS pods). If pool is not nil then the
+// port is allocated from the pool and released when the socket is closed.
+func NewRelayPacketConn(rt *runtime.Runtime, listener string, user UserFunc, relayIP net.IP, pool *PortPool, network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	var conn net.PacketConn
+	release, err := pool.bind("udp", sanitizePort(requestedPort), func(port int) error {
+		var err error
+		conn, err = rt.Net.ListenPacket(network, net.JoinHostPort(BindHost(relayIP), strconv.Itoa(port)))
+		return err
+	})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	prc := NewPacketConn(conn, listener, telemetry.ClusterType, rt.Telemetry, routeChecker(rt, listener),
-		rt.Logger.NewLogger(fmt.Sprintf("relay-%s", listener)))
+	prc := NewPacketConn(conn, listener, telemetry.ClusterType, rt.Telemetry,
+		retainAdmitted(rt, routeChecker(rt, listener, user)), rt.Logger.NewLogger(fmt.Sprintf("relay-%s", listener)))
+	prc.onClose = release
+	key := conn.LocalAddr().String()
+	prc.remap = func(cluster string, remote, current net.Addr) (net.Addr, error) {
+		return remapVirtual(rt, cluster, key, remote, current)
+	}
+	prc.pinned = map[netip.AddrPort]net.Addr{}
+	prc.virtual = map[netip.AddrPort]net.Addr{}
+	prc.crossZone = crossZoneChecker(rt)
 
 	relayAddr, ok := prc.LocalAddr().(*net.UDPAddr)
 	if !ok {
@@ -50,18 +70,25 @@ func NewRelayPacketConn(rt *runtime.Runtime, listener string, relayIP net.IP, ne
 
 // NewRelayListener binds the relayed TCP transport address of an RFC 6062 allocation and wraps it
 // so every accepted connection is routed/admitted at accept time. The relayed address is shared
-// with the allocation's outgoing dials (Dial), so it is bound with the reuse socket options.
-func NewRelayListener(rt *runtime.Runtime, listener string, relayIP net.IP, network string, requestedPort int) (net.Listener, net.Addr, error) {
-	l, err := listenTCP(rt, network, sanitizePort(requestedPort))
+// with the allocation's outgoing dials (Dial), so it is bound with the reuse socket options. Like
+// in NewRelayPacketConn, the listener is bound to relayIP unless relayIP is unspecified and the
+// port is allocated from the pool, if any.
+func NewRelayListener(rt *runtime.Runtime, listener string, user UserFunc, relayIP net.IP, pool *PortPool, network string, requestedPort int) (net.Listener, net.Addr, error) {
+	var l net.Listener
+	release, err := pool.bind("tcp", sanitizePort(requestedPort), func(port int) error {
+		var err error
+		l, err = listenTCP(rt, network, relayIP, port)
+		return err
+	})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	admit := func(addr net.Addr) (string, bool) {
-		return routeRemote(rt, listener, addr)
-	}
-	prl := NewListener(l, listener, telemetry.ClusterType, rt.Telemetry, admit,
+	prl := NewListener(l, listener, telemetry.ClusterType, rt.Telemetry, routeChecker(rt, listener, user),
 		rt.Logger.NewLogger(fmt.Sprintf("relay-%s", listener)))
+	prl.onClose = release
+	prl.crossZone = crossZoneChecker(rt)
+	prl.track = rt.Router.TrackConn
 
 	if tcpAddr, ok := l.Addr().(*net.TCPAddr); ok {
 		relayAddr := *tcpAddr
@@ -73,10 +100,14 @@ func NewRelayListener(rt *runtime.Runtime, listener string, relayIP net.IP, netw
 
 // Dial opens an outgoing connection for an RFC 6062 Connect: the peer is routed/admitted once, then
 // dialed from laddr (the allocation's relayed transport address, shared with its listener, hence
-// the reuse socket options). The returned conn is accounted in telemetry under the serving cluster.
-func Dial(rt *runtime.Runtime, listener string, laddr, raddr net.Addr) (net.Conn, error) {
-	cluster, ok := routeRemote(rt, listener, raddr)
+// the reuse socket options). A virtual peer address is dialed at the backend selected for the
+// allocation. The returned conn is accounted in telemetry under the serving cluster.
+func Dial(rt *runtime.Runtime, listener string, user runtime.User, laddr, raddr net.Addr) (net.Conn, error) {
+	cluster, ok := routeRemote(rt, listener, user, raddr)
 	if !ok {
+		if rt.Telemetry != nil {
+			rt.Telemetry.IncrementConnectDenials(listener, telemetry.Outgoing)
+		}
 		return nil, ErrPortProhibited
 	}
 
@@ -84,6 +115,13 @@ func Dial(rt *runtime.Runtime, listener string, laddr, raddr net.Addr) (net.Conn
 	if !ok {
 		return nil, ErrPortProhibited
 	}
+	backend, err := remapVirtual(rt, cluster, laddr.String(), raddr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if backend != nil {
+		remote = backend.(*net.TCPAddr)
+	}
 	network := "tcp4"
 	if remote.IP.To4() == nil {
 		network = "tcp6"
@@ -94,7 +132,133 @@ func Dial(rt *runtime.Runtime, listener string, laddr, raddr net.Addr) (net.Conn
 	if err != nil {
 		return nil, err
 	}
-	return NewConn(conn, cluster, telemetry.ClusterType, rt.Telemetry), nil
+	if rt.Telemetry != nil {
+		rt.Telemetry.IncrementClusterFlows(cluster, listener, "connection")
+	}
+	if backend != nil {
+		conn = &virtualConn{Conn: conn, remote: raddr}
+	}
+	c := NewConn(conn, cluster, telemetry.ClusterType, rt.Telemetry)
+	if crossZone := crossZoneChecker(rt); crossZone != nil {
+		c.crossZone = crossZone(cluster, remote)
+	}
+	c.onClose = rt.Router.TrackConn(cluster, remote, conn)
+	return c, nil
+}
+
+// virtualConn is a connection to a backend of a virtual address that reports the virtual address
+// as the remote address.
+type virtualConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *virtualConn) RemoteAddr() net.Addr { return c.remote }
+
+// crossZoneChecker returns a function that reports whether a peer of a cluster is in a different
+// zone than stunnerd, or nil if cross-zone traffic is not accounted.
+func crossZoneChecker(rt *runtime.Runtime) CrossZoneFunc {
+	if rt.Zone == "" || rt.Telemetry == nil {
+		return nil
+	}
+	return func(cluster string, remote net.Addr) bool {
+		switch a := remote.(type) {
+		case *net.UDPAddr:
+			return rt.Router.CrossZone(cluster, a.IP)
+		case *net.TCPAddr:
+			return rt.Router.CrossZone(cluster, a.IP)
+		default:
+			return false
+		}
+	}
+}
+
+// remapVirtual maps a virtual peer address of a cluster to a backend, or returns nil if the peer
+// address is not the virtual address of the cluster. The current backend of the peer address, if
+// any, is returned as long as it is available, otherwise a new backend is selected by rendezvous
+// hashing over the key, which identifies the allocation. Callers pin the returned backend and pass
+// it as current for the next datagram, so that an allocation sticks to its backend even when new
+// backends join.
+func remapVirtual(rt *runtime.Runtime, cluster, key string, remote, current net.Addr) (net.Addr, error) {
+	var (
+		peer net.IP
+		port int
+	)
+	switch a := remote.(type) {
+	case *net.UDPAddr:
+		peer, port = a.IP, a.Port
+	case *net.TCPAddr:
+		peer, port = a.IP, a.Port
+	default:
+		return nil, nil
+	}
+
+	backends, ok := rt.Router.VirtualBackends(cluster, peer, port)
+	if !ok {
+		return nil, nil
+	}
+	if len(backends) == 0 {
+		return nil, ErrPortProhibited
+	}
+
+	if current != nil {
+		for _, ep := range backends {
+			if isVirtualBackend(ep, current, port) {
+				return current, nil
+			}
+		}
+	}
+
+	var backend *util.Endpoint
+	var best uint64
+	for _, ep := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(key))    //nolint:errcheck
+		h.Write([]byte{'|'})    //nolint:errcheck
+		h.Write(ep.IP().To16()) //nolint:errcheck
+		h.Write(portBytes(ep))  //nolint:errcheck
+		if w := h.Sum64(); backend == nil || w > best {
+			backend, best = ep, w
+		}
+	}
+
+	port = virtualBackendPort(backend, port)
+	if _, ok := remote.(*net.UDPAddr); ok {
+		return &net.UDPAddr{IP: backend.IP(), Port: port}, nil
+	}
+	return &net.TCPAddr{IP: backend.IP(), Port: port}, nil
+}
+
+// virtualBackendPort returns the port a backend receives the traffic sent to a virtual port on: a
+// backend with a single port receives the traffic on its port.
+func virtualBackendPort(ep *util.Endpoint, port int) int {
+	if lo, hi := ep.PortRange(); ep.HasPort() && lo == hi {
+		return lo
+	}
+	return port
+}
+
+// isVirtualBackend reports whether addr is the address of a backend for a virtual port.
+func isVirtualBackend(ep *util.Endpoint, addr net.Addr, port int) bool {
+	var (
+		ip net.IP
+		p  int
+	)
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, p = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, p = a.IP, a.Port
+	default:
+		return false
+	}
+	return ep.IP().Equal(ip) && virtualBackendPort(ep, port) == p
+}
+
+// portBytes returns the port range of an endpoint for hashing.
+func portBytes(ep *util.Endpoint) []byte {
+	lo, hi := ep.PortRange()
+	return []byte{byte(lo >> 8), byte(lo), byte(hi >> 8), byte(hi)}
 }
 
 // HasRoutedCluster reports whether the listener routes to any cluster of the given protocol. Used
@@ -118,17 +282,52 @@ func ProtocolFromNetwork(network string) stnrv1.ClusterProtocol {
 	return stnrv1.ClusterProtocolTCP
 }
 
-// routeChecker returns an AdmitFunc that routes a peer endpoint through the Router for a listener,
-// using the serving cluster name as the admission/metric label.
-func routeChecker(rt *runtime.Runtime, listener string) AdmitFunc {
+// admission is the cluster a peer was admitted to and the config epoch it was admitted at.
+type admission struct {
+	cluster string
+	epoch   uint64
+}
+
+// retainAdmitted wraps the AdmitFunc of a relay socket so that the peers admitted once stay
+// admitted when they are removed from their cluster by a membership change, unless the cluster
+// revokes removed peers. A config change revokes the retained peers. The TURN server still
+// refuses to refresh the permissions of the removed peers, so the retained peers lose access
+// when their permissions expire.
+func retainAdmitted(rt *runtime.Runtime, admit AdmitFunc) AdmitFunc {
+	var mu sync.Mutex
+	admitted := map[netip.AddrPort]admission{}
 	return func(addr net.Addr) (string, bool) {
-		return routeRemote(rt, listener, addr)
+		key := addrPort(addr)
+		epoch := rt.Router.Epoch()
+		cluster, ok := admit(addr)
+		mu.Lock()
+		defer mu.Unlock()
+		if ok {
+			if a, found := admitted[key]; !found || a.cluster != cluster || a.epoch != epoch {
+				admitted[key] = admission{cluster: cluster, epoch: epoch}
+			}
+			return cluster, true
+		}
+		a, found := admitted[key]
+		if !found || a.epoch != epoch || rt.Router.RevokesRemovedPeers(a.cluster) {
+			delete(admitted, key)
+			return "", false
+		}
+		return a.cluster, true
+	}
+}
+
+// routeChecker returns an AdmitFunc that routes a peer endpoint through the Router for a listener
+// and a user, using the serving cluster name as the admission/metric label.
+func routeChecker(rt *runtime.Runtime, listener string, user UserFunc) AdmitFunc {
+	return func(addr net.Addr) (string, bool) {
+		return routeRemote(rt, listener, user(), addr)
 	}
 }
 
-// routeRemote resolves the cluster admitting a remote peer endpoint (protocol and port derived from
-// the address type), or ("", false) if none does.
-func routeRemote(rt *runtime.Runtime, listener string, remote net.Addr) (string, bool) {
+// routeRemote resolves the cluster admitting a remote peer endpoint for a user (protocol and port
+// derived from the address type), or ("", false) if none does.
+func routeRemote(rt *runtime.Runtime, listener string, user runtime.User, remote net.Addr) (string, bool) {
 	var (
 		proto stnrv1.ClusterProtocol
 		peer  net.IP
@@ -142,7 +341,7 @@ func routeRemote(rt *runtime.Runtime, listener string, remote net.Addr) (string,
 	default:
 		return "", false
 	}
-	return rt.Router.Route(listener, listenerRoutes(rt, listener), proto, peer, port)
+	return rt.Router.RouteUser(listener, listenerRoutes(rt, listener), user, proto, peer, port)
 }
 
 func listenerRoutes(rt *runtime.Runtime, listener string) []string {
@@ -155,12 +354,14 @@ func listenerRoutes(rt *runtime.Runtime, listener string) []string {
 // listenTCP binds the relayed TCP transport address with the reuse socket options so outgoing dials
 // can share it. transport.Net has no listen-config hook, so the kernel path uses net.ListenConfig
 // directly; only vnet-backed tests go through rt.Net.
-func listenTCP(rt *runtime.Runtime, network string, port int) (net.Listener, error) {
-	wildcard := net.IPv4zero
-	if strings.HasSuffix(network, "6") {
-		wildcard = net.IPv6unspecified
+func listenTCP(rt *runtime.Runtime, network string, ip net.IP, port int) (net.Listener, error) {
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4zero
+		if strings.HasSuffix(network, "6") {
+			ip = net.IPv6unspecified
+		}
 	}
-	laddr := &net.TCPAddr{IP: wildcard, Port: port}
+	laddr := &net.TCPAddr{IP: ip, Port: port}
 
 	if _, ok := rt.Net.(*stdnet.Net); ok {
 		lc := net.ListenConfig{Control: ReuseAddrControl}
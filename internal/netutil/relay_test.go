@@ -1,15 +1,23 @@
 package netutil
 
 import (
+	"fmt"
+	"io"
 	"net"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/pion/transport/v4/stdnet"
 	"github.com/pion/transport/v4/test"
 	"github.com/pion/transport/v4/vnet"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/l7mp/stunner/internal/runtime"
 	"github.com/l7mp/stunner/internal/telemetry"
+	"github.com/l7mp/stunner/internal/util"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 	"github.com/l7mp/stunner/pkg/logger"
 )
 
@@ -138,6 +146,214 @@ func TestPortRangePacketConn(t *testing.T) {
 	})
 }
 
+// virtualRouter is a fake Router that admits all peers, unless they are removed, and maps a
+// virtual address to backends.
+type virtualRouter struct {
+	runtime.Router
+	vip      net.IP
+	port     int
+	backends []*util.Endpoint
+	removed  bool
+	revoke   bool
+	epoch    uint64
+	zoneHits int
+}
+
+func (r *virtualRouter) RouteUser(_ string, _ []string, _ runtime.User, _ stnrv1.ClusterProtocol, _ net.IP, _ int) (string, bool) {
+	return testCluster, !r.removed
+}
+
+func (r *virtualRouter) CrossZone(_ string, _ net.IP) bool {
+	r.zoneHits++
+	return true
+}
+
+func (r *virtualRouter) Epoch() uint64                     { return r.epoch }
+func (r *virtualRouter) RevokesRemovedPeers(_ string) bool { return r.revoke }
+func (r *virtualRouter) TrackConn(_ string, _ net.Addr, _ io.Closer) func() {
+	return func() {}
+}
+
+func (r *virtualRouter) VirtualBackends(_ string, peer net.IP, port int) ([]*util.Endpoint, bool) {
+	if !peer.Equal(r.vip) || port != r.port {
+		return nil, false
+	}
+	return r.backends, true
+}
+
+func TestVirtualAddress(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	loggerFactory := logger.NewLoggerFactory(connTestLoglevel)
+	tm, err := telemetry.New(telemetry.Callbacks{}, true, loggerFactory.NewLogger("metric"))
+	require.NoError(t, err)
+	defer tm.Close() //nolint:errcheck
+	nw, err := stdnet.NewNet()
+	require.NoError(t, err)
+	vr := &virtualRouter{vip: net.ParseIP("10.96.0.10"), port: 3478}
+	rt := runtime.New(runtime.Config{Logger: loggerFactory, DryRun: true, Telemetry: tm, Net: nw})
+	rt.Router = vr
+
+	backends := map[string]net.PacketConn{}
+	for range 3 {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer conn.Close()
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		ep, err := util.ParseEndpoint(fmt.Sprintf("127.0.0.1:<%d-%d>", port, port))
+		require.NoError(t, err)
+		vr.backends = append(vr.backends, ep)
+		backends[conn.LocalAddr().String()] = conn
+	}
+
+	relay, _, err := NewRelayPacketConn(rt, "listener", func() runtime.User { return runtime.User{ID: "user"} }, net.ParseIP("127.0.0.1"), nil, "udp4", 0)
+	require.NoError(t, err)
+	defer relay.Close()
+	vip := &net.UDPAddr{IP: vr.vip, Port: vr.port}
+
+	// recv returns the backend that received a datagram sent to the virtual address.
+	recv := func() net.PacketConn {
+		_, err := relay.WriteTo([]byte("PING"), vip)
+		require.NoError(t, err)
+		for _, conn := range backends {
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)) //nolint:errcheck
+			buf := make([]byte, 16)
+			if _, addr, err := conn.ReadFrom(buf); err == nil {
+				// Replies of the backend come from the virtual address.
+				_, err := conn.WriteTo([]byte("PONG"), addr)
+				require.NoError(t, err)
+				require.NoError(t, relay.SetReadDeadline(time.Now().Add(time.Second)))
+				_, from, err := relay.ReadFrom(buf)
+				require.NoError(t, err)
+				require.Equal(t, vip.String(), from.String())
+				return conn
+			}
+		}
+		return nil
+	}
+
+	// The allocation sticks to its backend while the backend is available.
+	backend := recv()
+	require.NotNil(t, backend)
+	require.Equal(t, backend, recv())
+	port := backend.LocalAddr().(*net.UDPAddr).Port
+	all := slices.Clone(vr.backends)
+	vr.backends = slices.DeleteFunc(vr.backends, func(ep *util.Endpoint) bool {
+		lo, _ := ep.PortRange()
+		return lo == port
+	})
+	next := recv()
+	require.NotNil(t, next)
+	require.NotEqual(t, backend, next)
+
+	// The allocation is not moved when a backend joins.
+	vr.backends = all
+	require.Equal(t, next, recv())
+
+	// Other peers are not remapped, virtual addresses with no backends are prohibited.
+	_, err = relay.WriteTo([]byte("PING"), next.LocalAddr())
+	require.NoError(t, err)
+	vr.backends = nil
+	_, err = relay.WriteTo([]byte("PING"), vip)
+	require.ErrorIs(t, err, ErrPortProhibited)
+
+	// TCP connections to the virtual address are dialed at the backend.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	port = l.Addr().(*net.TCPAddr).Port
+	ep, err := util.ParseEndpoint(fmt.Sprintf("127.0.0.1:<%d-%d>", port, port))
+	require.NoError(t, err)
+	vr.backends = []*util.Endpoint{ep}
+	tcpVIP := &net.TCPAddr{IP: vr.vip, Port: vr.port}
+	conn, err := Dial(rt, "listener", runtime.User{ID: "user"}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, tcpVIP)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, tcpVIP.String(), conn.RemoteAddr().String())
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	accepted.Close()
+}
+
+func TestRetainAdmitted(t *testing.T) {
+	loggerFactory := logger.NewLoggerFactory(connTestLoglevel)
+	tm, err := telemetry.New(telemetry.Callbacks{}, true, loggerFactory.NewLogger("metric"))
+	require.NoError(t, err)
+	defer tm.Close() //nolint:errcheck
+	nw, err := stdnet.NewNet()
+	require.NoError(t, err)
+	vr := &virtualRouter{}
+	rt := runtime.New(runtime.Config{Logger: loggerFactory, DryRun: true, Telemetry: tm, Net: nw})
+	rt.Router = vr
+
+	relay, _, err := NewRelayPacketConn(rt, "listener", func() runtime.User { return runtime.User{} }, net.ParseIP("127.0.0.1"), nil, "udp4", 0)
+	require.NoError(t, err)
+	defer relay.Close()
+	peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+	other := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5001}
+	write := func(addr net.Addr) error {
+		_, err := relay.WriteTo([]byte("PING"), addr)
+		return err
+	}
+
+	// Admitted peers keep access when removed from their cluster, new peers are not admitted.
+	require.NoError(t, write(peer))
+	vr.removed = true
+	require.NoError(t, write(peer))
+	require.ErrorIs(t, write(other), ErrPortProhibited)
+
+	// Clusters that revoke removed peers drop the access.
+	vr.revoke = true
+	require.ErrorIs(t, write(peer), ErrPortProhibited)
+
+	// A config change drops the access.
+	vr.removed, vr.revoke = false, false
+	require.NoError(t, write(peer))
+	vr.removed = true
+	vr.epoch++
+	require.ErrorIs(t, write(peer), ErrPortProhibited)
+}
+
+func TestRelayCrossZone(t *testing.T) {
+	loggerFactory := logger.NewLoggerFactory(connTestLoglevel)
+	tm, err := telemetry.New(telemetry.Callbacks{}, true, loggerFactory.NewLogger("metric"))
+	require.NoError(t, err)
+	defer tm.Close() //nolint:errcheck
+	nw, err := stdnet.NewNet()
+	require.NoError(t, err)
+	vr := &virtualRouter{}
+	rt := runtime.New(runtime.Config{Logger: loggerFactory, DryRun: true, Telemetry: tm, Net: nw, Zone: "zone-a"})
+	rt.Router = vr
+
+	relay, _, err := NewRelayPacketConn(rt, "listener", func() runtime.User { return runtime.User{} }, net.ParseIP("127.0.0.1"), nil, "udp4", 0)
+	require.NoError(t, err)
+	defer relay.Close()
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer peer.Close()
+
+	// The zone of a peer is looked up once, not per datagram.
+	buf := make([]byte, 16)
+	for range 3 {
+		_, err := relay.WriteTo([]byte("PING"), peer.LocalAddr())
+		require.NoError(t, err)
+		require.NoError(t, peer.SetReadDeadline(time.Now().Add(time.Second)))
+		_, addr, err := peer.ReadFrom(buf)
+		require.NoError(t, err)
+		_, err = peer.WriteTo([]byte("PONG"), addr)
+		require.NoError(t, err)
+		require.NoError(t, relay.SetReadDeadline(time.Now().Add(time.Second)))
+		_, _, err = relay.ReadFrom(buf)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, vr.zoneHits)
+	rx, tx, ok := tm.CrossZoneBytes(testCluster)
+	require.True(t, ok)
+	require.Equal(t, uint64(12), rx)
+	require.Equal(t, uint64(12), tx)
+}
+
 // BenchmarkPortRangePacketConn sends lots of invalid packets: this is mostly for testing the logger
 func BenchmarkPortRangePacketConn(b *testing.B) {
 	loggerFactory := logger.NewLoggerFactory(connTestLoglevel)
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/url"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -15,9 +16,10 @@ import (
 )
 
 // Admin holds the bits of STUNner administration that aren't carved out into
-// Health/Metrics/Offload: Name/LogLevel/UserQuota/License.
+// Health/Metrics/Offload: Name/LogLevel/PeerDenyList/UserQuota/License.
 type Admin struct {
 	name, logLevel string
+	peerDenyList   []string
 	quota          int
 	licenseConfig  *stnrv1.LicenseConfig
 
@@ -64,6 +66,7 @@ func (a *Admin) GetConfig() stnrv1.Config {
 	healthEndpoint := ""
 	if hc, ok := a.rt.GetConfig(runtime.TypeHealth, "").(*HealthConfig); ok && hc != nil {
 		healthEndpoint = hc.Endpoint
+		out.CredentialEndpoint = hc.CredentialEndpoint
 	}
 	out.HealthCheckEndpoint = &healthEndpoint
 
@@ -91,10 +94,11 @@ func (a *Admin) Inspect(old, new stnrv1.Config, _ *stnrv1.StunnerConfig) (runtim
 	// their owning Objects.
 	changed := req.Name != cur.Name ||
 		req.LogLevel != cur.LogLevel ||
+		!slices.Equal(peerDenyList(req), peerDenyList(cur)) ||
 		req.UserQuota != cur.UserQuota ||
 		!reflect.DeepEqual(req.LicenseConfig, cur.LicenseConfig)
-	// Admin owns no restartable resources of its own: name/loglevel/quota/license can be
-	// updated in place.
+	// Admin owns no restartable resources of its own: name/loglevel/deny-list/quota/license
+	// can be updated in place.
 	if changed {
 		return runtime.ActionReconcile, nil
 	}
@@ -113,6 +117,9 @@ func (a *Admin) Reconcile(conf stnrv1.Config) error {
 
 	a.name = req.Name
 	a.logLevel = req.LogLevel
+	denyList := append([]string{}, *req.PeerDenyList...)
+	denyListChanged := !slices.Equal(a.peerDenyList, denyList)
+	a.peerDenyList = denyList
 	a.quota = req.UserQuota
 	a.rt.License.Reconcile(req.LicenseConfig)
 	a.licenseConfig = req.LicenseConfig
@@ -120,12 +127,26 @@ func (a *Admin) Reconcile(conf stnrv1.Config) error {
 	a.conf.Store(&stnrv1.AdminConfig{
 		Name:          a.name,
 		LogLevel:      a.logLevel,
+		PeerDenyList:  &denyList,
 		UserQuota:     a.quota,
 		LicenseConfig: a.licenseConfig,
 	})
+
+	// The router caches the parsed deny-list.
+	if denyListChanged && a.rt.Router != nil {
+		a.rt.Router.InvalidateCache()
+	}
 	return nil
 }
 
+// peerDenyList returns the effective peer deny-list of a config.
+func peerDenyList(req *stnrv1.AdminConfig) []string {
+	if req.PeerDenyList == nil {
+		return stnrv1.DefaultPeerDenyList()
+	}
+	return *req.PeerDenyList
+}
+
 func (a *Admin) Start() error       { return nil }
 func (a *Admin) Close(_ bool) error { return nil }
 
@@ -57,6 +57,20 @@ func TestAdminObjectSemantics(t *testing.T) {
 				},
 				want: runtime.ActionReconcile,
 			},
+			{
+				name: "deny-list-change-reconcile",
+				conf: &stnrv1.AdminConfig{
+					Name:                stnrv1.DefaultStunnerName,
+					LogLevel:            stnrv1.DefaultLogLevel,
+					MetricsEndpoint:     "",
+					HealthCheckEndpoint: strPtr(""),
+					PeerDenyList:        &[]string{},
+					UserQuota:           10,
+					OffloadEngine:       stnrv1.OffloadEngineNone.String(),
+					OffloadInterfaces:   []string{},
+				},
+				want: runtime.ActionReconcile,
+			},
 			{
 				name: "same-config-none",
 				conf: &stnrv1.AdminConfig{
@@ -1,22 +1,82 @@
 package object
 
 import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/pion/logging"
+	"k8s.io/utils/lru"
 
 	"github.com/l7mp/stunner/internal/runtime"
+	"github.com/l7mp/stunner/internal/telemetry"
+	"github.com/l7mp/stunner/internal/util"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
 )
 
+const secretHintCacheSize = 4096
+
 // Auth is the STUNner authenticator. TURN handlers read the live auth config per request via
-// rt.GetConfig(TypeAuth, ""), which loads the atomic snapshot published by Reconcile.
+// ResolvedConfig, which loads the atomic snapshot published by Reconcile.
 type Auth struct {
 	authType                          stnrv1.AuthType
 	realm, username, password, secret string
+	users                             []stnrv1.UserCredential
+	userFile                          string
+	jwt                               *stnrv1.JWTConfig
+	webhookConf                       *stnrv1.WebhookConfig
+	oauth                             *stnrv1.OAuthConfig
+
+	// conf is the atomic snapshot read by the auth handler on the request path, with the
+	// credential and secret references resolved. exported is the same snapshot with the
+	// references kept, returned by GetConfig, so that the referenced values do not leak into
+	// the config and the status.
+	conf     atomic.Pointer[stnrv1.AuthConfig]
+	exported atomic.Pointer[stnrv1.AuthConfig]
+
+	// userTable is the merged "static-multi" user table (the user file overlaid with the
+	// inline users), read by the auth and quota handlers on the request path via LookupUser.
+	userTable atomic.Pointer[map[string]stnrv1.UserCredential]
+
+	// inlineKeySet is the parsed inline "jwt" key set, merged with the key set file into
+	// keySet, which is read by the auth handler on the request path via VerifyToken.
+	inlineKeySet atomic.Pointer[a12n.KeySet]
+	keySet       atomic.Pointer[a12n.KeySet]
+
+	// webhook is the "webhook" authenticator along with its verdict cache, rebuilt only when
+	// the webhook config changes.
+	webhook atomic.Pointer[a12n.WebhookAuthenticator]
+
+	// secrets is the "ephemeral" secret list along with the rotation state of each secret, and
+	// secretHints remembers the secret generation that matched the last request of a client,
+	// keyed by client address and username.
+	secrets     atomic.Pointer[secretSet]
+	secretHints *lru.Cache
+
+	// oauthKeys holds the decoded "oauth" keys by key ID, and accessTokens remembers the last
+	// access token of each client, keyed by client address and key ID, since clients may send
+	// the token only in the first request of a session.
+	oauthKeys    atomic.Pointer[map[string][]byte]
+	accessTokens *lru.Cache
+
+	// guard is the brute-force protection, rebuilt only when its config changes so that the
+	// bans survive unrelated reconciliations. Nil when disabled.
+	guard     atomic.Pointer[bruteForceGuard]
+	telemetry *telemetry.Telemetry
 
-	// conf is the atomic snapshot read by the auth handler on the request path.
-	conf atomic.Pointer[stnrv1.AuthConfig]
+	// cancel stops the file watcher started by Start.
+	cancel context.CancelFunc
 
 	log logging.LeveledLogger
 }
@@ -24,7 +84,10 @@ type Auth struct {
 // NewAuth creates an Auth object.
 func NewAuth(conf stnrv1.Config, rt *runtime.Runtime) (runtime.Object, error) {
 	a := &Auth{
-		log: rt.Logger.NewLogger("auth"),
+		secretHints:  lru.New(secretHintCacheSize),
+		accessTokens: lru.New(secretHintCacheSize),
+		telemetry:    rt.Telemetry,
+		log:          rt.Logger.NewLogger("auth"),
 	}
 	if conf == nil {
 		return a, nil
@@ -48,10 +111,17 @@ func (a *Auth) Inspect(old, new stnrv1.Config, _ *stnrv1.StunnerConfig) (runtime
 		return runtime.ActionNone, stnrv1.ErrInvalidConf
 	}
 	cur := old.(*stnrv1.AuthConfig)
-	if !cur.DeepEqual(req) {
-		return runtime.ActionReconcile, nil
+	// Compare the resolved values as well, so that changes in the referenced files are picked
+	// up. If a reference cannot be resolved, Reconcile reports the error.
+	if res, err := resolveReferences(req); err == nil && cur.DeepEqual(req) &&
+		a.ResolvedConfig().DeepEqual(res) {
+		return runtime.ActionNone, nil
 	}
-	return runtime.ActionNone, nil
+	// The file watcher is owned by the lifecycle: a new path needs a restart.
+	if cur.UserFile != req.UserFile || keySetFile(cur) != keySetFile(req) {
+		return runtime.ActionRestart, nil
+	}
+	return runtime.ActionReconcile, nil
 }
 
 func (a *Auth) Reconcile(conf stnrv1.Config) error {
@@ -62,12 +132,49 @@ func (a *Auth) Reconcile(conf stnrv1.Config) error {
 	if err := req.Validate(); err != nil {
 		return err
 	}
+	orig := req
+	req, err := resolveReferences(req)
+	if err != nil {
+		return err
+	}
 	atype, _ := stnrv1.NewAuthType(req.Type)
 	a.log.Debugf("using authentication: %s", atype.String())
 
+	var fileUsers []stnrv1.UserCredential
+	if atype == stnrv1.AuthTypeStaticMulti && req.UserFile != "" {
+		users, err := loadUserFile(req.UserFile)
+		if err != nil {
+			return err
+		}
+		fileUsers = users
+	}
+
+	var inlineKeySet, fileKeySet *a12n.KeySet
+	if atype == stnrv1.AuthTypeJWT {
+		if req.JWT.KeySet != "" {
+			ks, err := a12n.ParseKeySet([]byte(req.JWT.KeySet))
+			if err != nil {
+				return fmt.Errorf("invalid JWT key set: %w", err)
+			}
+			inlineKeySet = ks
+		}
+		if req.JWT.KeySetFile != "" {
+			ks, err := loadKeySetFile(req.JWT.KeySetFile)
+			if err != nil {
+				return err
+			}
+			fileKeySet = ks
+		}
+	}
+
 	a.authType = atype
 	a.realm = req.Realm
+	oldWebhookConf, oldToken := a.webhookConf, a.secret
 	a.username, a.password, a.secret = "", "", ""
+	a.users, a.userFile = nil, ""
+	a.jwt = nil
+	a.webhookConf = nil
+	a.oauth = nil
 	switch atype {
 	case stnrv1.AuthTypeNone:
 	case stnrv1.AuthTypeStatic:
@@ -75,6 +182,23 @@ func (a *Auth) Reconcile(conf stnrv1.Config) error {
 		a.password = req.Credentials["password"]
 	case stnrv1.AuthTypeEphemeral:
 		a.secret = req.Credentials["secret"]
+	case stnrv1.AuthTypeStaticMulti:
+		for _, u := range req.Users {
+			a.users = append(a.users, u.DeepCopy())
+		}
+		a.userFile = req.UserFile
+	case stnrv1.AuthTypeJWT:
+		a.secret = req.Credentials["secret"]
+		j := *req.JWT
+		a.jwt = &j
+	case stnrv1.AuthTypeWebhook:
+		a.secret = req.Credentials["token"]
+		w := *req.Webhook
+		a.webhookConf = &w
+	case stnrv1.AuthTypeOAuth:
+		o := *req.OAuth
+		o.Keys = append([]stnrv1.OAuthKey(nil), req.OAuth.Keys...)
+		a.oauth = &o
 	}
 
 	// Publish the snapshot for the request path.
@@ -90,33 +214,719 @@ func (a *Auth) Reconcile(conf stnrv1.Config) error {
 		snap.Credentials["password"] = a.password
 	case stnrv1.AuthTypeEphemeral:
 		snap.Credentials["secret"] = a.secret
+		if len(req.Secrets) > 0 {
+			snap.Secrets = append([]string(nil), req.Secrets...)
+			snap.SecretGracePeriod = req.SecretGracePeriod
+		}
+	case stnrv1.AuthTypeStaticMulti:
+		snap.Users = a.copyUsers()
+		snap.UserFile = a.userFile
+	case stnrv1.AuthTypeJWT:
+		if a.secret != "" {
+			snap.Credentials["secret"] = a.secret
+		}
+		j := *a.jwt
+		snap.JWT = &j
+	case stnrv1.AuthTypeWebhook:
+		if a.secret != "" {
+			snap.Credentials["token"] = a.secret
+		}
+		w := *a.webhookConf
+		snap.Webhook = &w
+	case stnrv1.AuthTypeOAuth:
+		o := *a.oauth
+		o.Keys = append([]stnrv1.OAuthKey(nil), a.oauth.Keys...)
+		snap.OAuth = &o
+	}
+	if len(req.PasswordAlgorithms) > 0 {
+		snap.PasswordAlgorithms = append([]string(nil), req.PasswordAlgorithms...)
+	}
+	if len(req.UserClusters) > 0 {
+		snap.UserClusters = make(map[string][]string, len(req.UserClusters))
+		for k, v := range req.UserClusters {
+			snap.UserClusters[k] = append([]string(nil), v...)
+		}
+	}
+	if req.BruteForceProtection != nil {
+		b := *req.BruteForceProtection
+		b.AllowList = append([]string(nil), req.BruteForceProtection.AllowList...)
+		snap.BruteForceProtection = &b
 	}
 	a.conf.Store(snap)
+	a.exported.Store(exportReferences(snap, orig))
+	a.reconcileGuard(req.BruteForceProtection)
+	a.publishUserTable(fileUsers)
+	a.reconcileWebhook(oldWebhookConf, oldToken)
+	a.reconcileSecrets(req)
+	a.reconcileOAuthKeys()
+	a.inlineKeySet.Store(inlineKeySet)
+	a.keySet.Store(inlineKeySet.Merge(fileKeySet))
 	return nil
 }
 
-// GetConfig returns a copy of the live auth config. Safe for concurrent use.
+// resolveReferences returns a copy of an auth config with the credentials and the secrets given
+// as file or environment references replaced by the referenced values.
+func resolveReferences(req *stnrv1.AuthConfig) (*stnrv1.AuthConfig, error) {
+	ret := &stnrv1.AuthConfig{}
+	req.DeepCopyInto(ret)
+	for k, v := range ret.Credentials {
+		r, err := stnrv1.ResolveReference(v)
+		if err != nil {
+			return nil, fmt.Errorf("credential %q: %w", k, err)
+		}
+		ret.Credentials[k] = r
+	}
+	for i, v := range ret.Secrets {
+		r, err := stnrv1.ResolveReference(v)
+		if err != nil {
+			return nil, fmt.Errorf("secret %d: %w", i, err)
+		}
+		ret.Secrets[i] = r
+	}
+	return ret, nil
+}
+
+// exportReferences returns a copy of a resolved auth config snapshot with the credentials and the
+// secrets given as references in the original config replaced by the references.
+func exportReferences(snap, orig *stnrv1.AuthConfig) *stnrv1.AuthConfig {
+	ret := &stnrv1.AuthConfig{}
+	snap.DeepCopyInto(ret)
+	for k := range ret.Credentials {
+		if v := orig.Credentials[k]; stnrv1.IsReference(v) {
+			ret.Credentials[k] = v
+		}
+	}
+	for i := range ret.Secrets {
+		if i < len(orig.Secrets) && stnrv1.IsReference(orig.Secrets[i]) {
+			ret.Secrets[i] = orig.Secrets[i]
+		}
+	}
+	return ret
+}
+
+// GetConfig returns a copy of the live auth config, with the credentials and the secrets given as
+// references kept as references. Safe for concurrent use.
 func (a *Auth) GetConfig() stnrv1.Config {
-	snap := a.conf.Load()
+	return copyAuthConfig(a.exported.Load())
+}
+
+// ResolvedConfig returns a copy of the live auth config with the references resolved, for the
+// request path. Safe for concurrent use.
+func (a *Auth) ResolvedConfig() *stnrv1.AuthConfig {
+	return copyAuthConfig(a.conf.Load())
+}
+
+// resolvedAuthConfig returns the live auth config with the references resolved, or nil if there
+// is no auth object.
+func resolvedAuthConfig(rt *runtime.Runtime) *stnrv1.AuthConfig {
+	o, ok := rt.Registry.Get(runtime.TypeAuth, stnrv1.DefaultAuthName)
+	if !ok {
+		return nil
+	}
+	a, ok := o.(*Auth)
+	if !ok {
+		return nil
+	}
+	return a.ResolvedConfig()
+}
+
+// copyAuthConfig copies an auth config snapshot, or returns an empty config if there is none.
+func copyAuthConfig(snap *stnrv1.AuthConfig) *stnrv1.AuthConfig {
 	if snap == nil {
 		return &stnrv1.AuthConfig{
 			Type:        stnrv1.AuthTypeNone.String(),
 			Credentials: map[string]string{},
 		}
 	}
-	out := stnrv1.AuthConfig{
-		Type:        snap.Type,
-		Realm:       snap.Realm,
-		Credentials: make(map[string]string, len(snap.Credentials)),
+	out := stnrv1.AuthConfig{}
+	snap.DeepCopyInto(&out)
+	return &out
+}
+
+// Start starts watching the user file and the key set file, if any.
+func (a *Auth) Start() error {
+	files := []string{}
+	if a.userFile != "" {
+		files = append(files, a.userFile)
 	}
-	for k, v := range snap.Credentials {
-		out.Credentials[k] = v
+	if a.jwt != nil && a.jwt.KeySetFile != "" {
+		files = append(files, a.jwt.KeySetFile)
 	}
-	return &out
+	if len(files) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := util.WatchFiles(ctx, files, a.reloadFiles, a.log); err != nil {
+		cancel()
+		return fmt.Errorf("cannot watch auth files: %w", err)
+	}
+	a.cancel = cancel
+	// Catch up with changes that happened between Reconcile and the watch.
+	a.reloadFiles()
+	return nil
 }
 
-func (a *Auth) Start() error       { return nil }
-func (a *Auth) Close(_ bool) error { return nil }
+// Close stops the file watcher.
+func (a *Auth) Close(_ bool) error {
+	if a.cancel != nil {
+		a.cancel()
+		a.cancel = nil
+	}
+	return nil
+}
+
+// Status returns the auth config along with the use of the "ephemeral" secret generations, if
+// secret rotation is in effect, and the failed authentications and the active bans, if
+// brute-force protection is enabled.
 func (a *Auth) Status() stnrv1.Status {
-	return a.GetConfig()
+	status := &stnrv1.AuthStatus{AuthConfig: *a.GetConfig().(*stnrv1.AuthConfig)}
+	if g := a.guard.Load(); g != nil {
+		status.BruteForceStatus = g.status(time.Now())
+	}
+	set := a.secrets.Load()
+	if set == nil || len(set.gens) < 2 {
+		return status
+	}
+	for i, g := range set.gens {
+		s := stnrv1.SecretStatus{Generation: i, Matches: g.matches.Load()}
+		if i > 0 {
+			s.Expires = g.retiredAt.Add(set.grace).Format(time.RFC3339)
+		}
+		status.SecretStatus = append(status.SecretStatus, s)
+	}
+	return status
+}
+
+// LookupUser returns the entry for a username from the "static-multi" user table, or the quota of
+// a user ID last returned by the authorization webhook. The clusters returned by the webhook are
+// recorded on the allocations instead. Safe for concurrent use.
+func (a *Auth) LookupUser(username string) (stnrv1.UserCredential, bool) {
+	if w := a.webhook.Load(); w != nil {
+		v, ok := w.LookupUser(username)
+		if !ok {
+			return stnrv1.UserCredential{}, false
+		}
+		return stnrv1.UserCredential{Username: v.UserID, UserQuota: v.Quota}, true
+	}
+	table := a.userTable.Load()
+	if table == nil {
+		return stnrv1.UserCredential{}, false
+	}
+	u, ok := (*table)[username]
+	return u, ok
+}
+
+// VerifyToken verifies a "jwt" token against the live key set and the issuer and audience
+// constraints, and returns the claims. Safe for concurrent use.
+func (a *Auth) VerifyToken(token string) (a12n.JWTClaims, error) {
+	snap := a.conf.Load()
+	if snap == nil || snap.JWT == nil {
+		return nil, fmt.Errorf("JWT authentication is not configured")
+	}
+	claims, err := a12n.VerifyJWT(token, a.keySet.Load(), a12n.JWTVerifyOptions{
+		Issuer:   snap.JWT.Issuer,
+		Audience: snap.JWT.Audience,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// UserClusters returns the clusters the user of an allocation may access, or false if the user is
+// not restricted to a subset of the clusters. The clusters recorded from the token or the webhook
+// verdict of the allocation and the per-user clusters of the user table take precedence over the
+// longest matching key of the UserClusters config. An unknown user ("") may access no cluster as
+// soon as any user may be restricted, and neither may a user whose credential was not recorded if
+// the credentials may carry clusters, so that a client whose user cannot be found fails closed.
+// Safe for concurrent use.
+func (a *Auth) UserClusters(user runtime.User) ([]string, bool) {
+	if user.ID == "" {
+		return nil, a.restrictsUsers()
+	}
+	if user.Recorded && user.Clusters != nil {
+		return user.Clusters, true
+	}
+
+	snap := a.conf.Load()
+	if snap == nil {
+		return nil, false
+	}
+	if !user.Recorded && a.restrictsCredentials(snap) {
+		return nil, true
+	}
+	if table := a.userTable.Load(); table != nil {
+		if u, ok := (*table)[user.ID]; ok && u.Clusters != nil {
+			return u.Clusters, true
+		}
+	}
+	if clusters, ok := snap.UserClusters[user.ID]; ok {
+		return clusters, true
+	}
+	match, found := "", false
+	for k := range snap.UserClusters {
+		prefix, ok := strings.CutSuffix(k, "*")
+		if ok && strings.HasPrefix(user.ID, prefix) && (!found || len(prefix) > len(match)) {
+			match, found = prefix, true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	return snap.UserClusters[match+"*"], true
+}
+
+// restrictsUsers reports whether any user may be restricted to a subset of the clusters.
+func (a *Auth) restrictsUsers() bool {
+	snap := a.conf.Load()
+	if snap == nil {
+		return false
+	}
+	if len(snap.UserClusters) > 0 || a.restrictsCredentials(snap) {
+		return true
+	}
+	if table := a.userTable.Load(); table != nil {
+		for _, u := range *table {
+			if u.Clusters != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restrictsCredentials reports whether the credentials may restrict users to a subset of the
+// clusters: "jwt" tokens with a clusters claim and the webhook verdicts.
+func (a *Auth) restrictsCredentials(snap *stnrv1.AuthConfig) bool {
+	return (snap.JWT != nil && snap.JWT.ClustersClaim != "") || a.webhook.Load() != nil
+}
+
+// AdmitClient returns an error if the source IP or the username of a request is banned for too
+// many failed authentications. Safe for concurrent use.
+func (a *Auth) AdmitClient(src net.Addr, username string) error {
+	g := a.guard.Load()
+	if g == nil {
+		return nil
+	}
+	return g.admit(src, username, time.Now())
+}
+
+// RecordAuthFailure counts a failed authentication against the source IP and the username of a
+// request. Safe for concurrent use.
+func (a *Auth) RecordAuthFailure(src net.Addr, username string) {
+	if g := a.guard.Load(); g != nil {
+		g.recordFailure(src, username, time.Now())
+	}
+}
+
+// BanCount returns the number of source IPs and usernames currently banned. Safe for concurrent
+// use.
+func (a *Auth) BanCount() int {
+	g := a.guard.Load()
+	if g == nil {
+		return 0
+	}
+	return g.banCount(time.Now())
+}
+
+// reconcileGuard rebuilds the brute-force protection if its config has changed.
+func (a *Auth) reconcileGuard(conf *stnrv1.BruteForceConfig) {
+	if conf == nil {
+		a.guard.Store(nil)
+		return
+	}
+	if g := a.guard.Load(); g != nil && reflect.DeepEqual(&g.conf, conf) {
+		return
+	}
+	a.guard.Store(newBruteForceGuard(conf, a.telemetry))
+}
+
+// AuthenticateWebhook checks a user with the "webhook" authenticator. Safe for concurrent use.
+func (a *Auth) AuthenticateWebhook(username, realm string, src net.Addr) (a12n.WebhookVerdict, error) {
+	w := a.webhook.Load()
+	if w == nil {
+		return a12n.WebhookVerdict{}, fmt.Errorf("webhook authentication is not configured")
+	}
+	return w.Authenticate(username, realm, src)
+}
+
+// reconcileWebhook rebuilds the webhook authenticator if the webhook config has changed, so that
+// the verdict cache survives unrelated reconciliations.
+func (a *Auth) reconcileWebhook(old *stnrv1.WebhookConfig, oldToken string) {
+	if a.webhookConf == nil {
+		a.webhook.Store(nil)
+		return
+	}
+	if old != nil && *old == *a.webhookConf && oldToken == a.secret && a.webhook.Load() != nil {
+		return
+	}
+	// Durations were checked in Validate.
+	timeout, _ := time.ParseDuration(a.webhookConf.Timeout)
+	ttl, _ := time.ParseDuration(a.webhookConf.CacheTTL)
+	negTTL, _ := time.ParseDuration(a.webhookConf.NegativeCacheTTL)
+	a.webhook.Store(a12n.NewWebhookAuthenticator(a12n.WebhookAuthenticatorConfig{
+		URL:              a.webhookConf.URL,
+		BearerToken:      a.secret,
+		Timeout:          timeout,
+		CacheTTL:         ttl,
+		NegativeCacheTTL: negTTL,
+		FailOpen:         a.webhookConf.FailurePolicy == "open",
+	}))
+}
+
+// secretGeneration is an "ephemeral" shared secret along with its rotation state.
+type secretGeneration struct {
+	secret string
+	// retiredAt is the time the secret was rotated out, zero for the newest secret.
+	retiredAt time.Time
+	// matches counts the requests authenticated with the secret, kept across reconciliations.
+	matches *atomic.Uint64
+}
+
+// secretSet is the ordered "ephemeral" secret list, newest first.
+type secretSet struct {
+	gens  []secretGeneration
+	grace time.Duration
+}
+
+// accepted returns the secret generations accepted for verification at the given time.
+func (s *secretSet) accepted(now time.Time) []int {
+	ret := []int{}
+	for i, g := range s.gens {
+		if i == 0 || now.Before(g.retiredAt.Add(s.grace)) {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// reconcileSecrets publishes the "ephemeral" secret list. The rotation state of the secrets
+// already known is kept, secrets that are not the newest anymore are retired now.
+func (a *Auth) reconcileSecrets(req *stnrv1.AuthConfig) {
+	if a.authType != stnrv1.AuthTypeEphemeral {
+		a.secrets.Store(nil)
+		return
+	}
+	secrets := req.Secrets
+	if len(secrets) == 0 {
+		secrets = []string{a.secret}
+	}
+	grace, _ := time.ParseDuration(req.SecretGracePeriod) // checked in Validate
+
+	known := map[string]secretGeneration{}
+	if cur := a.secrets.Load(); cur != nil {
+		for _, g := range cur.gens {
+			known[g.secret] = g
+		}
+	}
+
+	now := time.Now()
+	set := &secretSet{grace: grace}
+	for i, secret := range secrets {
+		g, ok := known[secret]
+		if !ok {
+			g = secretGeneration{secret: secret, matches: &atomic.Uint64{}}
+		}
+		switch {
+		case i == 0:
+			g.retiredAt = time.Time{}
+		case g.retiredAt.IsZero():
+			a.log.Infof("ephemeral secret generation %d retired, accepted for %s", i,
+				grace.String())
+			g.retiredAt = now
+		}
+		set.gens = append(set.gens, g)
+	}
+	a.secrets.Store(set)
+}
+
+// reconcileOAuthKeys publishes the decoded "oauth" keys.
+func (a *Auth) reconcileOAuthKeys() {
+	if a.oauth == nil {
+		a.oauthKeys.Store(nil)
+		return
+	}
+	keys := make(map[string][]byte, len(a.oauth.Keys))
+	for _, k := range a.oauth.Keys {
+		key, _ := base64.StdEncoding.DecodeString(k.Key) // checked in Validate
+		keys[k.KID] = key
+	}
+	a.oauthKeys.Store(&keys)
+}
+
+// ProbeCredential finds the "ephemeral" secret generation used to issue the credential of a raw
+// STUN request, counts the match and remembers the secret for the next call to EphemeralSecret for
+// the same client and username. It is a no-op unless multiple secrets are accepted. For "oauth"
+// authentication the access token of the request, if any, is decrypted and remembered for
+// AccessToken. Returns the request to pass to the TURN server, which differs from raw only if the
+// access token had to be removed. Safe for concurrent use.
+func (a *Auth) ProbeCredential(raw []byte, src net.Addr) []byte {
+	if keys := a.oauthKeys.Load(); keys != nil {
+		return a.probeAccessToken(raw, src, *keys)
+	}
+
+	set := a.secrets.Load()
+	if set == nil || len(set.gens) < 2 {
+		return raw
+	}
+	accepted := set.accepted(time.Now())
+	if len(accepted) < 2 {
+		return raw
+	}
+	secrets := make([]string, len(accepted))
+	for i, idx := range accepted {
+		secrets[i] = set.gens[idx].secret
+	}
+	username, i := a12n.MatchLongTermCredential(raw, a.conf.Load().Realm, secrets)
+	if i < 0 {
+		return raw
+	}
+	// Count only the requests whose MESSAGE-INTEGRITY has been verified with the secret.
+	set.gens[accepted[i]].matches.Add(1)
+	a.secretHints.Add(src.String()+"|"+username, secrets[i])
+	return raw
+}
+
+// probeAccessToken decrypts the access token of a request and remembers it for the client. The
+// TURN server rejects the unknown ACCESS-TOKEN attribute, so the attribute is removed from the
+// request once MESSAGE-INTEGRITY has been verified with the session key of the token. Requests
+// with an invalid token are passed on unchanged and rejected by the TURN server.
+func (a *Auth) probeAccessToken(raw []byte, src net.Addr, keys map[string][]byte) []byte {
+	kid, token, ok := a12n.GetAccessToken(raw)
+	if !ok {
+		return raw
+	}
+	key, ok := keys[kid]
+	if !ok {
+		a.log.Debugf("oauth: client %s: unknown key ID %q", src, kid)
+		return raw
+	}
+	conf := a.conf.Load()
+	if conf == nil || conf.OAuth == nil {
+		return raw
+	}
+	t, err := a12n.DecryptAccessToken(key, conf.OAuth.ServerName, token)
+	if err != nil {
+		a.log.Debugf("oauth: client %s: %s", src, err)
+		return raw
+	}
+	stripped, err := a12n.StripAccessToken(raw, t.MACKey)
+	if err != nil {
+		a.log.Debugf("oauth: client %s: %s", src, err)
+		return raw
+	}
+	a.accessTokens.Add(src.String()+"|"+kid, t)
+	return stripped
+}
+
+// AccessToken returns the session key of the last access token received from a client with the
+// given key ID, if the token is still valid. Safe for concurrent use.
+func (a *Auth) AccessToken(kid string, src net.Addr) ([]byte, error) {
+	conf := a.conf.Load()
+	if conf == nil || conf.OAuth == nil {
+		return nil, errors.New("oauth authentication is not configured")
+	}
+	v, ok := a.accessTokens.Get(src.String() + "|" + kid)
+	if !ok {
+		return nil, fmt.Errorf("no valid access token for key ID %q", kid)
+	}
+	t := v.(a12n.AccessToken)
+	skew, _ := time.ParseDuration(conf.OAuth.MaxClockSkew) // checked in Validate
+	if err := t.Check(time.Now(), skew); err != nil {
+		a.accessTokens.Remove(src.String() + "|" + kid)
+		return nil, err
+	}
+	return t.MACKey, nil
+}
+
+// ThirdPartyAuthorization returns the name of the authorization server to advertise in 401
+// challenges, if any. Safe for concurrent use.
+func (a *Auth) ThirdPartyAuthorization() (string, bool) {
+	conf := a.conf.Load()
+	if conf == nil || conf.OAuth == nil || conf.OAuth.AuthorizationServer == "" {
+		return "", false
+	}
+	return conf.OAuth.AuthorizationServer, true
+}
+
+// EphemeralSecret returns the shared secret to check the credential of a client with, along with
+// the generation of the secret: the secret found by ProbeCredential for the client, if it is still
+// accepted, or the newest secret otherwise. Safe for concurrent use.
+func (a *Auth) EphemeralSecret(username string, src net.Addr) (string, int, bool) {
+	set := a.secrets.Load()
+	if set == nil || len(set.gens) == 0 {
+		return "", 0, false
+	}
+	gen := 0
+	if len(set.gens) > 1 {
+		if v, ok := a.secretHints.Get(src.String() + "|" + username); ok {
+			for _, idx := range set.accepted(time.Now()) {
+				if set.gens[idx].secret == v.(string) {
+					gen = idx
+					break
+				}
+			}
+		}
+	}
+	return set.gens[gen].secret, gen, true
+}
+
+func (a *Auth) reloadFiles() {
+	a.reloadUserFile()
+	a.reloadKeySetFile()
+}
+
+// reloadKeySetFile re-reads the key set file and republishes the key set. On error the last good
+// key set is kept.
+func (a *Auth) reloadKeySetFile() {
+	snap := a.conf.Load()
+	if snap == nil || snap.JWT == nil || snap.JWT.KeySetFile == "" {
+		return
+	}
+	path := snap.JWT.KeySetFile
+	if fi, err := os.Stat(path); err == nil && fi.Size() == 0 {
+		a.log.Debugf("ignoring empty key set file %q", path)
+		return
+	}
+	ks, err := loadKeySetFile(path)
+	if err != nil {
+		a.log.Warnf("could not reload key set file (keeping the current key set): %s",
+			err.Error())
+		return
+	}
+	a.log.Infof("key set file %q reloaded: %d keys", path, ks.Len())
+	a.keySet.Store(a.inlineKeySet.Load().Merge(ks))
+}
+
+// reloadUserFile re-reads the user file and republishes the user table. On error the last good
+// table is kept.
+func (a *Auth) reloadUserFile() {
+	snap := a.conf.Load()
+	if snap == nil || snap.UserFile == "" {
+		return
+	}
+	// Writers usually truncate the file first: wait for the content.
+	if fi, err := os.Stat(snap.UserFile); err == nil && fi.Size() == 0 {
+		a.log.Debugf("ignoring empty user file %q", snap.UserFile)
+		return
+	}
+	users, err := loadUserFile(snap.UserFile)
+	if err != nil {
+		a.log.Warnf("could not reload user file (keeping the current user table): %s",
+			err.Error())
+		return
+	}
+	a.log.Infof("user file %q reloaded: %d users", snap.UserFile, len(users))
+	a.publishUserTable(users)
+}
+
+// publishUserTable merges the inline users on top of the given file users and publishes the
+// result for the request path.
+func (a *Auth) publishUserTable(fileUsers []stnrv1.UserCredential) {
+	snap := a.conf.Load()
+	table := map[string]stnrv1.UserCredential{}
+	if snap != nil {
+		for _, u := range fileUsers {
+			table[u.Username] = u.DeepCopy()
+		}
+		for _, u := range snap.Users {
+			table[u.Username] = u.DeepCopy()
+		}
+	}
+	a.userTable.Store(&table)
+}
+
+func (a *Auth) copyUsers() []stnrv1.UserCredential {
+	if a.users == nil {
+		return nil
+	}
+	ret := make([]stnrv1.UserCredential, len(a.users))
+	for i, u := range a.users {
+		ret[i] = u.DeepCopy()
+	}
+	return ret
+}
+
+func keySetFile(req *stnrv1.AuthConfig) string {
+	if req.JWT == nil {
+		return ""
+	}
+	return req.JWT.KeySetFile
+}
+
+// loadKeySetFile reads a JSON Web Key Set or a PEM bundle from a file.
+func loadKeySetFile(path string) (*a12n.KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key set file: %w", err)
+	}
+	ks, err := a12n.ParseKeySet(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key set file %q: %w", path, err)
+	}
+	return ks, nil
+}
+
+// loadUserFile reads an htpasswd-style user file.
+func loadUserFile(path string) ([]stnrv1.UserCredential, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open user file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	users, err := parseUserFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user file %q: %w", path, err)
+	}
+	return users, nil
+}
+
+// parseUserFile parses "username:password[:quota]" entries, one per line. Passwords must be
+// stored in plain text since the TURN long-term credential mechanism needs the password to
+// compute the message integrity key.
+func parseUserFile(r io.Reader) ([]stnrv1.UserCredential, error) {
+	users := []stnrv1.UserCredential{}
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, ok := strings.Cut(line, ":")
+		if !ok || username == "" || password == "" {
+			return nil, fmt.Errorf("line %d: expected \"username:password[:quota]\"", lineNum)
+		}
+		u := stnrv1.UserCredential{Username: username}
+		// Passwords may contain ':', only a numeric last field is taken as the quota.
+		if i := strings.LastIndex(password, ":"); i >= 0 && isDigits(password[i+1:]) {
+			q, err := strconv.Atoi(password[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quota %q", lineNum, password[i+1:])
+			}
+			password, u.UserQuota = password[:i], &q
+		}
+		if password == "" {
+			return nil, fmt.Errorf("line %d: empty password", lineNum)
+		}
+		u.Password = password
+		users = append(users, u)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// isDigits reports whether s is a non-empty string of decimal digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
 }
@@ -1,13 +1,30 @@
 package object_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/pion/stun/v3"
 	"github.com/stretchr/testify/require"
 
 	"github.com/l7mp/stunner/internal/object"
 	"github.com/l7mp/stunner/internal/runtime"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
 )
 
 func TestAuthObjectSemantics(t *testing.T) {
@@ -36,3 +53,586 @@ func TestAuthObjectSemantics(t *testing.T) {
 		},
 	})
 }
+
+func TestAuthStaticMultiUserTable(t *testing.T) {
+	dir := t.TempDir()
+	userFile := filepath.Join(dir, "users")
+	require.NoError(t, os.WriteFile(userFile, []byte("# team users\nuser-a:pass-a:3\nuser-b:pass-b\n"+
+		"user-e:pa:ss:e\nuser-f:pa:ss:7:2\n"), 0o600))
+
+	quota := 5
+	conf := &stnrv1.AuthConfig{
+		Type: stnrv1.AuthTypeStaticMulti.String(),
+		Users: []stnrv1.UserCredential{
+			{Username: "user-b", Password: "inline-pass-b", UserQuota: &quota},
+			{Username: "user-c", Password: "pass-c"},
+		},
+		UserFile: userFile,
+	}
+
+	env := newTestEnv()
+	obj, err := object.NewAuth(conf, env.rt)
+	require.NoError(t, err)
+	auth := obj.(*object.Auth)
+
+	u, ok := auth.LookupUser("user-a")
+	require.True(t, ok)
+	require.Equal(t, "pass-a", u.Password)
+	require.NotNil(t, u.UserQuota)
+	require.Equal(t, 3, *u.UserQuota)
+
+	// Inline users override the user file.
+	u, ok = auth.LookupUser("user-b")
+	require.True(t, ok)
+	require.Equal(t, "inline-pass-b", u.Password)
+	require.Equal(t, 5, *u.UserQuota)
+
+	u, ok = auth.LookupUser("user-c")
+	require.True(t, ok)
+	require.Nil(t, u.UserQuota)
+
+	_, ok = auth.LookupUser("user-d")
+	require.False(t, ok)
+
+	// Passwords may contain ':'.
+	u, ok = auth.LookupUser("user-e")
+	require.True(t, ok)
+	require.Equal(t, "pa:ss:e", u.Password)
+	require.Nil(t, u.UserQuota)
+	u, ok = auth.LookupUser("user-f")
+	require.True(t, ok)
+	require.Equal(t, "pa:ss:7", u.Password)
+	require.Equal(t, 2, *u.UserQuota)
+
+	// Secrets are redacted.
+	require.NotContains(t, auth.GetConfig().String(), "pass")
+
+	// The user file is reloaded on change.
+	require.NoError(t, auth.Start())
+	defer auth.Close(true) //nolint:errcheck
+	require.NoError(t, os.WriteFile(userFile, []byte("user-d:pass-d\n"), 0o600))
+	require.Eventually(t, func() bool {
+		_, ok := auth.LookupUser("user-d")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	_, ok = auth.LookupUser("user-a")
+	require.False(t, ok)
+
+	// A broken user file keeps the last good table.
+	require.NoError(t, os.WriteFile(userFile, []byte("no-password-here\n"), 0o600))
+	time.Sleep(100 * time.Millisecond)
+	_, ok = auth.LookupUser("user-d")
+	require.True(t, ok)
+
+	// Changing the user file path restarts the watcher.
+	newConf := &stnrv1.AuthConfig{}
+	conf.DeepCopyInto(newConf)
+	newConf.UserFile = filepath.Join(dir, "other-users")
+	action, err := auth.Inspect(auth.GetConfig(), newConf, &stnrv1.StunnerConfig{})
+	require.NoError(t, err)
+	require.Equal(t, runtime.ActionRestart, action)
+}
+
+func TestAuthJWTKeySetFile(t *testing.T) {
+	dir := t.TempDir()
+	keySetFile := filepath.Join(dir, "keys.pem")
+	key1, pem1 := newTestECKey(t)
+	key2, pem2 := newTestECKey(t)
+	require.NoError(t, os.WriteFile(keySetFile, pem1, 0o600))
+
+	conf := &stnrv1.AuthConfig{
+		Type:        stnrv1.AuthTypeJWT.String(),
+		Credentials: map[string]string{"secret": "my-secret"},
+		JWT: &stnrv1.JWTConfig{
+			KeySetFile: keySetFile,
+			Audience:   "stunner",
+		},
+	}
+
+	env := newTestEnv()
+	obj, err := object.NewAuth(conf, env.rt)
+	require.NoError(t, err)
+	auth := obj.(*object.Auth)
+	require.Equal(t, stnrv1.DefaultJWTUserClaim, auth.GetConfig().(*stnrv1.AuthConfig).JWT.UserClaim)
+	require.NotContains(t, auth.GetConfig().String(), "my-secret")
+
+	claims := map[string]any{
+		"sub": "user-a",
+		"aud": []string{"stunner"},
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	c, err := auth.VerifyToken(signTestES256(t, key1, claims))
+	require.NoError(t, err)
+	require.Equal(t, "user-a", c.String("sub"))
+
+	_, err = auth.VerifyToken(signTestES256(t, key2, claims))
+	require.Error(t, err)
+
+	// The key set file is reloaded on change.
+	require.NoError(t, auth.Start())
+	defer auth.Close(true) //nolint:errcheck
+	require.NoError(t, os.WriteFile(keySetFile, pem2, 0o600))
+	require.Eventually(t, func() bool {
+		_, err := auth.VerifyToken(signTestES256(t, key2, claims))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = auth.VerifyToken(signTestES256(t, key1, claims))
+	require.Error(t, err)
+
+	// A broken key set file keeps the last good key set.
+	require.NoError(t, os.WriteFile(keySetFile, []byte("not a key set"), 0o600))
+	time.Sleep(100 * time.Millisecond)
+	_, err = auth.VerifyToken(signTestES256(t, key2, claims))
+	require.NoError(t, err)
+
+	// Changing the key set file path restarts the watcher.
+	newConf := &stnrv1.AuthConfig{}
+	conf.DeepCopyInto(newConf)
+	newConf.JWT.KeySetFile = filepath.Join(dir, "other-keys.pem")
+	action, err := auth.Inspect(auth.GetConfig(), newConf, &stnrv1.StunnerConfig{})
+	require.NoError(t, err)
+	require.Equal(t, runtime.ActionRestart, action)
+
+	// An unreadable key set file is a reconcile error.
+	require.Error(t, auth.Reconcile(newConf))
+}
+
+func newTestECKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func signTestES256(t *testing.T, key *ecdsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestAuthWebhook(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		quota := 3
+		json.NewEncoder(w).Encode(a12n.WebhookResponse{ //nolint:errcheck
+			UserID: "user-id", Password: "pass", Quota: &quota})
+	}))
+	defer srv.Close()
+
+	conf := &stnrv1.AuthConfig{
+		Type:        stnrv1.AuthTypeWebhook.String(),
+		Credentials: map[string]string{"token": "my-token"},
+		Webhook:     &stnrv1.WebhookConfig{URL: srv.URL},
+	}
+
+	env := newTestEnv()
+	obj, err := object.NewAuth(conf, env.rt)
+	require.NoError(t, err)
+	auth := obj.(*object.Auth)
+	webhook := auth.GetConfig().(*stnrv1.AuthConfig).Webhook
+	require.Equal(t, stnrv1.DefaultWebhookTimeout, webhook.Timeout)
+	require.Equal(t, stnrv1.DefaultWebhookFailurePolicy, webhook.FailurePolicy)
+	require.NotContains(t, auth.GetConfig().String(), "my-token")
+
+	src := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	v, err := auth.AuthenticateWebhook("user", "realm", src)
+	require.NoError(t, err)
+	require.True(t, v.Allowed)
+
+	// The webhook attributes are available to the quota handler.
+	u, ok := auth.LookupUser("user-id")
+	require.True(t, ok)
+	require.Equal(t, 3, *u.UserQuota)
+
+	// Unrelated changes keep the verdict cache.
+	conf.Realm = "other-realm"
+	require.NoError(t, auth.Reconcile(conf))
+	_, err = auth.AuthenticateWebhook("user", "realm", src)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), calls.Load())
+
+	// Webhook changes reset it.
+	conf.Webhook.CacheTTL = "10m"
+	require.NoError(t, auth.Reconcile(conf))
+	_, err = auth.AuthenticateWebhook("user", "realm", src)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), calls.Load())
+
+	// Invalid configs are rejected.
+	conf.Webhook.FailurePolicy = "sometimes"
+	require.Error(t, auth.Reconcile(conf))
+}
+
+func TestAuthEphemeralSecretRotation(t *testing.T) {
+	conf := &stnrv1.AuthConfig{
+		Type:        stnrv1.AuthTypeEphemeral.String(),
+		Credentials: map[string]string{"secret": "secret-1"},
+	}
+
+	env := newTestEnv()
+	obj, err := object.NewAuth(conf, env.rt)
+	require.NoError(t, err)
+	auth := obj.(*object.Auth)
+	require.Empty(t, auth.Status().(*stnrv1.AuthStatus).SecretStatus)
+
+	// Rotate: the new secret in the "secret" key is prepended to the list.
+	conf = &stnrv1.AuthConfig{
+		Type:        stnrv1.AuthTypeEphemeral.String(),
+		Credentials: map[string]string{"secret": "secret-2"},
+		Secrets:     []string{"secret-1"},
+	}
+	require.NoError(t, auth.Reconcile(conf))
+	got := auth.GetConfig().(*stnrv1.AuthConfig)
+	require.Equal(t, []string{"secret-2", "secret-1"}, got.Secrets)
+	require.Equal(t, "secret-2", got.Credentials["secret"])
+	require.Equal(t, stnrv1.DefaultSecretGracePeriod, got.SecretGracePeriod)
+	require.NotContains(t, auth.Status().String(), "secret-1")
+
+	src := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	username := "1999999999:user"
+	request := func(secret string) []byte {
+		password, err := a12n.GetLongTermCredential(username, secret)
+		require.NoError(t, err)
+		msg, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			stun.NewUsername(username), stun.NewRealm(got.Realm),
+			stun.MessageIntegrity(a12n.GenerateAuthKey(username, got.Realm, password)))
+		require.NoError(t, err)
+		return msg.Raw
+	}
+
+	// Without a hint the newest secret is used.
+	secret, gen, ok := auth.EphemeralSecret(username, src)
+	require.True(t, ok)
+	require.Equal(t, "secret-2", secret)
+	require.Equal(t, 0, gen)
+
+	// Requests issued with the old secret are matched to the old generation.
+	auth.ProbeCredential(request("secret-1"), src)
+	secret, gen, _ = auth.EphemeralSecret(username, src)
+	require.Equal(t, "secret-1", secret)
+	require.Equal(t, 1, gen)
+
+	auth.ProbeCredential(request("secret-2"), src)
+	_, gen, _ = auth.EphemeralSecret(username, src)
+	require.Equal(t, 0, gen)
+
+	// Only the verified credentials are counted.
+	auth.ProbeCredential(request("secret-3"), src)
+	auth.ProbeCredential([]byte("garbage"), src)
+
+	status := auth.Status().(*stnrv1.AuthStatus)
+	require.Len(t, status.SecretStatus, 2)
+	require.Equal(t, uint64(1), status.SecretStatus[0].Matches)
+	require.Equal(t, uint64(1), status.SecretStatus[1].Matches)
+	require.Empty(t, status.SecretStatus[0].Expires)
+	require.NotEmpty(t, status.SecretStatus[1].Expires)
+	require.Contains(t, status.String(), "secret-matches:[0:1,1:1")
+	require.Equal(t, stnrv1.AuthTypeEphemeral.String(), status.Type)
+	js, err := json.Marshal(status)
+	require.NoError(t, err)
+	require.Contains(t, string(js), `"type":"ephemeral"`)
+	require.Contains(t, string(js), `"secret_status":[`)
+
+	// Past the grace period the old secret is not accepted anymore.
+	auth.ProbeCredential(request("secret-1"), src)
+	conf.SecretGracePeriod = "1ms"
+	require.NoError(t, auth.Reconcile(conf))
+	time.Sleep(10 * time.Millisecond)
+	_, gen, _ = auth.EphemeralSecret(username, src)
+	require.Equal(t, 0, gen)
+
+	// Duplicate secrets are rejected.
+	conf.Secrets = []string{"secret-1", "secret-1"}
+	require.Error(t, auth.Reconcile(conf))
+}
+
+func TestAuthPasswordAlgorithms(t *testing.T) {
+	conf := staticAuthConfig()
+	conf.PasswordAlgorithms = []string{"sha-256", "md5"}
+
+	env := newTestEnv()
+	obj, err := object.NewAuth(conf, env.rt)
+	require.NoError(t, err)
+	auth := obj.(*object.Auth)
+	got := auth.GetConfig().(*stnrv1.AuthConfig)
+	require.Equal(t, []string{"SHA-256", "MD5"}, got.PasswordAlgorithms)
+	require.True(t, got.AcceptSHA256())
+	require.True(t, got.AcceptMD5())
+
+	// MD5 can be disabled.
+	conf.PasswordAlgorithms = []string{"SHA-256"}
+	require.NoError(t, auth.Reconcile(conf))
+	got = auth.GetConfig().(*stnrv1.AuthConfig)
+	require.True(t, got.AcceptSHA256())
+	require.False(t, got.AcceptMD5())
+
+	// Unknown and duplicate algorithms are rejected.
+	conf.PasswordAlgorithms = []string{"MD5", "SHA-512"}
+	require.Error(t, auth.Reconcile(conf))
+	conf.PasswordAlgorithms = []string{"SHA-256", "sha-256"}
+	require.Error(t, auth.Reconcile(conf))
+
+	// Rotated "ephemeral" secrets are matched with MESSAGE-INTEGRITY-SHA256 too.
+	conf = &stnrv1.AuthConfig{
+		Type:               stnrv1.AuthTypeEphemeral.String(),
+		Credentials:        map[string]string{"secret": "secret-2"},
+		Secrets:            []string{"secret-1"},
+		PasswordAlgorithms: []string{"SHA-256"},
+	}
+	require.NoError(t, auth.Reconcile(conf))
+	src := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	username := "1999999999:user"
+	password, err := a12n.GetLongTermCredential(username, "secret-1")
+	require.NoError(t, err)
+	msg, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewUsername(username), stun.NewRealm(got.Realm),
+		a12n.MessageIntegritySHA256(a12n.GenerateAuthKeySHA256(username, got.Realm, password)))
+	require.NoError(t, err)
+	auth.ProbeCredential(msg.Raw, src)
+	secret, gen, _ := auth.EphemeralSecret(username, src)
+	require.Equal(t, "secret-1", secret)
+	require.Equal(t, 1, gen)
+}
+
+func TestAuthUserClusters(t *testing.T) {
+	conf := &stnrv1.AuthConfig{
+		Type: stnrv1.AuthTypeStaticMulti.String(),
+		Users: []stnrv1.UserCredential{
+			{Username: "alice", Password: "pass", Clusters: []string{"own"}},
+			{Username: "tenant-a/bob", Password: "pass"},
+			{Username: "carol", Password: "pass"},
+		},
+		UserClusters: map[string][]string{
+			"tenant-a/*": {"tenant-a"},
+			"tenant-*":   {"tenants"},
+			"alice":      {"ignored"},
+		},
+	}
+
+	env := newTestEnv()
+	obj, err := object.NewAuth(conf, env.rt)
+	require.NoError(t, err)
+	auth := obj.(*object.Auth)
+
+	// The user table takes precedence.
+	clusters, ok := auth.UserClusters(runtime.User{ID: "alice"})
+	require.True(t, ok)
+	require.Equal(t, []string{"own"}, clusters)
+
+	// Longest prefix wins.
+	clusters, ok = auth.UserClusters(runtime.User{ID: "tenant-a/bob"})
+	require.True(t, ok)
+	require.Equal(t, []string{"tenant-a"}, clusters)
+	clusters, ok = auth.UserClusters(runtime.User{ID: "tenant-b/dave"})
+	require.True(t, ok)
+	require.Equal(t, []string{"tenants"}, clusters)
+
+	// Unmatched users are unrestricted.
+	_, ok = auth.UserClusters(runtime.User{ID: "carol"})
+	require.False(t, ok)
+
+	// Unknown users fail closed when users are restricted.
+	clusters, ok = auth.UserClusters(runtime.User{ID: ""})
+	require.True(t, ok)
+	require.Empty(t, clusters)
+
+	// The clusters recorded from the credential of the allocation take precedence.
+	clusters, ok = auth.UserClusters(runtime.User{ID: "alice", Clusters: []string{"token"}, Recorded: true})
+	require.True(t, ok)
+	require.Equal(t, []string{"token"}, clusters)
+	clusters, ok = auth.UserClusters(runtime.User{ID: "alice", Recorded: true})
+	require.True(t, ok)
+	require.Equal(t, []string{"own"}, clusters)
+
+	conf.Users = []stnrv1.UserCredential{{Username: "carol", Password: "pass"}}
+	conf.UserClusters = nil
+	require.NoError(t, auth.Reconcile(conf))
+	_, ok = auth.UserClusters(runtime.User{ID: ""})
+	require.False(t, ok)
+
+	// Users whose credential was not recorded fail closed when the credentials may carry
+	// clusters.
+	dir := t.TempDir()
+	keySetFile := filepath.Join(dir, "keys.pem")
+	_, pem := newTestECKey(t)
+	require.NoError(t, os.WriteFile(keySetFile, pem, 0o600))
+	jwtConf := &stnrv1.AuthConfig{
+		Type:        stnrv1.AuthTypeJWT.String(),
+		Credentials: map[string]string{"secret": "my-secret"},
+		JWT:         &stnrv1.JWTConfig{KeySetFile: keySetFile, ClustersClaim: "clusters"},
+	}
+	obj, err = object.NewAuth(jwtConf, env.rt)
+	require.NoError(t, err)
+	auth = obj.(*object.Auth)
+	clusters, ok = auth.UserClusters(runtime.User{ID: "carol"})
+	require.True(t, ok)
+	require.Empty(t, clusters)
+	_, ok = auth.UserClusters(runtime.User{ID: "carol", Recorded: true})
+	require.False(t, ok)
+	clusters, ok = auth.UserClusters(runtime.User{ID: "carol", Clusters: []string{}, Recorded: true})
+	require.True(t, ok)
+	require.Empty(t, clusters)
+}
+
+func TestAuthBruteForceProtection(t *testing.T) {
+	conf := &stnrv1.AuthConfig{
+		Type:        stnrv1.AuthTypeStatic.String(),
+		Credentials: map[string]string{"username": "user", "password": "pass"},
+		BruteForceProtection: &stnrv1.BruteForceConfig{
+			MaxFailures:    3,
+			Window:         "1m",
+			BanDuration:    "100ms",
+			MaxBanDuration: "150ms",
+			AllowList:      []string{"10.0.0.0/8"},
+		},
+	}
+
+	env := newTestEnv()
+	obj, err := object.NewAuth(conf, env.rt)
+	require.NoError(t, err)
+	auth := obj.(*object.Auth)
+
+	src := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	other := &net.UDPAddr{IP: net.ParseIP("1.2.3.5"), Port: 1234}
+	allowed := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}
+
+	// A ban after MaxFailures failures bans both the source and the username.
+	for range 3 {
+		require.NoError(t, auth.AdmitClient(src, "user"))
+		auth.RecordAuthFailure(src, "user")
+	}
+	require.Error(t, auth.AdmitClient(src, "other"))
+	require.Error(t, auth.AdmitClient(other, "user"))
+	require.NoError(t, auth.AdmitClient(other, "other"))
+	require.Equal(t, 2, auth.BanCount())
+
+	// Allow-listed sources are never banned.
+	require.NoError(t, auth.AdmitClient(allowed, "user"))
+	for range 5 {
+		auth.RecordAuthFailure(allowed, "admin")
+	}
+	require.NoError(t, auth.AdmitClient(allowed, "admin"))
+
+	status := auth.Status().(*stnrv1.AuthStatus)
+	require.NotNil(t, status.BruteForceStatus)
+	require.Equal(t, uint64(8), status.BruteForceStatus.Failures)
+	require.Equal(t, uint64(2), status.BruteForceStatus.Rejected)
+	require.Len(t, status.BruteForceStatus.Bans, 2)
+	require.Equal(t, "source", status.BruteForceStatus.Bans[0].Kind)
+	require.Equal(t, "1.2.3.4", status.BruteForceStatus.Bans[0].Key)
+	require.Equal(t, "username", status.BruteForceStatus.Bans[1].Kind)
+	require.Equal(t, "user", status.BruteForceStatus.Bans[1].Key)
+
+	// Unrelated reconciliations keep the bans.
+	conf.Realm = "new-realm"
+	require.NoError(t, auth.Reconcile(conf))
+	require.Error(t, auth.AdmitClient(src, "other"))
+
+	// Bans expire.
+	time.Sleep(120 * time.Millisecond)
+	require.NoError(t, auth.AdmitClient(src, "user"))
+	require.Equal(t, 0, auth.BanCount())
+
+	// Repeated bans last longer.
+	for range 3 {
+		auth.RecordAuthFailure(src, "user")
+	}
+	time.Sleep(120 * time.Millisecond)
+	require.Error(t, auth.AdmitClient(src, "user"))
+	status = auth.Status().(*stnrv1.AuthStatus)
+	require.Equal(t, 2, status.BruteForceStatus.Bans[0].Bans)
+
+	// Disabling the protection lifts the bans.
+	conf.BruteForceProtection = nil
+	require.NoError(t, auth.Reconcile(conf))
+	require.NoError(t, auth.AdmitClient(src, "user"))
+	require.Nil(t, auth.Status().(*stnrv1.AuthStatus).BruteForceStatus)
+}
+
+func TestAuthOAuth(t *testing.T) {
+	key := make([]byte, 16)
+	conf := &stnrv1.AuthConfig{
+		Type: stnrv1.AuthTypeOAuth.String(),
+		OAuth: &stnrv1.OAuthConfig{
+			AuthorizationServer: "auth.example.com",
+			Keys: []stnrv1.OAuthKey{{
+				KID:       "kid-1",
+				Key:       base64.StdEncoding.EncodeToString(key),
+				Algorithm: "a128gcm",
+			}},
+		},
+	}
+
+	env := newTestEnv()
+	obj, err := object.NewAuth(conf, env.rt)
+	require.NoError(t, err)
+	auth := obj.(*object.Auth)
+	got := auth.GetConfig().(*stnrv1.AuthConfig)
+	require.Equal(t, got.Realm, got.OAuth.ServerName)
+	require.Equal(t, "5s", got.OAuth.MaxClockSkew)
+	require.Equal(t, "A128GCM", got.OAuth.Keys[0].Algorithm)
+	server, ok := auth.ThirdPartyAuthorization()
+	require.True(t, ok)
+	require.Equal(t, "auth.example.com", server)
+
+	macKey := []byte("0123456789abcdefghij")
+	src := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	request := func(issued time.Time) []byte {
+		token, err := a12n.EncryptAccessToken(key, got.OAuth.ServerName, a12n.AccessToken{
+			MACKey:    macKey,
+			Timestamp: issued,
+			Lifetime:  time.Minute,
+		})
+		require.NoError(t, err)
+		msg, err := stun.Build(stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			stun.NewUsername("kid-1"), stun.NewRealm(got.Realm),
+			stun.RawAttribute{Type: a12n.AttrAccessToken, Value: token},
+			stun.MessageIntegrity(macKey))
+		require.NoError(t, err)
+		return msg.Raw
+	}
+
+	// No token yet.
+	_, err = auth.AccessToken("kid-1", src)
+	require.Error(t, err)
+
+	// The token is removed from the request and the session key is remembered.
+	raw := auth.ProbeCredential(request(time.Now()), src)
+	msg := &stun.Message{Raw: raw}
+	require.NoError(t, msg.Decode())
+	require.False(t, msg.Contains(a12n.AttrAccessToken))
+	require.NoError(t, stun.MessageIntegrity(macKey).Check(msg))
+	k, err := auth.AccessToken("kid-1", src)
+	require.NoError(t, err)
+	require.Equal(t, macKey, k)
+	_, err = auth.AccessToken("kid-2", src)
+	require.Error(t, err)
+
+	// Expired tokens are rejected.
+	src2 := &net.UDPAddr{IP: net.ParseIP("1.2.3.5"), Port: 1234}
+	auth.ProbeCredential(request(time.Now().Add(-time.Hour)), src2)
+	_, err = auth.AccessToken("kid-1", src2)
+	require.Error(t, err)
+
+	// Invalid configs are rejected.
+	conf.OAuth.Keys[0].Algorithm = "A256GCM"
+	require.Error(t, auth.Reconcile(conf))
+	conf.OAuth.Keys[0].Algorithm = "A128GCM"
+	conf.PasswordAlgorithms = []string{"MD5", "SHA-256"}
+	require.Error(t, auth.Reconcile(conf))
+}
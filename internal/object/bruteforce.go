@@ -0,0 +1,217 @@
+package object
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/utils/lru"
+
+	"github.com/l7mp/stunner/internal/telemetry"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+const bruteForceCacheSize = 16384
+
+const (
+	banKindSource   = "source"
+	banKindUsername = "username"
+)
+
+var errBanned = errors.New("banned due to too many failed authentications")
+
+// failureRecord tracks the failed authentications and the bans of a source IP or a username.
+type failureRecord struct {
+	failures    int
+	windowStart time.Time
+	bans        int
+	bannedUntil time.Time
+}
+
+// bruteForceGuard counts failed authentications per source IP and per username and bans the
+// offenders with an exponential back-off. Safe for concurrent use.
+type bruteForceGuard struct {
+	conf                        stnrv1.BruteForceConfig
+	window, banDuration, maxBan time.Duration
+	allowList                   []*net.IPNet
+
+	lock    sync.Mutex
+	records *lru.Cache                // kind|key -> *failureRecord
+	banned  map[string]*failureRecord // kind|key -> record, for the active bans
+
+	failures, rejected atomic.Uint64
+	telemetry          *telemetry.Telemetry
+}
+
+func newBruteForceGuard(conf *stnrv1.BruteForceConfig, t *telemetry.Telemetry) *bruteForceGuard {
+	g := &bruteForceGuard{
+		conf:      *conf,
+		records:   lru.New(bruteForceCacheSize),
+		banned:    map[string]*failureRecord{},
+		telemetry: t,
+	}
+	g.conf.AllowList = append([]string(nil), conf.AllowList...)
+	// Validated by AuthConfig.Validate.
+	g.window, _ = time.ParseDuration(conf.Window)
+	g.banDuration, _ = time.ParseDuration(conf.BanDuration)
+	g.maxBan, _ = time.ParseDuration(conf.MaxBanDuration)
+	for _, a := range conf.AllowList {
+		if _, n, err := net.ParseCIDR(a); err == nil {
+			g.allowList = append(g.allowList, n)
+		} else if ip := net.ParseIP(a); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			g.allowList = append(g.allowList, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return g
+}
+
+// admit returns an error if the source IP or the username of a request is banned.
+func (g *bruteForceGuard) admit(src net.Addr, username string, now time.Time) error {
+	ip := addrIP(src)
+	if g.allowed(ip) {
+		return nil
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, key := range []string{banKindSource + "|" + ip.String(), banKindUsername + "|" + username} {
+		if r, ok := g.banned[key]; ok && now.Before(r.bannedUntil) {
+			g.rejected.Add(1)
+			if g.telemetry != nil {
+				g.telemetry.IncrementAuthFailures("banned")
+			}
+			return errBanned
+		}
+	}
+	return nil
+}
+
+// recordFailure counts a failed authentication for the source IP and the username of a request.
+func (g *bruteForceGuard) recordFailure(src net.Addr, username string, now time.Time) {
+	g.failures.Add(1)
+	if g.telemetry != nil {
+		g.telemetry.IncrementAuthFailures("invalid")
+	}
+
+	ip := addrIP(src)
+	if g.allowed(ip) {
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.recordLocked(banKindSource, ip.String(), now)
+	if username != "" {
+		g.recordLocked(banKindUsername, username, now)
+	}
+}
+
+func (g *bruteForceGuard) recordLocked(kind, key string, now time.Time) {
+	k := kind + "|" + key
+	var r *failureRecord
+	if v, ok := g.records.Get(k); ok {
+		r = v.(*failureRecord)
+	} else {
+		r = &failureRecord{}
+		g.records.Add(k, r)
+	}
+
+	if now.Before(r.bannedUntil) {
+		return
+	}
+	// The back-off is reset after a quiet period as long as the longest ban.
+	if r.bans > 0 && now.Sub(r.bannedUntil) > g.maxBan {
+		r.bans = 0
+	}
+	if now.Sub(r.windowStart) > g.window {
+		r.failures, r.windowStart = 0, now
+	}
+	r.failures++
+	if r.failures < g.conf.MaxFailures {
+		return
+	}
+
+	d := g.banDuration
+	for i := 0; i < r.bans && d < g.maxBan; i++ {
+		d *= 2
+	}
+	r.bans++
+	r.bannedUntil = now.Add(min(d, g.maxBan))
+	r.failures = 0
+	g.banned[k] = r
+	if g.telemetry != nil {
+		g.telemetry.IncrementAuthBans(kind)
+	}
+}
+
+// status returns the failure counters and the active bans.
+func (g *bruteForceGuard) status(now time.Time) *stnrv1.BruteForceStatus {
+	s := &stnrv1.BruteForceStatus{Failures: g.failures.Load(), Rejected: g.rejected.Load()}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.pruneLocked(now)
+	for k, r := range g.banned {
+		kind, key, _ := strings.Cut(k, "|")
+		s.Bans = append(s.Bans, stnrv1.BanStatus{
+			Kind:  kind,
+			Key:   key,
+			Bans:  r.bans,
+			Until: r.bannedUntil.Format(time.RFC3339),
+		})
+	}
+	sort.Slice(s.Bans, func(i, j int) bool {
+		if s.Bans[i].Kind != s.Bans[j].Kind {
+			return s.Bans[i].Kind < s.Bans[j].Kind
+		}
+		return s.Bans[i].Key < s.Bans[j].Key
+	})
+	return s
+}
+
+// banCount returns the number of active bans.
+func (g *bruteForceGuard) banCount(now time.Time) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.pruneLocked(now)
+	return len(g.banned)
+}
+
+// pruneLocked drops the expired bans.
+func (g *bruteForceGuard) pruneLocked(now time.Time) {
+	for k, r := range g.banned {
+		if !now.Before(r.bannedUntil) {
+			delete(g.banned, k)
+		}
+	}
+}
+
+func (g *bruteForceGuard) allowed(ip net.IP) bool {
+	for _, n := range g.allowList {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
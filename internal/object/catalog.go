@@ -88,7 +88,12 @@ func NewCatalog() *Catalog {
 			if full.Admin.HealthCheckEndpoint != nil {
 				endpoint = *full.Admin.HealthCheckEndpoint
 			}
-			return []stnrv1.Config{&HealthConfig{Endpoint: endpoint}}, nil
+			conf := &HealthConfig{Endpoint: endpoint}
+			if full.Admin.CredentialEndpoint != nil {
+				ce := *full.Admin.CredentialEndpoint
+				conf.CredentialEndpoint = &ce
+			}
+			return []stnrv1.Config{conf}, nil
 		},
 		Singleton:     true,
 		SingletonName: func(_ string) string { return stnrv1.DefaultHealthName },
@@ -3,6 +3,7 @@ package object
 import (
 	"fmt"
 	"net"
+	"reflect"
 	"sort"
 	"strings"
 	"sync/atomic"
@@ -10,6 +11,8 @@ import (
 	"github.com/pion/logging"
 	"github.com/pion/transport/v4"
 
+	"github.com/l7mp/stunner/internal/endpointslice"
+	"github.com/l7mp/stunner/internal/healthcheck"
 	"github.com/l7mp/stunner/internal/resolver"
 	"github.com/l7mp/stunner/internal/runtime"
 	"github.com/l7mp/stunner/internal/util"
@@ -17,12 +20,15 @@ import (
 )
 
 // Cluster represents a set of upstream peers to which STUNner can relay traffic. Static clusters
-// hold IP/CIDR endpoints; strict-DNS clusters resolve domain names in the background. The cluster
-// holds the reconciled state as an atomic snapshot for the packet path (read by the Router via
-// GetConfig) and owns the strict-DNS domain registration lifecycle.
+// hold IP/CIDR endpoints; strict-DNS clusters resolve domain names in the background;
+// EndpointSlice clusters watch the endpoints of Kubernetes services. The cluster holds the
+// reconciled state as an atomic snapshot for the packet path (read by the Router via GetConfig)
+// and owns the strict-DNS domain and the EndpointSlice service registration lifecycle, as well as
+// the health checker of the endpoints.
 type Cluster struct {
 	name     string
 	resolver resolver.DnsResolver
+	watcher  endpointslice.Watcher
 	net      transport.Net
 
 	// state is the atomic snapshot of reconciled cluster data, published by Reconcile and read
@@ -33,17 +39,32 @@ type Cluster struct {
 	// unregisters exactly those. Touched only on the reconcile path.
 	registered []string
 
+	// watched holds the EndpointSlice services registered with the watcher by Start, so Close
+	// unregisters exactly those. Touched only on the reconcile path.
+	watched []string
+
+	// checker probes the endpoints of the cluster if health checking is enabled. Started by
+	// Start and read by the Router via Healthy.
+	checker atomic.Pointer[healthcheck.Checker]
+
 	rt  *runtime.Runtime
 	log logging.LeveledLogger
 }
 
 // clusterState is the immutable snapshot of reconciled cluster data: the single source of truth
-// for a cluster's type, protocol, and endpoint set.
+// for a cluster's type, protocol, and endpoint set. The endpoints of strict-DNS and EndpointSlice
+// clusters hold only the negative endpoints.
 type clusterState struct {
-	clusterType stnrv1.ClusterType
-	protocol    stnrv1.ClusterProtocol
-	endpoints   []*util.Endpoint
-	domains     []string
+	clusterType  stnrv1.ClusterType
+	protocol     stnrv1.ClusterProtocol
+	endpoints    []*util.Endpoint
+	domains      []string
+	services     []string
+	healthCheck  *stnrv1.HealthCheckConfig
+	virtual      string
+	topologyMode string
+	topology     map[string]stnrv1.EndpointTopology
+	revoke       bool
 }
 
 // NewCluster creates a Cluster object.
@@ -51,6 +72,7 @@ func NewCluster(conf stnrv1.Config, rt *runtime.Runtime) (runtime.Object, error)
 	if conf == nil {
 		return &Cluster{
 			resolver: rt.Resolver,
+			watcher:  rt.Endpoints,
 			net:      rt.Net,
 			rt:       rt,
 			log:      rt.Logger.NewLogger("cluster"),
@@ -66,6 +88,7 @@ func NewCluster(conf stnrv1.Config, rt *runtime.Runtime) (runtime.Object, error)
 	c := &Cluster{
 		name:     req.Name,
 		resolver: rt.Resolver,
+		watcher:  rt.Endpoints,
 		net:      rt.Net,
 		rt:       rt,
 		log:      rt.Logger.NewLogger(fmt.Sprintf("cluster-%s", req.Name)),
@@ -89,15 +112,20 @@ func (c *Cluster) Inspect(old, new stnrv1.Config, _ *stnrv1.StunnerConfig) (runt
 		return runtime.ActionNone, nil
 	}
 
-	strictDNS := stnrv1.ClusterTypeStrictDNS.String()
-	curStrictDNS := strings.EqualFold(cur.Type, strictDNS)
-	reqStrictDNS := strings.EqualFold(req.Type, strictDNS)
-	becomesStrictDNS := !curStrictDNS && reqStrictDNS
-	leavesStrictDNS := curStrictDNS && !reqStrictDNS
-	strictDNSEndpointsChanged := curStrictDNS && reqStrictDNS &&
+	// Strict-DNS domains and EndpointSlice services are registered in Start: a change calls for
+	// a restart.
+	curType, _ := stnrv1.NewClusterType(cur.Type)
+	reqType, _ := stnrv1.NewClusterType(req.Type)
+	curDynamic := curType == stnrv1.ClusterTypeStrictDNS || curType == stnrv1.ClusterTypeEndpointSlice
+	reqDynamic := reqType == stnrv1.ClusterTypeStrictDNS || reqType == stnrv1.ClusterTypeEndpointSlice
+	typeChanged := curType != reqType && (curDynamic || reqDynamic)
+	dynamicEndpointsChanged := curType == reqType && curDynamic &&
 		!sameStringSet(cur.Endpoints, req.Endpoints)
 
-	if becomesStrictDNS || strictDNSEndpointsChanged || leavesStrictDNS {
+	// The health checker is started in Start.
+	healthCheckChanged := !reflect.DeepEqual(cur.HealthCheck, req.HealthCheck)
+
+	if typeChanged || dynamicEndpointsChanged || healthCheckChanged {
 		return runtime.ActionRestart, nil
 	}
 
@@ -125,7 +153,7 @@ func (c *Cluster) Reconcile(conf stnrv1.Config) error {
 	}
 
 	var endpoints []*util.Endpoint
-	var domains []string
+	var domains, services []string
 	switch clusterType {
 	case stnrv1.ClusterTypeStatic:
 		for _, e := range req.Endpoints {
@@ -141,15 +169,55 @@ func (c *Cluster) Reconcile(conf stnrv1.Config) error {
 		if c.resolver == nil {
 			return fmt.Errorf("sTRICT_DNS cluster %q initialized with no DNS resolver", c.name)
 		}
-		domains = append([]string(nil), req.Endpoints...)
+		for _, e := range req.Endpoints {
+			if !util.IsNegatedEndpoint(e) {
+				domains = append(domains, e)
+				continue
+			}
+			// Negative endpoints of strict-DNS clusters are exclusions in the static syntax.
+			ep, err := util.ParseEndpoint(e)
+			if err != nil {
+				c.log.Warnf("cluster %q: could not parse endpoint %q (ignoring): %s",
+					c.name, e, err.Error())
+				continue
+			}
+			endpoints = append(endpoints, ep)
+		}
+	case stnrv1.ClusterTypeEndpointSlice:
+		if c.watcher == nil {
+			return fmt.Errorf("ENDPOINT_SLICE cluster %q initialized with no EndpointSlice watcher", c.name)
+		}
+		for _, e := range req.Endpoints {
+			if !util.IsNegatedEndpoint(e) {
+				services = append(services, e)
+				continue
+			}
+			ep, err := util.ParseEndpoint(e)
+			if err != nil {
+				c.log.Warnf("cluster %q: could not parse endpoint %q (ignoring): %s",
+					c.name, e, err.Error())
+				continue
+			}
+			endpoints = append(endpoints, ep)
+		}
 	}
 
+	// Copy the pointer and map fields.
+	cp := &stnrv1.ClusterConfig{}
+	req.DeepCopyInto(cp)
+
 	// Publish the snapshot for the packet path.
 	c.state.Store(&clusterState{
-		clusterType: clusterType,
-		protocol:    protocol,
-		endpoints:   endpoints,
-		domains:     domains,
+		clusterType:  clusterType,
+		protocol:     protocol,
+		endpoints:    endpoints,
+		domains:      domains,
+		services:     services,
+		healthCheck:  cp.HealthCheck,
+		virtual:      req.VirtualAddress,
+		topologyMode: req.TopologyMode,
+		topology:     cp.Topology,
+		revoke:       req.RevokeRemovedPeers,
 	})
 
 	c.rt.Router.InvalidateCache()
@@ -164,6 +232,15 @@ func (c *Cluster) GetConfig() stnrv1.Config {
 	}
 	conf.Protocol = state.protocol.String()
 	conf.Type = state.clusterType.String()
+	conf.VirtualAddress = state.virtual
+	conf.TopologyMode = state.topologyMode
+	conf.RevokeRemovedPeers = state.revoke
+	if state.topology != nil {
+		conf.Topology = make(map[string]stnrv1.EndpointTopology, len(state.topology))
+		for ip, t := range state.topology {
+			conf.Topology[ip] = t
+		}
+	}
 	switch state.clusterType {
 	case stnrv1.ClusterTypeStatic:
 		conf.Endpoints = make([]string, len(state.endpoints))
@@ -171,31 +248,72 @@ func (c *Cluster) GetConfig() stnrv1.Config {
 			conf.Endpoints[i] = e.String()
 		}
 	case stnrv1.ClusterTypeStrictDNS:
-		conf.Endpoints = make([]string, len(state.domains))
-		copy(conf.Endpoints, state.domains)
+		conf.Endpoints = make([]string, 0, len(state.domains)+len(state.endpoints))
+		conf.Endpoints = append(conf.Endpoints, state.domains...)
+		for _, e := range state.endpoints {
+			conf.Endpoints = append(conf.Endpoints, e.String())
+		}
+		sort.Strings(conf.Endpoints)
+	case stnrv1.ClusterTypeEndpointSlice:
+		conf.Endpoints = make([]string, 0, len(state.services)+len(state.endpoints))
+		conf.Endpoints = append(conf.Endpoints, state.services...)
+		for _, e := range state.endpoints {
+			conf.Endpoints = append(conf.Endpoints, e.String())
+		}
 		sort.Strings(conf.Endpoints)
 	}
+	if state.healthCheck != nil {
+		h := *state.healthCheck
+		conf.HealthCheck = &h
+	}
 	return &conf
 }
 
-// Start registers the cluster's strict-DNS domains with the resolver.
+// Start registers the cluster's strict-DNS domains with the resolver and the cluster's
+// EndpointSlice services with the watcher, and starts the health checker. DNS and EndpointSlice
+// updates and endpoint health changes invalidate the cached routing state of this cluster only.
 func (c *Cluster) Start() error {
-	domains := c.strictDNSDomains()
-	for _, d := range domains {
-		if err := c.resolver.Register(d); err != nil {
+	name := c.name
+	invalidate := func() { c.rt.Router.InvalidateCluster(name) }
+
+	for _, d := range c.strictDNSDomains() {
+		if err := c.resolver.Register(d, name, invalidate); err != nil {
 			return err
 		}
+		c.registered = append(c.registered, d)
+	}
+
+	for _, s := range c.endpointSliceServices() {
+		if err := c.watcher.Register(s, name, invalidate); err != nil {
+			return err
+		}
+		c.watched = append(c.watched, s)
+	}
+
+	// Health checks are not run in dry-run mode: all endpoints are healthy.
+	if state := c.state.Load(); state != nil && state.healthCheck != nil && !c.rt.DryRun {
+		checker := healthcheck.New(name, state.healthCheck, c.healthTargets, invalidate, c.net,
+			c.rt.Logger.NewLogger(fmt.Sprintf("health-check-%s", name)))
+		checker.Start()
+		c.checker.Store(checker)
 	}
-	c.registered = domains
 	return nil
 }
 
-// Close unregisters the strict-DNS domains registered by Start and drops cached routing state.
+// Close unregisters the strict-DNS domains and the EndpointSlice services registered by Start,
+// stops the health checker and drops cached routing state.
 func (c *Cluster) Close(_ bool) error {
+	if checker := c.checker.Swap(nil); checker != nil {
+		checker.Close()
+	}
 	for _, d := range c.registered {
-		c.resolver.Unregister(d)
+		c.resolver.Unregister(d, c.name)
 	}
 	c.registered = nil
+	for _, s := range c.watched {
+		c.watcher.Unregister(s, c.name)
+	}
+	c.watched = nil
 	c.rt.Router.InvalidateCache()
 	return nil
 }
@@ -207,9 +325,54 @@ func (c *Cluster) Status() stnrv1.Status {
 	if offloadStatus, ok := c.rt.GetStatus(runtime.TypeOffload, "").(*stnrv1.OffloadStatus); ok {
 		status.Stats = offloadStatus.Clusters[c.name]
 	}
+	if checker := c.checker.Load(); checker != nil {
+		status.Health = checker.Status()
+	}
+	if c.rt.Telemetry != nil {
+		if rx, tx, ok := c.rt.Telemetry.CrossZoneBytes(c.name); ok {
+			status.CrossZoneStats = &stnrv1.CrossZoneStat{RxBytes: rx, TxBytes: tx}
+		}
+	}
 	return status
 }
 
+// Healthy reports whether an endpoint of the cluster admits peers. With no health checking all
+// endpoints are healthy. Called by the Router when building the matcher of the cluster.
+func (c *Cluster) Healthy(ep *util.Endpoint) bool {
+	checker := c.checker.Load()
+	return checker == nil || checker.Healthy(ep)
+}
+
+// healthTargets returns the current admitting endpoints of the cluster for the health checker.
+func (c *Cluster) healthTargets() []*util.Endpoint {
+	state := c.state.Load()
+	if state == nil {
+		return nil
+	}
+	var ret []*util.Endpoint
+	switch state.clusterType {
+	case stnrv1.ClusterTypeStatic:
+		for _, ep := range state.endpoints {
+			if !ep.Negated() {
+				ret = append(ret, ep)
+			}
+		}
+	case stnrv1.ClusterTypeStrictDNS:
+		for _, d := range state.domains {
+			if eps, err := c.resolver.LookupEndpoints(d); err == nil {
+				ret = append(ret, eps...)
+			}
+		}
+	case stnrv1.ClusterTypeEndpointSlice:
+		for _, s := range state.services {
+			if eps, err := c.watcher.Lookup(s, state.protocol.String()); err == nil {
+				ret = append(ret, eps...)
+			}
+		}
+	}
+	return ret
+}
+
 // Route returns true if peer is in the cluster's endpoint set (admission via the Router).
 func (c *Cluster) Route(peer net.IP) bool { return c.Match(peer, 0) }
 
@@ -230,6 +393,16 @@ func (c *Cluster) strictDNSDomains() []string {
 	return append([]string(nil), state.domains...)
 }
 
+// endpointSliceServices returns the cluster's EndpointSlice services from the current snapshot, or
+// nil for non-EndpointSlice clusters. Used by Start to register services with the watcher.
+func (c *Cluster) endpointSliceServices() []string {
+	state := c.state.Load()
+	if state == nil || state.clusterType != stnrv1.ClusterTypeEndpointSlice {
+		return nil
+	}
+	return append([]string(nil), state.services...)
+}
+
 func sameStringSet(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -1,10 +1,18 @@
 package object_test
 
 import (
+	"context"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 
+	"github.com/l7mp/stunner/internal/endpointslice"
 	"github.com/l7mp/stunner/internal/object"
 	"github.com/l7mp/stunner/internal/runtime"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
@@ -88,6 +96,72 @@ func TestClusterStaticObjectSemantics(t *testing.T) {
 				},
 				want: runtime.ActionReconcile,
 			},
+			{
+				name: "static-health-check-restart",
+				conf: &stnrv1.ClusterConfig{
+					Name:        "cluster-static",
+					Type:        stnrv1.ClusterTypeStatic.String(),
+					Protocol:    stnrv1.ClusterProtocolUDP.String(),
+					Endpoints:   []string{"1.2.3.4"},
+					HealthCheck: &stnrv1.HealthCheckConfig{Port: 5000},
+				},
+				want: runtime.ActionRestart,
+			},
 		},
 	})
 }
+
+func TestClusterEndpointSlice(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv()
+	client := fake.NewClientset()
+	env.rt.Endpoints = endpointslice.NewWatcher("endpointslice-watcher", client, env.rt.Logger)
+	defer env.rt.Endpoints.Close()
+
+	obj, err := object.NewCluster(&stnrv1.ClusterConfig{
+		Name:      "media",
+		Type:      stnrv1.ClusterTypeEndpointSlice.String(),
+		Protocol:  stnrv1.ClusterProtocolUDP.String(),
+		Endpoints: []string{"media/media-server", "!10.0.0.3"},
+	}, env.rt)
+	require.NoError(t, err)
+	mustAdd(t, env, obj)
+	c := obj.(*object.Cluster)
+	require.NoError(t, c.Start())
+	defer c.Close(false) //nolint:errcheck
+
+	require.ElementsMatch(t, []string{"media/media-server", "!10.0.0.3"},
+		c.GetConfig().(*stnrv1.ClusterConfig).Endpoints)
+
+	port := int32(5000)
+	proto := corev1.ProtocolUDP
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "media-server-1",
+			Namespace: "media",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "media-server"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Port: &port, Protocol: &proto}},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}},
+			{Addresses: []string{"10.0.0.3"}},
+		},
+	}
+	slices := client.DiscoveryV1().EndpointSlices("media")
+	_, err = slices.Create(ctx, slice, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return c.Match(net.ParseIP("10.0.0.1"), 5000) },
+		time.Second, 10*time.Millisecond)
+	require.True(t, c.Route(net.ParseIP("10.0.0.1")))
+	require.False(t, c.Match(net.ParseIP("10.0.0.1"), 5001))
+	require.False(t, c.Match(net.ParseIP("10.0.0.3"), 5000), "excluded")
+
+	// Membership updates reach the router without a reconcile.
+	slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{Addresses: []string{"10.0.0.4"}})
+	_, err = slices.Update(ctx, slice, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return c.Match(net.ParseIP("10.0.0.4"), 5000) },
+		time.Second, 10*time.Millisecond)
+}
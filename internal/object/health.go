@@ -1,22 +1,27 @@
 package object
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/pion/logging"
 
 	"github.com/l7mp/stunner/internal/runtime"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
 )
 
-// Health is the Object that owns the /live, /ready, /status HTTP server.
+// Health is the Object that owns the /live, /ready, /status HTTP server, which also serves the
+// optional /turn credential endpoint.
 type Health struct {
 	endpoint string
 	server   *http.Server
@@ -37,6 +42,8 @@ type HealthConfig struct {
 	// health-checking. Empty endpoint == use defaults; nil pointer in AdminConfig is mapped to
 	// the default endpoint at extract time.
 	Endpoint string `json:"endpoint,omitempty"`
+	// CredentialEndpoint enables the TURN REST API credential endpoint, nil means disabled.
+	CredentialEndpoint *stnrv1.CredentialEndpointConfig `json:"credential_endpoint,omitempty"`
 }
 
 func (c *HealthConfig) Validate() error    { return nil }
@@ -46,7 +53,7 @@ func (c *HealthConfig) DeepEqual(other stnrv1.Config) bool {
 	if !ok {
 		return false
 	}
-	return c.Endpoint == o.Endpoint
+	return c.Endpoint == o.Endpoint && reflect.DeepEqual(c.CredentialEndpoint, o.CredentialEndpoint)
 }
 func (c *HealthConfig) DeepCopyInto(dst stnrv1.Config) {
 	d, ok := dst.(*HealthConfig)
@@ -54,9 +61,14 @@ func (c *HealthConfig) DeepCopyInto(dst stnrv1.Config) {
 		return
 	}
 	*d = *c
+	if c.CredentialEndpoint != nil {
+		ce := *c.CredentialEndpoint
+		d.CredentialEndpoint = &ce
+	}
 }
 func (c *HealthConfig) String() string {
-	return fmt.Sprintf("HealthConfig{endpoint=%q}", c.Endpoint)
+	return fmt.Sprintf("HealthConfig{endpoint=%q,credential_endpoint=%t}", c.Endpoint,
+		c.CredentialEndpoint != nil)
 }
 
 // NewHealth creates a Health object.
@@ -86,8 +98,9 @@ func (h *Health) Type() runtime.ObjectType { return runtime.TypeHealth }
 // GetConfig returns a copy of the live health config. Safe for concurrent use.
 func (h *Health) GetConfig() stnrv1.Config {
 	if snap := h.conf.Load(); snap != nil {
-		cp := *snap
-		return &cp
+		cp := &HealthConfig{}
+		snap.DeepCopyInto(cp)
+		return cp
 	}
 	return &HealthConfig{}
 }
@@ -103,6 +116,10 @@ func (h *Health) Inspect(old, new stnrv1.Config, _ *stnrv1.StunnerConfig) (runti
 	if reflect.DeepEqual(req, cur) {
 		return runtime.ActionNone, nil
 	}
+	// The credential endpoint config is read per request, no need to restart the server.
+	if req.Endpoint == cur.Endpoint {
+		return runtime.ActionReconcile, nil
+	}
 	return runtime.ActionRestart, nil
 }
 
@@ -112,7 +129,9 @@ func (h *Health) Reconcile(conf stnrv1.Config) error {
 		return stnrv1.ErrInvalidConf
 	}
 	h.endpoint = req.Endpoint
-	h.conf.Store(&HealthConfig{Endpoint: req.Endpoint})
+	snap := &HealthConfig{}
+	req.DeepCopyInto(snap)
+	h.conf.Store(snap)
 	if h.mux == nil {
 		h.mux = h.buildMux()
 	}
@@ -135,7 +154,8 @@ func (h *Health) Start() error {
 	}
 
 	h.log.Tracef("starting healthcheck server at http://%s", addr)
-	h.server = &http.Server{Addr: addr, Handler: h.mux}
+	server := &http.Server{Addr: addr, Handler: h.mux}
+	h.server = server
 
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -144,7 +164,8 @@ func (h *Health) Start() error {
 	h.servAddr = ln.Addr()
 
 	go func() {
-		if err := h.server.Serve(ln); err != nil {
+		// Close may reset h.server before the server starts serving.
+		if err := server.Serve(ln); err != nil {
 			if errors.Is(err, http.ErrServerClosed) {
 				h.log.Tracef("healthcheck server: normal shutdown")
 			} else {
@@ -216,9 +237,103 @@ func (h *Health) buildMux() *http.ServeMux {
 		w.WriteHeader(http.StatusOK)
 		w.Write(js) //nolint:errcheck
 	})
+	mux.HandleFunc(stnrv1.DefaultCredentialEndpointPath, h.serveCredential)
 	return mux
 }
 
+// turnCredential is the reply of the TURN REST API credential endpoint.
+type turnCredential struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int64    `json:"ttl"`
+	URIs     []string `json:"uris"`
+}
+
+// serveCredential mints a time-windowed "ephemeral" credential, as per the "REST API For Access To
+// TURN Services" (https://datatracker.ietf.org/doc/html/draft-uberti-behave-turn-rest-00) spec.
+func (h *Health) serveCredential(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fail := func(code int, msg string) {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, "{\"status\":%d,\"message\":%q}\n", code, msg) //nolint:errcheck
+	}
+
+	snap := h.conf.Load()
+	if snap == nil || snap.CredentialEndpoint == nil {
+		fail(http.StatusNotFound, "credential endpoint disabled")
+		return
+	}
+	conf := snap.CredentialEndpoint
+
+	if r.Method != http.MethodGet {
+		fail(http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	token := r.URL.Query().Get("key")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(conf.Token)) != 1 {
+		fail(http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	if service := r.URL.Query().Get("service"); service != "" && service != "turn" {
+		fail(http.StatusBadRequest, fmt.Sprintf("invalid service %q", service))
+		return
+	}
+
+	ttl, _ := time.ParseDuration(conf.TTL)
+	if t := r.URL.Query().Get("ttl"); t != "" {
+		secs, err := strconv.Atoi(t)
+		if err != nil || secs <= 0 {
+			fail(http.StatusBadRequest, fmt.Sprintf("invalid TTL %q", t))
+			return
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+	if maxTTL, err := time.ParseDuration(conf.MaxTTL); err == nil && ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	auth := resolvedAuthConfig(h.rt)
+	if auth == nil || auth.Type != stnrv1.AuthTypeEphemeral.String() {
+		fail(http.StatusServiceUnavailable, "credential endpoint requires ephemeral authentication")
+		return
+	}
+
+	username := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	if userID := r.URL.Query().Get("username"); userID != "" {
+		username = a12n.GenerateTimeWindowedUsername(time.Now(), ttl, userID)
+	}
+	password, err := a12n.GetLongTermCredential(username, auth.Credentials["secret"])
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	uris := []string{}
+	for _, c := range h.rt.GetConfigs(runtime.TypeListener) {
+		if uri, err := c.(*stnrv1.ListenerConfig).GetListenerURI(true); err == nil {
+			uris = append(uris, uri)
+		}
+	}
+
+	js, err := json.Marshal(turnCredential{
+		Username: username,
+		Password: password,
+		TTL:      int64(ttl / time.Second),
+		URIs:     uris,
+	})
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(js) //nolint:errcheck
+}
+
 // defaultHealthEndpoint mirrors the historical Admin behaviour: a nil HealthCheckEndpoint pointer
 // (the user not setting the field) maps to the default `http://:8086` endpoint.
 func defaultHealthEndpoint() string {
@@ -22,6 +22,13 @@ func TestHealthObjectSemantics(t *testing.T) {
 		expectations: []inspectExpectation{
 			{name: "endpoint-change-restart", conf: &object.HealthConfig{Endpoint: "http://:8086"}, want: runtime.ActionRestart},
 			{name: "same-config-none", conf: &object.HealthConfig{Endpoint: ""}, want: runtime.ActionNone},
+			{
+				name: "credential-endpoint-change-reconcile",
+				conf: &object.HealthConfig{
+					CredentialEndpoint: &stnrv1.CredentialEndpointConfig{Token: "token"},
+				},
+				want: runtime.ActionReconcile,
+			},
 		},
 	})
 }
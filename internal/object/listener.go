@@ -2,9 +2,12 @@ package object
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"net"
+	"reflect"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -13,6 +16,8 @@ import (
 	"github.com/pion/logging"
 	"github.com/pion/transport/v4"
 
+	"github.com/l7mp/stunner/internal/netutil"
+	objectturn "github.com/l7mp/stunner/internal/object/turn"
 	"github.com/l7mp/stunner/internal/runtime"
 	"github.com/l7mp/stunner/internal/telemetry"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
@@ -29,12 +34,23 @@ type Listener struct {
 	port, minPort, maxPort int
 	publicAddr             string
 	publicPort             int
+	relayAddr              string
+	discoveryServer        string
+	discoveryInterval      string
 	rawAddr                string
 	cert, key              []byte
+	tlsPairs               []certKeyPair
+	certificates           []stnrv1.CertificateConfig
+	clientAuth             *stnrv1.ClientAuthConfig
+	clientCA               []byte
 	routes                 []string
+	routeRules             []stnrv1.RouteRule
 
 	// conf is the atomic snapshot read by the TURN handlers on the request path.
 	conf atomic.Pointer[stnrv1.ListenerConfig]
+	// certs holds the TLS certificates consulted by the TLS and DTLS listeners on each
+	// handshake.
+	certs *objectturn.CertStore
 
 	rt           *runtime.Runtime
 	telemetry    *telemetry.Telemetry
@@ -48,6 +64,7 @@ type Listener struct {
 func NewListener(conf stnrv1.Config, rt *runtime.Runtime) (runtime.Object, error) {
 	if conf == nil {
 		return &Listener{
+			certs:        objectturn.NewCertStore(),
 			rt:           rt,
 			telemetry:    rt.Telemetry,
 			udpThreadNum: rt.UdpThreadNum,
@@ -63,6 +80,7 @@ func NewListener(conf stnrv1.Config, rt *runtime.Runtime) (runtime.Object, error
 	name := req.Name
 	l := &Listener{
 		name:         name,
+		certs:        objectturn.NewCertStore(),
 		rt:           rt,
 		telemetry:    rt.Telemetry,
 		udpThreadNum: rt.UdpThreadNum,
@@ -89,22 +107,50 @@ func (l *Listener) Inspect(old, new stnrv1.Config, full *stnrv1.StunnerConfig) (
 	changed := !cur.DeepEqual(req)
 
 	proto, _ := stnrv1.NewListenerProtocol(req.Protocol)
-	cert, err := base64.StdEncoding.DecodeString(req.Cert)
+	pairs, err := decodeCertificates(req)
 	if err != nil {
-		return runtime.ActionNone, fmt.Errorf("invalid TLS certificate: base64-decode error: %w", err)
-	}
-	key, err := base64.StdEncoding.DecodeString(req.Key)
-	if err != nil {
-		return runtime.ActionNone, fmt.Errorf("invalid TLS key: base64-decode error: %w", err)
+		return runtime.ActionNone, err
 	}
 
-	// A restart is only avoidable when Routes and/or PublicIP/PublicPort are the only changes.
+	// A restart is only avoidable when Routes, PublicIP/PublicPort, the TLS certificates and/or
+	// the client auth CA and rules are the only changes: these are updated in place.
 	restart := !(l.name == req.Name && //nolint:staticcheck
 		l.proto == proto &&
 		l.rawAddr == req.Addr &&
 		l.port == req.Port &&
-		bytes.Equal(l.cert, cert) &&
-		bytes.Equal(l.key, key))
+		l.minPort == req.MinRelayPort &&
+		l.maxPort == req.MaxRelayPort &&
+		l.relayAddr == req.RelayAddr &&
+		l.discoveryServer == req.RelayAddrDiscoveryServer &&
+		l.discoveryInterval == req.RelayAddrDiscoveryInterval &&
+		clientAuthMode(l.clientAuth) == clientAuthMode(req.ClientAuth))
+
+	// Referenced certificates may change while the config does not. Certificates rotated in
+	// place must load, otherwise the running listener would lose its certificates.
+	if isTLS(proto) && !slices.EqualFunc(l.tlsPairs, pairs, certKeyPair.equal) {
+		if !restart {
+			if _, err := loadCertificates(pairs); err != nil {
+				return runtime.ActionNone, err
+			}
+			l.log.Tracef("listener %s rotates TLS certificates", l.name)
+		}
+		changed = true
+	}
+	if isTLS(proto) && req.ClientAuth != nil {
+		ca, err := decodeClientCA(req.ClientAuth)
+		if err != nil {
+			return runtime.ActionNone, err
+		}
+		if !bytes.Equal(l.clientCA, ca) || !reflect.DeepEqual(cur.ClientAuth, req.ClientAuth) {
+			if !restart {
+				if _, err := objectturn.NewClientVerifier(req.ClientAuth, ca); err != nil {
+					return runtime.ActionNone, err
+				}
+				l.log.Tracef("listener %s updates client auth", l.name)
+			}
+			changed = true
+		}
+	}
 
 	curRealm := l.realm
 	if a := l.lookupAuthConfig(); a != nil {
@@ -139,29 +185,42 @@ func (l *Listener) Reconcile(conf stnrv1.Config) error {
 	}
 
 	proto, _ := stnrv1.NewListenerProtocol(req.Protocol)
-	ipAddr := net.ParseIP(req.Addr)
-	if ipAddr == nil && req.Addr == "localhost" {
-		ipAddr = net.ParseIP("127.0.0.1")
-	}
-	if ipAddr == nil {
-		return fmt.Errorf("invalid listener address: %s", req.Addr)
+	ipAddr, err := netutil.ListenerIP(l.net, req.Addr)
+	if err != nil {
+		return err
 	}
 
 	l.proto = proto
 	l.addr = ipAddr
 	l.rawAddr = req.Addr
 	l.port = req.Port
-	if proto == stnrv1.ListenerProtocolTURNTLS || proto == stnrv1.ListenerProtocolTURNDTLS {
-		cert, err := base64.StdEncoding.DecodeString(req.Cert)
+	l.minPort, l.maxPort = req.MinRelayPort, req.MaxRelayPort
+	l.relayAddr = req.RelayAddr
+	l.discoveryServer, l.discoveryInterval = req.RelayAddrDiscoveryServer, req.RelayAddrDiscoveryInterval
+	if isTLS(proto) {
+		pairs, err := decodeCertificates(req)
 		if err != nil {
-			return fmt.Errorf("invalid TLS certificate: base64-decode error: %w", err)
+			return err
 		}
-		key, err := base64.StdEncoding.DecodeString(req.Key)
-		if err != nil {
-			return fmt.Errorf("invalid TLS key: base64-decode error: %w", err)
+		// Certificates that fail to load fail the start of the listener.
+		certs, err := loadCertificates(pairs)
+		l.tlsPairs = pairs
+		// Keep references in the exported config: the referenced values are secret.
+		l.cert, l.key = exportTLSMaterial(req.Cert, pairs[0].cert), exportTLSMaterial(req.Key, pairs[0].key)
+		l.certificates = slices.Clone(req.Certificates)
+		l.certs.Update(certs, err)
+
+		l.clientAuth, l.clientCA = req.ClientAuth.DeepCopy(), nil
+		if req.ClientAuth == nil {
+			l.certs.UpdateClientAuth(nil, nil)
+		} else {
+			ca, err := decodeClientCA(req.ClientAuth)
+			if err != nil {
+				return err
+			}
+			l.clientCA = ca
+			l.certs.UpdateClientAuth(objectturn.NewClientVerifier(req.ClientAuth, ca))
 		}
-		l.cert = cert
-		l.key = key
 	}
 	l.realm = stnrv1.DefaultRealm
 	if a := l.lookupAuthConfig(); a != nil {
@@ -172,6 +231,10 @@ func (l *Listener) Reconcile(conf stnrv1.Config) error {
 
 	l.routes = make([]string, len(req.Routes))
 	copy(l.routes, req.Routes)
+	l.routeRules = nil
+	for _, r := range req.RouteRules {
+		l.routeRules = append(l.routeRules, r.DeepCopy())
+	}
 
 	// Publish the snapshot for the TURN request path.
 	l.conf.Store(l.buildConfig())
@@ -187,16 +250,25 @@ func (l *Listener) buildConfig() *stnrv1.ListenerConfig {
 	copy(routes, l.routes)
 	sort.Strings(routes)
 	c := &stnrv1.ListenerConfig{
-		Name:       l.name,
-		Protocol:   l.proto.String(),
-		Addr:       l.rawAddr,
-		Port:       l.port,
-		PublicAddr: l.publicAddr,
-		PublicPort: l.publicPort,
-		Routes:     routes,
+		Name:         l.name,
+		Protocol:     l.proto.String(),
+		Addr:         l.rawAddr,
+		Port:         l.port,
+		MinRelayPort: l.minPort,
+		MaxRelayPort: l.maxPort,
+		PublicAddr:   l.publicAddr,
+		PublicPort:   l.publicPort,
+		RelayAddr:    l.relayAddr,
+		Routes:       routes,
+	}
+	c.RelayAddrDiscoveryServer, c.RelayAddrDiscoveryInterval = l.discoveryServer, l.discoveryInterval
+	for _, r := range l.routeRules {
+		c.RouteRules = append(c.RouteRules, r.DeepCopy())
 	}
 	c.Cert = string(l.cert)
 	c.Key = string(l.key)
+	c.Certificates = slices.Clone(l.certificates)
+	c.ClientAuth = l.clientAuth.DeepCopy()
 	return c
 }
 
@@ -212,10 +284,9 @@ func (l *Listener) GetConfig() stnrv1.Config {
 	if snap == nil {
 		return &stnrv1.ListenerConfig{Name: l.name}
 	}
-	cp := *snap
-	cp.Routes = make([]string, len(snap.Routes))
-	copy(cp.Routes, snap.Routes)
-	return &cp
+	cp := &stnrv1.ListenerConfig{}
+	snap.DeepCopyInto(cp)
+	return cp
 }
 
 func (l *Listener) Start() error {
@@ -235,9 +306,33 @@ func (l *Listener) Status() stnrv1.Status {
 	if offloadStatus, ok := l.rt.GetStatus(runtime.TypeOffload, "").(*stnrv1.OffloadStatus); ok {
 		status.Stats = offloadStatus.Listeners[conf.Name]
 	}
+	if conf.RelayAddr != "" {
+		status.RelayAddrs, status.RelayAddrError = l.relayAddrs()
+	}
 	return status
 }
 
+// relayAddrs returns the relay addresses advertised by the listener's TURN server and the error of
+// the last public IP discovery, if any.
+func (l *Listener) relayAddrs() ([]string, string) {
+	o, ok := l.rt.Registry.Get(runtime.TypeListenerServer, l.name)
+	if !ok {
+		return nil, ""
+	}
+	s, ok := o.(interface {
+		RelayAddrs() ([]string, string)
+	})
+	if !ok {
+		return nil, ""
+	}
+	return s.RelayAddrs()
+}
+
+// CertStore returns the TLS certificate store of the listener.
+func (l *Listener) CertStore() *objectturn.CertStore {
+	return l.certs
+}
+
 // AllocationCount returns the number of active allocations on the listener's TURN server.
 func (l *Listener) AllocationCount() int {
 	o, ok := l.rt.Registry.Get(runtime.TypeListenerServer, l.name)
@@ -253,6 +348,97 @@ func (l *Listener) AllocationCount() int {
 	return s.AllocationCount()
 }
 
+// certKeyPair is a decoded TLS cert/key pair.
+type certKeyPair struct {
+	cert, key []byte
+}
+
+func (p certKeyPair) equal(other certKeyPair) bool {
+	return bytes.Equal(p.cert, other.cert) && bytes.Equal(p.key, other.key)
+}
+
+// isTLS reports whether a listener protocol serves TLS or DTLS.
+func isTLS(proto stnrv1.ListenerProtocol) bool {
+	return proto == stnrv1.ListenerProtocolTURNTLS || proto == stnrv1.ListenerProtocolTURNDTLS
+}
+
+// decodeCertificates returns the TLS cert/key pairs of the listener config, the default pair from
+// Cert/Key first.
+func decodeCertificates(req *stnrv1.ListenerConfig) ([]certKeyPair, error) {
+	confs := append([]stnrv1.CertificateConfig{{Cert: req.Cert, Key: req.Key}}, req.Certificates...)
+	pairs := make([]certKeyPair, 0, len(confs))
+	for _, c := range confs {
+		cert, err := decodeTLSMaterial(c.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS certificate: %w", err)
+		}
+		key, err := decodeTLSMaterial(c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS key: %w", err)
+		}
+		pairs = append(pairs, certKeyPair{cert: cert, key: key})
+	}
+	return pairs, nil
+}
+
+// loadCertificates parses the TLS cert/key pairs.
+func loadCertificates(pairs []certKeyPair) ([]tls.Certificate, error) {
+	certs := make([]tls.Certificate, 0, len(pairs))
+	for _, p := range pairs {
+		c, err := tls.X509KeyPair(p.cert, p.key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load TLS cert/key pair: %w", err)
+		}
+		certs = append(certs, c)
+	}
+	return certs, nil
+}
+
+// clientAuthMode returns the client auth mode of a listener, or the empty string if client auth is
+// disabled. Changing the mode restarts the listener.
+func clientAuthMode(c *stnrv1.ClientAuthConfig) string {
+	if c == nil {
+		return ""
+	}
+	return c.Mode
+}
+
+// decodeClientCA returns the PEM-encoded client auth CA bundle.
+func decodeClientCA(c *stnrv1.ClientAuthConfig) ([]byte, error) {
+	ca, err := decodeTLSMaterial(c.CA)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client auth CA: %w", err)
+	}
+	return ca, nil
+}
+
+// exportTLSMaterial returns the TLS cert or key to export in the listener config: the reference, if
+// the config value is a reference, or the decoded value otherwise.
+func exportTLSMaterial(v string, decoded []byte) []byte {
+	if stnrv1.IsReference(v) {
+		return []byte(v)
+	}
+	return decoded
+}
+
+// decodeTLSMaterial returns a TLS cert or key from the listener config: the value is either
+// base64-encoded or a reference to a PEM-encoded or a base64-encoded value.
+func decodeTLSMaterial(v string) ([]byte, error) {
+	ref := stnrv1.IsReference(v)
+	v, err := stnrv1.ResolveReference(v)
+	if err != nil {
+		return nil, err
+	}
+	if ref && strings.Contains(v, "-----BEGIN") {
+		return []byte(v), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("base64-decode error: %w", err)
+	}
+	return b, nil
+}
+
 // lookupAuthConfig is the runtime-backed cross-reference used at reconcile time to track auth
 // realm changes.
 func (l *Listener) lookupAuthConfig() *stnrv1.AuthConfig {
@@ -1,8 +1,17 @@
 package object_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
+	"math/big"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -150,10 +159,10 @@ func TestListenerObjectSemantics(t *testing.T) {
 }
 
 func TestListenerTLSObjectSemantics(t *testing.T) {
-	certA := base64.StdEncoding.EncodeToString([]byte("cert-a"))
-	keyA := base64.StdEncoding.EncodeToString([]byte("key-a"))
-	certB := base64.StdEncoding.EncodeToString([]byte("cert-b"))
-	keyB := base64.StdEncoding.EncodeToString([]byte("key-b"))
+	certA, keyA := newTestCertificate(t, "a.example.com")
+	certB, keyB := newTestCertificate(t, "b.example.com")
+	certC, keyC := newTestCertificate(t, "c.example.com")
+	invalid := base64.StdEncoding.EncodeToString([]byte("invalid"))
 
 	env := newTestEnv()
 
@@ -164,20 +173,25 @@ func TestListenerTLSObjectSemantics(t *testing.T) {
 	obj, err := object.NewListener(nil, env.rt)
 	require.NoError(t, err)
 
-	base := &stnrv1.ListenerConfig{
-		Name:     "listener-tls",
-		Protocol: stnrv1.ListenerProtocolTURNTLS.String(),
-		Addr:     "127.0.0.1",
-		Port:     5349,
-		Cert:     certA,
-		Key:      keyA,
-		Routes:   []string{"allow-a"},
+	conf := func(cert, key string, certs ...stnrv1.CertificateConfig) *stnrv1.ListenerConfig {
+		return &stnrv1.ListenerConfig{
+			Name:         "listener-tls",
+			Protocol:     stnrv1.ListenerProtocolTURNTLS.String(),
+			Addr:         "127.0.0.1",
+			Port:         5349,
+			Cert:         cert,
+			Key:          key,
+			Certificates: certs,
+			Routes:       []string{"allow-a"},
+		}
 	}
+	base := conf(certA, keyA)
 	require.NoError(t, obj.Reconcile(base))
 
 	old := obj.GetConfig()
 	full := &stnrv1.StunnerConfig{Auth: *staticAuthConfig()}
 
+	// Certificates are rotated in place.
 	tests := []inspectExpectation{
 		{
 			name: "route-change-reconcile",
@@ -193,29 +207,120 @@ func TestListenerTLSObjectSemantics(t *testing.T) {
 			want: runtime.ActionReconcile,
 		},
 		{
-			name: "cert-change-restart",
+			name: "cert-change-reconcile",
+			conf: conf(certB, keyB),
+			want: runtime.ActionReconcile,
+		},
+		{
+			name: "certificates-change-reconcile",
+			conf: conf(certA, keyA, stnrv1.CertificateConfig{Cert: certB, Key: keyB}),
+			want: runtime.ActionReconcile,
+		},
+		{
+			name: "port-change-restart",
 			conf: &stnrv1.ListenerConfig{
 				Name:     "listener-tls",
 				Protocol: stnrv1.ListenerProtocolTURNTLS.String(),
 				Addr:     "127.0.0.1",
-				Port:     5349,
+				Port:     5350,
 				Cert:     certB,
-				Key:      keyA,
+				Key:      keyB,
 				Routes:   []string{"allow-a"},
 			},
 			want: runtime.ActionRestart,
 		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			action, err := obj.Inspect(old, tc.conf, full)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, action)
+		})
+	}
+
+	// Certificates that do not load are not rotated in place.
+	_, err = obj.Inspect(old, conf(certA, invalid), full)
+	require.Error(t, err)
+	_, err = obj.Inspect(old, conf(certA, keyA, stnrv1.CertificateConfig{Cert: certB, Key: keyA}), full)
+	require.Error(t, err)
+
+	// The certificate is selected by SNI, falling back to the default certificate.
+	require.NoError(t, obj.Reconcile(conf(certA, keyA,
+		stnrv1.CertificateConfig{Cert: certB, Key: keyB}, stnrv1.CertificateConfig{Cert: certC, Key: keyC})))
+	store := obj.(*object.Listener).CertStore()
+	for sni, want := range map[string]string{
+		"":              "a.example.com",
+		"b.example.com": "b.example.com",
+		"c.example.com": "c.example.com",
+		"x.example.com": "a.example.com",
+	} {
+		hello := &tls.ClientHelloInfo{
+			ServerName:        sni,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		}
+		cert, err := store.GetCertificate(hello)
+		require.NoError(t, err)
+		require.Equal(t, want, cert.Leaf.DNSNames[0], sni)
+	}
+}
+
+func TestListenerClientAuthObjectSemantics(t *testing.T) {
+	cert, key := newTestCertificate(t, "stunner.example.com")
+	caA, _ := newTestCertificate(t, "ca-a")
+	caB, _ := newTestCertificate(t, "ca-b")
+	invalid := base64.StdEncoding.EncodeToString([]byte("invalid"))
+
+	env := newTestEnv()
+
+	auth, err := object.NewAuth(staticAuthConfig(), env.rt)
+	require.NoError(t, err)
+	mustAdd(t, env, auth)
+
+	obj, err := object.NewListener(nil, env.rt)
+	require.NoError(t, err)
+
+	conf := func(clientAuth *stnrv1.ClientAuthConfig) *stnrv1.ListenerConfig {
+		return &stnrv1.ListenerConfig{
+			Name:       "listener-tls",
+			Protocol:   stnrv1.ListenerProtocolTURNTLS.String(),
+			Addr:       "127.0.0.1",
+			Port:       5349,
+			Cert:       cert,
+			Key:        key,
+			ClientAuth: clientAuth,
+			Routes:     []string{"allow-a"},
+		}
+	}
+	require.NoError(t, obj.Reconcile(conf(&stnrv1.ClientAuthConfig{CA: caA})))
+
+	old := obj.GetConfig()
+	full := &stnrv1.StunnerConfig{Auth: *staticAuthConfig()}
+
+	// The CA and the rules are updated in place, enabling, disabling client auth or changing the
+	// mode restarts the listener.
+	tests := []inspectExpectation{
 		{
-			name: "key-change-restart",
-			conf: &stnrv1.ListenerConfig{
-				Name:     "listener-tls",
-				Protocol: stnrv1.ListenerProtocolTURNTLS.String(),
-				Addr:     "127.0.0.1",
-				Port:     5349,
-				Cert:     certA,
-				Key:      keyB,
-				Routes:   []string{"allow-a"},
-			},
+			name: "ca-change-reconcile",
+			conf: conf(&stnrv1.ClientAuthConfig{CA: caB}),
+			want: runtime.ActionReconcile,
+		},
+		{
+			name: "rules-change-reconcile",
+			conf: conf(&stnrv1.ClientAuthConfig{CA: caA, AllowedSANs: []string{"*.example.com"},
+				Identity: "san"}),
+			want: runtime.ActionReconcile,
+		},
+		{
+			name: "mode-change-restart",
+			conf: conf(&stnrv1.ClientAuthConfig{CA: caA, Mode: "Optional"}),
+			want: runtime.ActionRestart,
+		},
+		{
+			name: "disable-restart",
+			conf: conf(nil),
 			want: runtime.ActionRestart,
 		},
 	}
@@ -227,4 +332,52 @@ func TestListenerTLSObjectSemantics(t *testing.T) {
 			require.Equal(t, tc.want, action)
 		})
 	}
+
+	// A CA that does not load is not rotated in place.
+	_, err = obj.Inspect(old, conf(&stnrv1.ClientAuthConfig{CA: invalid}), full)
+	require.Error(t, err)
+
+	// Invalid client auth configs are rejected.
+	for _, c := range []*stnrv1.ClientAuthConfig{
+		{},
+		{CA: caA, Mode: "always"},
+		{CA: caA, Identity: "serial"},
+		{CA: caA, AllowedSubjects: []string{"[a-"}},
+	} {
+		_, err = obj.Inspect(old, conf(c), full)
+		require.Error(t, err)
+	}
+	udp := conf(&stnrv1.ClientAuthConfig{CA: caA})
+	udp.Protocol = stnrv1.ListenerProtocolTURNUDP.String()
+	require.Error(t, udp.Validate())
+
+	// Clients without a client cert are only admitted in the "optional" mode.
+	store := obj.(*object.Listener).CertStore()
+	require.Error(t, store.VerifyPeerCertificate(nil, nil))
+	require.NoError(t, obj.Reconcile(conf(&stnrv1.ClientAuthConfig{CA: caA, Mode: "optional"})))
+	require.NoError(t, store.VerifyPeerCertificate(nil, nil))
+	require.Equal(t, "optional", obj.GetConfig().(*stnrv1.ListenerConfig).ClientAuth.Mode)
+}
+
+// newTestCertificate returns a base64-encoded self-signed cert and key for a DNS name.
+func newTestCertificate(t *testing.T, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return base64.StdEncoding.EncodeToString(cert), base64.StdEncoding.EncodeToString(keyPem)
 }
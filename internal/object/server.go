@@ -2,6 +2,7 @@ package object
 
 import (
 	"fmt"
+	"net"
 	"strings"
 
 	objectturn "github.com/l7mp/stunner/internal/object/turn"
@@ -59,3 +60,20 @@ func (s *ListenerServer) AllocationCount() int {
 	}
 	return s.server.AllocationCount()
 }
+
+// ClientUser returns the user ID of the allocation of a client on the TURN server, if any.
+func (s *ListenerServer) ClientUser(src net.Addr) (string, bool) {
+	if s.server == nil {
+		return "", false
+	}
+	return s.server.ClientUser(src)
+}
+
+// RelayAddrs returns the relay addresses advertised by the TURN server and the error of the last
+// public IP discovery, if any.
+func (s *ListenerServer) RelayAddrs() ([]string, string) {
+	if s.server == nil {
+		return nil, ""
+	}
+	return s.server.RelayAddrs()
+}
@@ -59,7 +59,7 @@ func (s *Stunner) Status() stnrv1.Status {
 	if a, ok := s.rt.GetStatus(runtime.TypeAdmin, "").(*stnrv1.AdminStatus); ok {
 		status.Admin = a
 	}
-	if a, ok := s.rt.GetStatus(runtime.TypeAuth, "").(*stnrv1.AuthConfig); ok {
+	if a, ok := s.rt.GetStatus(runtime.TypeAuth, "").(*stnrv1.AuthStatus); ok {
 		status.Auth = a
 	}
 	listenerStatuses := s.rt.GetStatuses(runtime.TypeListener)
@@ -0,0 +1,149 @@
+package turn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync/atomic"
+
+	"github.com/pion/dtls/v3"
+
+	objruntime "github.com/l7mp/stunner/internal/runtime"
+)
+
+var errNoCertificate = errors.New("no TLS certificate")
+
+// CertStore holds the TLS certificates and the client certificate verifier of a listener. TLS and
+// DTLS listeners consult the store on each handshake, so that the certificates and the client CA
+// can be rotated without restarting the listener.
+type CertStore struct {
+	certs      atomic.Pointer[certSet]
+	clientAuth atomic.Pointer[clientAuthSet]
+}
+
+// clientAuthSet is a snapshot of the client certificate verifier, or the error that prevented
+// creating it.
+type clientAuthSet struct {
+	verifier *ClientVerifier
+	err      error
+}
+
+// certSet is a snapshot of the certificates, or the error that prevented loading them.
+type certSet struct {
+	certs []tls.Certificate
+	err   error
+}
+
+// NewCertStore creates an empty certificate store.
+func NewCertStore() *CertStore {
+	return &CertStore{}
+}
+
+// Update replaces the certificates. The first certificate is the default, the rest are only
+// selected by the server name requested by the client. If err is not nil then the certificates
+// could not be loaded and listeners fail to start with err.
+func (s *CertStore) Update(certs []tls.Certificate, err error) {
+	s.certs.Store(&certSet{certs: certs, err: err})
+}
+
+// UpdateClientAuth replaces the client certificate verifier. A nil verifier with a nil err disables
+// the verification of client certificates. If err is not nil then the verifier could not be
+// created and listeners fail to start with err, while running listeners refuse all clients.
+func (s *CertStore) UpdateClientAuth(v *ClientVerifier, err error) {
+	s.clientAuth.Store(&clientAuthSet{verifier: v, err: err})
+}
+
+// Err returns the error of the last update, or an error if the store is empty.
+func (s *CertStore) Err() error {
+	set := s.certs.Load()
+	switch {
+	case set == nil:
+		return errNoCertificate
+	case set.err != nil:
+		return set.err
+	case len(set.certs) == 0:
+		return errNoCertificate
+	}
+	if ca := s.clientAuth.Load(); ca != nil && ca.err != nil {
+		return ca.err
+	}
+	return nil
+}
+
+// VerifyPeerCertificate verifies the client certificate chain presented in a TLS or DTLS
+// handshake. The handshake fails, and no STUN/TURN request is processed, if verification fails.
+func (s *CertStore) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	set := s.clientAuth.Load()
+	switch {
+	case set == nil:
+		return nil
+	case set.err != nil:
+		return errClientAuthUnavailable
+	case set.verifier == nil:
+		return nil
+	}
+	return set.verifier.verify(rawCerts)
+}
+
+// ClientIdentity returns the TURN identity of a client from its verified client certificate, or
+// the empty string if client certificates do not serve as TURN identity.
+func (s *CertStore) ClientIdentity(cert *x509.Certificate) string {
+	set := s.clientAuth.Load()
+	if set == nil || set.verifier == nil {
+		return ""
+	}
+	return set.verifier.Identity(cert)
+}
+
+// GetCertificate returns the certificate for a TLS client hello.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.get(hello.ServerName, func(c *tls.Certificate) bool {
+		return hello.SupportsCertificate(c) == nil
+	})
+}
+
+// GetDTLSCertificate returns the certificate for a DTLS client hello.
+func (s *CertStore) GetDTLSCertificate(hello *dtls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.get(hello.ServerName, func(c *tls.Certificate) bool {
+		return c.Leaf != nil && c.Leaf.VerifyHostname(hello.ServerName) == nil
+	})
+}
+
+// get returns the first certificate that supports the server name, or the default certificate if
+// no server name was requested or no certificate supports it.
+func (s *CertStore) get(serverName string, supports func(*tls.Certificate) bool) (*tls.Certificate, error) {
+	set := s.certs.Load()
+	if set == nil || len(set.certs) == 0 {
+		return nil, errNoCertificate
+	}
+	if serverName != "" {
+		for i := range set.certs {
+			if c := &set.certs[i]; supports(c) {
+				return c, nil
+			}
+		}
+	}
+	return &set.certs[0], nil
+}
+
+// certStoreProvider is implemented by the Listener object to share its certificate store with the
+// TURN server.
+type certStoreProvider interface {
+	CertStore() *CertStore
+}
+
+// lookupCertStore returns the certificate store of a listener.
+func lookupCertStore(rt *objruntime.Runtime, listener string) (*CertStore, error) {
+	o, ok := rt.Registry.Get(objruntime.TypeListener, listener)
+	if !ok {
+		return nil, errNoCertificate
+	}
+	p, ok := o.(certStoreProvider)
+	if !ok {
+		return nil, errNoCertificate
+	}
+	if err := p.CertStore().Err(); err != nil {
+		return nil, err
+	}
+	return p.CertStore(), nil
+}
@@ -0,0 +1,232 @@
+package turn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sync"
+
+	"github.com/pion/dtls/v3"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+var (
+	errNoClientCertificate   = errors.New("no client certificate")
+	errClientCertNotAllowed  = errors.New("client certificate subject not allowed")
+	errClientAuthUnavailable = errors.New("client auth unavailable")
+)
+
+// ClientVerifier verifies the client certificates of a TLS or DTLS listener against a CA bundle
+// and the subject/SAN rules of the listener.
+type ClientVerifier struct {
+	roots          *x509.CertPool
+	optional       bool
+	subjects, sans []string
+	identity       string
+}
+
+// NewClientVerifier creates a client certificate verifier from a validated client auth config and
+// the PEM-encoded CA bundle.
+func NewClientVerifier(conf *stnrv1.ClientAuthConfig, ca []byte) (*ClientVerifier, error) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("cannot load client auth CA: no PEM-encoded certificate found")
+	}
+	return &ClientVerifier{
+		roots:    roots,
+		optional: conf.Mode == "optional",
+		subjects: append([]string(nil), conf.AllowedSubjects...),
+		sans:     append([]string(nil), conf.AllowedSANs...),
+		identity: conf.Identity,
+	}, nil
+}
+
+// verify checks a client certificate chain, leaf first. An empty chain is only accepted in the
+// "optional" mode.
+func (v *ClientVerifier) verify(rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		if v.optional {
+			return nil
+		}
+		return errNoClientCertificate
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("invalid client certificate: %w", err)
+		}
+		certs = append(certs, c)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return fmt.Errorf("invalid client certificate: %w", err)
+	}
+
+	if !v.allowed(certs[0]) {
+		return errClientCertNotAllowed
+	}
+	return nil
+}
+
+// allowed checks the subject common name and the SANs of a client certificate against the rules.
+// Without rules all certificates are allowed.
+func (v *ClientVerifier) allowed(cert *x509.Certificate) bool {
+	if len(v.subjects) == 0 && len(v.sans) == 0 {
+		return true
+	}
+	if matchAny(v.subjects, cert.Subject.CommonName) {
+		return true
+	}
+	for _, san := range certSANs(cert) {
+		if matchAny(v.sans, san) {
+			return true
+		}
+	}
+	return false
+}
+
+// Identity returns the TURN identity of the client with a client certificate, or the empty
+// string if the certificate does not serve as TURN identity.
+func (v *ClientVerifier) Identity(cert *x509.Certificate) string {
+	switch v.identity {
+	case "common-name":
+		return cert.Subject.CommonName
+	case "san":
+		switch {
+		case len(cert.DNSNames) > 0:
+			return cert.DNSNames[0]
+		case len(cert.EmailAddresses) > 0:
+			return cert.EmailAddresses[0]
+		case len(cert.URIs) > 0:
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// certSANs returns the DNS name, email address, IP address and URI SANs of a certificate.
+func certSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
+
+// matchAny reports whether a name matches any of the glob patterns. Patterns are validated by
+// ListenerConfig.Validate.
+func matchAny(patterns []string, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIdentities maps the remote address of the TLS and DTLS connections of a listener to the
+// TURN identity taken from the client certificate, see ClientVerifier.Identity.
+type ClientIdentities struct {
+	ids sync.Map // remote address -> identity
+}
+
+// lookup returns the TURN identity of a client, if any.
+func (i *ClientIdentities) lookup(src net.Addr) (string, bool) {
+	if i == nil || src == nil {
+		return "", false
+	}
+	id, ok := i.ids.Load(src.String())
+	if !ok {
+		return "", false
+	}
+	return id.(string), true
+}
+
+// clientAuthListener is a TLS or DTLS listener whose connections record the TURN identity from
+// the verified client certificate.
+type clientAuthListener struct {
+	net.Listener
+	certs *CertStore
+	ids   *ClientIdentities
+}
+
+func newClientAuthListener(l net.Listener, certs *CertStore, ids *ClientIdentities) net.Listener {
+	return &clientAuthListener{Listener: l, certs: certs, ids: ids}
+}
+
+func (l *clientAuthListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &clientAuthConn{Conn: conn, certs: l.certs, ids: l.ids}, nil
+}
+
+// clientAuthConn records the TURN identity of the client once the handshake completes. The
+// handshake runs on the first read, so the identity is known before the first request reaches
+// the TURN server.
+type clientAuthConn struct {
+	net.Conn
+	certs *CertStore
+	ids   *ClientIdentities
+	once  sync.Once
+	key   string
+}
+
+func (c *clientAuthConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.once.Do(c.identify)
+	}
+	return n, err
+}
+
+func (c *clientAuthConn) identify() {
+	var cert *x509.Certificate
+	switch conn := c.Conn.(type) {
+	case *tls.Conn:
+		if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			cert = certs[0]
+		}
+	case *dtls.Conn:
+		if state, ok := conn.ConnectionState(); ok && len(state.PeerCertificates) > 0 {
+			cert, _ = x509.ParseCertificate(state.PeerCertificates[0])
+		}
+	}
+	if cert == nil {
+		return
+	}
+	if id := c.certs.ClientIdentity(cert); id != "" {
+		c.key = c.RemoteAddr().String()
+		c.ids.ids.Store(c.key, id)
+	}
+}
+
+func (c *clientAuthConn) Close() error {
+	// Wait for a concurrent identify to finish before removing the identity.
+	c.once.Do(func() {})
+	if c.key != "" {
+		c.ids.ids.Delete(c.key)
+	}
+	return c.Conn.Close()
+}
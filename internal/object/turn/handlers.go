@@ -1,11 +1,14 @@
 package turn
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/pion/logging"
 	"github.com/pion/turn/v5"
+	"k8s.io/utils/lru"
 
 	"github.com/l7mp/stunner/internal/offload"
 	"github.com/l7mp/stunner/internal/router"
@@ -14,13 +17,26 @@ import (
 	a12n "github.com/l7mp/stunner/pkg/authentication"
 )
 
+// credentialCacheSize is the number of clients whose credential is kept until they create an
+// allocation.
+const credentialCacheSize = 4096
+
 // NewAuthHandler returns an authentication handler callback for a TURN server.
 func NewAuthHandler(rt *objruntime.Runtime, log logging.LeveledLogger) a12n.AuthHandler {
+	return newAuthHandler(rt, nil, nil, log)
+}
+
+// newAuthHandler returns an authentication handler callback for a TURN server that records the
+// credential of each client in users for the allocation the client may create. The TURN identity
+// of the clients with a client certificate is taken from ids, if any, and returned to the TURN
+// server instead of the user ID of the TURN credentials for quota enforcement and logging, while
+// the allocations are authorized with the user ID of the TURN credentials.
+func newAuthHandler(rt *objruntime.Runtime, ids *ClientIdentities, users *allocationUsers, log logging.LeveledLogger) a12n.AuthHandler {
 	log.Trace("NewAuthHandler")
 
 	// We must return a nil auth-handler to switch pure STUN on.
-	a, ok := rt.GetConfig(objruntime.TypeAuth, "").(*stnrv1.AuthConfig)
-	if !ok || a == nil {
+	a, ok := authConfig(rt)
+	if !ok {
 		log.Warn("auth handler: no auth config in runtime")
 		return nil
 	}
@@ -35,59 +51,404 @@ func NewAuthHandler(rt *objruntime.Runtime, log logging.LeveledLogger) a12n.Auth
 
 	return func(ra *turn.RequestAttributes) (string, []byte, bool) {
 		username := ra.Username
-		realm := ra.Realm
 		srcAddr := ra.SrcAddr
 
-		auth, ok := rt.GetConfig(objruntime.TypeAuth, "").(*stnrv1.AuthConfig)
-		if !ok || auth == nil {
+		auth, ok := authConfig(rt)
+		if !ok {
 			log.Infof("auth request: failed: auth config is unavailable")
 			return "", nil, false
 		}
-		authType, err := stnrv1.NewAuthType(auth.Type)
-		if err != nil {
-			log.Errorf("auth request: invalid auth type %q", auth.Type)
+		if err := admitClient(rt, srcAddr, username); err != nil {
+			log.Infof("auth request: failed: client %s: %s", srcAddr, err)
 			return "", nil, false
 		}
-
-		switch authType {
-		case stnrv1.AuthTypeStatic:
-			configuredUser := auth.Credentials["username"]
-			configuredPass := auth.Credentials["password"]
-			log.Tracef("static auth request: username=%q realm=%q srcAddr=%v", username, realm, srcAddr)
-			key := a12n.GenerateAuthKey(configuredUser, auth.Realm, configuredPass)
-			if username == configuredUser {
-				log.Debug("static auth request: valid username")
-				return username, key, true
-			}
-			log.Infof("static auth request: failed: invalid username")
+		cred, ok := checkCredentials(rt, auth, ra, log)
+		if !ok {
+			recordAuthFailure(rt, srcAddr, username)
 			return "", nil, false
+		}
+		users.authenticated(srcAddr, objruntime.User{ID: cred.userID, Clusters: cred.clusters, Recorded: true})
+		if id, ok := ids.lookup(srcAddr); ok {
+			log.Debugf("auth request: client %s: using client certificate identity %q instead "+
+				"of user %q for quota and logging", srcAddr, id, cred.userID)
+			return id, cred.key, true
+		}
+		return cred.userID, cred.key, true
+	}
+}
 
-		case stnrv1.AuthTypeEphemeral:
-			secret := auth.Credentials["secret"]
-			log.Tracef("ephemeral auth request: username=%q realm=%q srcAddr=%v", username, realm, srcAddr)
-			userID, err := a12n.CheckTimeWindowedUsername(username)
-			if err != nil {
-				log.Infof("ephemeral auth request: failed: %s", err)
-				return "", nil, false
+// credential is the long-term credential a request was authenticated with.
+type credential struct {
+	userID string
+	key    []byte
+	// password is the password of the user, when known, for checking
+	// MESSAGE-INTEGRITY-SHA256.
+	password string
+	// clusters lists the clusters the "jwt" token or the webhook verdict restricts the user to,
+	// or nil if none.
+	clusters []string
+}
+
+// checkCredentials finds the long-term credential for a request.
+func checkCredentials(rt *objruntime.Runtime, auth *stnrv1.AuthConfig, ra *turn.RequestAttributes, log logging.LeveledLogger) (credential, bool) {
+	username := ra.Username
+	realm := ra.Realm
+	srcAddr := ra.SrcAddr
+
+	authType, err := stnrv1.NewAuthType(auth.Type)
+	if err != nil {
+		log.Errorf("auth request: invalid auth type %q", auth.Type)
+		return credential{}, false
+	}
+
+	switch authType {
+	case stnrv1.AuthTypeStatic:
+		configuredUser := auth.Credentials["username"]
+		configuredPass := auth.Credentials["password"]
+		log.Tracef("static auth request: username=%q realm=%q srcAddr=%v", username, realm, srcAddr)
+		key := a12n.GenerateAuthKey(configuredUser, auth.Realm, configuredPass)
+		if username == configuredUser {
+			log.Debug("static auth request: valid username")
+			return credential{userID: username, key: key, password: configuredPass}, true
+		}
+		log.Infof("static auth request: failed: invalid username")
+		return credential{}, false
+
+	case stnrv1.AuthTypeStaticMulti:
+		log.Tracef("static-multi auth request: username=%q realm=%q srcAddr=%v", username, realm, srcAddr)
+		user, ok := lookupUser(rt, username)
+		if !ok {
+			log.Infof("static-multi auth request: failed: invalid username")
+			return credential{}, false
+		}
+		log.Debug("static-multi auth request: valid username")
+		key := a12n.GenerateAuthKey(username, auth.Realm, user.Password)
+		return credential{userID: username, key: key, password: user.Password}, true
+
+	case stnrv1.AuthTypeEphemeral:
+		secret := auth.Credentials["secret"]
+		log.Tracef("ephemeral auth request: username=%q realm=%q srcAddr=%v", username, realm, srcAddr)
+		userID, err := a12n.CheckTimeWindowedUsername(username)
+		if err != nil {
+			log.Infof("ephemeral auth request: failed: %s", err)
+			return credential{}, false
+		}
+		if s, gen, ok := ephemeralSecret(rt, username, srcAddr); ok {
+			log.Tracef("ephemeral auth request: using secret generation %d", gen)
+			secret = s
+		}
+		password, err := a12n.GetLongTermCredential(username, secret)
+		if err != nil {
+			log.Debugf("ephemeral auth request: error generating password: %s", err)
+			return credential{}, false
+		}
+		log.Debug("ephemeral auth request: success")
+		key := a12n.GenerateAuthKey(username, auth.Realm, password)
+		return credential{userID: userID, key: key, password: password}, true
+
+	case stnrv1.AuthTypeJWT:
+		log.Tracef("jwt auth request: realm=%q srcAddr=%v", realm, srcAddr)
+		if auth.JWT == nil {
+			log.Errorf("jwt auth request: failed: no JWT config")
+			return credential{}, false
+		}
+		claims, err := verifyToken(rt, username)
+		if err != nil {
+			log.Infof("jwt auth request: failed: %s", err)
+			return credential{}, false
+		}
+		userID := claims.String(auth.JWT.UserClaim)
+		if userID == "" {
+			log.Infof("jwt auth request: failed: missing user claim %q", auth.JWT.UserClaim)
+			return credential{}, false
+		}
+		var password string
+		if auth.JWT.PasswordClaim != "" {
+			password = claims.String(auth.JWT.PasswordClaim)
+			if password == "" {
+				log.Infof("jwt auth request: failed: missing password claim %q",
+					auth.JWT.PasswordClaim)
+				return credential{}, false
 			}
-			password, err := a12n.GetLongTermCredential(username, secret)
+		} else {
+			password, err = a12n.GetLongTermCredential(username, auth.Credentials["secret"])
 			if err != nil {
-				log.Debugf("ephemeral auth request: error generating password: %s", err)
-				return "", nil, false
+				log.Debugf("jwt auth request: error generating password: %s", err)
+				return credential{}, false
+			}
+		}
+		log.Debugf("jwt auth request: success for user %q", userID)
+		key := a12n.GenerateAuthKey(username, auth.Realm, password)
+		var clusters []string
+		if auth.JWT.ClustersClaim != "" {
+			if _, ok := claims[auth.JWT.ClustersClaim]; ok {
+				// A malformed clusters claim grants no cluster.
+				clusters = append([]string{}, claims.Strings(auth.JWT.ClustersClaim)...)
 			}
-			log.Debug("ephemeral auth request: success")
-			key := a12n.GenerateAuthKey(username, auth.Realm, password)
-			return userID, key, true
+		}
+		return credential{userID: userID, key: key, password: password, clusters: clusters}, true
 
-		default:
-			log.Errorf("internal error: unknown authentication mode %q", authType.String())
-			return "", nil, false
+	case stnrv1.AuthTypeWebhook:
+		log.Tracef("webhook auth request: username=%q realm=%q srcAddr=%v", username, realm, srcAddr)
+		verdict, err := authenticateWebhook(rt, username, auth.Realm, srcAddr)
+		if err != nil {
+			log.Infof("webhook auth request: failed: %s", err)
+			return credential{}, false
+		}
+		if !verdict.Allowed {
+			log.Infof("webhook auth request: failed: user denied by webhook")
+			return credential{}, false
+		}
+		log.Debugf("webhook auth request: success for user %q", verdict.UserID)
+		return credential{userID: verdict.UserID, key: verdict.Key, password: verdict.Password,
+			clusters: verdict.Clusters}, true
+
+	case stnrv1.AuthTypeOAuth:
+		log.Tracef("oauth auth request: kid=%q realm=%q srcAddr=%v", username, realm, srcAddr)
+		key, err := accessToken(rt, username, srcAddr)
+		if err != nil {
+			log.Infof("oauth auth request: failed: %s", err)
+			return credential{}, false
+		}
+		log.Debugf("oauth auth request: success for key ID %q", username)
+		return credential{userID: username, key: key}, true
+
+	default:
+		log.Errorf("internal error: unknown authentication mode %q", authType.String())
+		return credential{}, false
+	}
+}
+
+// userLookup is implemented by the Auth object to resolve users from the "static-multi" user
+// table, which may hold more users than the config snapshot (e.g., users loaded from a file), or
+// from the user attributes returned by the authorization webhook.
+type userLookup interface {
+	LookupUser(username string) (stnrv1.UserCredential, bool)
+}
+
+// lookupUser finds a user in the live Auth object.
+func lookupUser(rt *objruntime.Runtime, username string) (stnrv1.UserCredential, bool) {
+	o, ok := rt.Registry.Get(objruntime.TypeAuth, stnrv1.DefaultAuthName)
+	if !ok {
+		return stnrv1.UserCredential{}, false
+	}
+	l, ok := o.(userLookup)
+	if !ok {
+		return stnrv1.UserCredential{}, false
+	}
+	return l.LookupUser(username)
+}
+
+// tokenVerifier is implemented by the Auth object to verify "jwt" tokens against the live key set.
+type tokenVerifier interface {
+	VerifyToken(token string) (a12n.JWTClaims, error)
+}
+
+// verifyToken verifies a "jwt" token using the live Auth object.
+func verifyToken(rt *objruntime.Runtime, token string) (a12n.JWTClaims, error) {
+	o, ok := rt.Registry.Get(objruntime.TypeAuth, stnrv1.DefaultAuthName)
+	if !ok {
+		return nil, errors.New("auth object unavailable")
+	}
+	v, ok := o.(tokenVerifier)
+	if !ok {
+		return nil, errors.New("auth object cannot verify tokens")
+	}
+	return v.VerifyToken(token)
+}
+
+// secretSelector is implemented by the Auth object to select the "ephemeral" secret generation
+// a credential was issued with when the secret is being rotated.
+type secretSelector interface {
+	EphemeralSecret(username string, src net.Addr) (string, int, bool)
+}
+
+// ephemeralSecret selects the "ephemeral" secret for a client from the live Auth object.
+func ephemeralSecret(rt *objruntime.Runtime, username string, src net.Addr) (string, int, bool) {
+	o, ok := rt.Registry.Get(objruntime.TypeAuth, stnrv1.DefaultAuthName)
+	if !ok {
+		return "", 0, false
+	}
+	s, ok := o.(secretSelector)
+	if !ok {
+		return "", 0, false
+	}
+	return s.EphemeralSecret(username, src)
+}
+
+// webhookAuthenticator is implemented by the Auth object to check users with the authorization
+// webhook.
+type webhookAuthenticator interface {
+	AuthenticateWebhook(username, realm string, src net.Addr) (a12n.WebhookVerdict, error)
+}
+
+// authenticateWebhook checks a user with the authorization webhook of the live Auth object.
+func authenticateWebhook(rt *objruntime.Runtime, username, realm string, src net.Addr) (a12n.WebhookVerdict, error) {
+	o, ok := rt.Registry.Get(objruntime.TypeAuth, stnrv1.DefaultAuthName)
+	if !ok {
+		return a12n.WebhookVerdict{}, errors.New("auth object unavailable")
+	}
+	w, ok := o.(webhookAuthenticator)
+	if !ok {
+		return a12n.WebhookVerdict{}, errors.New("auth object cannot call webhooks")
+	}
+	return w.AuthenticateWebhook(username, realm, src)
+}
+
+// accessTokenLookup is implemented by the Auth object to find the session key of the access token
+// presented by a client for "oauth" authentication.
+type accessTokenLookup interface {
+	AccessToken(kid string, src net.Addr) ([]byte, error)
+}
+
+// accessToken returns the session key of the access token of a client from the live Auth object.
+func accessToken(rt *objruntime.Runtime, kid string, src net.Addr) ([]byte, error) {
+	o, ok := rt.Registry.Get(objruntime.TypeAuth, stnrv1.DefaultAuthName)
+	if !ok {
+		return nil, errors.New("auth object unavailable")
+	}
+	l, ok := o.(accessTokenLookup)
+	if !ok {
+		return nil, errors.New("auth object cannot check access tokens")
+	}
+	return l.AccessToken(kid, src)
+}
+
+// resolvedConfigProvider is implemented by the Auth object to share the auth config with the
+// credential and secret references resolved, which GetConfig keeps as references.
+type resolvedConfigProvider interface {
+	ResolvedConfig() *stnrv1.AuthConfig
+}
+
+// authConfig returns the live auth config with the references resolved.
+func authConfig(rt *objruntime.Runtime) (*stnrv1.AuthConfig, bool) {
+	if o, ok := rt.Registry.Get(objruntime.TypeAuth, stnrv1.DefaultAuthName); ok {
+		if p, ok := o.(resolvedConfigProvider); ok {
+			return p.ResolvedConfig(), true
+		}
+	}
+	a, ok := rt.GetConfig(objruntime.TypeAuth, "").(*stnrv1.AuthConfig)
+	return a, ok && a != nil
+}
+
+// allocationUsers records the user of each allocation of a TURN server, along with the clusters
+// the credential of the allocation restricts the user to, since permission requests carry only
+// the client address and relay sockets are created before the allocation. The credential of the
+// last authenticated request of each client is kept until the client creates an allocation, which
+// happens right after the authentication of the Allocate request. Allocation entries live as long
+// as the allocation.
+type allocationUsers struct {
+	credentials *lru.Cache // client address -> objruntime.User
+	users       sync.Map   // client address -> allocationUser
+	relays      sync.Map   // relay address -> objruntime.User
+}
+
+type allocationUser struct {
+	user  objruntime.User
+	relay string
+}
+
+func newAllocationUsers() *allocationUsers {
+	return &allocationUsers{credentials: lru.New(credentialCacheSize)}
+}
+
+// authenticated records the credential of the last authenticated request of a client.
+func (u *allocationUsers) authenticated(src net.Addr, user objruntime.User) {
+	if u != nil {
+		u.credentials.Add(src.String(), user)
+	}
+}
+
+// add records the user of a new allocation from the credential of the client, or only the user ID
+// if the credential is unknown.
+func (u *allocationUsers) add(src, relay net.Addr, userID string) {
+	if u == nil {
+		return
+	}
+	user := objruntime.User{ID: userID}
+	if v, ok := u.credentials.Get(src.String()); ok {
+		user = v.(objruntime.User)
+		u.credentials.Remove(src.String())
+	}
+	key := relayKey(relay)
+	u.users.Store(src.String(), allocationUser{user: user, relay: key})
+	u.relays.Store(key, user)
+}
+
+func (u *allocationUsers) remove(src net.Addr) {
+	if u == nil {
+		return
+	}
+	u.credentials.Remove(src.String())
+	if v, ok := u.users.LoadAndDelete(src.String()); ok {
+		u.relays.Delete(v.(allocationUser).relay)
+	}
+}
+
+// lookup returns the user of the allocation of a client, if any.
+func (u *allocationUsers) lookup(src net.Addr) (objruntime.User, bool) {
+	if u == nil || src == nil {
+		return objruntime.User{}, false
+	}
+	v, ok := u.users.Load(src.String())
+	if !ok {
+		return objruntime.User{}, false
+	}
+	return v.(allocationUser).user, true
+}
+
+// relayUser returns the user of the allocation of a relayed transport address, see relayKey, or
+// an unknown user if none.
+func (u *allocationUsers) relayUser(key string) objruntime.User {
+	if u == nil {
+		return objruntime.User{}
+	}
+	v, ok := u.relays.Load(key)
+	if !ok {
+		return objruntime.User{}
+	}
+	return v.(objruntime.User)
+}
+
+// relayKey identifies a relayed transport address: UDP and TCP allocations may share a port.
+func relayKey(addr net.Addr) string {
+	return addr.Network() + "|" + addr.String()
+}
+
+// authGuard is implemented by the Auth object to ban the source IPs and the usernames with too
+// many failed authentications.
+type authGuard interface {
+	AdmitClient(src net.Addr, username string) error
+	RecordAuthFailure(src net.Addr, username string)
+}
+
+// admitClient returns an error if a client is banned by the live Auth object.
+func admitClient(rt *objruntime.Runtime, src net.Addr, username string) error {
+	if o, ok := rt.Registry.Get(objruntime.TypeAuth, stnrv1.DefaultAuthName); ok {
+		if g, ok := o.(authGuard); ok {
+			return g.AdmitClient(src, username)
+		}
+	}
+	return nil
+}
+
+// recordAuthFailure counts a failed authentication in the live Auth object.
+func recordAuthFailure(rt *objruntime.Runtime, src net.Addr, username string) {
+	if o, ok := rt.Registry.Get(objruntime.TypeAuth, stnrv1.DefaultAuthName); ok {
+		if g, ok := o.(authGuard); ok {
+			g.RecordAuthFailure(src, username)
 		}
 	}
 }
 
 // NewPermissionHandler returns a callback to handle client permission requests to access peers.
 func NewPermissionHandler(name string, rt *objruntime.Runtime, log logging.LeveledLogger) a12n.PermissionHandler {
+	return newPermissionHandler(name, rt, nil, log)
+}
+
+// newPermissionHandler returns a callback to handle client permission requests to access peers
+// that takes the user of the client from the allocations in users.
+func newPermissionHandler(name string, rt *objruntime.Runtime, users *allocationUsers, log logging.LeveledLogger) a12n.PermissionHandler {
 	log.Trace("NewPermissionHandler")
 
 	return func(src net.Addr, peer net.IP) bool {
@@ -98,23 +459,47 @@ func NewPermissionHandler(name string, rt *objruntime.Runtime, log logging.Level
 		if !ok || conf == nil {
 			log.Infof("permission denied on listener %q for client %q to peer %s: listener config unavailable",
 				name, src.String(), peerIP)
+			countPermission(rt, name, "", "listener-unavailable")
 			return false
 		}
 
-		// Grant if the peer is routable via *any* cluster on the listener's routes.
-		cluster, ok := router.RouteAny(rt, name, conf.Routes, peer)
+		// Grant if the peer is routable via *any* cluster on the listener's routes the user may
+		// access. An unknown user matches no username condition and no per-user cluster.
+		user, _ := users.lookup(src)
+		cluster, ok := router.RouteAny(rt, name, conf.Routes, user, peer)
 		if ok {
 			log.Debugf("permission granted on listener %q for client %q to peer %s via cluster %q",
 				name, src.String(), peerIP, cluster)
+			countPermission(rt, name, cluster, "")
 			return true
 		}
 
+		if rt.Router.Denied(peer, 0) {
+			log.Infof("permission denied on listener %q for client %q to peer %s: peer on deny-list",
+				name, src.String(), peerIP)
+			countPermission(rt, name, "", "deny-list")
+			return false
+		}
+
 		log.Infof("permission denied on listener %q for client %q to peer %s: no route to endpoint",
 			name, src.String(), peerIP)
+		countPermission(rt, name, "", "no-route")
 		return false
 	}
 }
 
+// countPermission counts a permission decision in telemetry: a permission is granted via a
+// cluster and denied for a reason.
+func countPermission(rt *objruntime.Runtime, listener, cluster, reason string) {
+	if rt.Telemetry == nil {
+		return
+	}
+	rt.Telemetry.IncrementPermissions(listener, cluster != "", reason)
+	if cluster != "" {
+		rt.Telemetry.IncrementClusterFlows(cluster, listener, "permission")
+	}
+}
+
 // AllocationEventType is a helper type to administer allocations.
 type AllocationEventType int
 
@@ -132,11 +517,16 @@ func NewQuotaHandler(rt *objruntime.Runtime) *quotaHandler {
 	return &quotaHandler{runtime: rt}
 }
 
-// QuotaHandler returns a callback that enforces per-user allocation quotas.
+// QuotaHandler returns a callback that enforces per-user allocation quotas. The global quota can
+// be overridden per user in the "static-multi" user table or by the authorization webhook.
 func (q *quotaHandler) QuotaHandler() turn.QuotaHandler {
 	return func(username, realm string, _ net.Addr) bool {
 		admin := q.runtime.GetConfig(objruntime.TypeAdmin, "").(*stnrv1.AdminConfig)
-		return q.runtime.QuotaHandler.CheckAndIncrement(username, realm, admin.UserQuota)
+		quota := admin.UserQuota
+		if u, ok := lookupUser(q.runtime, username); ok && u.UserQuota != nil {
+			quota = *u.UserQuota
+		}
+		return q.runtime.QuotaHandler.CheckAndIncrement(username, realm, quota)
 	}
 }
 
@@ -149,11 +539,20 @@ func (q *quotaHandler) AllocationHandler(_ net.Addr, _ net.Addr, _ string, usern
 
 // NewEventHandler creates a set of callbacks for tracking the lifecycle of TURN allocations.
 func NewEventHandler(name string, rt *objruntime.Runtime, log logging.LeveledLogger, q *quotaHandler) turn.EventHandler {
+	return newEventHandler(name, rt, nil, log, q)
+}
+
+// newEventHandler creates a set of callbacks for tracking the lifecycle of TURN allocations that
+// records the user of each allocation in users.
+func newEventHandler(name string, rt *objruntime.Runtime, users *allocationUsers, log logging.LeveledLogger, q *quotaHandler) turn.EventHandler {
 	return turn.EventHandler{
 		OnAuth: func(src, dst net.Addr, proto, username, realm string, method string, verdict bool) {
 			status := "REJECTED"
 			if verdict {
 				status = "ACCEPTED"
+			} else {
+				// The auth handler accepted the user but MESSAGE-INTEGRITY did not match.
+				recordAuthFailure(rt, src, username)
 			}
 			log.Debugf("authentication request: client=%s, method=%s, verdict=%s",
 				dumpClient(src, dst, proto, username, realm), method, status)
@@ -161,10 +560,12 @@ func NewEventHandler(name string, rt *objruntime.Runtime, log logging.LeveledLog
 		OnAllocationCreated: func(src, dst net.Addr, proto, username, realm string, relayAddr net.Addr, reqPort int) {
 			log.Debugf("allocation created: client=%s, relay-address=%s, requested-port=%d",
 				dumpClient(src, dst, proto, username, realm), relayAddr.String(), reqPort)
+			users.add(src, relayAddr, username)
 			q.AllocationHandler(src, dst, proto, username, realm, AllocationCreated)
 		},
 		OnAllocationDeleted: func(src, dst net.Addr, proto, username, realm string) {
 			log.Debugf("allocation deleted: client=%s", dumpClient(src, dst, proto, username, realm))
+			users.remove(src)
 			q.AllocationHandler(src, dst, proto, username, realm, AllocationDeleted)
 		},
 		OnAllocationError: func(src, dst net.Addr, proto, message string) {
@@ -173,7 +574,8 @@ func NewEventHandler(name string, rt *objruntime.Runtime, log logging.LeveledLog
 		OnPermissionCreated: func(src, dst net.Addr, proto, username, realm string, relayAddr net.Addr, peer net.IP) {
 			cluster := ""
 			if conf, ok := rt.GetConfig(objruntime.TypeListener, name).(*stnrv1.ListenerConfig); ok && conf != nil {
-				if c, ok := router.RouteAny(rt, name, conf.Routes, peer); ok {
+				user, _ := users.lookup(src)
+				if c, ok := router.RouteAny(rt, name, conf.Routes, user, peer); ok {
 					cluster = c
 				}
 			}
@@ -191,13 +593,19 @@ func NewEventHandler(name string, rt *objruntime.Runtime, log logging.LeveledLog
 				return
 			}
 			if conf, ok := rt.GetConfig(objruntime.TypeListener, name).(*stnrv1.ListenerConfig); ok && conf != nil {
-				if c, ok := rt.Router.Route(name, conf.Routes, stnrv1.ClusterProtocolUDP, peerAddr.IP, 0); ok {
+				user, _ := users.lookup(src)
+				if c, ok := rt.Router.RouteUser(name, conf.Routes, user, stnrv1.ClusterProtocolUDP,
+					peerAddr.IP, peerAddr.Port); ok {
 					cluster = c
 				}
 			}
 			log.Debugf("channel created: listener=%s, cluster=%s, client=%s, relay-addr=%s, peer=%s, channel-num=%d",
 				name, cluster, dumpClient(src, dst, proto, username, realm),
 				relayAddr.String(), peer.String(), chanNum)
+			if cluster == "" {
+				// The relay path drops the traffic of the channel, so it must not be offloaded.
+				return
+			}
 			client := offload.Connection{RemoteAddr: src, LocalAddr: dst, Protocol: proto, ChannelID: uint32(chanNum)}
 			peerConn := offload.Connection{RemoteAddr: peer, LocalAddr: relayAddr, Protocol: proto}
 			if err := rt.OffloadEngine.Upsert(client, peerConn, name, cluster); err != nil {
@@ -0,0 +1,176 @@
+package turn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v5"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
+)
+
+const (
+	// transactionKeyTimeout is the time to keep the SHA-256 key of a transaction the TURN server
+	// did not respond to, about the duration of a STUN transaction over UDP.
+	transactionKeyTimeout = 40 * time.Second
+	// transactionKeySweepSize is the number of pending transactions above which the expired ones
+	// are removed.
+	transactionKeySweepSize = 1024
+)
+
+// checkIntegrity checks the integrity of a request with the password algorithms of RFC 8489 and
+// returns the request to pass on to the TURN server. It is a no-op unless SHA-256 is accepted.
+// Requests with a valid MESSAGE-INTEGRITY-SHA256, or with a valid MESSAGE-INTEGRITY and a NONCE
+// issued with the password algorithms, are re-signed with the MESSAGE-INTEGRITY the TURN server
+// verifies, and the SHA-256 key is remembered for signing the response. Other requests with an
+// invalid integrity or with a refused password algorithm are stripped of their integrity, so that
+// the TURN server challenges the client again.
+func (p *prober) checkIntegrity(raw []byte, src net.Addr) []byte {
+	auth, ok := authConfig(p.runtime)
+	if !ok || !auth.AcceptSHA256() {
+		return raw
+	}
+	msg := &stun.Message{Raw: append([]byte(nil), raw...)}
+	if msg.Decode() != nil {
+		return raw
+	}
+	sha256 := msg.Contains(a12n.AttrMessageIntegritySHA256)
+	if !sha256 && !msg.Contains(stun.AttrMessageIntegrity) {
+		return raw
+	}
+
+	if err := checkPasswordAlgorithm(msg, auth, sha256); err != nil {
+		p.log.Infof("auth request: client %s: %s", src, err)
+		return a12n.StripIntegrity(msg)
+	}
+	nonce := stun.Nonce{}
+	if !sha256 && (nonce.GetFrom(msg) != nil || !strings.HasPrefix(nonce.String(), a12n.NonceCookie)) {
+		// MESSAGE-INTEGRITY with a NONCE issued before SHA-256 was accepted.
+		return raw
+	}
+
+	username, realm := stun.Username{}, stun.Realm{}
+	if username.GetFrom(msg) != nil || realm.GetFrom(msg) != nil {
+		// Rejected by the TURN server.
+		return raw
+	}
+	if err := admitClient(p.runtime, src, username.String()); err != nil {
+		p.log.Infof("auth request: failed: client %s: %s", src, err)
+		return a12n.StripIntegrity(msg)
+	}
+	cred, ok := checkCredentials(p.runtime, auth, &turn.RequestAttributes{
+		Username: username.String(),
+		Realm:    realm.String(),
+		SrcAddr:  src,
+		Method:   msg.Type.Method,
+	}, p.log)
+	if !ok {
+		recordAuthFailure(p.runtime, src, username.String())
+		return a12n.StripIntegrity(msg)
+	}
+
+	var shaKey []byte
+	var err error
+	if sha256 {
+		if cred.password == "" {
+			p.log.Infof("auth request: failed: client %s: cannot check MESSAGE-INTEGRITY-SHA256: "+
+				"password unknown", src)
+			return a12n.StripIntegrity(msg)
+		}
+		shaKey = a12n.GenerateAuthKeySHA256(username.String(), auth.Realm, cred.password)
+		err = a12n.MessageIntegritySHA256(shaKey).Check(msg)
+	} else {
+		err = stun.MessageIntegrity(cred.key).Check(msg)
+	}
+	if err != nil {
+		p.log.Infof("auth request: failed: client %s: %s", src, err)
+		recordAuthFailure(p.runtime, src, username.String())
+		return a12n.StripIntegrity(msg)
+	}
+
+	resigned, err := a12n.ResignRequest(msg, cred.key)
+	if err != nil {
+		p.log.Warnf("auth request: client %s: cannot re-sign request: %s", src, err)
+		return a12n.StripIntegrity(msg)
+	}
+	if sha256 {
+		p.keys.add(src, msg.TransactionID, shaKey)
+	}
+	return resigned
+}
+
+// checkPasswordAlgorithm checks that the password algorithm of the integrity of a request is
+// accepted and, if the client has negotiated the password algorithm, that PASSWORD-ALGORITHMS
+// matches the advertised list and PASSWORD-ALGORITHM matches the integrity (RFC 8489, Section
+// 9.2.4).
+func checkPasswordAlgorithm(msg *stun.Message, auth *stnrv1.AuthConfig, sha256 bool) error {
+	algorithm := a12n.PasswordAlgorithmMD5
+	if sha256 {
+		algorithm = a12n.PasswordAlgorithmSHA256
+	}
+	if !sha256 && !auth.AcceptMD5() {
+		return fmt.Errorf("password algorithm %q refused", algorithm)
+	}
+
+	algorithms, selected := a12n.PasswordAlgorithms{}, a12n.PasswordAlgorithm("")
+	errAlgorithms, errSelected := algorithms.GetFrom(msg), selected.GetFrom(msg)
+	if errAlgorithms != nil && errSelected != nil {
+		return nil
+	}
+	if errAlgorithms != nil || errSelected != nil || !algorithms.Equal(auth.PasswordAlgorithms) ||
+		string(selected) != algorithm {
+		return errors.New("password algorithm negotiation failed")
+	}
+	return nil
+}
+
+// transactionKeys remembers the SHA-256 key of the requests checked with MESSAGE-INTEGRITY-SHA256
+// until the response is sent, for signing the response with the same password algorithm.
+type transactionKeys struct {
+	mu   sync.Mutex
+	keys map[string]transactionKey // client address and transaction ID -> key
+}
+
+type transactionKey struct {
+	key     []byte
+	expires time.Time
+}
+
+func (t *transactionKeys) add(src net.Addr, id [stun.TransactionIDSize]byte, key []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.keys == nil {
+		t.keys = map[string]transactionKey{}
+	}
+	if len(t.keys) >= transactionKeySweepSize {
+		for k, v := range t.keys {
+			if now.After(v.expires) {
+				delete(t.keys, k)
+			}
+		}
+	}
+	t.keys[src.String()+"|"+string(id[:])] = transactionKey{key: key, expires: now.Add(transactionKeyTimeout)}
+}
+
+// pop returns and forgets the SHA-256 key of a transaction, if any.
+func (t *transactionKeys) pop(dst net.Addr, id [stun.TransactionIDSize]byte) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.keys) == 0 {
+		return nil, false
+	}
+	k := dst.String() + "|" + string(id[:])
+	v, ok := t.keys[k]
+	if !ok {
+		return nil, false
+	}
+	delete(t.keys, k)
+	return v.key, true
+}
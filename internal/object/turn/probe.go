@@ -0,0 +1,334 @@
+package turn
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun/v3"
+
+	objruntime "github.com/l7mp/stunner/internal/runtime"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
+)
+
+const (
+	stunHeaderSize      = 20
+	stunMagicCookie     = 0x2112A442
+	stunCookieEnd       = 8
+	turnFrameHeaderSize = 4
+)
+
+// credentialProber is implemented by the Auth object to find the "ephemeral" secret generation a
+// request was issued with while the shared secret is being rotated and to extract "oauth" access
+// tokens. The auth handler sees only the username but not the message, so the raw requests are
+// probed on the listener sockets before they reach the TURN server. The prober returns the request
+// to pass on, which may be rewritten to remove attributes the TURN server does not understand.
+type credentialProber interface {
+	ProbeCredential(raw []byte, src net.Addr) []byte
+}
+
+// challengeAdvertiser is implemented by the Auth object to find the authorization server to
+// advertise in 401 challenges for STUN third-party authorization.
+type challengeAdvertiser interface {
+	ThirdPartyAuthorization() (string, bool)
+}
+
+// prober probes the requests received on the listener sockets of a TURN server and rewrites the
+// responses, to support the authentication features the TURN server does not implement: it
+// cannot add attributes to the challenges, and verifies and signs messages only with
+// MESSAGE-INTEGRITY.
+type prober struct {
+	runtime *objruntime.Runtime
+	keys    transactionKeys
+	log     logging.LeveledLogger
+}
+
+func newProber(rt *objruntime.Runtime, log logging.LeveledLogger) *prober {
+	return &prober{runtime: rt, log: log}
+}
+
+// probe passes STUN requests to the live Auth object for probing, checks the password algorithm
+// of the request and returns the request to pass on to the TURN server.
+func (p *prober) probe(raw []byte, src net.Addr) []byte {
+	// Skip ChannelData, indications and responses cheaply: only requests carry credentials.
+	if len(raw) < stunHeaderSize || raw[0]&0xc0 != 0 ||
+		binary.BigEndian.Uint32(raw[4:8]) != stunMagicCookie ||
+		binary.BigEndian.Uint16(raw[0:2])&0x0110 != 0 {
+		return raw
+	}
+	if o, ok := p.runtime.Registry.Get(objruntime.TypeAuth, stnrv1.DefaultAuthName); ok {
+		if c, ok := o.(credentialProber); ok {
+			raw = c.ProbeCredential(raw, src)
+		}
+	}
+	return p.checkIntegrity(raw, src)
+}
+
+// rewrite signs the responses to the requests checked with MESSAGE-INTEGRITY-SHA256 with the same
+// algorithm and adds the PASSWORD-ALGORITHMS and THIRD-PARTY-AUTHORIZATION attributes to the
+// challenges, if configured. Other messages are returned unchanged.
+func (p *prober) rewrite(raw []byte, dst net.Addr) []byte {
+	// Skip everything but responses cheaply.
+	if len(raw) < stunHeaderSize || raw[0]&0xc0 != 0 ||
+		binary.BigEndian.Uint32(raw[4:8]) != stunMagicCookie ||
+		binary.BigEndian.Uint16(raw[0:2])&0x0100 == 0 {
+		return raw
+	}
+	var id [stun.TransactionIDSize]byte
+	copy(id[:], raw[8:stunHeaderSize])
+	if key, ok := p.keys.pop(dst, id); ok {
+		signed, err := a12n.SignResponseSHA256(raw, key)
+		if err != nil {
+			p.log.Warnf("cannot sign response to client %s with MESSAGE-INTEGRITY-SHA256: %s", dst, err)
+			return raw
+		}
+		return signed
+	}
+	if binary.BigEndian.Uint16(raw[0:2])&0x0110 != 0x0110 {
+		return raw
+	}
+	return p.rewriteChallenge(raw)
+}
+
+// rewriteChallenge adds the PASSWORD-ALGORITHMS attribute and the matching NONCE to 401 and 438
+// error responses if SHA-256 is accepted, and the THIRD-PARTY-AUTHORIZATION attribute to 401 error
+// responses if configured.
+func (p *prober) rewriteChallenge(raw []byte) []byte {
+	msg := &stun.Message{Raw: append([]byte(nil), raw...)}
+	code := stun.ErrorCodeAttribute{}
+	if msg.Decode() != nil || code.GetFrom(msg) != nil ||
+		(code.Code != stun.CodeUnauthorized && code.Code != stun.CodeStaleNonce) ||
+		msg.Contains(stun.AttrMessageIntegrity) || msg.Contains(stun.AttrFingerprint) {
+		return raw
+	}
+
+	if auth, ok := authConfig(p.runtime); ok && auth.AcceptSHA256() &&
+		!msg.Contains(stun.AttrPasswordAlgorithms) {
+		advertised, err := a12n.AdvertisePasswordAlgorithms(msg.Raw, auth.PasswordAlgorithms)
+		if err != nil {
+			p.log.Warnf("cannot advertise password algorithms: %s", err)
+			return raw
+		}
+		msg = &stun.Message{Raw: advertised}
+		if msg.Decode() != nil {
+			return raw
+		}
+	}
+
+	if code.Code == stun.CodeUnauthorized && !msg.Contains(a12n.AttrThirdPartyAuthorization) {
+		if o, ok := p.runtime.Registry.Get(objruntime.TypeAuth, stnrv1.DefaultAuthName); ok {
+			if c, ok := o.(challengeAdvertiser); ok {
+				if server, ok := c.ThirdPartyAuthorization(); ok {
+					msg.Add(a12n.AttrThirdPartyAuthorization, []byte(server))
+				}
+			}
+		}
+	}
+	return msg.Raw
+}
+
+// probePacketConn is a net.PacketConn that probes the credentials of the received requests.
+type probePacketConn struct {
+	net.PacketConn
+	prober *prober
+}
+
+func newProbePacketConn(c net.PacketConn, p *prober) net.PacketConn {
+	return &probePacketConn{PacketConn: c, prober: p}
+}
+
+func (c *probePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		// Rewritten requests are always shorter than the original.
+		if msg := c.prober.probe(p[:n], addr); len(msg) != n {
+			n = copy(p, msg)
+		}
+	}
+	return n, addr, err
+}
+
+func (c *probePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if _, err := c.PacketConn.WriteTo(c.prober.rewrite(p, addr), addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// probeListener is a net.Listener whose connections probe the credentials of the received
+// requests.
+type probeListener struct {
+	net.Listener
+	prober *prober
+}
+
+func newProbeListener(l net.Listener, p *prober) net.Listener {
+	return &probeListener{Listener: l, prober: p}
+}
+
+func (l *probeListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &probeConn{Conn: conn, prober: l.prober}, nil
+}
+
+// probeConn is a stream connection that reassembles STUN requests from the TURN framing used on
+// connection-oriented transports (RFC 8656, Section 12.5) and probes their credentials. Since
+// requests may be rewritten, STUN messages are passed on only once complete, ChannelData is passed
+// on as it arrives. Once a ConnectionBind succeeds the connection carries the raw data of an RFC 6062
+// peer connection, which is passed through untouched in both directions.
+type probeConn struct {
+	net.Conn
+	prober *prober
+	bound  atomic.Bool // ConnectionBind succeeded
+
+	// The TURN server may read from multiple goroutines after a ConnectionBind.
+	mu     sync.Mutex
+	framer turnFramer
+	buf    []byte // read buffer
+	out    []byte // data to be returned by Read
+	err    error  // read error to be returned once out is drained
+}
+
+func (c *probeConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for len(c.out) == 0 {
+		if c.err != nil {
+			c.mu.Unlock()
+			return 0, c.err
+		}
+		if c.bound.Load() {
+			c.mu.Unlock()
+			return c.Conn.Read(b)
+		}
+		if c.buf == nil {
+			c.buf = make([]byte, len(b))
+		}
+		n, err := c.Conn.Read(c.buf)
+		if n > 0 {
+			if c.bound.Load() {
+				// The ConnectionBind response was written while reading: the client sends
+				// only data from now on.
+				c.framer.raw = true
+			}
+			c.framer.feed(c.buf[:n], func(data []byte) {
+				c.out = append(c.out, data...)
+			}, func(msg []byte) {
+				c.out = append(c.out, c.prober.probe(msg, c.RemoteAddr())...)
+			})
+		}
+		c.err = err
+	}
+	n := copy(b, c.out)
+	c.out = c.out[n:]
+	c.mu.Unlock()
+	return n, nil
+}
+
+// Write rewrites responses, assuming that the TURN server writes each message with a single call.
+func (c *probeConn) Write(b []byte) (int, error) {
+	if c.bound.Load() {
+		return c.Conn.Write(b)
+	}
+	if isConnectionBindSuccess(b) {
+		// Switch to pass-through before the client may start sending data.
+		c.bound.Store(true)
+	}
+	if _, err := c.Conn.Write(c.prober.rewrite(b, c.RemoteAddr())); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// isConnectionBindSuccess returns true if a message is a ConnectionBind success response.
+func isConnectionBindSuccess(b []byte) bool {
+	return len(b) >= stunHeaderSize && binary.BigEndian.Uint32(b[4:8]) == stunMagicCookie &&
+		stun.MessageType{Method: stun.MethodConnectionBind, Class: stun.ClassSuccessResponse}.Value() ==
+			binary.BigEndian.Uint16(b[0:2])
+}
+
+// turnFramer splits a TURN byte stream into frames. STUN messages are collected and passed to a
+// callback, ChannelData frames are passed to another callback in chunks as they arrive. Once the
+// stream is found not to carry TURN frames, everything is passed to the data callback as is.
+type turnFramer struct {
+	buf  []byte // partial frame header or STUN message
+	skip int    // bytes of the current ChannelData frame still to pass through
+	raw  bool   // not a TURN stream
+}
+
+func (f *turnFramer) feed(b []byte, onData, onMessage func([]byte)) {
+	for len(b) > 0 {
+		if f.raw {
+			if len(f.buf) > 0 {
+				onData(f.buf)
+				f.buf = f.buf[:0]
+			}
+			onData(b)
+			return
+		}
+
+		if f.skip > 0 {
+			n := min(f.skip, len(b))
+			onData(b[:n])
+			f.skip -= n
+			b = b[n:]
+			continue
+		}
+
+		if len(f.buf) < turnFrameHeaderSize {
+			n := min(turnFrameHeaderSize-len(f.buf), len(b))
+			f.buf = append(f.buf, b[:n]...)
+			b = b[n:]
+			if len(f.buf) < turnFrameHeaderSize {
+				return
+			}
+		}
+
+		// Both STUN messages and ChannelData frames carry the length in the 3rd-4th byte.
+		length := int(binary.BigEndian.Uint16(f.buf[2:4]))
+		if f.buf[0]&0xc0 == 0x40 {
+			// ChannelData is padded to a multiple of 4 bytes on streams.
+			onData(f.buf)
+			f.skip = (length + 3) &^ 3
+			f.buf = f.buf[:0]
+			continue
+		}
+		if f.buf[0]&0xc0 != 0 {
+			f.raw = true
+			continue
+		}
+
+		// Check the magic cookie before buffering a STUN message.
+		if len(f.buf) < stunCookieEnd {
+			n := min(stunCookieEnd-len(f.buf), len(b))
+			f.buf = append(f.buf, b[:n]...)
+			b = b[n:]
+			if len(f.buf) < stunCookieEnd {
+				return
+			}
+		}
+		if binary.BigEndian.Uint32(f.buf[4:stunCookieEnd]) != stunMagicCookie {
+			f.raw = true
+			continue
+		}
+
+		need := stunHeaderSize + length - len(f.buf)
+		n := min(need, len(b))
+		f.buf = append(f.buf, b[:n]...)
+		b = b[n:]
+		if n < need {
+			return
+		}
+		onMessage(f.buf)
+		f.buf = f.buf[:0]
+	}
+	if f.raw && len(f.buf) > 0 {
+		onData(f.buf)
+		f.buf = f.buf[:0]
+	}
+}
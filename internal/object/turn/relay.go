@@ -1,14 +1,14 @@
 package turn
 
 import (
-	"fmt"
 	"net"
+	"sync/atomic"
 
 	"github.com/pion/turn/v5"
 
 	"github.com/l7mp/stunner/internal/netutil"
+	"github.com/l7mp/stunner/internal/publicip"
 	objruntime "github.com/l7mp/stunner/internal/runtime"
-	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 )
 
 // Relay adapts the dataplane relay transport to the pion RelayAddressGenerator interface for one
@@ -17,43 +17,144 @@ import (
 type Relay struct {
 	listener string
 	runtime  *objruntime.Runtime
-	// relayIP is the address advertised to the client for relayed transport addresses.
+	// relayIP is the address relay sockets are bound to, unless it is the unspecified address.
+	// Advertised to the client for relayed transport addresses unless the listener has a relay
+	// address set.
 	relayIP net.IP
+	// pool allocates the relay ports from the relay port range of the listener, if any.
+	pool *netutil.PortPool
+	// advertised lists the fixed relay addresses advertised in a round-robin fashion, next is
+	// the index of the next one.
+	advertised []net.IP
+	next       atomic.Uint64
+	// discoverer discovers the public IP advertised with relay address "auto".
+	discoverer *publicip.Discoverer
+	// users records the users of the allocations, routed to per relayed packet.
+	users *allocationUsers
 }
 
-// NewRelay creates a relay address generator for a listener context.
-func NewRelay(listener string, rt *objruntime.Runtime) *Relay {
-	conf := rt.GetConfig(objruntime.TypeListener, listener).(*stnrv1.ListenerConfig)
-	ip := net.ParseIP(conf.Addr)
-	if ip == nil && conf.Addr == "localhost" {
-		ip = net.ParseIP("127.0.0.1")
+// NewRelay creates a relay address generator for a listener context with the resolved address of
+// the listener.
+func NewRelay(listener string, rt *objruntime.Runtime, relayIP net.IP) *Relay {
+	return &Relay{listener: listener, runtime: rt, relayIP: relayIP}
+}
+
+// setPortRange restricts the relay ports to a port range.
+func (r *Relay) setPortRange(minPort, maxPort int) {
+	r.pool = netutil.NewPortPool(r.listener, minPort, maxPort, r.runtime.Telemetry)
+}
+
+// setUsers takes the users of the allocations from users.
+func (r *Relay) setUsers(users *allocationUsers) {
+	r.users = users
+}
+
+// setRelayAddrs advertises a list of fixed relay addresses in a round-robin fashion.
+func (r *Relay) setRelayAddrs(ips []net.IP) {
+	r.advertised = ips
+}
+
+// setDiscoverer advertises the public IP found by a discoverer. Until the public IP is
+// discovered the relay IP is advertised.
+func (r *Relay) setDiscoverer(d *publicip.Discoverer) {
+	r.discoverer = d
+}
+
+// RelayAddrs returns the relay addresses currently advertised and the error of the last public IP
+// discovery, if any.
+func (r *Relay) RelayAddrs() ([]string, string) {
+	if r.discoverer != nil {
+		if ip := r.discoverer.IP(); ip != nil {
+			return []string{ip.String()}, r.discoverer.Error()
+		}
+		return nil, r.discoverer.Error()
+	}
+	ret := make([]string, 0, len(r.advertised))
+	for _, ip := range r.advertised {
+		ret = append(ret, ip.String())
+	}
+	return ret, ""
+}
+
+// Close stops the public IP discovery and releases the relay port range of the listener.
+func (r *Relay) Close() {
+	if r.discoverer != nil {
+		r.discoverer.Close()
+	}
+	if r.pool != nil {
+		r.pool.Close()
+	}
+}
+
+// advertise rewrites the IP of a relayed transport address to the relay address of the listener,
+// if any.
+func (r *Relay) advertise(addr net.Addr) net.Addr {
+	var ip net.IP
+	switch {
+	case r.discoverer != nil:
+		ip = r.discoverer.IP()
+	case len(r.advertised) > 0:
+		ip = r.advertised[(r.next.Add(1)-1)%uint64(len(r.advertised))]
 	}
 	if ip == nil {
-		panic(fmt.Sprintf("turn: invalid listener address for %q: %s", listener, conf.Addr))
+		return addr
 	}
-	return &Relay{listener: listener, runtime: rt, relayIP: ip}
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return &net.UDPAddr{IP: ip, Port: a.Port}
+	case *net.TCPAddr:
+		return &net.TCPAddr{IP: ip, Port: a.Port}
+	}
+	return addr
+}
+
+// bound rewrites the IP of a relayed transport address advertised to the client to the address
+// the relay sockets are bound to.
+func (r *Relay) bound(addr net.Addr) net.Addr {
+	if a, ok := addr.(*net.TCPAddr); ok && (r.discoverer != nil || len(r.advertised) > 0) {
+		return &net.TCPAddr{IP: r.relayIP, Port: a.Port}
+	}
+	return addr
 }
 
 // Validate is called on server startup and confirms the RelayAddressGenerator is configured.
 func (r *Relay) Validate() error { return nil }
 
-// AllocatePacketConn allocates the UDP relayed transport address of an allocation.
+// AllocatePacketConn allocates the UDP relayed transport address of an allocation. The user of the
+// allocation is looked up by the advertised relayed transport address, which the TURN server
+// reports when the allocation is created.
 func (r *Relay) AllocatePacketConn(conf turn.AllocateListenerConfig) (net.PacketConn, net.Addr, error) {
-	return netutil.NewRelayPacketConn(r.runtime, r.listener, r.relayIP, conf.Network, conf.RequestedPort)
+	var key string // set before the allocation is created
+	user := func() objruntime.User { return r.users.relayUser(key) }
+	conn, addr, err := netutil.NewRelayPacketConn(r.runtime, r.listener, user, r.relayIP, r.pool, conf.Network, conf.RequestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	relayAddr := r.advertise(addr)
+	key = relayKey(relayAddr)
+	return conn, relayAddr, nil
 }
 
 // AllocateConn opens an outgoing connection for an RFC 6062 Connect request, sourced from the
 // allocation's relayed transport address.
 func (r *Relay) AllocateConn(conf turn.AllocateConnConfig) (net.Conn, error) {
-	return netutil.Dial(r.runtime, r.listener, conf.LocalAddr, conf.RemoteAddr)
+	return netutil.Dial(r.runtime, r.listener, r.users.relayUser(relayKey(conf.LocalAddr)), r.bound(conf.LocalAddr), conf.RemoteAddr)
 }
 
 // AllocateListener binds the relayed transport address of an RFC 6062 TCP allocation, admitting
-// incoming connections at accept time. It fails early if the listener routes to no cluster of the
+// incoming connections at accept time for the user of the allocation, as in AllocatePacketConn. It fails early if the listener routes to no cluster of the
 // requested protocol.
 func (r *Relay) AllocateListener(conf turn.AllocateListenerConfig) (net.Listener, net.Addr, error) {
 	if !netutil.HasRoutedCluster(r.runtime, r.listener, netutil.ProtocolFromNetwork(conf.Network)) {
 		return nil, nil, netutil.ErrPortProhibited
 	}
-	return netutil.NewRelayListener(r.runtime, r.listener, r.relayIP, conf.Network, conf.RequestedPort)
+	var key string // set before the allocation is created
+	user := func() objruntime.User { return r.users.relayUser(key) }
+	l, addr, err := netutil.NewRelayListener(r.runtime, r.listener, user, r.relayIP, r.pool, conf.Network, conf.RequestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	relayAddr := r.advertise(addr)
+	key = relayKey(relayAddr)
+	return l, relayAddr, nil
 }
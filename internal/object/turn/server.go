@@ -6,12 +6,14 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pion/dtls/v3"
 	"github.com/pion/logging"
 	"github.com/pion/turn/v5"
 
 	"github.com/l7mp/stunner/internal/netutil"
+	"github.com/l7mp/stunner/internal/publicip"
 	objruntime "github.com/l7mp/stunner/internal/runtime"
 	"github.com/l7mp/stunner/internal/telemetry"
 	"github.com/l7mp/stunner/internal/util"
@@ -25,6 +27,9 @@ type Server struct {
 	listener string
 	name     string
 	proto    stnrv1.ListenerProtocol
+	relay    *Relay
+	ids      *ClientIdentities // TURN identities from client certificates
+	users    *allocationUsers  // users of the allocations
 	Conns    []any
 	log      logging.LeveledLogger
 }
@@ -43,6 +48,8 @@ func NewServer(listener string, rt *objruntime.Runtime) (*Server, error) {
 		listener: listener,
 		name:     listener,
 		proto:    proto,
+		ids:      &ClientIdentities{},
+		users:    newAllocationUsers(),
 		log:      log,
 	}
 	s.log.Debugf("TURN server %s (re)starting", s.name)
@@ -50,14 +57,18 @@ func NewServer(listener string, rt *objruntime.Runtime) (*Server, error) {
 	var pConns []turn.PacketConnConfig
 	var lConns []turn.ListenerConfig
 
-	permissionHandler := NewPermissionHandler(listener, rt, log)
-	relay := NewRelay(listener, rt)
-	// Empty host is the unspecified address: on dual-stack hosts (Linux default
-	// with net.ipv6.bindv6only=0) ":port" binds a single socket reachable via
-	// both IPv4 and IPv6, while on single-family hosts it binds the available
-	// family. Hardcoding "0.0.0.0" would be IPv4-only and fail on IPv6-only
-	// clusters.
-	addr := net.JoinHostPort("", strconv.Itoa(conf.Port))
+	// The listener binds the address or the interface of the listener, or all addresses
+	// (dual-stack) if the address is unspecified. Relay sockets are bound to the same address.
+	ip, err := netutil.ListenerIP(rt.Net, conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	permissionHandler := newPermissionHandler(listener, rt, s.users, log)
+	probe := newProber(rt, log)
+	relay := NewRelay(listener, rt, ip)
+	relay.setUsers(s.users)
+	s.relay = relay
+	addr := net.JoinHostPort(netutil.BindHost(ip), strconv.Itoa(conf.Port))
 
 	switch s.proto {
 	case stnrv1.ListenerProtocolTURNUDP:
@@ -70,7 +81,7 @@ func NewServer(listener string, rt *objruntime.Runtime) (*Server, error) {
 		}
 		for _, c := range conns {
 			conn := turn.PacketConnConfig{
-				PacketConn:            c,
+				PacketConn:            newProbePacketConn(c, probe),
 				RelayAddressGenerator: relay,
 				PermissionHandler:     permissionHandler,
 			}
@@ -86,6 +97,7 @@ func NewServer(listener string, rt *objruntime.Runtime) (*Server, error) {
 		}
 		tcpListener = netutil.NewListener(tcpListener, s.name, telemetry.ListenerType,
 			rt.Telemetry, nil, nil)
+		tcpListener = newProbeListener(tcpListener, probe)
 		conn := turn.ListenerConfig{
 			Listener:              tcpListener,
 			RelayAddressGenerator: relay,
@@ -96,19 +108,33 @@ func NewServer(listener string, rt *objruntime.Runtime) (*Server, error) {
 
 	case stnrv1.ListenerProtocolTURNTLS:
 		s.log.Debugf("setting up TLS/TCP listener at %s", addr)
-		cer, err := tls.X509KeyPair([]byte(conf.Cert), []byte(conf.Key))
+		certs, err := lookupCertStore(rt, listener)
 		if err != nil {
 			return nil, fmt.Errorf("cannot load cert/key pair for creating TLS listener at %s: %s", addr, err)
 		}
-		tlsListener, err := tls.Listen("tcp", addr, &tls.Config{
-			MinVersion:   tls.VersionTLS12,
-			Certificates: []tls.Certificate{cer},
-		})
+		tlsConf := &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+		if conf.ClientAuth != nil {
+			// Chains are verified against the CA of the certificate store, so that the CA
+			// can be rotated in place.
+			tlsConf.ClientAuth = tls.RequireAnyClientCert
+			if conf.ClientAuth.Mode == "optional" {
+				tlsConf.ClientAuth = tls.RequestClientCert
+			}
+			tlsConf.VerifyPeerCertificate = certs.VerifyPeerCertificate
+		}
+		tlsListener, err := tls.Listen("tcp", addr, tlsConf)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create TLS listener at %s: %s", addr, err)
 		}
+		if conf.ClientAuth != nil {
+			tlsListener = newClientAuthListener(tlsListener, certs, s.ids)
+		}
 		tlsListener = netutil.NewListener(tlsListener, s.name, telemetry.ListenerType,
 			rt.Telemetry, nil, nil)
+		tlsListener = newProbeListener(tlsListener, probe)
 		conn := turn.ListenerConfig{
 			Listener:              tlsListener,
 			RelayAddressGenerator: relay,
@@ -119,7 +145,7 @@ func NewServer(listener string, rt *objruntime.Runtime) (*Server, error) {
 
 	case stnrv1.ListenerProtocolTURNDTLS:
 		s.log.Debugf("setting up DTLS/UDP listener at %s", addr)
-		cer, err := tls.X509KeyPair([]byte(conf.Cert), []byte(conf.Key))
+		certs, err := lookupCertStore(rt, listener)
 		if err != nil {
 			return nil, fmt.Errorf("cannot load cert/key pair for creating DTLS listener at %s: %s", addr, err)
 		}
@@ -127,12 +153,25 @@ func NewServer(listener string, rt *objruntime.Runtime) (*Server, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse DTLS listener address %s: %s", addr, err)
 		}
-		dtlsListener, err := dtls.ListenWithOptions("udp", udpAddr, dtls.WithCertificates(cer))
+		opts := []dtls.ServerOption{dtls.WithGetCertificate(certs.GetDTLSCertificate)}
+		if conf.ClientAuth != nil {
+			clientAuth := dtls.RequireAnyClientCert
+			if conf.ClientAuth.Mode == "optional" {
+				clientAuth = dtls.RequestClientCert
+			}
+			opts = append(opts, dtls.WithClientAuth(clientAuth),
+				dtls.WithVerifyPeerCertificate(certs.VerifyPeerCertificate))
+		}
+		dtlsListener, err := dtls.ListenWithOptions("udp", udpAddr, opts...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create DTLS listener at %s: %s", addr, err)
 		}
+		if conf.ClientAuth != nil {
+			dtlsListener = newClientAuthListener(dtlsListener, certs, s.ids)
+		}
 		dtlsListener = netutil.NewListener(dtlsListener, s.name, telemetry.ListenerType,
 			rt.Telemetry, nil, nil)
+		dtlsListener = newProbeListener(dtlsListener, probe)
 		conn := turn.ListenerConfig{
 			Listener:              dtlsListener,
 			RelayAddressGenerator: relay,
@@ -145,18 +184,33 @@ func NewServer(listener string, rt *objruntime.Runtime) (*Server, error) {
 		return nil, fmt.Errorf("internal error: unknown listener protocol %q", s.proto.String())
 	}
 
+	if conf.MaxRelayPort != 0 {
+		relay.setPortRange(conf.MinRelayPort, conf.MaxRelayPort)
+	}
+	if conf.RelayAddr == stnrv1.RelayAddrAuto {
+		// Validated by ListenerConfig.Validate.
+		interval, _ := time.ParseDuration(conf.RelayAddrDiscoveryInterval)
+		d := publicip.New(conf.RelayAddrDiscoveryServer, interval, netutil.BindHost(ip), rt.Net,
+			rt.Logger.NewLogger(fmt.Sprintf("public-ip-%s", listener)))
+		d.Start()
+		relay.setDiscoverer(d)
+	} else if ips, err := conf.RelayAddrs(); err == nil && len(ips) > 0 {
+		relay.setRelayAddrs(ips)
+	}
+
 	q := NewQuotaHandler(rt)
 	auth := rt.GetConfig(objruntime.TypeAuth, "").(*stnrv1.AuthConfig)
 	server, err := turn.NewServer(turn.ServerConfig{
 		Realm:             auth.Realm,
-		AuthHandler:       NewAuthHandler(rt, log),
-		EventHandler:      NewEventHandler(listener, rt, log, q),
+		AuthHandler:       newAuthHandler(rt, s.ids, s.users, log),
+		EventHandler:      newEventHandler(listener, rt, s.users, log, q),
 		QuotaHandler:      q.QuotaHandler(),
 		PacketConnConfigs: pConns,
 		ListenerConfigs:   lConns,
 		LoggerFactory:     rt.Logger,
 	})
 	if err != nil {
+		relay.Close()
 		return nil, fmt.Errorf("cannot set up TURN server for listener %s: %w", listener, err)
 	}
 	s.Server = server
@@ -167,6 +221,21 @@ func NewServer(listener string, rt *objruntime.Runtime) (*Server, error) {
 // Start is a no-op because the TURN server is fully initialized by NewServer.
 func (s *Server) Start() error { return nil }
 
+// ClientUser returns the user ID of the allocation of a client, if any.
+func (s *Server) ClientUser(src net.Addr) (string, bool) {
+	user, ok := s.users.lookup(src)
+	return user.ID, ok
+}
+
+// RelayAddrs returns the relay addresses currently advertised and the error of the last public IP
+// discovery, if any.
+func (s *Server) RelayAddrs() ([]string, string) {
+	if s.relay == nil {
+		return nil, ""
+	}
+	return s.relay.RelayAddrs()
+}
+
 // Close shuts down the TURN server and its underlying transport listeners.
 func (s *Server) Close() error {
 	conf := s.runtime.GetConfig(objruntime.TypeListener, s.listener).(*stnrv1.ListenerConfig)
@@ -195,5 +264,9 @@ func (s *Server) Close() error {
 		}
 	}
 	s.Conns = []any{}
+	if s.relay != nil {
+		s.relay.Close()
+		s.relay = nil
+	}
 	return nil
 }
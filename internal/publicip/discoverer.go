@@ -0,0 +1,171 @@
+// Package publicip implements the discovery of the public IP of STUNner. A Discoverer
+// periodically sends a STUN Binding request to an external STUN server and tracks the
+// server-reflexive address it reports.
+package publicip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun/v3"
+	"github.com/pion/transport/v4"
+)
+
+// maxTimeout caps the time a discovery waits for the response of the STUN server.
+const maxTimeout = 5 * time.Second
+
+// Discoverer discovers the public IP in the background.
+type Discoverer struct {
+	server   string
+	interval time.Duration
+	bindHost string
+	net      transport.Net
+
+	lock    sync.RWMutex
+	ip      net.IP
+	lastErr string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	log    logging.LeveledLogger
+}
+
+// New creates a public IP discoverer that queries the STUN server at server ("host:port") every
+// interval from a socket bound to bindHost.
+func New(server string, interval time.Duration, bindHost string, net transport.Net, log logging.LeveledLogger) *Discoverer {
+	d := &Discoverer{
+		server:   server,
+		interval: interval,
+		bindHost: bindHost,
+		net:      net,
+		done:     make(chan struct{}),
+		log:      log,
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	return d
+}
+
+// Start starts the discovery in the background.
+func (d *Discoverer) Start() {
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			d.update(d.discover())
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the discoverer and waits for the running discovery to finish.
+func (d *Discoverer) Close() {
+	d.cancel()
+	<-d.done
+}
+
+// IP returns the last discovered public IP, or nil if the public IP is not yet discovered. The
+// last discovered IP is kept when a later discovery fails.
+func (d *Discoverer) IP() net.IP {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.ip
+}
+
+// Error returns the error of the last discovery, if any.
+func (d *Discoverer) Error() string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.lastErr
+}
+
+// update records the result of a discovery.
+func (d *Discoverer) update(ip net.IP, err error) {
+	if d.ctx.Err() != nil {
+		return
+	}
+
+	d.lock.Lock()
+	if err != nil {
+		d.lastErr = err.Error()
+		d.lock.Unlock()
+		d.log.Warnf("public IP discovery via %s failed: %s", d.server, err.Error())
+		return
+	}
+	changed := !ip.Equal(d.ip)
+	d.ip, d.lastErr = ip, ""
+	d.lock.Unlock()
+
+	if changed {
+		d.log.Infof("public IP discovered via %s: %s", d.server, ip.String())
+	}
+}
+
+// discover sends a STUN Binding request to the STUN server and returns the server-reflexive
+// address from the response.
+func (d *Discoverer) discover() (net.IP, error) {
+	server, err := d.net.ResolveUDPAddr("udp", d.server)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if server.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := d.net.ListenPacket(network, net.JoinHostPort(d.bindHost, "0"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	timeout := min(d.interval, maxTimeout)
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(req.Raw, server); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, fmt.Errorf("no response from STUN server %s", d.server)
+			}
+			return nil, err
+		}
+
+		res := &stun.Message{Raw: buf[:n]}
+		if res.Decode() != nil || res.TransactionID != req.TransactionID {
+			continue
+		}
+		if res.Type != stun.BindingSuccess {
+			return nil, fmt.Errorf("unexpected response from STUN server %s: %s", d.server, res.Type)
+		}
+		var xorAddr stun.XORMappedAddress
+		if err := xorAddr.GetFrom(res); err == nil {
+			return xorAddr.IP, nil
+		}
+		var addr stun.MappedAddress
+		if err := addr.GetFrom(res); err != nil {
+			return nil, fmt.Errorf("no mapped address in response from STUN server %s", d.server)
+		}
+		return addr.IP, nil
+	}
+}
@@ -0,0 +1,68 @@
+package publicip
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/transport/v4/stdnet"
+	"github.com/stretchr/testify/require"
+
+	"github.com/l7mp/stunner/pkg/logger"
+)
+
+// stunServer answers STUN Binding requests with a fixed mapped address while up is set.
+func stunServer(t *testing.T, mapped net.IP, up *atomic.Bool) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+			if req.Decode() != nil || !up.Load() {
+				continue
+			}
+			res, err := stun.Build(req, stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: mapped, Port: addr.(*net.UDPAddr).Port})
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(res.Raw, addr) //nolint:errcheck
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDiscoverer(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	server := stunServer(t, net.ParseIP("1.2.3.4"), &up)
+
+	n, err := stdnet.NewNet()
+	require.NoError(t, err)
+	d := New(server, 50*time.Millisecond, "127.0.0.1", n,
+		logger.NewLoggerFactory("all:ERROR").NewLogger("public-ip"))
+	d.Start()
+	defer d.Close()
+
+	require.Eventually(t, func() bool { return d.IP().Equal(net.ParseIP("1.2.3.4")) },
+		2*time.Second, 10*time.Millisecond)
+	require.Empty(t, d.Error())
+
+	// The last discovered IP is kept when the STUN server fails.
+	up.Store(false)
+	require.Eventually(t, func() bool { return d.Error() != "" }, 2*time.Second, 10*time.Millisecond)
+	require.True(t, d.IP().Equal(net.ParseIP("1.2.3.4")))
+
+	up.Store(true)
+	require.Eventually(t, func() bool { return d.Error() == "" }, 2*time.Second, 10*time.Millisecond)
+}
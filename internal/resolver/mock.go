@@ -6,6 +6,8 @@ import (
 	"strings"
 
 	"github.com/pion/logging"
+
+	"github.com/l7mp/stunner/internal/util"
 )
 
 // for testing
@@ -37,14 +39,14 @@ func (m *MockResolver) Close() {
 }
 
 // Register mocks the DNS resolver's Register method
-func (m *MockResolver) Register(domain string) error {
-	m.log.Tracef("register (mock): %q", domain)
+func (m *MockResolver) Register(domain, owner string, _ func()) error {
+	m.log.Tracef("register (mock): %q, owner %q", domain, owner)
 	return nil
 }
 
 // Unregister mocks the Unregister method
-func (m *MockResolver) Unregister(domain string) {
-	m.log.Tracef("unregister (mock): %q", domain)
+func (m *MockResolver) Unregister(domain, owner string) {
+	m.log.Tracef("unregister (mock): %q, owner %q", domain, owner)
 }
 
 // Lookup returns the hostname(s) for a domain
@@ -56,7 +58,9 @@ func (m *MockResolver) Lookup(domain string) ([]net.IP, error) {
 			if e, found := m.Zone[domain]; found {
 				ret := []net.IP{}
 				for _, i := range e {
-					ret = append(ret, net.ParseIP(i))
+					if ep, err := util.ParseEndpoint(i); err == nil {
+						ret = append(ret, ep.IP())
+					}
 				}
 				return ret, nil
 			}
@@ -65,3 +69,24 @@ func (m *MockResolver) Lookup(domain string) ([]net.IP, error) {
 
 	return []net.IP{}, fmt.Errorf("host %q not found: 3(NXDOMAIN)", domain)
 }
+
+// LookupEndpoints returns the endpoints for a domain. Zone entries may carry port ranges in the
+// static cluster endpoint syntax, e.g., "1.2.3.4:<5000-5000>".
+func (m *MockResolver) LookupEndpoints(domain string) ([]*util.Endpoint, error) {
+	m.log.Tracef("lookup endpoints for domain in mock DNS: %q", domain)
+
+	e, found := m.Zone[domain]
+	if !found {
+		return []*util.Endpoint{}, fmt.Errorf("host %q not found: 3(NXDOMAIN)", domain)
+	}
+
+	ret := []*util.Endpoint{}
+	for _, i := range e {
+		ep, err := util.ParseEndpoint(i)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, ep)
+	}
+	return ret, nil
+}
@@ -27,7 +27,7 @@ func TestMockResolver(t *testing.T) {
 	mockDns.Start()
 
 	// should never err
-	err := mockDns.Register("dummy")
+	err := mockDns.Register("dummy", "test", nil)
 	assert.NoError(t, err, "register")
 
 	ip, err := mockDns.Lookup("stunner.l7mp.io")
@@ -51,7 +51,7 @@ func TestMockResolver(t *testing.T) {
 	assert.Len(t, ip, 0, "nonexistent ip")
 
 	// should never err
-	mockDns.Unregister("dummy")
+	mockDns.Unregister("dummy", "test")
 
 	// should never err
 	mockDns.Close()
@@ -2,24 +2,65 @@ package resolver
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pion/logging"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/l7mp/stunner/internal/util"
 )
 
 // STRICT_DNS clusters embed a DnsResolver to resolve domain names in the background
 
 const (
+	// dnsUpdateInterval is the refresh interval when the TTL of a domain is not known, e.g., when
+	// the domain is resolved from the hosts file, or after a transient resolution failure.
 	dnsUpdateInterval = 5 * time.Second
+	// dnsTimeout bounds a single resolution round.
+	dnsTimeout = 5 * time.Second
+
+	// DefaultMinTTL is the default floor of the refresh interval of a domain.
+	DefaultMinTTL = time.Second
+	// DefaultMaxTTL is the default cap of the refresh interval of a domain.
+	DefaultMaxTTL = 5 * time.Minute
+	// DefaultNegativeTTL is the default refresh interval of a domain that was found not to
+	// exist, if the DNS response carries no SOA record to derive the negative TTL from.
+	DefaultNegativeTTL = 5 * time.Second
 )
 
+// Config configures the DNS resolver. The zero value selects the defaults.
+type Config struct {
+	// Nameserver is the address of a custom DNS server in the form "host" or "host:port".
+	// Default is to use the nameservers of the system resolver configuration.
+	Nameserver string
+	// MinTTL is the floor of the refresh interval of a domain. Default is DefaultMinTTL.
+	MinTTL time.Duration
+	// MaxTTL is the cap of the refresh interval of a domain. Default is DefaultMaxTTL.
+	MaxTTL time.Duration
+	// NegativeTTL is the refresh interval of a domain that was found not to exist, when the
+	// DNS response carries no SOA record. Default is DefaultNegativeTTL.
+	NegativeTTL time.Duration
+}
+
 type DnsResolver interface {
-	Register(domain string) error
-	Unregister(domain string)
+	// Register starts resolving a domain in the background on behalf of an owner. onChange is
+	// called each time the endpoints of the domain change.
+	Register(domain, owner string, onChange func()) error
+	// Unregister stops resolving a domain on behalf of an owner. The domain is removed once the
+	// last owner unregisters.
+	Unregister(domain, owner string)
 	Lookup(domain string) ([]net.IP, error)
+	// LookupEndpoints returns the endpoints of a domain: the IP addresses of the domain with
+	// all ports, or, for SRV domains of the form "_service._proto.name", the IP addresses of
+	// the SRV targets with the ports of the SRV records.
+	LookupEndpoints(domain string) ([]*util.Endpoint, error)
 	Start()
 	Close()
 }
@@ -28,39 +69,64 @@ type serviceEntry struct {
 	lock         sync.RWMutex
 	ctx          context.Context
 	cancel       context.CancelFunc
-	refCount     int
-	resolver     net.Resolver
+	handlers     map[string]func()
 	domain       string
 	hostNames    []net.IP
-	cname        string
+	endpoints    []*util.Endpoint
 	lastResolved time.Time
 }
 
 type dnsResolverImpl struct {
+	lock     sync.RWMutex
 	ctx      context.Context
+	config   Config
 	register map[string]*serviceEntry
 	log      logging.LeveledLogger
 }
 
 // NewDnsResolver creates a new DNS resolver
-func NewDnsResolver(name string, logger logging.LoggerFactory) DnsResolver {
+func NewDnsResolver(name string, config Config, logger logging.LoggerFactory) DnsResolver {
 	log := logger.NewLogger(name)
 	log.Tracef("newDnsResolver")
 
+	if config.MinTTL <= 0 {
+		config.MinTTL = DefaultMinTTL
+	}
+	if config.MaxTTL <= 0 {
+		config.MaxTTL = DefaultMaxTTL
+	}
+	if config.MaxTTL < config.MinTTL {
+		config.MaxTTL = config.MinTTL
+	}
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = DefaultNegativeTTL
+	}
+	if config.Nameserver != "" {
+		if _, _, err := net.SplitHostPort(config.Nameserver); err != nil {
+			config.Nameserver = net.JoinHostPort(config.Nameserver, "53")
+		}
+	}
+
 	return &dnsResolverImpl{
 		ctx:      context.Background(),
+		config:   config,
 		register: make(map[string]*serviceEntry),
 		log:      log,
 	}
 }
 
 // Register adds domain name to the resolver queue for background resolution
-func (r *dnsResolverImpl) Register(domain string) error {
-	r.log.Tracef("register: %q", domain)
+func (r *dnsResolverImpl) Register(domain, owner string, onChange func()) error {
+	r.log.Tracef("register: %q, owner %q", domain, owner)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
 	e, found := r.register[domain]
 	if found {
-		e.refCount += 1
+		e.lock.Lock()
+		e.handlers[owner] = onChange
+		e.lock.Unlock()
 		return nil
 	}
 
@@ -69,99 +135,238 @@ func (r *dnsResolverImpl) Register(domain string) error {
 		lock:         sync.RWMutex{},
 		ctx:          resolverCtx,
 		cancel:       cancel,
-		refCount:     1,
-		resolver:     net.Resolver{PreferGo: true},
+		handlers:     map[string]func(){owner: onChange},
 		domain:       domain,
-		cname:        "",
 		lastResolved: time.Time{},
 	}
 	r.register[domain] = e
 
 	r.log.Debugf("starting resolver thread for domain %q", domain)
-	go startResolver(e, r.log)
+	go r.startResolver(e)
 
 	return nil
 }
 
 // the resolver goroutine
-func startResolver(e *serviceEntry, log logging.LeveledLogger) {
-	log.Infof("resolver thread starting for domain %q, DNS update interval: %v",
-		e.domain, dnsUpdateInterval)
+func (r *dnsResolverImpl) startResolver(e *serviceEntry) {
+	r.log.Infof("resolver thread starting for domain %q", e.domain)
 
-	if err := doResolve(e); err != nil {
-		log.Debugf("initial resolution failed for domain %q: %s", e.domain, err.Error())
-	}
-	log.Tracef("initial resolution ready for domain %q, found %d endpoints", e.domain,
-		len(e.hostNames))
-
-	ticker := time.NewTicker(dnsUpdateInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-e.ctx.Done():
-			log.Debugf("resolver thread exiting for domain %q", e.domain)
+			r.log.Debugf("resolver thread exiting for domain %q", e.domain)
 			return
-		case <-ticker.C:
-			log.Tracef("resolving for domain %q", e.domain)
-			if err := doResolve(e); err != nil {
-				log.Debugf("resolution failed for domain %q: %s",
-					e.domain, err.Error())
+		case <-timer.C:
+			r.log.Tracef("resolving for domain %q", e.domain)
+			next, err := r.doResolve(e)
+			if err != nil {
+				r.log.Debugf("resolution failed for domain %q: %s", e.domain, err.Error())
 			}
-			log.Tracef("periodic resolution ready for domain %q, found %d endpoints", e.domain,
-				len(e.hostNames))
+			r.log.Tracef("resolution ready for domain %q, next update in %v", e.domain, next)
+			timer.Reset(next)
 		}
 	}
 }
 
-// do the heavy lifting
-func doResolve(e *serviceEntry) error {
-	if e.cname == "" {
-		cname, err := e.resolver.LookupCNAME(e.ctx, e.domain)
-		if err != nil {
-			return fmt.Errorf("failed to resolve CNAME for domain %q: %s",
-				e.domain, err.Error())
+// do the heavy lifting: resolve the domain and return the time to the next refresh
+func (r *dnsResolverImpl) doResolve(e *serviceEntry) (time.Duration, error) {
+	ttl := &ttlRecorder{}
+	resolver := r.newResolver(ttl)
+	ctx, cancel := context.WithTimeout(e.ctx, dnsTimeout)
+	defer cancel()
+
+	var endpoints []*util.Endpoint
+	var err error
+	if isSRVDomain(e.domain) {
+		endpoints, err = lookupSRV(ctx, resolver, e.domain)
+	} else {
+		endpoints, err = lookupHost(ctx, resolver, e.domain, 0)
+	}
+
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			// Transient failure: keep the last known endpoints and retry.
+			return r.clamp(dnsUpdateInterval), fmt.Errorf("failed to resolve domain %q: %w",
+				e.domain, err)
 		}
-		e.cname = cname
+
+		// Negative caching: the domain does not exist, drop the endpoints until the
+		// negative TTL expires.
+		r.update(e, nil)
+		neg, ok := ttl.negativeTTL()
+		if !ok {
+			neg = r.config.NegativeTTL
+		}
+		return r.clamp(neg), fmt.Errorf("domain %q not found: %w", e.domain, err)
 	}
 
-	hosts, err := e.resolver.LookupHost(e.ctx, e.domain)
+	r.update(e, endpoints)
+	pos, ok := ttl.answerTTL()
+	if !ok {
+		pos = dnsUpdateInterval
+	}
+	return r.clamp(pos), nil
+}
+
+// clamp bounds a refresh interval by the TTL floor and cap.
+func (r *dnsResolverImpl) clamp(d time.Duration) time.Duration {
+	return min(max(d, r.config.MinTTL), r.config.MaxTTL)
+}
+
+// newResolver returns a Go resolver that records the TTLs of the DNS responses and that uses the
+// custom nameserver, if any.
+func (r *dnsResolverImpl) newResolver(ttl *ttlRecorder) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if r.config.Nameserver != "" {
+				address = r.config.Nameserver
+			}
+			d := net.Dialer{}
+			conn, err := d.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if udpConn, ok := conn.(*net.UDPConn); ok {
+				return &ttlPacketConn{UDPConn: udpConn, ttl: ttl}, nil
+			}
+			return &ttlStreamConn{Conn: conn, ttl: ttl}, nil
+		},
+	}
+}
+
+// isSRVDomain returns true for SRV domains of the form "_service._proto.name".
+func isSRVDomain(domain string) bool {
+	labels := strings.SplitN(domain, ".", 3)
+	return len(labels) == 3 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_")
+}
+
+// lookupHost resolves a domain into endpoints with the given port, or all ports if port is zero.
+func lookupHost(ctx context.Context, resolver *net.Resolver, domain string, port int) ([]*util.Endpoint, error) {
+	hosts, err := resolver.LookupHost(ctx, domain)
 	if err != nil {
-		return fmt.Errorf("failed to resolve CNAME for domain %q: %s",
-			e.domain, err.Error())
+		return nil, err
 	}
 
-	e.lastResolved = time.Now()
+	endpoints := []*util.Endpoint{}
+	for _, h := range hosts {
+		ip := net.ParseIP(h)
+		if ip == nil {
+			// skip silently
+			continue
+		}
+		endpoints = append(endpoints, util.NewEndpoint(ip, port, port))
+	}
+	return endpoints, nil
+}
+
+// lookupSRV resolves an SRV domain into the endpoints of the SRV targets.
+func lookupSRV(ctx context.Context, resolver *net.Resolver, domain string) ([]*util.Endpoint, error) {
+	_, srvs, err := resolver.LookupSRV(ctx, "", "", domain)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := []*util.Endpoint{}
+	for _, srv := range srvs {
+		if srv.Port == 0 {
+			continue
+		}
+		eps, err := lookupHost(ctx, resolver, srv.Target, int(srv.Port))
+		if err != nil {
+			// A missing target does not invalidate the other targets.
+			continue
+		}
+		endpoints = append(endpoints, eps...)
+	}
+	return endpoints, nil
+}
+
+// update stores the endpoints of a domain and notifies the owners if the endpoints have changed.
+func (r *dnsResolverImpl) update(e *serviceEntry, endpoints []*util.Endpoint) {
+	if handlers := e.set(endpoints); len(handlers) > 0 {
+		r.log.Debugf("endpoints changed for domain %q: notifying %d owner(s)", e.domain, len(handlers))
+		for _, h := range handlers {
+			h()
+		}
+	}
+}
+
+// set stores the endpoints of a domain and returns the change handlers to call if the endpoints
+// differ from the last known endpoints.
+func (e *serviceEntry) set(endpoints []*util.Endpoint) []func() {
+	hostNames := []net.IP{}
+	seen := map[string]bool{}
+	for _, ep := range endpoints {
+		ip := ep.IP()
+		if seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		hostNames = append(hostNames, ip)
+	}
 
 	// for writing
 	e.lock.Lock()
 	defer e.lock.Unlock()
 
-	e.hostNames = make([]net.IP, len(hosts))
-	for i, h := range hosts {
-		n := net.ParseIP(h)
-		if n == nil {
-			// skip silently
-			continue
+	changed := !sameEndpoints(e.endpoints, endpoints)
+	e.lastResolved = time.Now()
+	e.endpoints = endpoints
+	e.hostNames = hostNames
+
+	if !changed {
+		return nil
+	}
+	handlers := []func(){}
+	for _, h := range e.handlers {
+		if h != nil {
+			handlers = append(handlers, h)
 		}
-		e.hostNames[i] = n
 	}
+	return handlers
+}
 
-	return nil
+// sameEndpoints returns true if two endpoint lists contain the same endpoints, in any order.
+func sameEndpoints(a, b []*util.Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as, bs := make([]string, len(a)), make([]string, len(b))
+	for i := range a {
+		as[i], bs[i] = a[i].String(), b[i].String()
+	}
+	slices.Sort(as)
+	slices.Sort(bs)
+	return slices.Equal(as, bs)
 }
 
 // Unregister removes a domain name from the resolver queue
-func (r *dnsResolverImpl) Unregister(domain string) {
-	r.log.Tracef("unregister: %q", domain)
+func (r *dnsResolverImpl) Unregister(domain, owner string) {
+	r.log.Tracef("unregister: %q, owner %q", domain, owner)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.unregister(domain, owner)
+}
 
+func (r *dnsResolverImpl) unregister(domain, owner string) {
 	e, found := r.register[domain]
 	if !found {
 		r.log.Tracef("trying to ungregister resolver for unknown domain: %q", domain)
 		return
 	}
 
-	e.refCount -= 1
-	if e.refCount == 0 {
+	e.lock.Lock()
+	delete(e.handlers, owner)
+	last := len(e.handlers) == 0
+	e.lock.Unlock()
+
+	if last {
 		e.cancel()
 		delete(r.register, domain)
 	}
@@ -173,9 +378,9 @@ func (r *dnsResolverImpl) Unregister(domain string) {
 func (r *dnsResolverImpl) Lookup(domain string) ([]net.IP, error) {
 	r.log.Tracef("lookup domain: %q", domain)
 
-	e, found := r.register[domain]
-	if !found {
-		return []net.IP{}, fmt.Errorf("unknown domain name: %q", domain)
+	e, err := r.getEntry(domain)
+	if err != nil {
+		return []net.IP{}, err
 	}
 
 	e.lock.RLock()
@@ -189,6 +394,37 @@ func (r *dnsResolverImpl) Lookup(domain string) ([]net.IP, error) {
 	return ret, nil
 }
 
+// LookupEndpoints returns the endpoints for a domain
+func (r *dnsResolverImpl) LookupEndpoints(domain string) ([]*util.Endpoint, error) {
+	r.log.Tracef("lookup endpoints for domain: %q", domain)
+
+	e, err := r.getEntry(domain)
+	if err != nil {
+		return []*util.Endpoint{}, err
+	}
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	ret := make([]*util.Endpoint, len(e.endpoints))
+	copy(ret, e.endpoints)
+
+	r.log.Tracef("lookup ready: domain %q, endpoints: %d", domain, len(ret))
+
+	return ret, nil
+}
+
+func (r *dnsResolverImpl) getEntry(domain string) (*serviceEntry, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	e, found := r.register[domain]
+	if !found {
+		return nil, fmt.Errorf("unknown domain name: %q", domain)
+	}
+	return e, nil
+}
+
 // Starts spawns the background resolver thread
 func (r *dnsResolverImpl) Start() {
 	r.log.Debugf("starting")
@@ -197,15 +433,129 @@ func (r *dnsResolverImpl) Start() {
 
 // Close closes the background resolver
 func (r *dnsResolverImpl) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
 	r.log.Debugf("closing: active domains: %d", len(r.register))
 	// XXX: if the server Close sequence is OK then this should never happen
 	if len(r.register) > 0 {
 		r.log.Warnf("trying to close DNS resolver with %d active domains",
 			len(r.register))
 		for _, e := range r.register {
-			r.log.Debugf("unregistering active domain %q, refCount: %d",
-				e.domain, e.refCount)
-			r.Unregister(e.domain)
+			r.log.Debugf("unregistering active domain %q, owners: %d",
+				e.domain, len(e.handlers))
+			e.cancel()
+			delete(r.register, e.domain)
+		}
+	}
+}
+
+// ttlRecorder records the TTLs of the DNS responses received during a resolution round: the
+// smallest TTL of the answers and the negative TTL of the SOA records (RFC 2308).
+type ttlRecorder struct {
+	lock                   sync.Mutex
+	answer, negative       uint32
+	hasAnswer, hasNegative bool
+}
+
+func (t *ttlRecorder) record(msg []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || !h.Response {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return
+		}
+		if !t.hasAnswer || rh.TTL < t.answer {
+			t.answer, t.hasAnswer = rh.TTL, true
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+
+	for {
+		rh, err := p.AuthorityHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return
+		}
+		if rh.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return
+		}
+		neg := min(rh.TTL, soa.MinTTL)
+		if !t.hasNegative || neg < t.negative {
+			t.negative, t.hasNegative = neg, true
+		}
+	}
+}
+
+func (t *ttlRecorder) answerTTL() (time.Duration, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return time.Duration(t.answer) * time.Second, t.hasAnswer
+}
+
+func (t *ttlRecorder) negativeTTL() (time.Duration, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return time.Duration(t.negative) * time.Second, t.hasNegative
+}
+
+// ttlPacketConn records the TTLs of DNS responses received over UDP. It must remain a
+// net.PacketConn for the Go resolver to use the datagram framing.
+type ttlPacketConn struct {
+	*net.UDPConn
+	ttl *ttlRecorder
+}
+
+func (c *ttlPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		c.ttl.record(b[:n])
+	}
+	return n, err
+}
+
+// ttlStreamConn records the TTLs of length-prefixed DNS responses received over TCP.
+type ttlStreamConn struct {
+	net.Conn
+	ttl *ttlRecorder
+	buf []byte
+}
+
+func (c *ttlStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.buf = append(c.buf, b[:n]...)
+		for len(c.buf) >= 2 {
+			l := int(binary.BigEndian.Uint16(c.buf))
+			if len(c.buf) < 2+l {
+				break
+			}
+			c.ttl.record(c.buf[2 : 2+l])
+			c.buf = c.buf[2+l:]
 		}
 	}
+	return n, err
 }
@@ -0,0 +1,236 @@
+package resolver
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/l7mp/stunner/pkg/logger"
+)
+
+// testDNSServer is an in-process authoritative DNS server for the "example.com." zone.
+type testDNSServer struct {
+	lock    sync.Mutex
+	conn    net.PacketConn
+	a       map[string]string // name -> IPv4 address
+	srv     map[string]dnsmessage.SRVResource
+	ttl     uint32
+	negTTL  uint32
+	queries map[string]int
+}
+
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &testDNSServer{
+		conn:    conn,
+		a:       map[string]string{},
+		srv:     map[string]dnsmessage.SRVResource{},
+		ttl:     1,
+		negTTL:  1,
+		queries: map[string]int{},
+	}
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+func (s *testDNSServer) addr() string { return s.conn.LocalAddr().String() }
+
+func (s *testDNSServer) setA(name, addr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.a[name] = addr
+}
+
+func (s *testDNSServer) setSRV(name string, srv dnsmessage.SRVResource) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.srv[name] = srv
+}
+
+func (s *testDNSServer) setTTL(ttl, negTTL uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ttl, s.negTTL = ttl, negTTL
+}
+
+func (s *testDNSServer) numQueries(name string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.queries[name]
+}
+
+func (s *testDNSServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+			continue
+		}
+		if resp, err := s.answer(req); err == nil {
+			s.conn.WriteTo(resp, addr) //nolint:errcheck
+		}
+	}
+}
+
+func (s *testDNSServer) answer(req dnsmessage.Message) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q := req.Questions[0]
+	name := q.Name.String()
+	if q.Type == dnsmessage.TypeA {
+		s.queries[name]++
+	}
+
+	h := dnsmessage.Header{ID: req.ID, Response: true, Authoritative: true}
+	_, hasA := s.a[name]
+	_, hasSRV := s.srv[name]
+	if !strings.HasSuffix(name, "example.com.") || (!hasA && !hasSRV) {
+		h.RCode = dnsmessage.RCodeNameError
+	}
+
+	b := dnsmessage.NewBuilder(nil, h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	answered := false
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+	switch {
+	case q.Type == dnsmessage.TypeA && hasA:
+		ip := net.ParseIP(s.a[name]).To4()
+		if err := b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip)}); err != nil {
+			return nil, err
+		}
+		answered = true
+	case q.Type == dnsmessage.TypeSRV && hasSRV:
+		if err := b.SRVResource(rh, s.srv[name]); err != nil {
+			return nil, err
+		}
+		answered = true
+	}
+	if !answered {
+		// NXDOMAIN or NODATA: add the SOA record for negative caching.
+		if err := b.StartAuthorities(); err != nil {
+			return nil, err
+		}
+		zone := dnsmessage.MustNewName("example.com.")
+		if err := b.SOAResource(dnsmessage.ResourceHeader{Name: zone, Class: dnsmessage.ClassINET, TTL: 3600},
+			dnsmessage.SOAResource{NS: zone, MBox: zone, MinTTL: s.negTTL}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+func TestDnsResolver(t *testing.T) {
+	server := newTestDNSServer(t)
+	server.setA("media.example.com.", "10.0.0.1")
+	server.setSRV("_turn._udp.example.com.", dnsmessage.SRVResource{
+		Port:   5000,
+		Target: dnsmessage.MustNewName("media.example.com."),
+	})
+
+	r := NewDnsResolver("dns-resolver", Config{Nameserver: server.addr(), MinTTL: 10 * time.Millisecond},
+		logger.NewLoggerFactory(resolverTestLoglevel))
+	r.Start()
+	defer r.Close()
+
+	matches := func(domain, ip string, port int) bool {
+		eps, err := r.LookupEndpoints(domain)
+		require.NoError(t, err)
+		for _, e := range eps {
+			if e.Match(net.ParseIP(ip), port) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var changes atomic.Int32
+	require.NoError(t, r.Register("media.example.com", "test", func() { changes.Add(1) }))
+	require.NoError(t, r.Register("_turn._udp.example.com", "test", nil))
+	require.NoError(t, r.Register("late.example.com", "test", nil))
+	defer r.Unregister("media.example.com", "test")
+	defer r.Unregister("_turn._udp.example.com", "test")
+	defer r.Unregister("late.example.com", "test")
+
+	// A records admit all ports, SRV records only the advertised port.
+	require.Eventually(t, func() bool { return matches("media.example.com", "10.0.0.1", 0) },
+		time.Second, 10*time.Millisecond)
+	require.True(t, matches("media.example.com", "10.0.0.1", 1234))
+	require.Equal(t, int32(1), changes.Load())
+	require.Eventually(t, func() bool { return matches("_turn._udp.example.com", "10.0.0.1", 5000) },
+		time.Second, 10*time.Millisecond)
+	require.False(t, matches("_turn._udp.example.com", "10.0.0.1", 5001))
+	ips, err := r.Lookup("_turn._udp.example.com")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	require.Equal(t, "10.0.0.1", ips[0].String())
+
+	// Unknown domains are cached negatively and resolved once they appear.
+	require.False(t, matches("late.example.com", "10.0.0.3", 0))
+
+	// Records are refreshed as per their TTL (1 sec), well before the default update interval.
+	server.setA("media.example.com.", "10.0.0.2")
+	server.setA("late.example.com.", "10.0.0.3")
+	require.Eventually(t, func() bool {
+		return matches("media.example.com", "10.0.0.2", 0) &&
+			matches("_turn._udp.example.com", "10.0.0.2", 5000) &&
+			!matches("media.example.com", "10.0.0.1", 0)
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool { return matches("late.example.com", "10.0.0.3", 0) },
+		3*time.Second, 50*time.Millisecond)
+
+	// Owners are notified only when the endpoints change, not on each refresh.
+	require.Equal(t, int32(2), changes.Load())
+	time.Sleep(1500 * time.Millisecond)
+	require.Equal(t, int32(2), changes.Load())
+}
+
+func TestDnsResolverTTLBounds(t *testing.T) {
+	server := newTestDNSServer(t)
+	server.setA("media.example.com.", "10.0.0.1")
+	server.setTTL(3600, 3600)
+
+	r := NewDnsResolver("dns-resolver", Config{Nameserver: server.addr(), MinTTL: 10 * time.Millisecond,
+		MaxTTL: 100 * time.Millisecond},
+		logger.NewLoggerFactory(resolverTestLoglevel))
+	r.Start()
+	defer r.Close()
+
+	// The TTL is capped at MaxTTL and the negative TTL is taken from the SOA record.
+	require.NoError(t, r.Register("media.example.com", "test", nil))
+	defer r.Unregister("media.example.com", "test")
+	require.Eventually(t, func() bool { return server.numQueries("media.example.com.") >= 3 },
+		2*time.Second, 10*time.Millisecond)
+
+	r = NewDnsResolver("dns-resolver", Config{Nameserver: server.addr()},
+		logger.NewLoggerFactory(resolverTestLoglevel))
+	defer r.Close()
+	require.NoError(t, r.Register("missing.example.com", "test", nil))
+	defer r.Unregister("missing.example.com", "test")
+	require.Eventually(t, func() bool { return server.numQueries("missing.example.com.") >= 1 },
+		time.Second, 10*time.Millisecond)
+	time.Sleep(1500 * time.Millisecond)
+	require.Equal(t, 1, server.numQueries("missing.example.com."), "negative caching")
+}
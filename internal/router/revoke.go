@@ -0,0 +1,82 @@
+package router
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// trackedConn is a relayed TCP connection to a peer of a cluster.
+type trackedConn struct {
+	peer net.IP
+	port int
+	conn io.Closer
+}
+
+// connSet is the set of the tracked connections of a cluster.
+type connSet struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+// Epoch returns the config epoch of the router, bumped by InvalidateCache.
+func (r *router) Epoch() uint64 {
+	return r.epoch.Load()
+}
+
+// RevokesRemovedPeers reports whether the peers removed from a cluster lose access immediately.
+func (r *router) RevokesRemovedPeers(cluster string) bool {
+	return r.getMatcher(cluster).revoke
+}
+
+// TrackConn registers a relayed TCP connection to a peer of a cluster, which is closed when the
+// peer is removed from the cluster if the cluster revokes removed peers. The returned function
+// unregisters the connection.
+func (r *router) TrackConn(cluster string, peer net.Addr, conn io.Closer) func() {
+	t := &trackedConn{conn: conn}
+	switch a := peer.(type) {
+	case *net.TCPAddr:
+		t.peer, t.port = a.IP, a.Port
+	case *net.UDPAddr:
+		t.peer, t.port = a.IP, a.Port
+	default:
+		return func() {}
+	}
+
+	v, _ := r.conns.LoadOrStore(cluster, &connSet{conns: map[*trackedConn]struct{}{}})
+	set := v.(*connSet)
+	set.mu.Lock()
+	set.conns[t] = struct{}{}
+	set.mu.Unlock()
+	return func() {
+		set.mu.Lock()
+		delete(set.conns, t)
+		set.mu.Unlock()
+	}
+}
+
+// revokeConns closes the tracked connections to the peers no longer admitted by a cluster, if
+// the cluster revokes removed peers.
+func (r *router) revokeConns(cluster string) {
+	v, ok := r.conns.Load(cluster)
+	if !ok || !r.RevokesRemovedPeers(cluster) {
+		return
+	}
+	set := v.(*connSet)
+	set.mu.Lock()
+	var revoked []*trackedConn
+	for t := range set.conns {
+		if !r.Match(cluster, t.peer, t.port) {
+			revoked = append(revoked, t)
+			delete(set.conns, t)
+		}
+	}
+	set.mu.Unlock()
+
+	for _, t := range revoked {
+		r.log.Infof("cluster %s: closing relay connection to removed peer %s", cluster,
+			net.JoinHostPort(t.peer.String(), strconv.Itoa(t.port)))
+		_ = t.conn.Close()
+	}
+}
@@ -5,8 +5,13 @@
 package router
 
 import (
+	"cmp"
+	"hash/fnv"
+	"math"
 	"net"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"k8s.io/utils/lru"
@@ -33,40 +38,130 @@ type router struct {
 	matcherCache *lru.Cache // cluster name -> *clusterMatcher
 	routeCache   *lru.Cache // listener -> *routeCacheEntry
 	peerCache    *lru.Cache // listener|proto|peer -> *peerCacheValue
+	denyList     atomic.Pointer[denyMatcher]
+	generations  sync.Map // cluster name -> *atomic.Uint64
+	conns        sync.Map // cluster name -> *connSet
 	epoch        atomic.Uint64
 	log          logging.LeveledLogger
 }
 
 // clusterMatcher is the parsed, ready-to-match endpoint snapshot of one cluster, built from its
-// config and cached until the next epoch.
+// config and cached until the next epoch or the next generation of the cluster. Endpoints are
+// compiled into a prefix trie, negative endpoints are kept apart as exclusions.
 type clusterMatcher struct {
-	epoch     uint64
-	typ       stnrv1.ClusterType
-	proto     stnrv1.ClusterProtocol
-	endpoints []*util.Endpoint
-	domains   []string
+	epoch      uint64
+	generation uint64
+	typ        stnrv1.ClusterType
+	proto      stnrv1.ClusterProtocol
+	endpoints  []*util.Endpoint
+	trie       *prefixTrie
+	exclusions *prefixTrie
+	domains    []string
+	// health is the health state of the endpoints, or nil if the cluster is not health checked.
+	health endpointHealth
+	// virtual is the virtual address of the cluster, or nil if none. backends holds the backends
+	// the virtual address maps to for static and EndpointSlice clusters.
+	virtual  *util.Endpoint
+	backends []*util.Endpoint
+	// mode is the topology mode of the cluster and topology maps endpoint IPs to their
+	// locations. hasZones is set if any endpoint may have a known zone.
+	mode     stnrv1.TopologyMode
+	topology map[string]stnrv1.EndpointTopology
+	hasZones bool
+	// revoke is set if the peers removed from the cluster lose access immediately.
+	revoke bool
+}
+
+// denyMatcher is the parsed process-wide peer deny-list of the admin config, cached until the
+// next epoch.
+type denyMatcher struct {
+	epoch uint64
+	trie  *prefixTrie
+}
+
+// routeIndex is the per-listener snapshot of the endpoints of the routed clusters of a protocol,
+// compiled into a single prefix trie that maps peers to the route positions of the candidate
+// clusters. Clusters with dynamic membership (STRICT_DNS) are always candidates. The index is
+// rebuilt when any of the clusters changes its generation.
+type routeIndex struct {
+	generation uint64
+	trie       *prefixTrie
+	dynamic    []int
 }
 
 type routeCacheEntry struct {
 	epoch    uint64
 	routeKey string
 	// clusters lists, per protocol, the names of the listener's routed clusters of that protocol,
-	// in route order.
+	// in route order: by priority, then by weight, then by name.
 	clusters map[stnrv1.ClusterProtocol][]string
+	// weights holds the weights of the routes, in the same order.
+	weights map[stnrv1.ClusterProtocol][]int
+	// groupEnd holds, per route position, the position past the last route of the same priority.
+	groupEnd map[stnrv1.ClusterProtocol][]int
+	// conditions holds the match conditions of the routes, in the same order, or nil if the
+	// route matches all users and peer ports.
+	conditions map[stnrv1.ClusterProtocol][]*routeCondition
+	// conditional is set if any route has a condition: such routes depend on the user and the
+	// peer port so the peer cache is bypassed.
+	conditional bool
+	// generations holds the generation counters of the clusters, in the same order.
+	generations map[stnrv1.ClusterProtocol][]*atomic.Uint64
+	// index holds the route index of the clusters, built on the first route cache miss.
+	index map[stnrv1.ClusterProtocol]*atomic.Pointer[routeIndex]
+}
+
+// routeCondition is the parsed match condition of a route evaluated per request. The realm
+// condition is static and is evaluated when the route cache entry is built.
+type routeCondition struct {
+	port, endPort  int
+	hasPort        bool
+	usernamePrefix string
+}
+
+// matches checks a route condition for a user and a peer port. An unknown port (0) matches: the
+// condition is enforced again on the relay path, where the port is known. An unknown user ("")
+// never matches a username condition.
+func (c *routeCondition) matches(user string, port int) bool {
+	if c == nil {
+		return true
+	}
+	if c.hasPort && port != 0 && (port < c.port || port > c.endPort) {
+		return false
+	}
+	return c.usernamePrefix == "" || (user != "" && strings.HasPrefix(user, c.usernamePrefix))
 }
 
+// peerCacheValue is a cached route of a peer. The route is valid as long as neither the clusters
+// of the priority of the serving cluster nor any cluster preceding them in the route changes its
+// generation: generation is the sum of the generations of the clusters up to the position last
+// when the route was resolved.
 type peerCacheValue struct {
-	epoch   uint64
-	proto   stnrv1.ClusterProtocol
-	cluster string
+	epoch      uint64
+	proto      stnrv1.ClusterProtocol
+	cluster    string
+	index      int
+	last       int
+	generation uint64
 }
 
-// RouteAny resolves the cluster serving a peer across all cluster protocols (UDP preferred). Used
-// for IP-level permission decisions where the flow protocol is not yet known: protocol and port
-// specificity are enforced at flow establishment.
-func RouteAny(rt *runtime.Runtime, listener string, routes []string, peer net.IP) (string, bool) {
+// endpointHealth is implemented by the Cluster object to report the health of its endpoints.
+type endpointHealth interface {
+	Healthy(ep *util.Endpoint) bool
+}
+
+// userAuthorizer is implemented by the Auth object to find the clusters the user of an
+// allocation may access.
+type userAuthorizer interface {
+	UserClusters(user runtime.User) ([]string, bool)
+}
+
+// RouteAny resolves the cluster serving a peer for a user across all cluster protocols (UDP
+// preferred). Used for IP-level permission decisions where the flow protocol is not yet known:
+// protocol and port specificity are enforced at flow establishment.
+func RouteAny(rt *runtime.Runtime, listener string, routes []string, user runtime.User, peer net.IP) (string, bool) {
 	for _, proto := range []stnrv1.ClusterProtocol{stnrv1.ClusterProtocolUDP, stnrv1.ClusterProtocolTCP} {
-		if cluster, ok := rt.Router.Route(listener, routes, proto, peer, 0); ok {
+		if cluster, ok := rt.Router.RouteUser(listener, routes, user, proto, peer, 0); ok {
 			return cluster, true
 		}
 	}
@@ -91,50 +186,193 @@ func (r *router) InvalidateCache() {
 	r.peerCache.Clear()
 }
 
+// InvalidateCluster drops the matcher of a cluster. The listener route cache does not depend on
+// cluster membership and is kept. Cached peer routes via or past the cluster are invalidated
+// lazily by the generation bump, the routes of the peers of other clusters are kept. If the
+// cluster revokes removed peers then the tracked TCP relay connections to the peers removed
+// from the cluster are closed, the relayed datagrams are revoked by the per-packet admission.
+func (r *router) InvalidateCluster(cluster string) {
+	r.generation(cluster).Add(1)
+	r.matcherCache.Remove(cluster)
+	r.revokeConns(cluster)
+}
+
+// generation returns the generation counter of a cluster.
+func (r *router) generation(cluster string) *atomic.Uint64 {
+	if g, ok := r.generations.Load(cluster); ok {
+		return g.(*atomic.Uint64)
+	}
+	g, _ := r.generations.LoadOrStore(cluster, &atomic.Uint64{})
+	return g.(*atomic.Uint64)
+}
+
 func (r *router) Match(cluster string, peer net.IP, port int) bool {
 	return r.match(r.getMatcher(cluster), peer, port)
 }
 
 func (r *router) Route(listener string, routes []string, proto stnrv1.ClusterProtocol, peer net.IP, port int) (string, bool) {
 	entry := r.getRouteEntry(listener, routes)
+	if entry.conditional {
+		r.countLookup(listener, "bypass")
+		return r.routeSlow(entry, "", nil, false, proto, peer, port)
+	}
+	return r.route(listener, entry, proto, peer, port)
+}
 
+// route resolves the cluster serving a peer over the peer cache.
+func (r *router) route(listener string, entry *routeCacheEntry, proto stnrv1.ClusterProtocol, peer net.IP, port int) (string, bool) {
 	if cluster, ok := r.getPeerCluster(listener, proto, peer, entry); ok {
+		r.countLookup(listener, "hit")
 		if r.Match(cluster, peer, port) {
 			return cluster, true
 		}
 		return "", false
 	}
+	r.countLookup(listener, "miss")
 
-	for _, cluster := range entry.clusters[proto] {
-		if r.Match(cluster, peer, 0) {
-			r.setPeer(listener, proto, peer, cluster, entry.epoch)
-			return cluster, r.Match(cluster, peer, port)
+	// Snapshot the generations before matching so that a concurrent invalidation of a cluster
+	// invalidates the cached route. Only the candidates of the route index are matched.
+	clusters, generations := entry.clusters[proto], entry.generations[proto]
+	candidates := r.getRouteIndex(entry, proto).candidates(peer, len(clusters))
+	admits := func(i int) bool { return candidates[i] && r.Match(clusters[i], peer, 0) }
+	var generation uint64
+	for i := range clusters {
+		generation += generations[i].Load()
+		if !admits(i) {
+			continue
+		}
+		last := entry.groupEnd[proto][i] - 1
+		for _, g := range generations[i+1 : last+1] {
+			generation += g.Load()
 		}
+		j := entry.pick(proto, i, peer, admits)
+		r.setPeer(listener, proto, peer, clusters[j], entry.epoch, j, last, generation)
+		return clusters[j], r.Match(clusters[j], peer, port)
+	}
+
+	return "", false
+}
+
+func (r *router) RouteUser(listener string, routes []string, user runtime.User, proto stnrv1.ClusterProtocol, peer net.IP, port int) (string, bool) {
+	entry := r.getRouteEntry(listener, routes)
+	allowed, restricted := r.userClusters(user)
+	if !restricted && !entry.conditional {
+		return r.route(listener, entry, proto, peer, port)
 	}
+	r.countLookup(listener, "bypass")
+	return r.routeSlow(entry, user.ID, allowed, restricted, proto, peer, port)
+}
 
+// routeSlow resolves the cluster serving a peer over the cached matchers. The peer cache is
+// shared by all users and ports, so restricted users and conditional routes take the slow path.
+func (r *router) routeSlow(entry *routeCacheEntry, user string, allowed []string, restricted bool, proto stnrv1.ClusterProtocol, peer net.IP, port int) (string, bool) {
+	clusters := entry.clusters[proto]
+	admits := func(i int) bool {
+		if restricted && !slices.Contains(allowed, clusters[i]) {
+			return false
+		}
+		if !entry.conditions[proto][i].matches(user, port) {
+			return false
+		}
+		return r.Match(clusters[i], peer, 0)
+	}
+	for i := range clusters {
+		if admits(i) {
+			j := entry.pick(proto, i, peer, admits)
+			return clusters[j], r.Match(clusters[j], peer, port)
+		}
+	}
 	return "", false
 }
 
-// match tests a parsed matcher against a peer endpoint.
+// pick selects the route serving a peer from the routes of the priority of the first admitting
+// route i. The routes of the priority admitting the peer with a positive weight are selected by
+// weighted rendezvous hashing over the peer, so that the peers are spread across the routes in
+// proportion to the weights and each peer sticks to its route. Returns i if no such route exists.
+func (e *routeCacheEntry) pick(proto stnrv1.ClusterProtocol, i int, peer net.IP, admits func(int) bool) int {
+	end, weights := e.groupEnd[proto][i], e.weights[proto]
+	if end-i == 1 {
+		return i
+	}
+	best, bestScore := i, math.Inf(1)
+	for j := i; j < end; j++ {
+		if weights[j] <= 0 || (j != i && !admits(j)) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write(peer.To16())                  //nolint:errcheck
+		h.Write([]byte(e.clusters[proto][j])) //nolint:errcheck
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		if score := -math.Log(u) / float64(weights[j]); score < bestScore {
+			best, bestScore = j, score
+		}
+	}
+	return best
+}
+
+// mix64 is the 64-bit finalizer of SplitMix64: FNV spreads the last bytes of the input poorly to
+// the high bits of the hash.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Denied reports whether (peer, port) is on the peer deny-list. port==0 ignores the port.
+func (r *router) Denied(peer net.IP, port int) bool {
+	return r.getDenyList().trie.excludes(peer, port)
+}
+
+// countLookup counts a peer route lookup of a listener in telemetry.
+func (r *router) countLookup(listener, result string) {
+	if r.rt.Telemetry != nil {
+		r.rt.Telemetry.IncrementRouteCache(listener, result)
+	}
+}
+
+// userClusters returns the clusters the user of an allocation may access from the live Auth
+// object, or false if the user is not restricted.
+func (r *router) userClusters(user runtime.User) ([]string, bool) {
+	o, ok := r.rt.Registry.Get(runtime.TypeAuth, stnrv1.DefaultAuthName)
+	if !ok {
+		return nil, false
+	}
+	a, ok := o.(userAuthorizer)
+	if !ok {
+		return nil, false
+	}
+	return a.UserClusters(user)
+}
+
+// match tests a parsed matcher against a peer endpoint. Exclusions win: a peer on the deny-list or
+// matching a negative endpoint of the cluster is never admitted.
 func (r *router) match(m *clusterMatcher, peer net.IP, port int) bool {
+	if r.Denied(peer, port) || m.exclusions.excludes(peer, port) {
+		return false
+	}
+
+	// A virtual address admits peers as long as it maps to a backend.
+	if m.virtual != nil && m.virtual.Match(peer, port) {
+		return len(r.virtualBackends(m)) > 0
+	}
+
 	switch m.typ {
-	case stnrv1.ClusterTypeStatic:
-		for _, e := range m.endpoints {
-			if e.Match(peer, port) {
-				return true
-			}
-		}
+	case stnrv1.ClusterTypeStatic, stnrv1.ClusterTypeEndpointSlice:
+		return m.trie.admits(peer, port)
 	case stnrv1.ClusterTypeStrictDNS:
 		if r.rt.Resolver == nil {
 			return false
 		}
 		for _, d := range m.domains {
-			hosts, err := r.rt.Resolver.Lookup(d)
+			eps, err := r.rt.Resolver.LookupEndpoints(d)
 			if err != nil {
 				continue
 			}
-			for _, h := range hosts {
-				if h.Equal(peer) {
+			for _, e := range eps {
+				if e.Match(peer, port) && (m.health == nil || m.health.Healthy(e)) && r.local(m, e) {
 					return true
 				}
 			}
@@ -143,31 +381,142 @@ func (r *router) match(m *clusterMatcher, peer net.IP, port int) bool {
 	return false
 }
 
+// VirtualBackends returns the backends of a cluster if (peer, port) is the virtual address of the
+// cluster.
+func (r *router) VirtualBackends(cluster string, peer net.IP, port int) ([]*util.Endpoint, bool) {
+	m := r.getMatcher(cluster)
+	if m.virtual == nil || !m.virtual.Match(peer, port) {
+		return nil, false
+	}
+	return r.virtualBackends(m), true
+}
+
+// virtualBackends returns the backends of the virtual address of a cluster, restricted to the
+// preferred locality. The backends of strict-DNS clusters are resolved on each call.
+func (r *router) virtualBackends(m *clusterMatcher) []*util.Endpoint {
+	if m.typ != stnrv1.ClusterTypeStrictDNS || r.rt.Resolver == nil {
+		return m.backends
+	}
+	var ret []*util.Endpoint
+	for _, d := range m.domains {
+		eps, err := r.rt.Resolver.LookupEndpoints(d)
+		if err != nil {
+			continue
+		}
+		for _, ep := range eps {
+			if r.isBackend(m, ep) && (m.health == nil || m.health.Healthy(ep)) && r.local(m, ep) {
+				ret = append(ret, ep)
+			}
+		}
+	}
+	return r.preferred(m, ret)
+}
+
+// isBackend reports whether an endpoint can serve as a backend of a virtual address: the endpoint
+// must specify a single host that is neither denied nor excluded.
+func (r *router) isBackend(m *clusterMatcher, ep *util.Endpoint) bool {
+	prefix := ep.Prefix()
+	if ones, bits := prefix.Mask.Size(); ep.Negated() || ones != bits {
+		return false
+	}
+	return !r.Denied(ep.IP(), 0) && !m.exclusions.excludes(ep.IP(), 0)
+}
+
+// getDenyList returns the parsed peer deny-list, building it from the admin config on a cache miss.
+// With no admin config the default deny-list applies.
+func (r *router) getDenyList() *denyMatcher {
+	curEpoch := r.epoch.Load()
+	if d := r.denyList.Load(); d != nil && d.epoch == curEpoch {
+		return d
+	}
+
+	denyList := stnrv1.DefaultPeerDenyList()
+	if conf, ok := r.rt.GetConfig(runtime.TypeAdmin, "").(*stnrv1.AdminConfig); ok && conf != nil && conf.PeerDenyList != nil {
+		denyList = *conf.PeerDenyList
+	}
+
+	d := &denyMatcher{epoch: curEpoch, trie: newPrefixTrie()}
+	for _, e := range denyList {
+		ep, err := util.ParseEndpoint(e)
+		if err != nil {
+			r.log.Warnf("could not parse peer deny-list endpoint %q (ignoring): %s", e, err.Error())
+			continue
+		}
+		d.trie.insert(ep, 0)
+	}
+
+	r.denyList.Store(d)
+	return d
+}
+
 // getMatcher returns the parsed matcher for a cluster, building it from the cluster's config on a
 // cache miss. A missing cluster yields an empty matcher that admits nothing.
 func (r *router) getMatcher(cluster string) *clusterMatcher {
 	curEpoch := r.epoch.Load()
+	curGeneration := r.generation(cluster).Load()
 	if v, ok := r.matcherCache.Get(cluster); ok {
-		if m := v.(*clusterMatcher); m.epoch == curEpoch {
+		if m := v.(*clusterMatcher); m.epoch == curEpoch && m.generation == curGeneration {
 			return m
 		}
 	}
 
-	m := &clusterMatcher{epoch: curEpoch}
+	m := &clusterMatcher{epoch: curEpoch, generation: curGeneration, trie: newPrefixTrie(),
+		exclusions: newPrefixTrie()}
 	if conf, ok := r.rt.GetConfig(runtime.TypeCluster, cluster).(*stnrv1.ClusterConfig); ok && conf != nil {
 		m.typ, _ = stnrv1.NewClusterType(conf.Type)
 		m.proto, _ = stnrv1.NewClusterProtocol(conf.Protocol)
-		switch m.typ {
-		case stnrv1.ClusterTypeStatic:
-			for _, e := range conf.Endpoints {
-				ep, err := util.ParseEndpoint(e)
-				if err != nil {
-					continue
-				}
+		m.mode = stnrv1.TopologyModeNone
+		if conf.TopologyMode != "" {
+			m.mode, _ = stnrv1.NewTopologyMode(conf.TopologyMode)
+		}
+		m.topology, m.hasZones = conf.Topology, len(conf.Topology) > 0
+		m.revoke = conf.RevokeRemovedPeers
+		for _, e := range conf.Endpoints {
+			if m.typ == stnrv1.ClusterTypeStrictDNS && !util.IsNegatedEndpoint(e) {
+				m.domains = append(m.domains, e)
+				continue
+			}
+			if m.typ == stnrv1.ClusterTypeEndpointSlice && !util.IsNegatedEndpoint(e) {
+				m.endpoints = append(m.endpoints, r.lookupService(e, m.proto)...)
+				continue
+			}
+			ep, err := util.ParseEndpoint(e)
+			if err != nil {
+				continue
+			}
+			if ep.Negated() {
+				m.exclusions.insert(ep, 0)
+			} else {
 				m.endpoints = append(m.endpoints, ep)
 			}
-		case stnrv1.ClusterTypeStrictDNS:
-			m.domains = append([]string(nil), conf.Endpoints...)
+		}
+		// Unhealthy endpoints do not admit peers. Health changes invalidate the matcher.
+		if o, ok := r.rt.Registry.Get(runtime.TypeCluster, cluster); ok && conf.HealthCheck != nil {
+			if h, ok := o.(endpointHealth); ok {
+				m.health = h
+				m.endpoints = slices.DeleteFunc(m.endpoints, func(ep *util.Endpoint) bool {
+					return !h.Healthy(ep)
+				})
+			}
+		}
+		// Remote endpoints do not admit peers in the REQUIRE topology modes.
+		m.endpoints = slices.DeleteFunc(m.endpoints, func(ep *util.Endpoint) bool {
+			return !r.local(m, ep)
+		})
+		for i, ep := range m.endpoints {
+			m.trie.insert(ep, i)
+			m.hasZones = m.hasZones || ep.Zone() != ""
+		}
+		if conf.VirtualAddress != "" {
+			if ip, port, err := stnrv1.ParseVirtualAddress(conf.VirtualAddress); err == nil {
+				m.virtual = util.NewEndpoint(ip, port, port)
+				for _, ep := range m.endpoints {
+					if r.isBackend(m, ep) {
+						m.backends = append(m.backends, ep)
+					}
+				}
+				m.backends = r.preferred(m, m.backends)
+			}
 		}
 	}
 
@@ -175,6 +524,19 @@ func (r *router) getMatcher(cluster string) *clusterMatcher {
 	return m
 }
 
+// lookupService returns the ready endpoints of a Kubernetes service for a protocol.
+func (r *router) lookupService(service string, proto stnrv1.ClusterProtocol) []*util.Endpoint {
+	if r.rt.Endpoints == nil {
+		return nil
+	}
+	eps, err := r.rt.Endpoints.Lookup(service, proto.String())
+	if err != nil {
+		r.log.Debugf("could not look up service %q: %s", service, err.Error())
+		return nil
+	}
+	return eps
+}
+
 func (r *router) getRouteEntry(listener string, routes []string) *routeCacheEntry {
 	curEpoch := r.epoch.Load()
 	routeKey := strings.Join(routes, "\x00")
@@ -193,19 +555,150 @@ func (r *router) getRouteEntry(listener string, routes []string) *routeCacheEntr
 			stnrv1.ClusterProtocolUDP: {},
 			stnrv1.ClusterProtocolTCP: {},
 		},
+		weights: map[stnrv1.ClusterProtocol][]int{
+			stnrv1.ClusterProtocolUDP: {},
+			stnrv1.ClusterProtocolTCP: {},
+		},
+		groupEnd: map[stnrv1.ClusterProtocol][]int{
+			stnrv1.ClusterProtocolUDP: {},
+			stnrv1.ClusterProtocolTCP: {},
+		},
+		conditions: map[stnrv1.ClusterProtocol][]*routeCondition{
+			stnrv1.ClusterProtocolUDP: {},
+			stnrv1.ClusterProtocolTCP: {},
+		},
+		generations: map[stnrv1.ClusterProtocol][]*atomic.Uint64{
+			stnrv1.ClusterProtocolUDP: {},
+			stnrv1.ClusterProtocolTCP: {},
+		},
+		index: map[stnrv1.ClusterProtocol]*atomic.Pointer[routeIndex]{
+			stnrv1.ClusterProtocolUDP: {},
+			stnrv1.ClusterProtocolTCP: {},
+		},
 	}
-	for _, name := range routes {
+	rules := r.getRouteRules(listener)
+	realm := stnrv1.DefaultRealm
+	if conf, ok := r.rt.GetConfig(runtime.TypeAuth, "").(*stnrv1.AuthConfig); ok && conf != nil && conf.Realm != "" {
+		realm = conf.Realm
+	}
+
+	ordered := slices.Clone(routes)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		ra, rb := rules[a], rules[b]
+		if ra.Priority != rb.Priority {
+			return cmp.Compare(ra.Priority, rb.Priority)
+		}
+		if ra.Weight != rb.Weight {
+			return cmp.Compare(rb.Weight, ra.Weight)
+		}
+		return strings.Compare(a, b)
+	})
+
+	priorities := map[stnrv1.ClusterProtocol][]int{}
+	for _, name := range ordered {
+		rule := rules[name]
+		if rule.Match != nil && rule.Match.Realm != "" && rule.Match.Realm != realm {
+			continue
+		}
+		cond := newRouteCondition(rule)
+		if cond != nil {
+			entry.conditional = true
+		}
+
 		m := r.getMatcher(name)
 		switch m.proto {
 		case stnrv1.ClusterProtocolUDP, stnrv1.ClusterProtocolTCP:
 			entry.clusters[m.proto] = append(entry.clusters[m.proto], name)
+			entry.weights[m.proto] = append(entry.weights[m.proto], rule.Weight)
+			entry.conditions[m.proto] = append(entry.conditions[m.proto], cond)
+			entry.generations[m.proto] = append(entry.generations[m.proto], r.generation(name))
+			priorities[m.proto] = append(priorities[m.proto], rule.Priority)
+		}
+	}
+	for proto, prios := range priorities {
+		ends := make([]int, len(prios))
+		for i := len(prios) - 1; i >= 0; i-- {
+			ends[i] = i + 1
+			if i+1 < len(prios) && prios[i+1] == prios[i] {
+				ends[i] = ends[i+1]
+			}
 		}
+		entry.groupEnd[proto] = ends
 	}
 
 	r.routeCache.Add(listener, entry)
 	return entry
 }
 
+// getRouteRules returns the route rules of a listener by cluster name.
+func (r *router) getRouteRules(listener string) map[string]stnrv1.RouteRule {
+	rules := map[string]stnrv1.RouteRule{}
+	if conf, ok := r.rt.GetConfig(runtime.TypeListener, listener).(*stnrv1.ListenerConfig); ok && conf != nil {
+		for _, rule := range conf.RouteRules {
+			rules[rule.Cluster] = rule
+		}
+	}
+	return rules
+}
+
+// newRouteCondition parses the per-request match conditions of a route rule, or returns nil if
+// the route matches all users and peer ports.
+func newRouteCondition(rule stnrv1.RouteRule) *routeCondition {
+	if rule.Match == nil || (rule.Match.PeerPorts == "" && rule.Match.UsernamePrefix == "") {
+		return nil
+	}
+	c := &routeCondition{usernamePrefix: rule.Match.UsernamePrefix}
+	if rule.Match.PeerPorts != "" {
+		if port, endPort, err := rule.Match.PortRange(); err == nil {
+			c.port, c.endPort, c.hasPort = port, endPort, true
+		}
+	}
+	return c
+}
+
+// getRouteIndex returns the route index of the routed clusters of a protocol, building it on a
+// cache miss.
+func (r *router) getRouteIndex(entry *routeCacheEntry, proto stnrv1.ClusterProtocol) *routeIndex {
+	var generation uint64
+	for _, g := range entry.generations[proto] {
+		generation += g.Load()
+	}
+	if idx := entry.index[proto].Load(); idx != nil && idx.generation == generation {
+		return idx
+	}
+
+	idx := &routeIndex{generation: generation, trie: newPrefixTrie()}
+	for i, cluster := range entry.clusters[proto] {
+		m := r.getMatcher(cluster)
+		if m.virtual != nil {
+			idx.trie.insert(m.virtual, i)
+		}
+		if m.typ == stnrv1.ClusterTypeStrictDNS {
+			idx.dynamic = append(idx.dynamic, i)
+			continue
+		}
+		for _, ep := range m.endpoints {
+			idx.trie.insert(ep, i)
+		}
+	}
+
+	entry.index[proto].Store(idx)
+	return idx
+}
+
+// candidates returns, per route position, whether the cluster may admit a peer on some port.
+func (idx *routeIndex) candidates(peer net.IP, n int) []bool {
+	ret := make([]bool, n)
+	for _, i := range idx.dynamic {
+		ret[i] = true
+	}
+	idx.trie.lookup(peer, func(r portRange) bool {
+		ret[r.value] = true
+		return false
+	})
+	return ret
+}
+
 func (r *router) getPeerCluster(listener string, proto stnrv1.ClusterProtocol, peer net.IP, entry *routeCacheEntry) (string, bool) {
 	key := peerCacheKey(listener, proto, peer)
 	v, ok := r.peerCache.Get(key)
@@ -214,7 +707,7 @@ func (r *router) getPeerCluster(listener string, proto stnrv1.ClusterProtocol, p
 	}
 
 	p := v.(*peerCacheValue)
-	if p.epoch != entry.epoch || p.proto != proto {
+	if p.epoch != entry.epoch || p.proto != proto || !entry.valid(p) {
 		r.peerCache.Remove(key)
 		return "", false
 	}
@@ -222,11 +715,28 @@ func (r *router) getPeerCluster(listener string, proto stnrv1.ClusterProtocol, p
 	return p.cluster, true
 }
 
-func (r *router) setPeer(listener string, proto stnrv1.ClusterProtocol, peer net.IP, cluster string, epoch uint64) {
+// valid checks whether a cached peer route is still current: no cluster up to and including the
+// serving cluster has changed since the route was resolved.
+func (e *routeCacheEntry) valid(p *peerCacheValue) bool {
+	gens := e.generations[p.proto]
+	if p.last >= len(gens) || e.clusters[p.proto][p.index] != p.cluster {
+		return false
+	}
+	var generation uint64
+	for _, g := range gens[:p.last+1] {
+		generation += g.Load()
+	}
+	return generation == p.generation
+}
+
+func (r *router) setPeer(listener string, proto stnrv1.ClusterProtocol, peer net.IP, cluster string, epoch uint64, index, last int, generation uint64) {
 	r.peerCache.Add(peerCacheKey(listener, proto, peer), &peerCacheValue{
-		epoch:   epoch,
-		proto:   proto,
-		cluster: cluster,
+		epoch:      epoch,
+		proto:      proto,
+		cluster:    cluster,
+		index:      index,
+		last:       last,
+		generation: generation,
 	})
 }
 
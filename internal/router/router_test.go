@@ -1,13 +1,23 @@
 package router_test
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 
+	"github.com/l7mp/stunner/internal/resolver"
 	"github.com/l7mp/stunner/internal/router"
 	"github.com/l7mp/stunner/internal/runtime"
+	"github.com/l7mp/stunner/internal/telemetry"
+	"github.com/l7mp/stunner/internal/util"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 	"github.com/l7mp/stunner/pkg/logger"
 )
@@ -30,7 +40,7 @@ func (o *fakeReconcilable) Inspect(_, _ stnrv1.Config, _ *stnrv1.StunnerConfig)
 }
 func (o *fakeReconcilable) Reconcile(_ stnrv1.Config) error { return nil }
 
-func newRuntime(t *testing.T) *runtime.Runtime {
+func newRuntime(t testing.TB) *runtime.Runtime {
 	t.Helper()
 	log := logger.NewLoggerFactory("all:ERROR")
 	rt := runtime.New(runtime.Config{Logger: log, DryRun: true})
@@ -39,7 +49,7 @@ func newRuntime(t *testing.T) *runtime.Runtime {
 }
 
 // addCluster registers a static fake cluster so the Router can resolve and match it via GetConfig.
-func addCluster(t *testing.T, rt *runtime.Runtime, name string, proto stnrv1.ClusterProtocol, endpoints ...string) {
+func addCluster(t testing.TB, rt *runtime.Runtime, name string, proto stnrv1.ClusterProtocol, endpoints ...string) {
 	t.Helper()
 	c := &fakeReconcilable{
 		name: name,
@@ -64,6 +74,291 @@ func TestRouterMatch(t *testing.T) {
 	require.False(t, rt.Router.Match("nonexistent", net.ParseIP("10.0.0.1"), 0))
 }
 
+func TestRouterStrictDNS(t *testing.T) {
+	log := logger.NewLoggerFactory("all:ERROR")
+	rt := runtime.New(runtime.Config{Logger: log, DryRun: true, Resolver: resolver.NewMockResolver(
+		map[string][]string{
+			"media.example.com":      {"10.0.0.1"},
+			"_turn._udp.example.com": {"10.0.0.2:<5000-5000>"},
+		}, log)})
+	rt.Router = router.NewRouter(rt)
+	require.NoError(t, rt.Registry.Add(&fakeReconcilable{
+		name: "dns",
+		typ:  runtime.TypeCluster,
+		config: &stnrv1.ClusterConfig{
+			Name:      "dns",
+			Type:      stnrv1.ClusterTypeStrictDNS.String(),
+			Protocol:  stnrv1.ClusterProtocolUDP.String(),
+			Endpoints: []string{"media.example.com", "_turn._udp.example.com"},
+		},
+	}, nil))
+
+	// Plain domains admit all ports, SRV domains only the ports of the SRV records.
+	require.True(t, rt.Router.Match("dns", net.ParseIP("10.0.0.1"), 1234))
+	require.True(t, rt.Router.Match("dns", net.ParseIP("10.0.0.2"), 5000))
+	require.False(t, rt.Router.Match("dns", net.ParseIP("10.0.0.2"), 5001))
+	require.False(t, rt.Router.Match("dns", net.ParseIP("10.0.0.3"), 5000))
+}
+
+func TestRouterInvalidateCluster(t *testing.T) {
+	log := logger.NewLoggerFactory("all:ERROR")
+	dns := resolver.NewMockResolver(map[string][]string{"media.example.com": {"10.0.0.1"}}, log)
+	rt := runtime.New(runtime.Config{Logger: log, DryRun: true, Resolver: dns})
+	rt.Router = router.NewRouter(rt)
+	require.NoError(t, rt.Registry.Add(&fakeReconcilable{
+		name: "dns",
+		typ:  runtime.TypeCluster,
+		config: &stnrv1.ClusterConfig{
+			Name:      "dns",
+			Type:      stnrv1.ClusterTypeStrictDNS.String(),
+			Protocol:  stnrv1.ClusterProtocolUDP.String(),
+			Endpoints: []string{"media.example.com"},
+		},
+	}, nil))
+	addCluster(t, rt, "fallback", stnrv1.ClusterProtocolUDP, "10.0.0.0/8")
+	routes := []string{"dns", "fallback"}
+	route := func(peer string) string {
+		cluster, ok := rt.Router.Route("listener", routes, stnrv1.ClusterProtocolUDP, net.ParseIP(peer), 0)
+		if !ok {
+			return ""
+		}
+		return cluster
+	}
+
+	require.Equal(t, "dns", route("10.0.0.1"))
+	require.Equal(t, "fallback", route("10.0.0.2"))
+
+	// The peer moves: the cached route is stale until the cluster is invalidated.
+	dns.(*resolver.MockResolver).Zone["media.example.com"] = []string{"10.0.0.2"}
+	require.Equal(t, "", route("10.0.0.1"))
+	rt.Router.InvalidateCluster("dns")
+	require.Equal(t, "fallback", route("10.0.0.1"))
+
+	// Routes past the invalidated cluster are invalidated too.
+	require.Equal(t, "dns", route("10.0.0.2"))
+}
+
+// closer records whether it was closed.
+type closer struct{ closed atomic.Bool }
+
+func (c *closer) Close() error { c.closed.Store(true); return nil }
+
+func TestRouterRevokeRemovedPeers(t *testing.T) {
+	for _, revoke := range []bool{false, true} {
+		log := logger.NewLoggerFactory("all:ERROR")
+		dns := resolver.NewMockResolver(map[string][]string{"media.example.com": {"10.0.0.1", "10.0.0.2"}}, log)
+		rt := runtime.New(runtime.Config{Logger: log, DryRun: true, Resolver: dns})
+		rt.Router = router.NewRouter(rt)
+		require.NoError(t, rt.Registry.Add(&fakeReconcilable{
+			name: "dns",
+			typ:  runtime.TypeCluster,
+			config: &stnrv1.ClusterConfig{
+				Name:               "dns",
+				Type:               stnrv1.ClusterTypeStrictDNS.String(),
+				Protocol:           stnrv1.ClusterProtocolTCP.String(),
+				Endpoints:          []string{"media.example.com"},
+				RevokeRemovedPeers: revoke,
+			},
+		}, nil))
+		require.Equal(t, revoke, rt.Router.RevokesRemovedPeers("dns"))
+
+		removed, kept, untracked := &closer{}, &closer{}, &closer{}
+		rt.Router.TrackConn("dns", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}, removed)
+		rt.Router.TrackConn("dns", &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}, kept)
+		untrack := rt.Router.TrackConn("dns", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1235}, untracked)
+		untrack()
+
+		// Only the connections to the removed peers are closed, and only if the cluster
+		// revokes removed peers.
+		dns.(*resolver.MockResolver).Zone["media.example.com"] = []string{"10.0.0.2"}
+		rt.Router.InvalidateCluster("dns")
+		require.Equal(t, revoke, removed.closed.Load())
+		require.False(t, kept.closed.Load())
+		require.False(t, untracked.closed.Load())
+	}
+}
+
+func TestRouterTelemetry(t *testing.T) {
+	log := logger.NewLoggerFactory("all:ERROR")
+	tm, err := telemetry.New(telemetry.Callbacks{GetAllocationCount: func() int64 { return 0 }}, true,
+		log.NewLogger("metric"))
+	require.NoError(t, err)
+	defer tm.Close() //nolint:errcheck
+	rt := runtime.New(runtime.Config{Logger: log, DryRun: true, Telemetry: tm})
+	rt.Router = router.NewRouter(rt)
+	addCluster(t, rt, "media", stnrv1.ClusterProtocolUDP, "10.0.0.0/8")
+
+	lookups := func(result string) int64 {
+		rm := metricdata.ResourceMetrics{}
+		require.NoError(t, tm.Collect(context.Background(), &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != "stunner_route_cache_lookups_total" {
+					continue
+				}
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					if v, ok := dp.Attributes.Value(attribute.Key("result")); ok && v.AsString() == result {
+						return dp.Value
+					}
+				}
+			}
+		}
+		return 0
+	}
+
+	for range 3 {
+		_, ok := rt.Router.Route("listener", []string{"media"}, stnrv1.ClusterProtocolUDP, net.ParseIP("10.0.0.1"), 0)
+		require.True(t, ok)
+	}
+	require.Equal(t, int64(1), lookups("miss"))
+	require.Equal(t, int64(2), lookups("hit"))
+
+	// The default deny-list covers loopback peers.
+	require.True(t, rt.Router.Denied(net.ParseIP("127.0.0.1"), 0))
+	require.False(t, rt.Router.Denied(net.ParseIP("10.0.0.1"), 0))
+}
+
+// healthCheckedCluster is a fake cluster that reports the health of its endpoints.
+type healthCheckedCluster struct {
+	fakeReconcilable
+	unhealthy sync.Map // endpoint -> bool
+}
+
+func (c *healthCheckedCluster) Healthy(ep *util.Endpoint) bool {
+	_, ok := c.unhealthy.Load(ep.String())
+	return !ok
+}
+
+func TestRouterHealthCheck(t *testing.T) {
+	rt := newRuntime(t)
+	c := &healthCheckedCluster{fakeReconcilable: fakeReconcilable{
+		name: "media",
+		typ:  runtime.TypeCluster,
+		config: &stnrv1.ClusterConfig{
+			Name:        "media",
+			Type:        stnrv1.ClusterTypeStatic.String(),
+			Protocol:    stnrv1.ClusterProtocolUDP.String(),
+			Endpoints:   []string{"10.0.0.1", "10.0.0.2"},
+			HealthCheck: &stnrv1.HealthCheckConfig{Type: "UDP", Port: 5000},
+		},
+	}}
+	require.NoError(t, rt.Registry.Add(c, nil))
+	addCluster(t, rt, "spare", stnrv1.ClusterProtocolUDP, "10.0.0.2")
+	route := func(peer string) string {
+		cluster, _ := rt.Router.Route("listener", []string{"media", "spare"}, stnrv1.ClusterProtocolUDP,
+			net.ParseIP(peer), 0)
+		return cluster
+	}
+
+	require.Equal(t, "media", route("10.0.0.1"))
+	require.Equal(t, "media", route("10.0.0.2"))
+
+	// Unhealthy endpoints do not admit peers once the cluster is invalidated.
+	c.unhealthy.Store("10.0.0.1", true)
+	c.unhealthy.Store("10.0.0.2", true)
+	rt.Router.InvalidateCluster("media")
+	require.Equal(t, "", route("10.0.0.1"))
+	require.Equal(t, "spare", route("10.0.0.2"))
+	require.False(t, rt.Router.Match("media", net.ParseIP("10.0.0.1"), 0))
+
+	c.unhealthy.Delete("10.0.0.1")
+	rt.Router.InvalidateCluster("media")
+	require.Equal(t, "media", route("10.0.0.1"))
+}
+
+func TestRouterVirtualAddress(t *testing.T) {
+	rt := newRuntime(t)
+	require.NoError(t, rt.Registry.Add(&fakeReconcilable{
+		name: "media",
+		typ:  runtime.TypeCluster,
+		config: &stnrv1.ClusterConfig{
+			Name:           "media",
+			Type:           stnrv1.ClusterTypeStatic.String(),
+			Protocol:       stnrv1.ClusterProtocolUDP.String(),
+			Endpoints:      []string{"10.0.0.1:<5000-5000>", "10.0.0.3", "10.0.1.0/24", "!10.0.0.3", "127.0.0.1"},
+			VirtualAddress: "10.96.0.10:3478",
+		},
+	}, nil))
+	vip := net.ParseIP("10.96.0.10")
+
+	// The virtual address is admitted by the cluster.
+	cluster, ok := rt.Router.Route("listener", []string{"media"}, stnrv1.ClusterProtocolUDP, vip, 3478)
+	require.True(t, ok)
+	require.Equal(t, "media", cluster)
+	_, ok = rt.Router.Route("listener", []string{"media"}, stnrv1.ClusterProtocolUDP, vip, 3479)
+	require.False(t, ok)
+
+	// Prefixes, excluded and denied endpoints are not backends.
+	backends, ok := rt.Router.VirtualBackends("media", vip, 3478)
+	require.True(t, ok)
+	require.Len(t, backends, 1)
+	require.Equal(t, "10.0.0.1:<5000-5000>", backends[0].String())
+	_, ok = rt.Router.VirtualBackends("media", net.ParseIP("10.0.0.1"), 5000)
+	require.False(t, ok)
+}
+
+func TestRouterTopology(t *testing.T) {
+	rt := runtime.New(runtime.Config{Logger: logger.NewLoggerFactory("all:ERROR"), DryRun: true,
+		NodeName: "node-a", Zone: "zone-a"})
+	rt.Router = router.NewRouter(rt)
+	topology := map[string]stnrv1.EndpointTopology{
+		"10.0.0.1": {Node: "node-a", Zone: "zone-a"},
+		"10.0.0.2": {Node: "node-b", Zone: "zone-a"},
+		"10.0.0.3": {Node: "node-c", Zone: "zone-b"},
+	}
+	addTopologyCluster := func(name, mode string, endpoints ...string) {
+		require.NoError(t, rt.Registry.Add(&fakeReconcilable{
+			name: name,
+			typ:  runtime.TypeCluster,
+			config: &stnrv1.ClusterConfig{
+				Name:           name,
+				Type:           stnrv1.ClusterTypeStatic.String(),
+				Protocol:       stnrv1.ClusterProtocolUDP.String(),
+				Endpoints:      endpoints,
+				VirtualAddress: "10.96.0.10:3478",
+				TopologyMode:   mode,
+				Topology:       topology,
+			},
+		}, nil))
+	}
+	all := []string{"10.0.0.1:<5000-5000>", "10.0.0.2:<5000-5000>", "10.0.0.3:<5000-5000>"}
+	addTopologyCluster("require-node", "REQUIRE_NODE", all...)
+	addTopologyCluster("require-zone", "REQUIRE_ZONE", all...)
+	addTopologyCluster("prefer-node", "PREFER_NODE", all...)
+	addTopologyCluster("prefer-zone", "PREFER_ZONE", all...)
+	addTopologyCluster("prefer-remote", "PREFER_NODE", "10.0.0.3:<5000-5000>")
+	vip := net.ParseIP("10.96.0.10")
+
+	backends := func(cluster string) []string {
+		eps, ok := rt.Router.VirtualBackends(cluster, vip, 3478)
+		require.True(t, ok)
+		ret := []string{}
+		for _, ep := range eps {
+			ret = append(ret, ep.IP().String())
+		}
+		return ret
+	}
+
+	// REQUIRE modes restrict the admitting endpoints.
+	require.True(t, rt.Router.Match("require-node", net.ParseIP("10.0.0.1"), 5000))
+	require.False(t, rt.Router.Match("require-node", net.ParseIP("10.0.0.2"), 5000))
+	require.True(t, rt.Router.Match("require-zone", net.ParseIP("10.0.0.2"), 5000))
+	require.False(t, rt.Router.Match("require-zone", net.ParseIP("10.0.0.3"), 5000))
+	require.Equal(t, []string{"10.0.0.1"}, backends("require-node"))
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, backends("require-zone"))
+
+	// PREFER modes admit all endpoints but select the backends of the best locality.
+	require.True(t, rt.Router.Match("prefer-node", net.ParseIP("10.0.0.3"), 5000))
+	require.Equal(t, []string{"10.0.0.1"}, backends("prefer-node"))
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, backends("prefer-zone"))
+	require.Equal(t, []string{"10.0.0.3"}, backends("prefer-remote"))
+
+	// Cross-zone peers are identified by the topology of their endpoint.
+	require.False(t, rt.Router.CrossZone("prefer-node", net.ParseIP("10.0.0.2")))
+	require.True(t, rt.Router.CrossZone("prefer-node", net.ParseIP("10.0.0.3")))
+	require.False(t, rt.Router.CrossZone("prefer-node", net.ParseIP("10.0.0.4")))
+}
+
 func TestRouteWithProtocol(t *testing.T) {
 	rt := newRuntime(t)
 	peer := net.ParseIP("10.0.0.1")
@@ -99,3 +394,308 @@ func TestRouteWithProtocol(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, "cluster-udp", got)
 }
+
+// fakeAuth restricts users to clusters.
+type fakeAuth struct {
+	fakeReconcilable
+	users map[string][]string
+}
+
+func (a *fakeAuth) UserClusters(user runtime.User) ([]string, bool) {
+	c, ok := a.users[user.ID]
+	return c, ok
+}
+
+func TestRouteUser(t *testing.T) {
+	rt := newRuntime(t)
+	peerA, peerB := net.ParseIP("10.0.0.1"), net.ParseIP("10.1.0.1")
+
+	addCluster(t, rt, "tenant-a", stnrv1.ClusterProtocolUDP, "10.0.0.0/16")
+	addCluster(t, rt, "tenant-b", stnrv1.ClusterProtocolUDP, "10.1.0.0/16")
+	addCluster(t, rt, "shared", stnrv1.ClusterProtocolUDP, "10.0.0.0/8")
+	require.NoError(t, rt.Registry.Add(&fakeAuth{
+		fakeReconcilable: fakeReconcilable{name: stnrv1.DefaultAuthName, typ: runtime.TypeAuth},
+		users:            map[string][]string{"user-a": {"tenant-a"}, "nobody": {}},
+	}, nil))
+
+	routes := []string{"tenant-a", "tenant-b"}
+
+	// Unrestricted users reach all routed clusters.
+	got, ok := rt.Router.RouteUser("listener", routes, runtime.User{ID: "user-x"}, stnrv1.ClusterProtocolUDP, peerB, 0)
+	require.True(t, ok)
+	require.Equal(t, "tenant-b", got)
+
+	// Restricted users reach only their own clusters, even if the peer is cached.
+	got, ok = rt.Router.RouteUser("listener", routes, runtime.User{ID: "user-a"}, stnrv1.ClusterProtocolUDP, peerA, 0)
+	require.True(t, ok)
+	require.Equal(t, "tenant-a", got)
+	_, ok = rt.Router.RouteUser("listener", routes, runtime.User{ID: "user-a"}, stnrv1.ClusterProtocolUDP, peerB, 0)
+	require.False(t, ok)
+	_, ok = rt.Router.RouteUser("listener", routes, runtime.User{ID: "nobody"}, stnrv1.ClusterProtocolUDP, peerA, 0)
+	require.False(t, ok)
+
+	// Clusters not routed from the listener remain unreachable.
+	_, ok = rt.Router.RouteUser("listener", []string{"shared"}, runtime.User{ID: "user-a"}, stnrv1.ClusterProtocolUDP, peerA, 0)
+	require.False(t, ok)
+
+	// Protocol is enforced.
+	_, ok = rt.Router.RouteUser("listener", routes, runtime.User{ID: "user-a"}, stnrv1.ClusterProtocolTCP, peerA, 0)
+	require.False(t, ok)
+
+	got, ok = router.RouteAny(rt, "listener", routes, runtime.User{ID: "user-a"}, peerA)
+	require.True(t, ok)
+	require.Equal(t, "tenant-a", got)
+}
+
+func TestRouteRules(t *testing.T) {
+	rt := newRuntime(t)
+	for _, c := range []string{"a", "b", "c", "d", "e"} {
+		addCluster(t, rt, c, stnrv1.ClusterProtocolUDP, "10.0.0.0/8")
+	}
+	addListener := func(name string, routes []string, rules ...stnrv1.RouteRule) {
+		t.Helper()
+		require.NoError(t, rt.Registry.Add(&fakeReconcilable{
+			name:   name,
+			typ:    runtime.TypeListener,
+			config: &stnrv1.ListenerConfig{Name: name, Routes: routes, RouteRules: rules},
+		}, nil))
+	}
+	route := func(listener string, routes []string, user string, port int) string {
+		cluster, ok := rt.Router.RouteUser(listener, routes, runtime.User{ID: user}, stnrv1.ClusterProtocolUDP, net.ParseIP("10.0.0.1"), port)
+		if !ok {
+			return ""
+		}
+		return cluster
+	}
+
+	// Overlapping plain routes are tried in alphabetical order.
+	require.Equal(t, "a", route("plain", []string{"a", "b"}, "", 0))
+
+	// Priority and weight override the alphabetical order.
+	addListener("priority", []string{"a", "b"}, stnrv1.RouteRule{Cluster: "a", Priority: 1})
+	require.Equal(t, "b", route("priority", []string{"a", "b"}, "", 0))
+	addListener("weight", []string{"a", "b"}, stnrv1.RouteRule{Cluster: "b", Weight: 10})
+	require.Equal(t, "b", route("weight", []string{"a", "b"}, "", 0))
+
+	// Peers are spread across the routes of the same priority in proportion to the weights, and
+	// each peer sticks to its route.
+	addListener("weights", []string{"a", "b"}, stnrv1.RouteRule{Cluster: "a", Weight: 1},
+		stnrv1.RouteRule{Cluster: "b", Weight: 3})
+	counts := map[string]int{}
+	for i := range 4000 {
+		peer := net.IPv4(10, 1, byte(i>>8), byte(i))
+		cluster, ok := rt.Router.Route("weights", []string{"a", "b"}, stnrv1.ClusterProtocolUDP, peer, 0)
+		require.True(t, ok)
+		again, _ := rt.Router.RouteUser("weights", []string{"a", "b"}, runtime.User{ID: "user"}, stnrv1.ClusterProtocolUDP, peer, 0)
+		require.Equal(t, cluster, again)
+		counts[cluster]++
+	}
+	require.InDelta(t, 3000, counts["b"], 200)
+	require.InDelta(t, 1000, counts["a"], 200)
+
+	// Match conditions select the route per user and per peer port.
+	routes := []string{"a", "c", "d", "e"}
+	addListener("match", routes,
+		stnrv1.RouteRule{Cluster: "c", Priority: -1, Match: &stnrv1.RouteMatch{PeerPorts: "5000-5999"}},
+		stnrv1.RouteRule{Cluster: "d", Priority: -2, Match: &stnrv1.RouteMatch{UsernamePrefix: "vip-"}},
+		stnrv1.RouteRule{Cluster: "e", Priority: -3, Match: &stnrv1.RouteMatch{Realm: "other-realm"}})
+	require.Equal(t, "d", route("match", routes, "vip-user", 6000))
+	require.Equal(t, "c", route("match", routes, "user", 5500))
+	require.Equal(t, "a", route("match", routes, "user", 6000))
+	require.Equal(t, "c", route("match", routes, "user", 0), "unknown port matches")
+	cluster, ok := rt.Router.Route("match", routes, stnrv1.ClusterProtocolUDP, net.ParseIP("10.0.0.1"), 6000)
+	require.True(t, ok)
+	require.Equal(t, "a", cluster, "unknown user does not match")
+}
+
+func TestRouterExclusions(t *testing.T) {
+	rt := newRuntime(t)
+	addCluster(t, rt, "open", stnrv1.ClusterProtocolUDP, "0.0.0.0/0", "!10.0.0.0/8", "!192.168.0.1:<22-22>")
+
+	// Negative endpoints win over admitting ones.
+	require.True(t, rt.Router.Match("open", net.ParseIP("192.168.0.2"), 0))
+	require.False(t, rt.Router.Match("open", net.ParseIP("10.1.2.3"), 0))
+	require.False(t, rt.Router.Match("open", net.ParseIP("10.1.2.3"), 1234))
+	_, ok := rt.Router.Route("listener", []string{"open"}, stnrv1.ClusterProtocolUDP, net.ParseIP("10.1.2.3"), 0)
+	require.False(t, ok)
+
+	// Port-specific exclusions apply only when the port is known.
+	require.True(t, rt.Router.Match("open", net.ParseIP("192.168.0.1"), 0))
+	require.True(t, rt.Router.Match("open", net.ParseIP("192.168.0.1"), 80))
+	require.False(t, rt.Router.Match("open", net.ParseIP("192.168.0.1"), 22))
+
+	// The default deny-list is enforced even for open clusters.
+	for _, peer := range []string{"127.0.0.1", "169.254.169.254", "0.0.0.0", "100.100.100.200", "::1", "fe80::1", "fd00:ec2::254", "::ffff:127.0.0.1"} {
+		require.False(t, rt.Router.Match("open", net.ParseIP(peer), 0), peer)
+	}
+
+	// The deny-list can be overridden in the admin config.
+	require.NoError(t, rt.Registry.Add(&fakeReconcilable{
+		name:   stnrv1.DefaultAdminName,
+		typ:    runtime.TypeAdmin,
+		config: &stnrv1.AdminConfig{PeerDenyList: &[]string{"192.168.0.0/16"}},
+	}, nil))
+	rt.Router.InvalidateCache()
+	require.True(t, rt.Router.Match("open", net.ParseIP("127.0.0.1"), 0))
+	require.False(t, rt.Router.Match("open", net.ParseIP("192.168.0.2"), 0))
+	require.False(t, rt.Router.Match("open", net.ParseIP("10.1.2.3"), 0))
+}
+
+// randomEndpoints returns n random endpoints in 10.0.0.0/8 and 2001:db8::/32 with an IPv4 prefix
+// length of at least minLen, some with port ranges.
+func randomEndpoints(rng *rand.Rand, n, minLen int) []string {
+	ret := make([]string, 0, n)
+	for range n {
+		var ep string
+		if rng.Intn(4) == 0 {
+			ep = fmt.Sprintf("2001:db8:%x:%x::/%d", rng.Intn(1<<16), rng.Intn(1<<16), 32+rng.Intn(97))
+		} else {
+			ep = fmt.Sprintf("10.%d.%d.%d/%d", rng.Intn(256), rng.Intn(256), rng.Intn(256), minLen+rng.Intn(33-minLen))
+		}
+		if rng.Intn(2) == 0 {
+			port := 1 + rng.Intn(60000)
+			ep += fmt.Sprintf(":<%d-%d>", port, port+rng.Intn(5000))
+		}
+		ret = append(ret, ep)
+	}
+	return ret
+}
+
+// randomPeer returns a random peer address in the ranges used by randomEndpoints.
+func randomPeer(rng *rand.Rand) net.IP {
+	if rng.Intn(4) == 0 {
+		return net.ParseIP(fmt.Sprintf("2001:db8:%x:%x::%x", rng.Intn(1<<16), rng.Intn(1<<16), rng.Intn(1<<16)))
+	}
+	return net.IPv4(10, byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256)))
+}
+
+// linearMatch is the reference linear matcher: exclusions win over admitting endpoints.
+func linearMatch(endpoints, exclusions []*util.Endpoint, peer net.IP, port int) bool {
+	for _, e := range exclusions {
+		if (port != 0 || !e.HasPort()) && e.Match(peer, port) {
+			return false
+		}
+	}
+	for _, e := range endpoints {
+		if e.Match(peer, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseEndpoints(t testing.TB, eps []string) []*util.Endpoint {
+	t.Helper()
+	ret := make([]*util.Endpoint, 0, len(eps))
+	for _, e := range eps {
+		ep, err := util.ParseEndpoint(e)
+		require.NoError(t, err)
+		ret = append(ret, ep)
+	}
+	return ret
+}
+
+func TestRouterTrieMatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	rt := newRuntime(t)
+
+	admit := randomEndpoints(rng, 2000, 8)
+	exclude := randomEndpoints(rng, 200, 8)
+	config := append([]string{}, admit...)
+	for _, e := range exclude {
+		config = append(config, "!"+e)
+	}
+	addCluster(t, rt, "big", stnrv1.ClusterProtocolUDP, config...)
+	endpoints, exclusions := parseEndpoints(t, admit), parseEndpoints(t, exclude)
+
+	for range 20000 {
+		peer, port := randomPeer(rng), 0
+		if rng.Intn(2) == 0 {
+			port = 1 + rng.Intn(65535)
+		}
+		require.Equal(t, linearMatch(endpoints, exclusions, peer, port),
+			rt.Router.Match("big", peer, port), "peer %s, port %d", peer, port)
+	}
+
+	// Routing over the listener index agrees with matching each cluster in route order.
+	routes := []string{"big"}
+	for i := range 8 {
+		name := fmt.Sprintf("cluster-%d", i)
+		addCluster(t, rt, name, stnrv1.ClusterProtocolUDP, randomEndpoints(rng, 100, 8)...)
+		routes = append(routes, name)
+	}
+	for range 5000 {
+		peer := randomPeer(rng)
+		want := ""
+		for _, c := range routes {
+			if rt.Router.Match(c, peer, 0) {
+				want = c
+				break
+			}
+		}
+		got, _ := rt.Router.Route("listener", routes, stnrv1.ClusterProtocolUDP, peer, 0)
+		require.Equal(t, want, got, "peer %s", peer)
+	}
+}
+
+func BenchmarkRouterMatch(b *testing.B) {
+	for _, n := range []int{16, 256, 4096} {
+		rng := rand.New(rand.NewSource(1))
+		config := randomEndpoints(rng, n, 16)
+		endpoints := parseEndpoints(b, config)
+		peers := make([]net.IP, 1024)
+		for i := range peers {
+			peers[i] = randomPeer(rng)
+		}
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := range b.N {
+				linearMatch(endpoints, nil, peers[i%len(peers)], 5000)
+			}
+		})
+
+		rt := newRuntime(b)
+		addCluster(b, rt, "big", stnrv1.ClusterProtocolUDP, config...)
+		b.Run(fmt.Sprintf("trie/%d", n), func(b *testing.B) {
+			for i := range b.N {
+				rt.Router.Match("big", peers[i%len(peers)], 5000)
+			}
+		})
+	}
+}
+
+// BenchmarkRouterRouteMiss routes distinct peers over many clusters, with most lookups missing the
+// peer cache.
+func BenchmarkRouterRouteMiss(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	rt := newRuntime(b)
+	routes := []string{}
+	clusters := [][]*util.Endpoint{}
+	for i := range 16 {
+		name := fmt.Sprintf("cluster-%d", i)
+		config := randomEndpoints(rng, 256, 16)
+		addCluster(b, rt, name, stnrv1.ClusterProtocolUDP, config...)
+		routes = append(routes, name)
+		clusters = append(clusters, parseEndpoints(b, config))
+	}
+	peers := make([]net.IP, 1<<16)
+	for i := range peers {
+		peers[i] = randomPeer(rng)
+	}
+
+	b.Run("linear", func(b *testing.B) {
+		for i := range b.N {
+			for _, eps := range clusters {
+				if linearMatch(eps, nil, peers[i%len(peers)], 0) {
+					break
+				}
+			}
+		}
+	})
+
+	b.Run("trie", func(b *testing.B) {
+		for i := range b.N {
+			rt.Router.Route("listener", routes, stnrv1.ClusterProtocolUDP, peers[i%len(peers)], 0)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package router
+
+import (
+	"net"
+
+	"github.com/l7mp/stunner/internal/util"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// Locality ranks of an endpoint relative to stunnerd.
+const (
+	rankNode = iota
+	rankZone
+	rankRemote
+)
+
+// locate returns the node and the zone of an endpoint. The topology of the cluster config
+// overrides the topology of the endpoint.
+func (m *clusterMatcher) locate(ep *util.Endpoint) (string, string) {
+	if t, ok := m.topology[ep.IP().String()]; ok {
+		return t.Node, t.Zone
+	}
+	return ep.Node(), ep.Zone()
+}
+
+// rank returns the locality rank of an endpoint: on the node of stunnerd, in the zone of stunnerd,
+// or remote. Endpoints with unknown topology are remote.
+func (r *router) rank(m *clusterMatcher, ep *util.Endpoint) int {
+	node, zone := m.locate(ep)
+	switch {
+	case r.rt.NodeName != "" && node == r.rt.NodeName:
+		return rankNode
+	case r.rt.Zone != "" && zone == r.rt.Zone:
+		return rankZone
+	default:
+		return rankRemote
+	}
+}
+
+// local reports whether an endpoint may admit peers under the REQUIRE topology modes of a cluster.
+// The modes have no effect if the node, resp., the zone of stunnerd is unknown.
+func (r *router) local(m *clusterMatcher, ep *util.Endpoint) bool {
+	switch m.mode {
+	case stnrv1.TopologyModeRequireNode:
+		return r.rt.NodeName == "" || r.rank(m, ep) == rankNode
+	case stnrv1.TopologyModeRequireZone:
+		return r.rt.Zone == "" || r.rank(m, ep) <= rankZone
+	default:
+		return true
+	}
+}
+
+// preferred returns the endpoints of the best locality rank under the PREFER topology modes of a
+// cluster, or all endpoints otherwise.
+func (r *router) preferred(m *clusterMatcher, eps []*util.Endpoint) []*util.Endpoint {
+	var rank func(ep *util.Endpoint) int
+	switch m.mode {
+	case stnrv1.TopologyModePreferNode:
+		rank = func(ep *util.Endpoint) int { return r.rank(m, ep) }
+	case stnrv1.TopologyModePreferZone:
+		rank = func(ep *util.Endpoint) int { return max(r.rank(m, ep), rankZone) }
+	default:
+		return eps
+	}
+
+	best := rankRemote
+	for _, ep := range eps {
+		best = min(best, rank(ep))
+	}
+	var ret []*util.Endpoint
+	for _, ep := range eps {
+		if rank(ep) == best {
+			ret = append(ret, ep)
+		}
+	}
+	return ret
+}
+
+// CrossZone reports whether a peer of a cluster is at an endpoint in a different zone than
+// stunnerd. Peers at endpoints with unknown zone are not cross-zone.
+func (r *router) CrossZone(cluster string, peer net.IP) bool {
+	if r.rt.Zone == "" {
+		return false
+	}
+	m := r.getMatcher(cluster)
+	if !m.hasZones {
+		return false
+	}
+
+	crossZone := func(ep *util.Endpoint) bool {
+		_, zone := m.locate(ep)
+		return zone != "" && zone != r.rt.Zone
+	}
+	if m.typ != stnrv1.ClusterTypeStrictDNS {
+		return m.trie.lookup(peer, func(pr portRange) bool { return crossZone(m.endpoints[pr.value]) })
+	}
+	if r.rt.Resolver == nil {
+		return false
+	}
+	for _, d := range m.domains {
+		eps, err := r.rt.Resolver.LookupEndpoints(d)
+		if err != nil {
+			continue
+		}
+		for _, ep := range eps {
+			if ep.Contains(peer) && crossZone(ep) {
+				return true
+			}
+		}
+	}
+	return false
+}
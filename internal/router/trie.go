@@ -0,0 +1,184 @@
+package router
+
+import (
+	"math/bits"
+	"net"
+
+	"github.com/l7mp/stunner/internal/util"
+)
+
+// portRange is the port range of an endpoint stored at a trie prefix. value is the payload of the
+// entry, e.g., the route position of the cluster the endpoint belongs to.
+type portRange struct {
+	port, endPort int
+	hasPort       bool
+	value         int
+}
+
+// admits reports whether the range admits a port. If port is zero then port-matching is disabled.
+func (r portRange) admits(port int) bool {
+	return port == 0 || (r.port <= port && r.endPort >= port)
+}
+
+// excludes reports whether the range excludes a port. If port is zero, only ranges covering all
+// ports apply: port-specific exclusions are enforced at flow establishment.
+func (r portRange) excludes(port int) bool {
+	if port == 0 {
+		return !r.hasPort
+	}
+	return r.port <= port && r.endPort >= port
+}
+
+type trieNode struct {
+	key    []byte // masked to the prefix length
+	bits   int    // prefix length
+	ranges []portRange
+	child  [2]*trieNode
+}
+
+// prefixTrie is a path-compressed binary trie over IPv4 and IPv6 prefixes with port ranges at the
+// prefixes. A lookup walks at most one node per distinct prefix length along the path of the
+// peer address, independently of the number of endpoints.
+type prefixTrie struct {
+	v4, v6 *trieNode
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{}
+}
+
+// trieKey returns the lookup key of an IP address and whether the address is IPv6. IPv4-mapped
+// IPv6 addresses are looked up as IPv4 addresses, like in net.IPNet.Contains.
+func trieKey(ip net.IP) ([]byte, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, false
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16, true
+	}
+	return nil, false
+}
+
+// insert adds an endpoint to the trie.
+func (t *prefixTrie) insert(ep *util.Endpoint, value int) {
+	prefix := ep.Prefix()
+	key, v6 := trieKey(prefix.IP)
+	if key == nil {
+		return
+	}
+	ones, size := prefix.Mask.Size()
+	if !v6 && size == 8*net.IPv6len {
+		ones = max(ones-8*(net.IPv6len-net.IPv4len), 0)
+	}
+	port, endPort := ep.PortRange()
+	r := portRange{port: port, endPort: endPort, hasPort: ep.HasPort(), value: value}
+
+	root := &t.v4
+	if v6 {
+		root = &t.v6
+	}
+	insertNode(root, maskKey(key, ones), ones, r)
+}
+
+func insertNode(n **trieNode, key []byte, prefixLen int, r portRange) {
+	for {
+		cur := *n
+		if cur == nil {
+			*n = &trieNode{key: key, bits: prefixLen, ranges: []portRange{r}}
+			return
+		}
+
+		common := min(commonBits(cur.key, key), cur.bits, prefixLen)
+		if common == cur.bits {
+			if prefixLen == cur.bits {
+				cur.ranges = append(cur.ranges, r)
+				return
+			}
+			n = &cur.child[bitAt(key, cur.bits)]
+			continue
+		}
+
+		// split the path at the common prefix
+		leaf := &trieNode{key: key, bits: prefixLen, ranges: []portRange{r}}
+		if common == prefixLen {
+			leaf.child[bitAt(cur.key, prefixLen)] = cur
+			*n = leaf
+			return
+		}
+		branch := &trieNode{key: maskKey(key, common), bits: common}
+		branch.child[bitAt(cur.key, common)] = cur
+		branch.child[bitAt(key, common)] = leaf
+		*n = branch
+		return
+	}
+}
+
+// lookup calls fn on the port ranges of all prefixes containing ip, from the shortest to the
+// longest, until fn returns true. Returns true if fn returned true.
+func (t *prefixTrie) lookup(ip net.IP, fn func(portRange) bool) bool {
+	if t == nil {
+		return false
+	}
+	key, v6 := trieKey(ip)
+	if key == nil {
+		return false
+	}
+	n := t.v4
+	if v6 {
+		n = t.v6
+	}
+	for n != nil && commonBits(n.key, key) >= n.bits {
+		for _, r := range n.ranges {
+			if fn(r) {
+				return true
+			}
+		}
+		if n.bits == 8*len(key) {
+			break
+		}
+		n = n.child[bitAt(key, n.bits)]
+	}
+	return false
+}
+
+// admits reports whether an endpoint of the trie admits (ip, port). If port is zero then
+// port-matching is disabled.
+func (t *prefixTrie) admits(ip net.IP, port int) bool {
+	return t.lookup(ip, func(r portRange) bool { return r.admits(port) })
+}
+
+// excludes reports whether an endpoint of the trie, taken as an exclusion, matches (ip, port).
+func (t *prefixTrie) excludes(ip net.IP, port int) bool {
+	return t.lookup(ip, func(r portRange) bool { return r.excludes(port) })
+}
+
+// commonBits returns the length of the common prefix of two keys in bits.
+func commonBits(a, b []byte) int {
+	for i := range min(len(a), len(b)) {
+		if x := a[i] ^ b[i]; x != 0 {
+			return 8*i + bits.LeadingZeros8(x)
+		}
+	}
+	return 8 * min(len(a), len(b))
+}
+
+// bitAt returns the i-th bit of a key, counting from the most significant bit.
+func bitAt(key []byte, i int) int {
+	return int(key[i/8]>>(7-i%8)) & 1
+}
+
+// maskKey returns a copy of a key with all but the first prefixLen bits cleared.
+func maskKey(key []byte, prefixLen int) []byte {
+	ret := make([]byte, len(key))
+	copy(ret, key)
+	for i := range ret {
+		switch {
+		case 8*(i+1) <= prefixLen:
+		case 8*i >= prefixLen:
+			ret[i] = 0
+		default:
+			ret[i] &= ^byte(0xff >> (prefixLen - 8*i))
+		}
+	}
+	return ret
+}
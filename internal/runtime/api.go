@@ -1,8 +1,10 @@
 package runtime
 
 import (
+	"io"
 	"net"
 
+	"github.com/l7mp/stunner/internal/util"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 )
 
@@ -19,10 +21,45 @@ type Router interface {
 	// Route returns the name of the cluster on the listener's routes that admits (peer, port)
 	// for the given protocol, or ("", false) if none does. port==0 ignores the port.
 	Route(listener string, routes []string, proto stnrv1.ClusterProtocol, peer net.IP, port int) (string, bool)
+	// RouteUser is Route restricted to the clusters the user of an allocation is authorized to
+	// access.
+	RouteUser(listener string, routes []string, user User, proto stnrv1.ClusterProtocol, peer net.IP, port int) (string, bool)
 	// Match reports whether the named cluster admits (peer, port). port==0 ignores the port.
 	Match(cluster string, peer net.IP, port int) bool
+	// Denied reports whether (peer, port) is on the process-wide peer deny-list. port==0 ignores
+	// the port.
+	Denied(peer net.IP, port int) bool
+	// VirtualBackends returns the backends of the named cluster if (peer, port) is the virtual
+	// address of the cluster, or (nil, false) if it is not. port==0 ignores the port.
+	VirtualBackends(cluster string, peer net.IP, port int) ([]*util.Endpoint, bool)
+	// CrossZone reports whether a peer of the named cluster is at an endpoint in a different zone
+	// than stunnerd.
+	CrossZone(cluster string, peer net.IP) bool
 	// InvalidateCache drops all cached routing state; call after a config change.
 	InvalidateCache()
+	// InvalidateCluster drops the cached routing state of a single cluster; call after the
+	// membership of a cluster changes without a config change.
+	InvalidateCluster(cluster string)
+	// Epoch returns a counter bumped by InvalidateCache, i.e., on each config change.
+	Epoch() uint64
+	// RevokesRemovedPeers reports whether the peers removed from the named cluster by a
+	// membership change lose access immediately.
+	RevokesRemovedPeers(cluster string) bool
+	// TrackConn registers a relayed TCP connection to a peer of the named cluster, closed by
+	// InvalidateCluster when the peer is removed from a cluster that revokes removed peers. The
+	// returned function unregisters the connection.
+	TrackConn(cluster string, peer net.Addr, conn io.Closer) func()
+}
+
+// User is the user of an allocation, as recorded when the allocation was created.
+type User struct {
+	// ID is the user ID the allocation was authenticated with, or "" if unknown.
+	ID string
+	// Clusters lists the clusters the credential of the allocation (a "jwt" token or a webhook
+	// verdict) restricts the user to, or nil if the credential carries no restriction.
+	Clusters []string
+	// Recorded is set if the credential of the allocation was recorded.
+	Recorded bool
 }
 
 // QuotaHandler tracks per-user TURN allocation quotas. CheckAndIncrement reports whether a new
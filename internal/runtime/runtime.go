@@ -10,6 +10,7 @@ import (
 
 	"github.com/pion/transport/v4"
 
+	"github.com/l7mp/stunner/internal/endpointslice"
 	"github.com/l7mp/stunner/internal/offload"
 	"github.com/l7mp/stunner/internal/resolver"
 	"github.com/l7mp/stunner/internal/telemetry"
@@ -25,12 +26,17 @@ type Config struct {
 	Logger        logger.LoggerFactory
 	DryRun        bool
 	Resolver      resolver.DnsResolver
+	Endpoints     endpointslice.Watcher
 	Telemetry     *telemetry.Telemetry
 	QuotaHandler  QuotaHandler
 	License       licensecfg.ConfigManager
 	OffloadEngine offload.Engine
 	UdpThreadNum  int
 	Net           transport.Net
+	// NodeName and Zone are the Kubernetes node and the zone stunnerd runs in, if known. Used
+	// for topology-aware routing.
+	NodeName string
+	Zone     string
 }
 
 // Runtime is the single cross-object access point: process-wide dependencies, the object
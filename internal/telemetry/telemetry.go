@@ -3,6 +3,8 @@ package telemetry
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/logging"
@@ -24,6 +26,8 @@ const (
 type Callbacks struct {
 	// GetAllocationCount should map to the total allocation counter of the server.
 	GetAllocationCount func() int64
+	// GetBanCount, if set, should return the number of active authentication bans.
+	GetBanCount func() int64
 }
 
 type Telemetry struct {
@@ -42,6 +46,19 @@ type Telemetry struct {
 	ClusterPacketsCounter  metric.Int64Counter
 	ClusterBytesCounter    metric.Int64Counter
 	AllocationsGauge       metric.Int64ObservableGauge
+	AuthFailuresCounter    metric.Int64Counter
+	AuthBansCounter        metric.Int64Counter
+	AuthBansGauge          metric.Int64ObservableGauge
+	RouteCacheCounter      metric.Int64Counter
+	PermissionsCounter     metric.Int64Counter
+	ConnectDenialsCounter  metric.Int64Counter
+	ClusterFlowsCounter    metric.Int64Counter
+	CrossZoneBytesCounter  metric.Int64Counter
+	RelayPortsGauge        metric.Int64UpDownCounter
+	RelayPortRangeGauge    metric.Int64UpDownCounter
+
+	// crossZone holds the cross-zone byte counts per cluster for the cluster status.
+	crossZone sync.Map // cluster -> *crossZoneStat
 
 	callbacks Callbacks
 
@@ -167,12 +184,97 @@ func (t *Telemetry) init() error {
 		return err
 	}
 
+	// Initialize authentication metrics
+	t.AuthFailuresCounter, err = t.meter.Int64Counter(
+		stunnerInstrumentName+"_auth_failures_total",
+		metric.WithDescription("Number of failed authentications"),
+	)
+	if err != nil {
+		return err
+	}
+
+	t.AuthBansCounter, err = t.meter.Int64Counter(
+		stunnerInstrumentName+"_auth_bans_total",
+		metric.WithDescription("Number of source IPs or usernames banned due to failed authentications"),
+	)
+	if err != nil {
+		return err
+	}
+
+	t.AuthBansGauge, err = t.meter.Int64ObservableGauge(
+		stunnerInstrumentName+"_auth_bans_active",
+		metric.WithDescription("Number of active authentication bans"),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Initialize routing and admission metrics
+	t.RouteCacheCounter, err = t.meter.Int64Counter(
+		stunnerInstrumentName+"_route_cache_lookups_total",
+		metric.WithDescription("Number of peer route lookups at a listener by cache result"),
+	)
+	if err != nil {
+		return err
+	}
+
+	t.PermissionsCounter, err = t.meter.Int64Counter(
+		stunnerInstrumentName+"_permissions_total",
+		metric.WithDescription("Number of peer permissions granted or denied at a listener"),
+	)
+	if err != nil {
+		return err
+	}
+
+	t.ConnectDenialsCounter, err = t.meter.Int64Counter(
+		stunnerInstrumentName+"_connect_denials_total",
+		metric.WithDescription("Number of TCP relay connections to or from unadmitted peers"),
+	)
+	if err != nil {
+		return err
+	}
+
+	t.ClusterFlowsCounter, err = t.meter.Int64Counter(
+		stunnerInstrumentName+"_cluster_flows_total",
+		metric.WithDescription("Number of peer permissions and TCP relay connections admitted by a cluster"),
+	)
+	if err != nil {
+		return err
+	}
+
+	t.CrossZoneBytesCounter, err = t.meter.Int64Counter(
+		stunnerInstrumentName+"_cluster_cross_zone_bytes_total",
+		metric.WithDescription("Number of bytes sent to or received from backends in a different zone"),
+	)
+	if err != nil {
+		return err
+	}
+
+	t.RelayPortsGauge, err = t.meter.Int64UpDownCounter(
+		stunnerInstrumentName+"_relay_ports_used",
+		metric.WithDescription("Number of relay ports in use in the relay port range of a listener"),
+	)
+	if err != nil {
+		return err
+	}
+
+	t.RelayPortRangeGauge, err = t.meter.Int64UpDownCounter(
+		stunnerInstrumentName+"_relay_port_range_size",
+		metric.WithDescription("Number of ports in the relay port range of a listener"),
+	)
+	if err != nil {
+		return err
+	}
+
 	_, err = t.meter.RegisterCallback(
 		func(_ context.Context, o metric.Observer) error {
 			o.ObserveInt64(t.AllocationsGauge, t.callbacks.GetAllocationCount())
+			if t.callbacks.GetBanCount != nil {
+				o.ObserveInt64(t.AuthBansGauge, t.callbacks.GetBanCount())
+			}
 			return nil
 		},
-		t.AllocationsGauge,
+		t.AllocationsGauge, t.AuthBansGauge,
 	)
 	if err != nil {
 		return err
@@ -181,6 +283,110 @@ func (t *Telemetry) init() error {
 	return nil
 }
 
+// IncrementAuthFailures counts a failed authentication. The reason is "invalid" for invalid
+// credentials and "banned" for requests rejected due to a ban.
+func (t *Telemetry) IncrementAuthFailures(reason string) {
+	t.AuthFailuresCounter.Add(t.ctx, 1, metric.WithAttributes(attribute.String("reason", reason)))
+}
+
+// IncrementAuthBans counts a new ban. The kind is either "source" or "username".
+func (t *Telemetry) IncrementAuthBans(kind string) {
+	t.AuthBansCounter.Add(t.ctx, 1, metric.WithAttributes(attribute.String("kind", kind)))
+}
+
+// IncrementRouteCache counts a peer route lookup at a listener. The result is "hit" or "miss" for
+// lookups served over the peer cache and "bypass" for lookups that cannot be cached.
+func (t *Telemetry) IncrementRouteCache(listener, result string) {
+	t.RouteCacheCounter.Add(t.ctx, 1, metric.WithAttributes(
+		attribute.String("listener", listener),
+		attribute.String("result", result),
+	))
+}
+
+// IncrementPermissions counts a permission decision at a listener. Granted permissions have an
+// empty reason, the reason of a denial is "listener-unavailable", "deny-list" or "no-route".
+func (t *Telemetry) IncrementPermissions(listener string, granted bool, reason string) {
+	result := "granted"
+	if !granted {
+		result = "denied"
+	}
+	t.PermissionsCounter.Add(t.ctx, 1, metric.WithAttributes(
+		attribute.String("listener", listener),
+		attribute.String("result", result),
+		attribute.String("reason", reason),
+	))
+}
+
+// IncrementConnectDenials counts a TCP relay connection rejected due to an unadmitted peer. The
+// direction is "tx" for outgoing connects and "rx" for incoming connections.
+func (t *Telemetry) IncrementConnectDenials(listener string, d Direction) {
+	t.ConnectDenialsCounter.Add(t.ctx, 1, metric.WithAttributes(
+		attribute.String("listener", listener),
+		attribute.String("direction", d.String()),
+	))
+}
+
+// IncrementClusterFlows counts a flow admitted by a cluster. The kind is "permission" for peer
+// permissions and "connection" for TCP relay connections.
+func (t *Telemetry) IncrementClusterFlows(cluster, listener, kind string) {
+	t.ClusterFlowsCounter.Add(t.ctx, 1, metric.WithAttributes(
+		attribute.String("name", cluster),
+		attribute.String("listener", listener),
+		attribute.String("kind", kind),
+	))
+}
+
+// AddRelayPorts adjusts the number of relay ports in use at a listener. The protocol is "udp" or
+// "tcp".
+func (t *Telemetry) AddRelayPorts(listener, proto string, delta int64) {
+	t.RelayPortsGauge.Add(t.ctx, delta, metric.WithAttributes(
+		attribute.String("listener", listener),
+		attribute.String("protocol", proto),
+	))
+}
+
+// AddRelayPortRange adjusts the size of the relay port range of a listener.
+func (t *Telemetry) AddRelayPortRange(listener string, delta int64) {
+	t.RelayPortRangeGauge.Add(t.ctx, delta, metric.WithAttributes(attribute.String("listener", listener)))
+}
+
+// crossZoneStat holds the cross-zone byte counts of a cluster.
+type crossZoneStat struct {
+	rx, tx atomic.Uint64
+}
+
+// IncrementCrossZoneBytes counts the bytes relayed to or from a backend of a cluster in a
+// different zone.
+func (t *Telemetry) IncrementCrossZoneBytes(n string, d Direction, count uint64) {
+	t.CrossZoneBytesCounter.Add(t.ctx, int64(count), metric.WithAttributes(
+		attribute.String("name", n),
+		attribute.String("direction", d.String()),
+	))
+
+	v, ok := t.crossZone.Load(n)
+	if !ok {
+		v, _ = t.crossZone.LoadOrStore(n, &crossZoneStat{})
+	}
+	s := v.(*crossZoneStat)
+	switch d {
+	case Incoming:
+		s.rx.Add(count)
+	case Outgoing:
+		s.tx.Add(count)
+	}
+}
+
+// CrossZoneBytes returns the number of bytes relayed to and from the backends of a cluster in a
+// different zone, or false if no cross-zone traffic was relayed.
+func (t *Telemetry) CrossZoneBytes(n string) (uint64, uint64, bool) {
+	v, ok := t.crossZone.Load(n)
+	if !ok {
+		return 0, 0, false
+	}
+	s := v.(*crossZoneStat)
+	return s.rx.Load(), s.tx.Load(), true
+}
+
 func (t *Telemetry) IncrementPackets(n string, c ConnType, d Direction, count uint64) {
 	attrs := metric.WithAttributes(
 		attribute.String("name", n),
@@ -5,18 +5,31 @@ import (
 	"net"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 var endPointMatcher = regexp.MustCompile("^(.*):<([0-9]+)-([0-9]+)>$")
 
-// Endpoint is a pair of an IP prefix and a port range.
+// EndpointNegationPrefix marks a negative endpoint that excludes peers instead of admitting them,
+// e.g., "!10.0.0.0/8".
+const EndpointNegationPrefix = "!"
+
+// Endpoint is a pair of an IP prefix and a port range, optionally negated, with the optional
+// topology (node and zone) of the endpoint.
 type Endpoint struct {
 	prefix                net.IPNet
 	port, endPort         int
 	hasPrefixLen, hasPort bool
+	negated               bool
+	node, zone            string
+}
+
+// IsNegatedEndpoint returns true if an endpoint string is a negative endpoint.
+func IsNegatedEndpoint(ep string) bool {
+	return strings.HasPrefix(ep, EndpointNegationPrefix)
 }
 
-// ParseEndpoint parses an endpoint from the canonical format: "<IP>[optional slash and prefix length]:<minPort-maxPort)."
+// ParseEndpoint parses an endpoint from the canonical format: "[optional !]<IP>[optional slash and prefix length]:<minPort-maxPort)."
 func ParseEndpoint(ep string) (*Endpoint, error) {
 	// separate the ports
 	var port, endPort int
@@ -24,8 +37,9 @@ func ParseEndpoint(ep string) (*Endpoint, error) {
 	hasPrefixLen := true
 	hasPort := false
 
-	cidr := ep
-	m := endPointMatcher.FindStringSubmatch(ep)
+	negated := IsNegatedEndpoint(ep)
+	cidr := strings.TrimPrefix(ep, EndpointNegationPrefix)
+	m := endPointMatcher.FindStringSubmatch(cidr)
 	if len(m) != 4 {
 		// no ports at the end
 		port = 1
@@ -65,10 +79,26 @@ func ParseEndpoint(ep string) (*Endpoint, error) {
 		endPort:      endPort,
 		hasPrefixLen: hasPrefixLen,
 		hasPort:      hasPort,
+		negated:      negated,
 	}, nil
 
 }
 
+// NewEndpoint returns an endpoint for a single IP address and a port range. If port is zero then the
+// endpoint matches all ports.
+func NewEndpoint(ip net.IP, port, endPort int) *Endpoint {
+	ep := &Endpoint{port: 1, endPort: 65535}
+	if ip4 := ip.To4(); ip4 != nil {
+		ep.prefix = net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	} else {
+		ep.prefix = net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+	}
+	if port != 0 {
+		ep.port, ep.endPort, ep.hasPort = port, endPort, true
+	}
+	return ep
+}
+
 // Contains reports whether the endppoint network includes ip.
 func (ep *Endpoint) Contains(ip net.IP) bool {
 	return ep.Match(ip, 0)
@@ -87,6 +117,47 @@ func (ep *Endpoint) Match(ip net.IP, port int) bool {
 	}
 }
 
+// Negated reports whether the endpoint excludes rather than admits the peers it matches.
+func (ep *Endpoint) Negated() bool {
+	return ep.negated
+}
+
+// HasPort reports whether the endpoint is restricted to a port range.
+func (ep *Endpoint) HasPort() bool {
+	return ep.hasPort
+}
+
+// Prefix returns the IP prefix of the endpoint.
+func (ep *Endpoint) Prefix() net.IPNet {
+	return ep.prefix
+}
+
+// PortRange returns the first and the last port of the port range of the endpoint.
+func (ep *Endpoint) PortRange() (int, int) {
+	return ep.port, ep.endPort
+}
+
+// WithTopology sets the node and the zone of the endpoint. Returns the endpoint.
+func (ep *Endpoint) WithTopology(node, zone string) *Endpoint {
+	ep.node, ep.zone = node, zone
+	return ep
+}
+
+// Node returns the node of the endpoint, or "" if unknown.
+func (ep *Endpoint) Node() string {
+	return ep.node
+}
+
+// Zone returns the zone of the endpoint, or "" if unknown.
+func (ep *Endpoint) Zone() string {
+	return ep.zone
+}
+
+// IP returns the network address of the endpoint.
+func (ep *Endpoint) IP() net.IP {
+	return ep.prefix.IP
+}
+
 func (ep *Endpoint) Network() string {
 	return ep.prefix.Network()
 }
@@ -102,5 +173,10 @@ func (ep *Endpoint) String() string {
 		portRange = fmt.Sprintf(":<%d-%d>", ep.port, ep.endPort)
 	}
 
-	return ip + portRange
+	neg := ""
+	if ep.negated {
+		neg = EndpointNegationPrefix
+	}
+
+	return neg + ip + portRange
 }
@@ -86,6 +86,24 @@ var endpointTester = []endpointTest{
 		endPort: 65535,
 		success: true,
 	},
+	{
+		name:    "ipv4 - negated",
+		input:   "!10.0.0.0/8:<1-2>",
+		output:  "!10.0.0.0/8:<1-2>",
+		ipnet:   "10.0.0.0/8",
+		port:    1,
+		endPort: 2,
+		success: true,
+	},
+	{
+		name:    "ipv6 - negated, no port, no prefix len",
+		input:   "!fd00:ec2::254",
+		output:  "!fd00:ec2::254",
+		ipnet:   "fd00:ec2::254/128",
+		port:    1,
+		endPort: 65535,
+		success: true,
+	},
 	{
 		name:    "ipv4 - no addr fails ",
 		input:   ":<1-65535>",
@@ -96,6 +114,11 @@ var endpointTester = []endpointTest{
 		input:   "dummy",
 		success: false,
 	},
+	{
+		name:    "negated - no addr fails ",
+		input:   "!",
+		success: false,
+	},
 }
 
 func TestEndpointParse(t *testing.T) {
@@ -108,6 +131,7 @@ func TestEndpointParse(t *testing.T) {
 				assert.Equal(t, c.port, ep.port, "port equal")
 				assert.Equal(t, c.endPort, ep.endPort, "endport equal")
 				assert.Equal(t, c.output, ep.String(), "output")
+				assert.Equal(t, IsNegatedEndpoint(c.input), ep.Negated(), "negated")
 			} else {
 				assert.Error(t, err, "parse")
 			}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pion/logging"
+)
+
+// WatchFiles calls onChange each time one of the given files is created, written, renamed or
+// removed, until the context is canceled. The watch is placed on the parent directories rather
+// than on the files themselves so that atomic replacements are caught as well: Kubernetes updates
+// mounted Secrets and ConfigMaps by swapping the "..data" symlink, which is reported as an event on
+// the directory only. The callback may be invoked spuriously, so it should be idempotent.
+func WatchFiles(ctx context.Context, files []string, onChange func(), log logging.LeveledLogger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("cannot create file watcher: %w", err)
+	}
+
+	watched := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, f := range files {
+		f = filepath.Clean(f)
+		watched[f] = true
+		dir := filepath.Dir(f)
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close() //nolint:errcheck
+			return fmt.Errorf("cannot watch directory %q: %w", dir, err)
+		}
+		dirs[dir] = true
+	}
+
+	go func() {
+		defer watcher.Close() //nolint:errcheck
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Clean(e.Name)
+				if !watched[name] && !strings.HasPrefix(filepath.Base(name), "..") {
+					continue
+				}
+				if e.Has(fsnotify.Chmod) && !e.Has(fsnotify.Write) && !e.Has(fsnotify.Create) {
+					continue
+				}
+				log.Debugf("file watcher: received event %s", e.String())
+				onChange()
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warnf("file watcher error: %s", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
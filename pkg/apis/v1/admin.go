@@ -6,6 +6,9 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"time"
+
+	"github.com/l7mp/stunner/internal/util"
 )
 
 // AdminConfig holds the administrative configuration.
@@ -26,6 +29,17 @@ type AdminConfig struct {
 	// health-checking at `http://:8086`. Set to a pointer to an empty string to disable
 	// health-checking.
 	HealthCheckEndpoint *string `json:"healthcheck_endpoint,omitempty"`
+	// CredentialEndpoint, if set, enables a TURN REST API credential endpoint on the
+	// health-check server, see CredentialEndpointConfig. Requires the health-check server to be
+	// enabled.
+	CredentialEndpoint *CredentialEndpointConfig `json:"credential_endpoint,omitempty"`
+	// PeerDenyList lists the peer endpoints, in the static cluster endpoint syntax, STUNner
+	// never relays to, whatever the clusters admit. The deny-list is enforced for all clusters,
+	// including open clusters like "0.0.0.0/0". If ignored, the default is to deny the
+	// loopback, unspecified and link-local addresses, and the cloud metadata services that
+	// are not link-local, see DefaultPeerDenyList. Set to a pointer to an empty list to allow
+	// relaying to any peer admitted by the clusters.
+	PeerDenyList *[]string `json:"peer_deny_list,omitempty"`
 	// UserQuota defines the number of permitted TURN allocatoins per username. Affects
 	// allocation created on any listener. Default is 0, meaning no quota is enforced.
 	UserQuota int `json:"user_quota,omitempty"`
@@ -40,6 +54,44 @@ type AdminConfig struct {
 	LicenseConfig *LicenseConfig `json:"license_config,omitempty"`
 }
 
+// CredentialEndpointConfig configures the TURN REST API credential endpoint, as per the "REST API
+// For Access To TURN Services" (https://datatracker.ietf.org/doc/html/draft-uberti-behave-turn-rest-00)
+// spec. The endpoint is served on the path `/turn` of the health-check server and it mints
+// time-windowed credentials for "ephemeral" authentication. A GET request with the optional query
+// parameters "username" (the user ID) and "ttl" (the lifetime of the credential in seconds)
+// returns a JSON object with the "username", "password", "ttl" and "uris" fields, where "uris"
+// lists the TURN URIs of the listeners.
+type CredentialEndpointConfig struct {
+	// Token is the API key clients must present, either as a bearer token in the
+	// Authorization header or in the "key" query parameter. Mandatory.
+	Token string `json:"token"`
+	// TTL is the default lifetime of the credentials, as a Go duration string. Default is
+	// "24h".
+	TTL string `json:"ttl,omitempty"`
+	// MaxTTL caps the lifetime requested by clients, as a Go duration string. Default is TTL.
+	MaxTTL string `json:"max_ttl,omitempty"`
+}
+
+func (c *CredentialEndpointConfig) validate() error {
+	if c.Token == "" {
+		return fmt.Errorf("credential endpoint: empty token")
+	}
+	if c.TTL == "" {
+		c.TTL = DefaultCredentialTTL
+	}
+	ttl, err := time.ParseDuration(c.TTL)
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("credential endpoint: invalid TTL %q", c.TTL)
+	}
+	if c.MaxTTL == "" {
+		c.MaxTTL = c.TTL
+	}
+	if d, err := time.ParseDuration(c.MaxTTL); err != nil || d < ttl {
+		return fmt.Errorf("credential endpoint: invalid max TTL %q", c.MaxTTL)
+	}
+	return nil
+}
+
 // Licensing info to be used to check subscription status with the license server.
 type LicenseConfig struct {
 	// Key is a comma-separated list of unlocked features plus a time-window during which the
@@ -79,6 +131,25 @@ func (req *AdminConfig) Validate() error {
 		}
 	}
 
+	if req.CredentialEndpoint != nil {
+		if err := req.CredentialEndpoint.validate(); err != nil {
+			return err
+		}
+	}
+
+	if req.PeerDenyList == nil {
+		l := DefaultPeerDenyList()
+		req.PeerDenyList = &l
+	}
+	for _, ep := range *req.PeerDenyList {
+		if util.IsNegatedEndpoint(ep) {
+			return fmt.Errorf("invalid peer deny-list endpoint %q: negative endpoints not allowed", ep)
+		}
+		if _, err := util.ParseEndpoint(ep); err != nil {
+			return fmt.Errorf("invalid peer deny-list: %w", err)
+		}
+	}
+
 	if req.UserQuota < 0 {
 		req.UserQuota = 0
 	}
@@ -118,6 +189,15 @@ func (req *AdminConfig) DeepCopyInto(dst Config) {
 	*ret = *req
 	ret.OffloadInterfaces = make([]string, len(req.OffloadInterfaces))
 	copy(ret.OffloadInterfaces, req.OffloadInterfaces)
+	if req.CredentialEndpoint != nil {
+		c := *req.CredentialEndpoint
+		ret.CredentialEndpoint = &c
+	}
+	if req.PeerDenyList != nil {
+		l := make([]string, len(*req.PeerDenyList))
+		copy(l, *req.PeerDenyList)
+		ret.PeerDenyList = &l
+	}
 }
 
 // String stringifies the configuration.
@@ -135,6 +215,13 @@ func (req *AdminConfig) String() string {
 	if req.HealthCheckEndpoint != nil {
 		status = append(status, fmt.Sprintf("health-check=%q", *req.HealthCheckEndpoint))
 	}
+	if req.CredentialEndpoint != nil {
+		status = append(status, fmt.Sprintf("credential-endpoint={token=<SECRET>,ttl=%s,max_ttl=%s}",
+			req.CredentialEndpoint.TTL, req.CredentialEndpoint.MaxTTL))
+	}
+	if req.PeerDenyList != nil {
+		status = append(status, fmt.Sprintf("peer-deny-list=[%s]", strings.Join(*req.PeerDenyList, ",")))
+	}
 	if req.UserQuota > 0 {
 		status = append(status, fmt.Sprintf("quota=%d", req.UserQuota))
 	}
@@ -1,23 +1,238 @@
 package v1
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net"
+	"net/url"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
+)
+
+const (
+	// PasswordAlgorithmMD5 selects MESSAGE-INTEGRITY with the MD5 long-term credential key.
+	PasswordAlgorithmMD5 = "MD5"
+	// PasswordAlgorithmSHA256 selects MESSAGE-INTEGRITY-SHA256 with the SHA-256 long-term
+	// credential key.
+	PasswordAlgorithmSHA256 = "SHA-256"
 )
 
 // Auth specifies the STUN/TURN authentication mechanism used by STUNner.
 type AuthConfig struct {
-	// Type of the STUN/TURN authentication mechanism ("static" or "ephemeral"). The deprecated
-	// type name "plaintext" is accepted for "static" and the deprecated type name "longterm"
-	// is accepted for "ephemeral" for compatibility with older versions.
+	// Type of the STUN/TURN authentication mechanism ("static", "static-multi", "ephemeral",
+	// "jwt", "webhook" or "oauth"). The deprecated type name "plaintext" is accepted for "static" and the
+	// deprecated type name "longterm" is accepted for "ephemeral" for compatibility with older
+	// versions.
 	Type string `json:"type,omitempty"`
 	// Realm defines the STUN/TURN authentication realm.
 	Realm string `json:"realm,omitempty"`
 	// Credentials specifies the authententication credentials: for "static" at least the keys
 	// "username" and "password" must be set, for "ephemeral" the key "secret" specifying the
-	// shared authentication secret must be set.
+	// shared authentication secret must be set (unless Secrets is set). For "jwt" the optional "secret" key is used to
+	// derive the TURN password from the token, see JWTConfig. For "webhook" the optional "token"
+	// key sets a bearer token sent to the webhook. Values may be references to a file
+	// ("file:///path/to/file") or to an environment variable ("env:VAR") instead of inline
+	// values, resolved at reconcile time. Referenced files are watched for changes.
 	Credentials map[string]string `json:"credentials"`
+	// Secrets is the ordered list of the shared secrets for "ephemeral" authentication, newest
+	// first, used to rotate the secret without invalidating the credentials already issued. The
+	// newest secret is used to issue credentials and it is kept in sync with the "secret" key of
+	// Credentials: if the "secret" key is set and it differs from the first secret, it is taken
+	// as the newest secret and prepended to the list. Older secrets are also accepted for
+	// verification until SecretGracePeriod has elapsed since they were rotated out. Secrets may
+	// be references, see Credentials.
+	Secrets []string `json:"secrets,omitempty"`
+	// SecretGracePeriod is the time older "ephemeral" secrets are accepted for after they have
+	// been rotated out, as a Go duration string. Since STUNner does not persist state, the grace
+	// period restarts when stunnerd restarts. Set it to at least the lifetime of the issued
+	// credentials. Default is "24h".
+	SecretGracePeriod string `json:"secret_grace_period,omitempty"`
+	// Users is the user table for "static-multi" authentication.
+	Users []UserCredential `json:"users,omitempty"`
+	// UserFile is the path of an htpasswd-style file holding further users for "static-multi"
+	// authentication, one "username:password[:quota]" entry per line. Passwords may contain
+	// ':', but a password ending in ':' followed by digits must be followed by an explicit
+	// quota. Empty lines and lines starting with "#" are ignored. The file is reloaded on
+	// change. Users listed in Users take precedence over the entries of the file.
+	UserFile string `json:"user_file,omitempty"`
+	// JWT configures "jwt" authentication.
+	JWT *JWTConfig `json:"jwt,omitempty"`
+	// Webhook configures "webhook" authentication.
+	Webhook *WebhookConfig `json:"webhook,omitempty"`
+	// OAuth configures "oauth" authentication.
+	OAuth *OAuthConfig `json:"oauth,omitempty"`
+	// PasswordAlgorithms is the list of the password algorithms of RFC 8489 accepted for the
+	// long-term credential mechanism, in the order of preference: "MD5" for MESSAGE-INTEGRITY
+	// and "SHA-256" for MESSAGE-INTEGRITY-SHA256. If "SHA-256" is listed then the challenges
+	// advertise the list in PASSWORD-ALGORITHMS and the responses are signed with the algorithm
+	// of the request. Clients not supporting RFC 8489 fall back to "MD5" as long as it is
+	// listed, omit "MD5" to refuse MESSAGE-INTEGRITY. SHA-256 needs the password of the user,
+	// so "webhook" replies must carry the "password" instead of the key. Default is ["MD5"].
+	PasswordAlgorithms []string `json:"password_algorithms,omitempty"`
+	// UserClusters binds users or user groups to the clusters they may access. Keys are user
+	// IDs, i.e., the username for "static" and "static-multi" authentication, the user-ID part
+	// of the username for "ephemeral" authentication, the user claim for "jwt" and the user ID
+	// returned by the webhook for "webhook" authentication. A key ending with "*" matches all
+	// user IDs with the given prefix (e.g., "tenant-a/*"), the longest matching key wins. Users
+	// can only reach the clusters that are both routed from the listener and listed here. The
+	// clusters set per user in the user table, in the clusters claim of the token or returned
+	// by the webhook take precedence. Users not matched by any key may access all clusters.
+	UserClusters map[string][]string `json:"user_clusters,omitempty"`
+	// BruteForceProtection, if set, temporarily bans the source IPs and the usernames with too
+	// many failed authentications.
+	BruteForceProtection *BruteForceConfig `json:"brute_force_protection,omitempty"`
+}
+
+// BruteForceConfig configures the protection against brute-force and credential-stuffing attacks.
+// Failed authentications are counted per source IP and per username. A source IP or a username
+// with MaxFailures failures within Window is banned for BanDuration, which is doubled with each
+// further ban up to MaxBanDuration. Requests from a banned source IP or with a banned username are
+// rejected without checking the credentials. Note that banning a username also locks out the
+// legitimate user from all sources not on the allow list.
+type BruteForceConfig struct {
+	// MaxFailures is the number of failed authentications that triggers a ban. Default is 10.
+	MaxFailures int `json:"max_failures,omitempty"`
+	// Window is the time window failures are counted in, as a Go duration string. Default is
+	// "1m".
+	Window string `json:"window,omitempty"`
+	// BanDuration is the duration of the first ban, as a Go duration string. Default is "1m".
+	BanDuration string `json:"ban_duration,omitempty"`
+	// MaxBanDuration caps the duration of repeated bans, as a Go duration string. Default is
+	// "1h".
+	MaxBanDuration string `json:"max_ban_duration,omitempty"`
+	// AllowList is a list of IP addresses and CIDR prefixes that are never banned, and for
+	// which username bans do not apply.
+	AllowList []string `json:"allow_list,omitempty"`
+}
+
+func (b *BruteForceConfig) validate() error {
+	if b.MaxFailures <= 0 {
+		b.MaxFailures = DefaultBruteForceMaxFailures
+	}
+	for _, d := range []struct {
+		val *string
+		def string
+	}{
+		{&b.Window, DefaultBruteForceWindow},
+		{&b.BanDuration, DefaultBruteForceBanDuration},
+		{&b.MaxBanDuration, DefaultBruteForceMaxBanDuration},
+	} {
+		if *d.val == "" {
+			*d.val = d.def
+		}
+		if t, err := time.ParseDuration(*d.val); err != nil || t <= 0 {
+			return fmt.Errorf("invalid duration %q", *d.val)
+		}
+	}
+	for _, a := range b.AllowList {
+		if _, _, err := net.ParseCIDR(a); err != nil && net.ParseIP(a) == nil {
+			return fmt.Errorf("invalid allow-list entry %q", a)
+		}
+	}
+	return nil
+}
+
+// JWTConfig configures "jwt" authentication. In this mode the TURN username is a signed JSON Web
+// Token that is verified against a key set. The token must have an "exp" claim and, if present,
+// the "nbf" claim must hold. Since the TURN long-term credential mechanism needs a password to
+// compute the message integrity key, the password is either taken from a claim of the token
+// (PasswordClaim), or derived from the token and the shared secret set in the "secret" key of
+// the credentials, the same way as for "ephemeral" authentication: base64(HMAC-SHA1(secret,
+// token)). Note that STUN limits the username to 513 bytes, so tokens must be kept short.
+type JWTConfig struct {
+	// KeySet is an inline JSON Web Key Set (RFC 7517) or a PEM bundle of public keys and
+	// certificates used to verify tokens. RSA keys must be at least 2048 bits long and ECDSA
+	// keys verify only the algorithm of their curve.
+	KeySet string `json:"keyset,omitempty"`
+	// KeySetFile is the path of a file holding a JSON Web Key Set or a PEM bundle. The file is
+	// reloaded on change. Keys from KeySet and KeySetFile are merged.
+	KeySetFile string `json:"keyset_file,omitempty"`
+	// Issuer, if set, must match the "iss" claim of the token.
+	Issuer string `json:"issuer,omitempty"`
+	// Audience, if set, must be listed in the "aud" claim of the token.
+	Audience string `json:"audience,omitempty"`
+	// UserClaim is the claim identifying the user, used in quota accounting and logs. Default
+	// is "sub".
+	UserClaim string `json:"user_claim,omitempty"`
+	// PasswordClaim is the claim holding the TURN password. If empty, the password is derived
+	// from the shared secret.
+	PasswordClaim string `json:"password_claim,omitempty"`
+	// ClustersClaim, if set, is the claim holding the list of the clusters the user may access,
+	// see AuthConfig.UserClusters.
+	ClustersClaim string `json:"clusters_claim,omitempty"`
+}
+
+// UserCredential is an entry in the user table of "static-multi" authentication.
+type UserCredential struct {
+	// Username is the TURN username.
+	Username string `json:"username"`
+	// Password is the TURN password.
+	Password string `json:"password"`
+	// UserQuota overrides the global allocation quota set in AdminConfig for this user. Nil
+	// means the global quota applies, zero means no quota is enforced.
+	UserQuota *int `json:"user_quota,omitempty"`
+	// Clusters optionally restricts the user to the listed clusters, see
+	// AuthConfig.UserClusters.
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+// WebhookConfig configures "webhook" authentication. In this mode each TURN user is checked by
+// POSTing a JSON object with the "username", "realm" and "source_address" fields to an external
+// HTTP endpoint. On status 200 the endpoint returns a JSON object with the "password" of the user,
+// or the hex-encoded long-term credential "key", plus the optional "user_id", "clusters" and
+// "quota" attributes. Status 401 or 403 denies the user. Verdicts are cached per username,
+// realm and client IP.
+type WebhookConfig struct {
+	// URL is the HTTP(S) endpoint of the authorization webhook.
+	URL string `json:"url"`
+	// Timeout limits the duration of a webhook call, as a Go duration string. Default is
+	// "1s".
+	Timeout string `json:"timeout,omitempty"`
+	// CacheTTL is the time successful verdicts are cached for. Default is "1m".
+	CacheTTL string `json:"cache_ttl,omitempty"`
+	// NegativeCacheTTL is the time denials are cached for. Default is "5s".
+	NegativeCacheTTL string `json:"negative_cache_ttl,omitempty"`
+	// FailurePolicy specifies what happens when the webhook cannot be reached or returns an
+	// unexpected reply: "closed" (default) denies the request, "open" falls back to the last
+	// successful verdict cached for the client even if it has expired. Since the TURN
+	// long-term credential mechanism needs a password, unknown users are denied either way.
+	FailurePolicy string `json:"failure_policy,omitempty"`
+}
+
+// OAuthConfig configures "oauth" authentication, i.e., STUN third-party authorization (RFC 7635).
+// In this mode clients obtain a self-contained access token from an authorization server and
+// present it in the ACCESS-TOKEN attribute, along with the ID of the key the token was encrypted
+// with in the USERNAME attribute. The token holds a session key ("mac_key") that is used as the
+// key of MESSAGE-INTEGRITY instead of a password, so STUNner does not need to manage TURN
+// passwords. The authorization server is advertised in the THIRD-PARTY-AUTHORIZATION attribute of
+// the 401 challenges. The key ID is used as the user ID in quota accounting, so the user quota
+// applies per key. MESSAGE-INTEGRITY-SHA256 is not supported in this mode.
+type OAuthConfig struct {
+	// ServerName is the name of the STUN server, used as the associated data of the token
+	// encryption. Default is the realm.
+	ServerName string `json:"server_name,omitempty"`
+	// AuthorizationServer is the name of the authorization server advertised to the clients,
+	// if set.
+	AuthorizationServer string `json:"authorization_server,omitempty"`
+	// Keys is the list of the long-term keys shared with the authorization server.
+	Keys []OAuthKey `json:"keys"`
+	// MaxClockSkew is the clock skew tolerated between the authorization server and STUNner
+	// when checking the timestamp and the lifetime of the tokens, as a Go duration string.
+	// Default is "5s".
+	MaxClockSkew string `json:"max_clock_skew,omitempty"`
+}
+
+// OAuthKey is a long-term key shared with the authorization server.
+type OAuthKey struct {
+	// KID is the key ID, sent by the clients in the USERNAME attribute.
+	KID string `json:"kid"`
+	// Key is the base64-encoded key.
+	Key string `json:"key"`
+	// Algorithm is the AEAD algorithm the tokens are encrypted with: "A256GCM" (default) or
+	// "A128GCM".
+	Algorithm string `json:"algorithm,omitempty"`
 }
 
 // Validate checks a configuration and injects defaults.
@@ -33,6 +248,17 @@ func (req *AuthConfig) Validate() error {
 	}
 	req.Type = atype.String()
 
+	for _, v := range req.Credentials {
+		if err := validateReference(v); err != nil {
+			return fmt.Errorf("%s: %w", atype.String(), err)
+		}
+	}
+	for _, v := range req.Secrets {
+		if err := validateReference(v); err != nil {
+			return fmt.Errorf("%s: %w", atype.String(), err)
+		}
+	}
+
 	switch atype {
 	case AuthTypeNone:
 		// no auth
@@ -45,18 +271,121 @@ func (req *AuthConfig) Validate() error {
 		}
 
 	case AuthTypeEphemeral:
-		_, secretFound := req.Credentials["secret"]
-		if !secretFound {
+		secret, secretFound := req.Credentials["secret"]
+		if !secretFound && len(req.Secrets) == 0 {
 			return fmt.Errorf("no secret found in %s auth config", atype.String())
 		}
+		if len(req.Secrets) > 0 {
+			if req.Credentials == nil {
+				req.Credentials = map[string]string{}
+			}
+			if !secretFound {
+				req.Credentials["secret"] = req.Secrets[0]
+			} else if secret != req.Secrets[0] {
+				req.Secrets = append([]string{secret}, req.Secrets...)
+			}
+			seen := map[string]bool{}
+			for _, s := range req.Secrets {
+				if s == "" {
+					return fmt.Errorf("%s: empty secret in secret list", atype.String())
+				}
+				if seen[s] {
+					return fmt.Errorf("%s: duplicate secret in secret list", atype.String())
+				}
+				seen[s] = true
+			}
+			if req.SecretGracePeriod == "" {
+				req.SecretGracePeriod = DefaultSecretGracePeriod
+			}
+			if d, err := time.ParseDuration(req.SecretGracePeriod); err != nil || d < 0 {
+				return fmt.Errorf("%s: invalid secret grace period %q", atype.String(),
+					req.SecretGracePeriod)
+			}
+		}
+
+	case AuthTypeStaticMulti:
+		if len(req.Users) == 0 && req.UserFile == "" {
+			return fmt.Errorf("%s: no users and no user file specified", atype.String())
+		}
+		seen := map[string]bool{}
+		for i, u := range req.Users {
+			if u.Username == "" || u.Password == "" {
+				return fmt.Errorf("%s: empty username or password in user table", atype.String())
+			}
+			if seen[u.Username] {
+				return fmt.Errorf("%s: duplicate username %q in user table", atype.String(),
+					u.Username)
+			}
+			seen[u.Username] = true
+			if u.UserQuota != nil && *u.UserQuota < 0 {
+				q := 0
+				req.Users[i].UserQuota = &q
+			}
+		}
+		sort.Slice(req.Users, func(i, j int) bool {
+			return req.Users[i].Username < req.Users[j].Username
+		})
+
+	case AuthTypeJWT:
+		if req.JWT == nil || (req.JWT.KeySet == "" && req.JWT.KeySetFile == "") {
+			return fmt.Errorf("%s: no key set specified", atype.String())
+		}
+		if req.JWT.PasswordClaim == "" && req.Credentials["secret"] == "" {
+			return fmt.Errorf("%s: either a password claim or a secret must be specified",
+				atype.String())
+		}
+		if req.JWT.UserClaim == "" {
+			req.JWT.UserClaim = DefaultJWTUserClaim
+		}
+
+	case AuthTypeWebhook:
+		if req.Webhook == nil || req.Webhook.URL == "" {
+			return fmt.Errorf("%s: no webhook URL specified", atype.String())
+		}
+		if err := req.Webhook.validate(); err != nil {
+			return fmt.Errorf("%s: %w", atype.String(), err)
+		}
+
+	case AuthTypeOAuth:
+		if req.OAuth == nil || len(req.OAuth.Keys) == 0 {
+			return fmt.Errorf("%s: no keys specified", atype.String())
+		}
+		if err := req.OAuth.validate(); err != nil {
+			return fmt.Errorf("%s: %w", atype.String(), err)
+		}
+
 	default:
 		return fmt.Errorf("invalid authentication type %q", req.Type)
 	}
 
+	for k := range req.UserClusters {
+		if k == "" {
+			return fmt.Errorf("%s: empty user ID in user clusters", atype.String())
+		}
+	}
+
+	if req.BruteForceProtection != nil {
+		if err := req.BruteForceProtection.validate(); err != nil {
+			return fmt.Errorf("%s: brute-force protection: %w", atype.String(), err)
+		}
+	}
+
+	if err := req.validatePasswordAlgorithms(); err != nil {
+		return fmt.Errorf("%s: %w", atype.String(), err)
+	}
+	if atype == AuthTypeOAuth && req.AcceptSHA256() {
+		return fmt.Errorf("%s: password algorithm %q is not supported", atype.String(),
+			PasswordAlgorithmSHA256)
+	}
+
 	if req.Realm == "" {
 		req.Realm = DefaultRealm
 	}
 
+	if atype == AuthTypeOAuth && req.OAuth.ServerName == "" {
+		req.OAuth.ServerName = req.Realm
+	}
+
 	if req.Credentials == nil {
 		req.Credentials = map[string]string{}
 	}
@@ -83,6 +412,171 @@ func (req *AuthConfig) DeepCopyInto(dst Config) {
 	for k, v := range req.Credentials {
 		ret.Credentials[k] = v
 	}
+	if req.Secrets != nil {
+		ret.Secrets = make([]string, len(req.Secrets))
+		copy(ret.Secrets, req.Secrets)
+	}
+	if req.Users != nil {
+		ret.Users = make([]UserCredential, len(req.Users))
+		for i, u := range req.Users {
+			ret.Users[i] = u.DeepCopy()
+		}
+	}
+	if req.JWT != nil {
+		j := *req.JWT
+		ret.JWT = &j
+	}
+	if req.Webhook != nil {
+		w := *req.Webhook
+		ret.Webhook = &w
+	}
+	if req.OAuth != nil {
+		o := *req.OAuth
+		o.Keys = append([]OAuthKey(nil), req.OAuth.Keys...)
+		ret.OAuth = &o
+	}
+	if req.PasswordAlgorithms != nil {
+		ret.PasswordAlgorithms = make([]string, len(req.PasswordAlgorithms))
+		copy(ret.PasswordAlgorithms, req.PasswordAlgorithms)
+	}
+	if req.BruteForceProtection != nil {
+		b := *req.BruteForceProtection
+		b.AllowList = append([]string(nil), req.BruteForceProtection.AllowList...)
+		ret.BruteForceProtection = &b
+	}
+	if req.UserClusters != nil {
+		ret.UserClusters = make(map[string][]string, len(req.UserClusters))
+		for k, v := range req.UserClusters {
+			ret.UserClusters[k] = append([]string(nil), v...)
+		}
+	}
+}
+
+func (req *AuthConfig) validatePasswordAlgorithms() error {
+	if len(req.PasswordAlgorithms) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	for i, a := range req.PasswordAlgorithms {
+		a = strings.ToUpper(a)
+		if a != PasswordAlgorithmMD5 && a != PasswordAlgorithmSHA256 {
+			return fmt.Errorf("invalid password algorithm %q", req.PasswordAlgorithms[i])
+		}
+		if seen[a] {
+			return fmt.Errorf("duplicate password algorithm %q", a)
+		}
+		seen[a] = true
+		req.PasswordAlgorithms[i] = a
+	}
+	return nil
+}
+
+// AcceptMD5 returns true if requests with MESSAGE-INTEGRITY are accepted.
+func (req *AuthConfig) AcceptMD5() bool {
+	if len(req.PasswordAlgorithms) == 0 {
+		return true
+	}
+	for _, a := range req.PasswordAlgorithms {
+		if a == PasswordAlgorithmMD5 {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptSHA256 returns true if requests with MESSAGE-INTEGRITY-SHA256 are accepted.
+func (req *AuthConfig) AcceptSHA256() bool {
+	for _, a := range req.PasswordAlgorithms {
+		if a == PasswordAlgorithmSHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *WebhookConfig) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", w.URL)
+	}
+	for _, d := range []struct {
+		val *string
+		def string
+	}{
+		{&w.Timeout, DefaultWebhookTimeout},
+		{&w.CacheTTL, DefaultWebhookCacheTTL},
+		{&w.NegativeCacheTTL, DefaultWebhookNegativeCacheTTL},
+	} {
+		if *d.val == "" {
+			*d.val = d.def
+		}
+		if t, err := time.ParseDuration(*d.val); err != nil || t < 0 {
+			return fmt.Errorf("invalid duration %q", *d.val)
+		}
+	}
+	if w.FailurePolicy == "" {
+		w.FailurePolicy = DefaultWebhookFailurePolicy
+	}
+	w.FailurePolicy = strings.ToLower(w.FailurePolicy)
+	if w.FailurePolicy != "open" && w.FailurePolicy != "closed" {
+		return fmt.Errorf("invalid failure policy %q", w.FailurePolicy)
+	}
+	return nil
+}
+
+func (o *OAuthConfig) validate() error {
+	kids := map[string]bool{}
+	for i := range o.Keys {
+		k := &o.Keys[i]
+		if k.KID == "" {
+			return fmt.Errorf("empty key ID")
+		}
+		if kids[k.KID] {
+			return fmt.Errorf("duplicate key ID %q", k.KID)
+		}
+		kids[k.KID] = true
+		if k.Algorithm == "" {
+			k.Algorithm = DefaultOAuthAlgorithm
+		}
+		k.Algorithm = strings.ToUpper(k.Algorithm)
+		size := 0
+		switch k.Algorithm {
+		case "A256GCM":
+			size = 32
+		case "A128GCM":
+			size = 16
+		default:
+			return fmt.Errorf("key %q: invalid algorithm %q", k.KID, k.Algorithm)
+		}
+		key, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return fmt.Errorf("key %q: invalid base64 encoding", k.KID)
+		}
+		if len(key) != size {
+			return fmt.Errorf("key %q: invalid key size %d for algorithm %s", k.KID, len(key),
+				k.Algorithm)
+		}
+	}
+	if o.MaxClockSkew == "" {
+		o.MaxClockSkew = DefaultOAuthMaxClockSkew
+	}
+	if t, err := time.ParseDuration(o.MaxClockSkew); err != nil || t < 0 {
+		return fmt.Errorf("invalid duration %q", o.MaxClockSkew)
+	}
+	return nil
+}
+
+// DeepCopy copies a user table entry.
+func (u UserCredential) DeepCopy() UserCredential {
+	ret := u
+	if u.UserQuota != nil {
+		q := *u.UserQuota
+		ret.UserQuota = &q
+	}
+	if u.Clusters != nil {
+		ret.Clusters = append([]string(nil), u.Clusters...)
+	}
+	return ret
 }
 
 // String stringifies the configuration.
@@ -132,11 +626,141 @@ func (req *AuthConfig) String() string {
 			}
 
 			status = append(status, fmt.Sprintf("secret=%q", s))
+			if len(req.Secrets) > 1 {
+				status = append(status, fmt.Sprintf("secrets=%d,secret_grace_period=%s",
+					len(req.Secrets), req.SecretGracePeriod))
+			}
+
+		case AuthTypeStaticMulti:
+			status = append(status, fmt.Sprintf("users=%d", len(req.Users)))
+			if req.UserFile != "" {
+				status = append(status, fmt.Sprintf("user_file=%q", req.UserFile))
+			}
+
+		case AuthTypeJWT:
+			if req.JWT == nil {
+				break
+			}
+			if req.JWT.KeySet != "" {
+				status = append(status, "keyset=\"<SECRET>\"")
+			}
+			if req.JWT.KeySetFile != "" {
+				status = append(status, fmt.Sprintf("keyset_file=%q", req.JWT.KeySetFile))
+			}
+			if req.JWT.Issuer != "" {
+				status = append(status, fmt.Sprintf("issuer=%q", req.JWT.Issuer))
+			}
+			if req.JWT.Audience != "" {
+				status = append(status, fmt.Sprintf("audience=%q", req.JWT.Audience))
+			}
+			if req.JWT.PasswordClaim != "" {
+				status = append(status, fmt.Sprintf("password_claim=%q", req.JWT.PasswordClaim))
+			} else {
+				status = append(status, "secret=\"<SECRET>\"")
+			}
+
+		case AuthTypeWebhook:
+			if req.Webhook == nil {
+				break
+			}
+			status = append(status, fmt.Sprintf("url=%q,timeout=%s,cache_ttl=%s,negative_cache_ttl=%s,failure_policy=%s",
+				req.Webhook.URL, req.Webhook.Timeout, req.Webhook.CacheTTL,
+				req.Webhook.NegativeCacheTTL, req.Webhook.FailurePolicy))
+			if _, ok := req.Credentials["token"]; ok {
+				status = append(status, "token=\"<SECRET>\"")
+			}
+
+		case AuthTypeOAuth:
+			if req.OAuth == nil {
+				break
+			}
+			kids := make([]string, len(req.OAuth.Keys))
+			for i, k := range req.OAuth.Keys {
+				kids[i] = k.KID
+			}
+			status = append(status, fmt.Sprintf("server_name=%q,authorization_server=%q,max_clock_skew=%s,keys=[%s],key=\"<SECRET>\"",
+				req.OAuth.ServerName, req.OAuth.AuthorizationServer, req.OAuth.MaxClockSkew,
+				strings.Join(kids, ",")))
 		}
 	}
 
+	if len(req.UserClusters) > 0 {
+		status = append(status, fmt.Sprintf("user_clusters=%d", len(req.UserClusters)))
+	}
+	if b := req.BruteForceProtection; b != nil {
+		status = append(status, fmt.Sprintf("brute_force_protection={max_failures=%d,window=%s,ban_duration=%s,max_ban_duration=%s,allow_list=%d}",
+			b.MaxFailures, b.Window, b.BanDuration, b.MaxBanDuration, len(b.AllowList)))
+	}
+	if len(req.PasswordAlgorithms) > 0 {
+		status = append(status, fmt.Sprintf("password_algorithms=%s",
+			strings.Join(req.PasswordAlgorithms, ",")))
+	}
+
 	return fmt.Sprintf("%s-auth:{%s}", req.Type, strings.Join(status, ","))
 }
 
-// AuthStatus represents the authentication status.
-type AuthStatus = AuthConfig
+// AuthStatus represents the authentication status: the auth config along with the status of the
+// secret rotation and the brute-force protection.
+type AuthStatus struct {
+	AuthConfig
+	// SecretStatus reports the use of the "ephemeral" secret generations when secret rotation
+	// is in effect.
+	SecretStatus []SecretStatus `json:"secret_status,omitempty"`
+	// BruteForceStatus reports the failed authentications and the active bans when
+	// brute-force protection is enabled.
+	BruteForceStatus *BruteForceStatus `json:"brute_force_status,omitempty"`
+}
+
+// BruteForceStatus reports the state of the brute-force protection.
+type BruteForceStatus struct {
+	// Failures is the number of failed authentications observed.
+	Failures uint64 `json:"failures"`
+	// Rejected is the number of requests rejected due to a ban.
+	Rejected uint64 `json:"rejected"`
+	// Bans lists the active bans.
+	Bans []BanStatus `json:"bans,omitempty"`
+}
+
+// BanStatus reports an active ban.
+type BanStatus struct {
+	// Kind is either "source" for a banned source IP or "username" for a banned username.
+	Kind string `json:"kind"`
+	// Key is the banned source IP or username.
+	Key string `json:"key"`
+	// Bans is the number of consecutive bans, which sets the ban duration.
+	Bans int `json:"bans"`
+	// Until is the time, in RFC 3339 format, the ban expires.
+	Until string `json:"until"`
+}
+
+// SecretStatus reports the use of an "ephemeral" shared secret generation.
+type SecretStatus struct {
+	// Generation is the position of the secret in the secret list, 0 being the newest.
+	Generation int `json:"generation"`
+	// Matches is the number of requests authenticated with the secret.
+	Matches uint64 `json:"matches"`
+	// Expires is the time, in RFC 3339 format, the secret stops being accepted. Empty for the
+	// newest secret.
+	Expires string `json:"expires,omitempty"`
+}
+
+// String stringifies the status.
+func (s *AuthStatus) String() string {
+	status := s.AuthConfig.String()
+	if len(s.SecretStatus) > 0 {
+		gens := []string{}
+		for _, g := range s.SecretStatus {
+			e := ""
+			if g.Expires != "" {
+				e = fmt.Sprintf("(expires:%s)", g.Expires)
+			}
+			gens = append(gens, fmt.Sprintf("%d:%d%s", g.Generation, g.Matches, e))
+		}
+		status = fmt.Sprintf("%s,secret-matches:[%s]", status, strings.Join(gens, ","))
+	}
+	if b := s.BruteForceStatus; b != nil {
+		status = fmt.Sprintf("%s,auth-failures:%d,auth-rejected:%d,bans:%d", status, b.Failures,
+			b.Rejected, len(b.Bans))
+	}
+	return status
+}
@@ -0,0 +1,96 @@
+package v1
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ClientAuthConfig configures the verification of client certificates (mutual TLS) on TLS and DTLS
+// listeners. Clients are verified during the TLS/DTLS handshake, before any STUN/TURN request is
+// processed.
+type ClientAuthConfig struct {
+	// CA is the base64-encoded PEM bundle of the CA certs client certs must chain to, or a
+	// reference to a file or to an environment variable holding the PEM-encoded or the
+	// base64-encoded bundle, see ListenerConfig.Cert. Mandatory.
+	CA string `json:"ca"`
+	// Mode is either "require", to refuse clients without a valid client cert, or "optional",
+	// to admit clients without a client cert but refuse clients with an invalid one. Default is
+	// "require".
+	Mode string `json:"mode,omitempty"`
+	// AllowedSubjects restricts the client certs to the certs whose subject common name matches
+	// one of the patterns. Patterns use shell glob syntax, e.g., "*.devices.example.com".
+	AllowedSubjects []string `json:"allowed_subjects,omitempty"`
+	// AllowedSANs restricts the client certs to the certs with a DNS name, email address, IP
+	// address or URI subject alternative name (SAN) that matches one of the patterns, see
+	// AllowedSubjects. A client cert is admitted if it matches either AllowedSubjects or
+	// AllowedSANs. Default is to admit all client certs chaining to the CA.
+	AllowedSANs []string `json:"allowed_sans,omitempty"`
+	// Identity selects the client cert field that serves as the TURN identity of the client,
+	// overriding the user ID of the TURN credentials in quota enforcement and logs:
+	// "common-name" uses the subject common name, "san" uses the first DNS name, email address
+	// or URI SAN. Routing and cluster access are always authorized with the user ID of the TURN
+	// credentials. Default is "none", which keeps the user ID of the TURN credentials.
+	Identity string `json:"identity,omitempty"`
+}
+
+// validate checks a client auth config and injects defaults.
+func (c *ClientAuthConfig) validate() error {
+	if c.CA == "" {
+		return fmt.Errorf("client auth: empty CA")
+	}
+	if err := validateReference(c.CA); err != nil {
+		return fmt.Errorf("client auth: invalid CA: %w", err)
+	}
+
+	if c.Mode == "" {
+		c.Mode = DefaultClientAuthMode
+	}
+	c.Mode = strings.ToLower(c.Mode)
+	if c.Mode != "require" && c.Mode != "optional" {
+		return fmt.Errorf("client auth: invalid mode %q", c.Mode)
+	}
+
+	if c.Identity == "" {
+		c.Identity = DefaultClientAuthIdentity
+	}
+	c.Identity = strings.ToLower(c.Identity)
+	if c.Identity != "none" && c.Identity != "common-name" && c.Identity != "san" {
+		return fmt.Errorf("client auth: invalid identity %q", c.Identity)
+	}
+
+	for _, p := range append(append([]string{}, c.AllowedSubjects...), c.AllowedSANs...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("client auth: invalid pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// DeepCopy copies a client auth config.
+func (c *ClientAuthConfig) DeepCopy() *ClientAuthConfig {
+	if c == nil {
+		return nil
+	}
+	ret := *c
+	ret.AllowedSubjects = append([]string(nil), c.AllowedSubjects...)
+	ret.AllowedSANs = append([]string(nil), c.AllowedSANs...)
+	return &ret
+}
+
+// String stringifies a client auth config.
+func (c *ClientAuthConfig) String() string {
+	ca := "<SECRET>"
+	if IsReference(c.CA) {
+		ca = c.CA
+	}
+	status := []string{fmt.Sprintf("mode=%s", c.Mode), fmt.Sprintf("ca=%s", ca)}
+	if len(c.AllowedSubjects) > 0 {
+		status = append(status, fmt.Sprintf("subjects=[%s]", strings.Join(c.AllowedSubjects, ",")))
+	}
+	if len(c.AllowedSANs) > 0 {
+		status = append(status, fmt.Sprintf("sans=[%s]", strings.Join(c.AllowedSANs, ",")))
+	}
+	status = append(status, fmt.Sprintf("identity=%s", c.Identity))
+	return fmt.Sprintf("client-auth(%s)", strings.Join(status, ","))
+}
@@ -2,31 +2,183 @@ package v1
 
 import (
 	"fmt"
+	"net"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
 
 	"github.com/l7mp/stunner/internal/util"
 )
 
 // ClusterConfig specifies a set of upstream peers to which STUNner can open transport relay
-// connections. There are two address resolution policies. In STATIC clusters the allowed peer IP
+// connections. There are three address resolution policies. In STATIC clusters the allowed peer IP
 // addresses are explicitly listed in the endpoint list. In STRICT_DNS clusters the endpoints are
 // assumed to be proper DNS domain names: STUNner will resolve each domain name in the background
 // and admit a new connection only if the peer address matches one of the IP addresses returned by
-// the DNS resolver for one of the endpoints. STRICT_DNS clusters are best used with headless
-// Kubernetes services.
+// the DNS resolver for one of the endpoints. Endpoints of the form "_service._proto.name" are
+// resolved as SRV records: then the peer port must also match the port of one of the SRV records.
+// STRICT_DNS clusters are best used with headless Kubernetes services. In ENDPOINT_SLICE clusters the endpoints are Kubernetes Services, given as
+// "namespace/name" or "name" (in the namespace of stunnerd): STUNner will watch the EndpointSlices
+// of each Service and admit a new connection only if the peer address and port match one of the
+// ready endpoints of the Service for the cluster protocol. In all cluster types, endpoints prefixed
+// with "!" are negative endpoints in the static endpoint syntax, e.g., "!10.0.0.0/8", that exclude
+// the peers they match: an exclusion always wins over an admitting endpoint.
 type ClusterConfig struct {
 	// Name of the cluster. Name is mandatory.
 	Name string `json:"name"`
-	// Type specifies the cluster address resolution policy, either STATIC or
-	// STRICT_DNS. Default is "STATIC".
+	// Type specifies the cluster address resolution policy, either STATIC, STRICT_DNS or
+	// ENDPOINT_SLICE. Default is "STATIC".
 	Type string `json:"type,omitempty"`
 	// Protocol specifies the protocol to be used with the cluster, either UDP (default) or TCP
 	// (not implemented yet).
 	Protocol string `json:"protocol,omitempty"`
-	// Endpoints specifies the peers that can be reached via this cluster.
+	// Endpoints specifies the peers that can be reached via this cluster. Endpoints prefixed
+	// with "!" specify the peers that cannot be reached via this cluster.
 	Endpoints []string `json:"endpoints,omitempty"`
+	// HealthCheck specifies active health checking of the endpoints of the cluster. Peers at
+	// unhealthy endpoints are not admitted. Default is no health checking.
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+	// VirtualAddress is a stable virtual peer address of the cluster, given as "IP:port" or
+	// "IP", e.g., the ClusterIP of a Kubernetes Service. Clients open permissions to the
+	// virtual address and the relay transparently maps it to one of the backends of the
+	// cluster, selected once per allocation and kept until the backend leaves the cluster.
+	// The backends are the single-host, healthy endpoints of the cluster: a backend endpoint
+	// with a single port receives the traffic on its port, any other backend on the port the
+	// client addressed. Default is no virtual address.
+	VirtualAddress string `json:"virtual_address,omitempty"`
+	// TopologyMode specifies the locality preference of the cluster, either NONE (default),
+	// PREFER_NODE, PREFER_ZONE, REQUIRE_NODE or REQUIRE_ZONE. In the REQUIRE modes only the
+	// endpoints on the node, resp., in the zone of stunnerd admit peers. In the PREFER modes all
+	// endpoints admit peers but the backends of the virtual address are selected from the
+	// endpoints on the same node, then in the same zone (PREFER_NODE) or from the endpoints in
+	// the same zone (PREFER_ZONE), if any. Endpoints with no topology are remote. The mode has no
+	// effect if the node, resp., the zone of stunnerd is unknown.
+	TopologyMode string `json:"topology_mode,omitempty"`
+	// Topology maps the IP addresses of the endpoints to their node and zone. The topology of
+	// the endpoints of ENDPOINT_SLICE clusters is taken from the EndpointSlices by default.
+	Topology map[string]EndpointTopology `json:"topology,omitempty"`
+	// RevokeRemovedPeers, if set, revokes the access to the peers removed from the cluster by a
+	// DNS, EndpointSlice or endpoint health change immediately: the relayed traffic of the
+	// existing permissions to the removed peers is dropped and the TCP relay connections to the
+	// removed peers are closed. Otherwise the existing permissions and connections are kept
+	// until they expire, resp., close, or the configuration changes. Default is false.
+	RevokeRemovedPeers bool `json:"revoke_removed_peers,omitempty"`
+}
+
+// EndpointTopology is the location of an endpoint.
+type EndpointTopology struct {
+	// Node is the name of the Kubernetes node of the endpoint.
+	Node string `json:"node,omitempty"`
+	// Zone is the zone of the endpoint.
+	Zone string `json:"zone,omitempty"`
+}
+
+// ParseVirtualAddress parses a virtual address of the form "IP:port" or "IP". The returned port
+// is zero if the virtual address specifies no port.
+func ParseVirtualAddress(addr string) (net.IP, int, error) {
+	host, port := addr, "0"
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		host, port = h, p
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid virtual address %q", addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, 0, fmt.Errorf("invalid port in virtual address %q", addr)
+	}
+	return ip, p, nil
+}
+
+// HealthCheckConfig specifies the active health checking of the endpoints of a cluster. Endpoints
+// that specify a single host are probed periodically: a UDP probe sends a datagram and fails if the
+// endpoint answers with an ICMP port unreachable error, a TCP probe opens a connection, and an
+// HTTP probe sends a GET request and expects a 2xx or 3xx response, e.g., from a health check
+// sidecar of the media server. An endpoint becomes unhealthy after UnhealthyThreshold consecutive
+// failed probes and healthy again after HealthyThreshold consecutive successful probes. Endpoints
+// are healthy until proven otherwise, and endpoints that specify a prefix are not probed.
+type HealthCheckConfig struct {
+	// Type is the type of the probe, either UDP, TCP or HTTP. Default is the cluster protocol.
+	Type string `json:"type,omitempty"`
+	// Port is the port to probe. Default is the port of the endpoint. Mandatory for HTTP probes
+	// and for endpoints with no port.
+	Port int `json:"port,omitempty"`
+	// Path is the request path of HTTP probes. Default is "/".
+	Path string `json:"path,omitempty"`
+	// Interval is the time between two probes of an endpoint, as a Go duration string. Default
+	// is "5s".
+	Interval string `json:"interval,omitempty"`
+	// Timeout is the time to wait for a probe to complete, as a Go duration string. Default is
+	// "1s".
+	Timeout string `json:"timeout,omitempty"`
+	// HealthyThreshold is the number of consecutive successful probes after which an unhealthy
+	// endpoint becomes healthy. Default is 2.
+	HealthyThreshold int `json:"healthy_threshold,omitempty"`
+	// UnhealthyThreshold is the number of consecutive failed probes after which an endpoint
+	// becomes unhealthy. Default is 3.
+	UnhealthyThreshold int `json:"unhealthy_threshold,omitempty"`
+}
+
+func (h *HealthCheckConfig) validate(protocol ClusterProtocol) error {
+	if h.Type == "" {
+		h.Type = protocol.String()
+	}
+	h.Type = strings.ToUpper(h.Type)
+	switch h.Type {
+	case "UDP", "TCP":
+	case "HTTP":
+		if h.Port == 0 {
+			return fmt.Errorf("missing port in HTTP health check")
+		}
+		if h.Path == "" {
+			h.Path = "/"
+		}
+	default:
+		return fmt.Errorf("invalid health check type %q", h.Type)
+	}
+	if h.Port < 0 || h.Port > 65535 {
+		return fmt.Errorf("invalid health check port %d", h.Port)
+	}
+	for _, d := range []struct {
+		val *string
+		def string
+	}{
+		{&h.Interval, DefaultHealthCheckInterval},
+		{&h.Timeout, DefaultHealthCheckTimeout},
+	} {
+		if *d.val == "" {
+			*d.val = d.def
+		}
+		if t, err := time.ParseDuration(*d.val); err != nil || t <= 0 {
+			return fmt.Errorf("invalid duration %q", *d.val)
+		}
+	}
+	if h.HealthyThreshold <= 0 {
+		h.HealthyThreshold = DefaultHealthyThreshold
+	}
+	if h.UnhealthyThreshold <= 0 {
+		h.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	return nil
+}
+
+// String stringifies a health check configuration.
+func (h *HealthCheckConfig) String() string {
+	status := []string{fmt.Sprintf("type=%s", h.Type)}
+	if h.Port != 0 {
+		status = append(status, fmt.Sprintf("port=%d", h.Port))
+	}
+	if h.Path != "" {
+		status = append(status, fmt.Sprintf("path=%s", h.Path))
+	}
+	status = append(status, fmt.Sprintf("interval=%s,timeout=%s,thresholds=%d/%d", h.Interval,
+		h.Timeout, h.HealthyThreshold, h.UnhealthyThreshold))
+	return fmt.Sprintf("{%s}", strings.Join(status, ","))
 }
 
 // Validate checks a configuration and injects defaults.
@@ -56,11 +208,16 @@ func (req *ClusterConfig) Validate() error {
 	req.Protocol = p.String()
 
 	// Do endpoints parse?
-	if t == ClusterTypeStatic {
-		for _, ep := range req.Endpoints {
+	for _, ep := range req.Endpoints {
+		switch {
+		case t == ClusterTypeStatic || util.IsNegatedEndpoint(ep):
 			if _, err := util.ParseEndpoint(ep); err != nil {
 				return err
 			}
+		case t == ClusterTypeEndpointSlice:
+			if err := validateServiceRef(ep); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -68,11 +225,50 @@ func (req *ClusterConfig) Validate() error {
 		req.Endpoints = []string{}
 	}
 
+	if req.HealthCheck != nil {
+		if err := req.HealthCheck.validate(p); err != nil {
+			return err
+		}
+	}
+
+	if req.VirtualAddress != "" {
+		if _, _, err := ParseVirtualAddress(req.VirtualAddress); err != nil {
+			return err
+		}
+	}
+
+	if req.TopologyMode != "" {
+		m, err := NewTopologyMode(req.TopologyMode)
+		if err != nil {
+			return err
+		}
+		req.TopologyMode = m.String()
+	}
+	for ip := range req.Topology {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid IP address %q in cluster topology", ip)
+		}
+	}
+
 	sort.Strings(req.Endpoints)
 
 	return nil
 }
 
+// validateServiceRef checks a Kubernetes Service reference of the form "namespace/name" or "name".
+func validateServiceRef(ref string) error {
+	parts := strings.Split(ref, "/")
+	if len(parts) > 2 {
+		return fmt.Errorf("invalid service reference %q: expected \"namespace/name\" or \"name\"", ref)
+	}
+	for _, p := range parts {
+		if errs := validation.IsDNS1123Label(p); len(errs) > 0 {
+			return fmt.Errorf("invalid service reference %q: %s", ref, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
 // Name returns the name of the object to be configured.
 func (req *ClusterConfig) ConfigName() string {
 	return req.Name
@@ -89,6 +285,16 @@ func (req *ClusterConfig) DeepCopyInto(dst Config) {
 	*ret = *req
 	ret.Endpoints = make([]string, len(req.Endpoints))
 	copy(ret.Endpoints, req.Endpoints)
+	if req.HealthCheck != nil {
+		h := *req.HealthCheck
+		ret.HealthCheck = &h
+	}
+	if req.Topology != nil {
+		ret.Topology = make(map[string]EndpointTopology, len(req.Topology))
+		for ip, t := range req.Topology {
+			ret.Topology[ip] = t
+		}
+	}
 }
 
 // String stringifies the configuration.
@@ -111,12 +317,58 @@ func (req *ClusterConfig) String() string {
 	status = append(status, fmt.Sprintf("endpoints=[%s]",
 		strings.Join(req.Endpoints, ",")))
 
+	if req.HealthCheck != nil {
+		status = append(status, fmt.Sprintf("health_check=%s", req.HealthCheck.String()))
+	}
+
+	if req.VirtualAddress != "" {
+		status = append(status, fmt.Sprintf("virtual_address=%s", req.VirtualAddress))
+	}
+
+	if req.TopologyMode != "" {
+		status = append(status, fmt.Sprintf("topology_mode=%s", req.TopologyMode))
+	}
+
+	if req.RevokeRemovedPeers {
+		status = append(status, "revoke_removed_peers=true")
+	}
+
+	if len(req.Topology) > 0 {
+		topology := make([]string, 0, len(req.Topology))
+		for ip, t := range req.Topology {
+			topology = append(topology, fmt.Sprintf("%s:%s/%s", ip, t.Zone, t.Node))
+		}
+		sort.Strings(topology)
+		status = append(status, fmt.Sprintf("topology=[%s]", strings.Join(topology, ",")))
+	}
+
 	return fmt.Sprintf("%q:{%s}", n, strings.Join(status, ","))
 }
 
 type ClusterStatus struct {
 	*ClusterConfig
 	Stats OffloadDirStat `json:"stats"`
+	// Health holds the health state of the probed endpoints, if health checking is enabled.
+	Health []EndpointHealth `json:"health,omitempty"`
+	// CrossZoneStats holds the traffic relayed to and from endpoints in a different zone than
+	// stunnerd.
+	CrossZoneStats *CrossZoneStat `json:"cross_zone_stats,omitempty"`
+}
+
+// CrossZoneStat holds the number of bytes relayed across zones in the RX and TX directions.
+type CrossZoneStat struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// EndpointHealth is the health state of a probed cluster endpoint.
+type EndpointHealth struct {
+	// Endpoint is the probed endpoint.
+	Endpoint string `json:"endpoint"`
+	// Healthy is true if the endpoint admits peers.
+	Healthy bool `json:"healthy"`
+	// Error is the error of the last failed probe, if any.
+	Error string `json:"error,omitempty"`
 }
 
 // String stringifies the configuration.
@@ -124,5 +376,18 @@ func (req *ClusterStatus) String() string {
 	status := req.ClusterConfig.String()
 	status += fmt.Sprintf(",offload(rx/tx): %d/%d pkts %d/%d bytes",
 		req.Stats.Rx.Pkts, req.Stats.Tx.Pkts, req.Stats.Rx.Bytes, req.Stats.Tx.Bytes)
+	if len(req.Health) > 0 {
+		healthy := 0
+		for _, h := range req.Health {
+			if h.Healthy {
+				healthy++
+			}
+		}
+		status += fmt.Sprintf(",healthy endpoints: %d/%d", healthy, len(req.Health))
+	}
+	if req.CrossZoneStats != nil {
+		status += fmt.Sprintf(",cross-zone(rx/tx): %d/%d bytes", req.CrossZoneStats.RxBytes,
+			req.CrossZoneStats.TxBytes)
+	}
 	return status
 }
@@ -2,27 +2,66 @@ package v1
 
 // stunnerd defaults
 const (
-	ApiVersion                    string = "v1"
-	DefaultStunnerName                   = "default-stunnerd"
-	DefaultProtocol                      = "turn-udp"
-	DefaultClusterProtocol               = "udp"
-	DefaultPort                   int    = 3478
-	DefaultLogLevel                      = "all:INFO"
-	DefaultRealm                         = "stunner.l7mp.io"
-	DefaultAuthType                      = "static"
-	DefaultMinRelayPort           int    = 1
-	DefaultMaxRelayPort           int    = 1<<16 - 1
-	DefaultClusterType                   = "STATIC"
-	DefaultAdminName                     = "default-admin-config"
-	DefaultAuthName                      = "default-auth-config"
-	DefaultListenerListName              = "default-listener-list"
-	DefaultClusterListName               = "default-cluster-list"
-	DefaultHealthName                    = "default-health"
-	DefaultMetricsName                   = "default-metrics"
-	DefaultOffloadName                   = "default-offload"
-	DefaultNodeAddressPlaceholder        = "__node_address_placeholder" // guaranteed to not parse as a valid IP
+	ApiVersion                      string = "v1"
+	DefaultStunnerName                     = "default-stunnerd"
+	DefaultProtocol                        = "turn-udp"
+	DefaultClusterProtocol                 = "udp"
+	DefaultPort                     int    = 3478
+	DefaultLogLevel                        = "all:INFO"
+	DefaultRealm                           = "stunner.l7mp.io"
+	DefaultAuthType                        = "static"
+	DefaultSecretGracePeriod               = "24h"
+	DefaultJWTUserClaim                    = "sub"
+	DefaultWebhookTimeout                  = "1s"
+	DefaultWebhookCacheTTL                 = "1m"
+	DefaultWebhookNegativeCacheTTL         = "5s"
+	DefaultWebhookFailurePolicy            = "closed"
+	DefaultOAuthAlgorithm                  = "A256GCM"
+	DefaultOAuthMaxClockSkew               = "5s"
+	DefaultBruteForceMaxFailures    int    = 10
+	DefaultBruteForceWindow                = "1m"
+	DefaultBruteForceBanDuration           = "1m"
+	DefaultBruteForceMaxBanDuration        = "1h"
+	DefaultCredentialTTL                   = "24h"
+	DefaultCredentialEndpointPath          = "/turn"
+	DefaultMinRelayPort             int    = 1
+	DefaultMaxRelayPort             int    = 1<<16 - 1
+	DefaultRelayDiscoveryServer            = "stun.l.google.com:19302"
+	DefaultRelayDiscoveryInterval          = "1m"
+	DefaultClientAuthMode                  = "require"
+	DefaultClientAuthIdentity              = "none"
+	DefaultClusterType                     = "STATIC"
+	DefaultTopologyMode                    = "NONE"
+	DefaultHealthCheckInterval             = "5s"
+	DefaultHealthCheckTimeout              = "1s"
+	DefaultHealthyThreshold         int    = 2
+	DefaultUnhealthyThreshold       int    = 3
+	DefaultAdminName                       = "default-admin-config"
+	DefaultAuthName                        = "default-auth-config"
+	DefaultListenerListName                = "default-listener-list"
+	DefaultClusterListName                 = "default-cluster-list"
+	DefaultHealthName                      = "default-health"
+	DefaultMetricsName                     = "default-metrics"
+	DefaultOffloadName                     = "default-offload"
+	DefaultNodeAddressPlaceholder          = "__node_address_placeholder" // guaranteed to not parse as a valid IP
 )
 
+// DefaultPeerDenyList returns the default peer deny-list: the IPv4 and IPv6 loopback, unspecified
+// and link-local addresses, the latter including the 169.254.169.254 cloud metadata service, plus
+// the AWS IPv6 and the Alibaba Cloud metadata services.
+func DefaultPeerDenyList() []string {
+	return []string{
+		"0.0.0.0/8",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"100.100.100.200",
+		"::/128",
+		"::1/128",
+		"fe80::/10",
+		"fd00:ec2::254",
+	}
+}
+
 // default ports
 const (
 	DefaultMetricsPort     int = 8080
@@ -52,6 +91,7 @@ const (
 	DefaultEnvVarNamespace        = "STUNNER_NAMESPACE"
 	DefaultEnvVarAddr             = "STUNNER_ADDR"
 	DefaultEnvVarNodeName         = "STUNNER_NODENAME"
+	DefaultEnvVarZone             = "STUNNER_ZONE"
 	DefaultEnvVarConfigOrigin     = "STUNNER_CONFIG_ORIGIN"
 	DefaultCDSServerAddrEnv       = "CDS_SERVER_ADDR"
 	DefaultCDSServerNamespaceEnv  = "CDS_SERVER_NAMESPACE"
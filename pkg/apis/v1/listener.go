@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ListenerConfig specifies a server socket on which STUN/TURN connections will be served.
@@ -19,21 +20,67 @@ type ListenerConfig struct {
 	// and "TURN-UDP" are equivalent (and so on for the other protocols). Default is
 	// "TURN-UDP".
 	Protocol string `json:"protocol,omitempty"`
-	// PublicAddr is the Internet-facing public IP address for the listener (ignored by
-	// STUNner).
+	// PublicAddr is the Internet-facing public IP address for the listener, used in the TURN
+	// URIs of the listener. Not advertised in the relayed transport addresses, see RelayAddr.
 	PublicAddr string `json:"public_address,omitempty"`
 	// PublicPort is the Internet-facing public port for the listener (ignored by STUNner).
 	PublicPort int `json:"public_port,omitempty"`
-	// Addr is the IP address for the listener. Default is localhost.
+	// Addr is the IP address or the name of the network interface the listener is bound to.
+	// Relay sockets are bound to the same address. An interface is bound at its first IPv4
+	// address, or at its first IPv6 address if it has no IPv4 address. Default is the
+	// unspecified address, which binds all addresses of the host in both IPv4 and IPv6.
 	Addr string `json:"address,omitempty"`
 	// Port is the port for the listener. Default is the standard TURN port (3478).
 	Port int `json:"port,omitempty"`
-	// Cert is the base64-encoded TLS cert.
+	// MinRelayPort is the smallest port of the relayed transport addresses allocated at the
+	// listener, e.g., to open a fixed port range on a firewall. Default is to let the OS choose
+	// an ephemeral port. If only one of MinRelayPort and MaxRelayPort is set, the other one
+	// defaults to the smallest (1), resp., the largest (65535) port.
+	MinRelayPort int `json:"min_relay_port,omitempty"`
+	// MaxRelayPort is the largest port of the relayed transport addresses allocated at the
+	// listener, see MinRelayPort.
+	MaxRelayPort int `json:"max_relay_port,omitempty"`
+	// RelayAddr is the IP address advertised to clients in the relayed transport addresses
+	// (XOR-RELAYED-ADDRESS) of the allocations at the listener, e.g., the public IP when
+	// STUNner runs behind 1:1 NAT. Either an IP address, a comma-separated list of IP
+	// addresses advertised in a round-robin fashion, or "auto" to discover the public IP
+	// through an external STUN server, see RelayAddrDiscoveryServer. Relay sockets are still
+	// bound to Addr. Default is to advertise the address of the listener.
+	RelayAddr string `json:"relay_address,omitempty"`
+	// RelayAddrDiscoveryServer is the address ("host:port") of the STUN server used to
+	// discover the public IP with relay address "auto". Default is
+	// DefaultRelayDiscoveryServer.
+	RelayAddrDiscoveryServer string `json:"relay_address_discovery_server,omitempty"`
+	// RelayAddrDiscoveryInterval is the period at which the public IP is re-checked with relay
+	// address "auto", as a Go duration string. Default is DefaultRelayDiscoveryInterval.
+	RelayAddrDiscoveryInterval string `json:"relay_address_discovery_interval,omitempty"`
+	// Cert is the base64-encoded TLS cert, or a reference to a file ("file:///path/to/file")
+	// or to an environment variable ("env:VAR") holding the PEM-encoded or the base64-encoded
+	// cert. Referenced files are watched for changes.
 	Cert string `json:"cert,omitempty"`
-	// Key is the base64-encoded TLS key.
+	// Key is the base64-encoded TLS key, or a reference to a file or to an environment
+	// variable, see Cert.
 	Key string `json:"key,omitempty"`
+	// Certificates lists further TLS cert/key pairs for TLS and DTLS listeners. The cert is
+	// selected by the server name (SNI) requested by the client, falling back to Cert/Key
+	// if no cert matches. Certs and keys are given like Cert and Key.
+	Certificates []CertificateConfig `json:"certificates,omitempty"`
+	// ClientAuth enables the verification of client certs on TLS and DTLS listeners. Default
+	// is to not request client certs.
+	ClientAuth *ClientAuthConfig `json:"client_auth,omitempty"`
 	// Routes specifies the list of Routes allowed via a listener.
 	Routes []string `json:"routes,omitempty"`
+	// RouteRules specifies the priority, the weight and the match conditions of the routes, if
+	// any. Route rules are encoded in the routes list, see RouteRule.
+	RouteRules []RouteRule `json:"-"`
+}
+
+// CertificateConfig is a TLS cert/key pair.
+type CertificateConfig struct {
+	// Cert is the TLS cert, see ListenerConfig.Cert.
+	Cert string `json:"cert"`
+	// Key is the TLS key, see ListenerConfig.Key.
+	Key string `json:"key"`
 }
 
 // Validate checks a configuration and injects defaults.
@@ -63,6 +110,22 @@ func (req *ListenerConfig) Validate() error {
 		return fmt.Errorf("invalid port: %d", req.Port)
 	}
 
+	if req.MinRelayPort != 0 || req.MaxRelayPort != 0 {
+		if req.MinRelayPort == 0 {
+			req.MinRelayPort = DefaultMinRelayPort
+		}
+		if req.MaxRelayPort == 0 {
+			req.MaxRelayPort = DefaultMaxRelayPort
+		}
+		if req.MinRelayPort < 0 || req.MaxRelayPort > 65535 || req.MinRelayPort > req.MaxRelayPort {
+			return fmt.Errorf("invalid relay port range: %d-%d", req.MinRelayPort, req.MaxRelayPort)
+		}
+	}
+
+	if err := req.validateRelayAddr(); err != nil {
+		return err
+	}
+
 	if proto == ListenerProtocolTURNTLS || proto == ListenerProtocolTURNDTLS ||
 		proto == ListenerProtocolTLS || proto == ListenerProtocolDTLS {
 		if req.Cert == "" {
@@ -72,10 +135,41 @@ func (req *ListenerConfig) Validate() error {
 			return fmt.Errorf("empty TLS key for %s listener", proto.String())
 		}
 	}
+	if err := validateReference(req.Cert); err != nil {
+		return fmt.Errorf("invalid TLS cert: %w", err)
+	}
+	if err := validateReference(req.Key); err != nil {
+		return fmt.Errorf("invalid TLS key: %w", err)
+	}
+	for i, c := range req.Certificates {
+		if c.Cert == "" || c.Key == "" {
+			return fmt.Errorf("empty TLS cert or key in certificate %d", i)
+		}
+		if err := validateReference(c.Cert); err != nil {
+			return fmt.Errorf("invalid TLS cert in certificate %d: %w", i, err)
+		}
+		if err := validateReference(c.Key); err != nil {
+			return fmt.Errorf("invalid TLS key in certificate %d: %w", i, err)
+		}
+	}
+	if len(req.Certificates) == 0 {
+		req.Certificates = nil
+	}
+	if req.ClientAuth != nil {
+		if proto != ListenerProtocolTURNTLS && proto != ListenerProtocolTURNDTLS {
+			return fmt.Errorf("client auth is not supported for %s listener", proto.String())
+		}
+		if err := req.ClientAuth.validate(); err != nil {
+			return err
+		}
+	}
 
 	if req.Routes == nil {
 		req.Routes = []string{}
 	}
+	if err := req.validateRouteRules(); err != nil {
+		return err
+	}
 
 	sort.Strings(req.Routes)
 	return nil
@@ -97,6 +191,16 @@ func (req *ListenerConfig) DeepCopyInto(dst Config) {
 	*ret = *req
 	ret.Routes = make([]string, len(req.Routes))
 	copy(ret.Routes, req.Routes)
+	ret.Certificates = nil
+	if req.Certificates != nil {
+		ret.Certificates = make([]CertificateConfig, len(req.Certificates))
+		copy(ret.Certificates, req.Certificates)
+	}
+	ret.ClientAuth = req.ClientAuth.DeepCopy()
+	ret.RouteRules = nil
+	for _, r := range req.RouteRules {
+		ret.RouteRules = append(ret.RouteRules, r.DeepCopy())
+	}
 }
 
 // String stringifies the configuration.
@@ -124,19 +228,129 @@ func (req *ListenerConfig) String() string {
 	}
 	status = append(status, fmt.Sprintf("public=%s:%s", a, p))
 
+	if req.MaxRelayPort != 0 {
+		status = append(status, fmt.Sprintf("relay-ports=%d-%d", req.MinRelayPort, req.MaxRelayPort))
+	}
+
+	if req.RelayAddr != "" {
+		status = append(status, fmt.Sprintf("relay-address=%s", req.RelayAddr))
+	}
+
 	c, k := "-", "-"
-	if req.Cert != "" {
+	if IsReference(req.Cert) {
+		c = req.Cert
+	} else if req.Cert != "" {
 		c = "<SECRET>"
 	}
-	if req.Key != "" {
+	if IsReference(req.Key) {
+		k = req.Key
+	} else if req.Key != "" {
 		k = "<SECRET>"
 	}
 	status = append(status, fmt.Sprintf("cert/key=%s/%s", c, k))
-	status = append(status, fmt.Sprintf("routes=[%s]", strings.Join(req.Routes, ",")))
+	if len(req.Certificates) > 0 {
+		status = append(status, fmt.Sprintf("certificates=%d", len(req.Certificates)))
+	}
+	if req.ClientAuth != nil {
+		status = append(status, req.ClientAuth.String())
+	}
+	routes := make([]string, 0, len(req.Routes))
+	for _, c := range req.Routes {
+		if r, ok := req.GetRouteRule(c); ok {
+			c = r.String()
+		}
+		routes = append(routes, c)
+	}
+	status = append(status, fmt.Sprintf("routes=[%s]", strings.Join(routes, ",")))
 
 	return fmt.Sprintf("%q:{%s}", n, strings.Join(status, ","))
 }
 
+// RelayAddrAuto is the relay address that makes STUNner discover its public IP.
+const RelayAddrAuto = "auto"
+
+// validateRelayAddr checks the relay address of the listener and injects the discovery defaults
+// for relay address "auto".
+func (req *ListenerConfig) validateRelayAddr() error {
+	if strings.EqualFold(strings.TrimSpace(req.RelayAddr), RelayAddrAuto) {
+		req.RelayAddr = RelayAddrAuto
+		if req.RelayAddrDiscoveryServer == "" {
+			req.RelayAddrDiscoveryServer = DefaultRelayDiscoveryServer
+		}
+		if _, _, err := net.SplitHostPort(req.RelayAddrDiscoveryServer); err != nil {
+			return fmt.Errorf("invalid relay address discovery server %q: %w",
+				req.RelayAddrDiscoveryServer, err)
+		}
+		if req.RelayAddrDiscoveryInterval == "" {
+			req.RelayAddrDiscoveryInterval = DefaultRelayDiscoveryInterval
+		}
+		if d, err := time.ParseDuration(req.RelayAddrDiscoveryInterval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid relay address discovery interval %q",
+				req.RelayAddrDiscoveryInterval)
+		}
+		return nil
+	}
+
+	if req.RelayAddr == "" {
+		return nil
+	}
+	ips, err := req.RelayAddrs()
+	if err != nil {
+		return err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	req.RelayAddr = strings.Join(addrs, ",")
+	return nil
+}
+
+// RelayAddrs returns the IP addresses of a fixed relay address, or nil if the relay address is
+// unset or "auto".
+func (req *ListenerConfig) RelayAddrs() ([]net.IP, error) {
+	if req.RelayAddr == "" || req.RelayAddr == RelayAddrAuto {
+		return nil, nil
+	}
+	var ips []net.IP
+	for _, a := range strings.Split(req.RelayAddr, ",") {
+		ip := net.ParseIP(strings.TrimSpace(a))
+		if ip == nil || ip.IsUnspecified() {
+			return nil, fmt.Errorf("invalid relay address %q", req.RelayAddr)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// transport returns the transport protocol ("udp" or "tcp") of the listener socket.
+func (req *ListenerConfig) transport() string {
+	proto, _ := NewListenerProtocol(req.Protocol)
+	switch proto {
+	case ListenerProtocolUDP, ListenerProtocolDTLS, ListenerProtocolTURNUDP, ListenerProtocolTURNDTLS:
+		return "udp"
+	default:
+		return "tcp"
+	}
+}
+
+// bindsAll reports whether the listener is bound to all addresses of the host.
+func (req *ListenerConfig) bindsAll() bool {
+	ip := net.ParseIP(req.Addr)
+	return req.Addr == "" || (ip != nil && ip.IsUnspecified())
+}
+
+// bindAddr returns the address the listener is bound to in a canonical form.
+func (req *ListenerConfig) bindAddr() string {
+	if req.Addr == "localhost" {
+		return "127.0.0.1"
+	}
+	if ip := net.ParseIP(req.Addr); ip != nil {
+		return ip.String()
+	}
+	return req.Addr
+}
+
 // GetListenerURI is a helper that can output two types of Listener URIs: one with "://" after the
 // scheme or one with only ":" (as per RFC7065).
 func (req *ListenerConfig) GetListenerURI(rfc7065 bool) (string, error) {
@@ -188,12 +402,29 @@ func (req *ListenerConfig) GetListenerURI(rfc7065 bool) (string, error) {
 
 type ListenerStatus struct {
 	*ListenerConfig
-	Stats OffloadDirStat `json:"stats"`
+	// RelayAddrs lists the IP addresses currently advertised in the relayed transport
+	// addresses, if a relay address is set. Empty while the public IP is not yet discovered
+	// with relay address "auto".
+	RelayAddrs []string `json:"relay_addresses,omitempty"`
+	// RelayAddrError is the error of the last public IP discovery with relay address "auto",
+	// if any.
+	RelayAddrError string         `json:"relay_address_error,omitempty"`
+	Stats          OffloadDirStat `json:"stats"`
 }
 
 // String stringifies the configuration.
 func (req *ListenerStatus) String() string {
 	status := req.ListenerConfig.String()
+	if req.RelayAddr != "" {
+		a := "-"
+		if len(req.RelayAddrs) > 0 {
+			a = strings.Join(req.RelayAddrs, ",")
+		}
+		status += fmt.Sprintf(",relay-addresses=%s", a)
+		if req.RelayAddrError != "" {
+			status += fmt.Sprintf(",relay-address-error=%q", req.RelayAddrError)
+		}
+	}
 	status += fmt.Sprintf(",offload(rx/tx): %d/%d pkts %d/%d bytes",
 		req.Stats.Rx.Pkts, req.Stats.Tx.Pkts, req.Stats.Rx.Bytes, req.Stats.Tx.Bytes)
 	return status
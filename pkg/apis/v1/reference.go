@@ -0,0 +1,98 @@
+package v1
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// ReferencePrefixFile marks a config value that is read from a file, e.g.,
+	// "file:///var/run/secrets/stunner/password".
+	ReferencePrefixFile = "file://"
+	// ReferencePrefixEnv marks a config value that is read from an environment variable, e.g.,
+	// "env:STUNNER_PASSWORD".
+	ReferencePrefixEnv = "env:"
+)
+
+// IsReference returns true if a config value is a reference to a file or to an environment
+// variable rather than an inline value.
+func IsReference(v string) bool {
+	return strings.HasPrefix(v, ReferencePrefixFile) || strings.HasPrefix(v, ReferencePrefixEnv)
+}
+
+// ReferencedFile returns the path of the file a config value refers to, if any.
+func ReferencedFile(v string) (string, bool) {
+	if !strings.HasPrefix(v, ReferencePrefixFile) {
+		return "", false
+	}
+	return strings.TrimPrefix(v, ReferencePrefixFile), true
+}
+
+// ResolveReference returns the value a reference points to: the content of the file or the value
+// of the environment variable, with trailing newlines removed. Inline values are returned as is.
+func ResolveReference(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, ReferencePrefixFile):
+		path := strings.TrimPrefix(v, ReferencePrefixFile)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("cannot resolve reference %q: %w", v, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(v, ReferencePrefixEnv):
+		name := strings.TrimPrefix(v, ReferencePrefixEnv)
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("cannot resolve reference %q: environment variable not set", v)
+		}
+		return strings.TrimRight(val, "\r\n"), nil
+	}
+	return v, nil
+}
+
+// validateReference checks the syntax of a reference. Inline values are always valid.
+func validateReference(v string) error {
+	switch {
+	case strings.HasPrefix(v, ReferencePrefixFile):
+		if path := strings.TrimPrefix(v, ReferencePrefixFile); !filepath.IsAbs(path) {
+			return fmt.Errorf("invalid file reference %q: path must be absolute", v)
+		}
+	case strings.HasPrefix(v, ReferencePrefixEnv):
+		if strings.TrimPrefix(v, ReferencePrefixEnv) == "" {
+			return fmt.Errorf("invalid environment reference %q: empty variable name", v)
+		}
+	}
+	return nil
+}
+
+// ReferencedFiles returns the files referred to by the auth credentials and the TLS material of the
+// listeners, for watching the files for changes. The result is sorted and free of duplicates.
+func (req *StunnerConfig) ReferencedFiles() []string {
+	vals := []string{}
+	for _, v := range req.Auth.Credentials {
+		vals = append(vals, v)
+	}
+	vals = append(vals, req.Auth.Secrets...)
+	for _, l := range req.Listeners {
+		vals = append(vals, l.Cert, l.Key)
+		for _, c := range l.Certificates {
+			vals = append(vals, c.Cert, c.Key)
+		}
+		if l.ClientAuth != nil {
+			vals = append(vals, l.ClientAuth.CA)
+		}
+	}
+
+	files := []string{}
+	for _, v := range vals {
+		if f, ok := ReferencedFile(v); ok {
+			files = append(files, f)
+		}
+	}
+	// Credentials is a map: sort for a stable result.
+	slices.Sort(files)
+	return slices.Compact(files)
+}
@@ -0,0 +1,263 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RouteRule specifies the priority, the weight and the match conditions of a route of a listener.
+// In the "routes" list of the listener config, a route with a rule is given as an object and a
+// plain route is given as the name of the cluster, e.g.:
+//
+//	routes: ["media", {"cluster": "media-fallback", "priority": 1}]
+type RouteRule struct {
+	// Cluster is the name of the cluster the route points to. Mandatory.
+	Cluster string `json:"cluster"`
+	// Priority orders the routes of a listener: a peer is routed to a cluster of the lowest
+	// priority that admits it. Default is 0.
+	Priority int `json:"priority,omitempty"`
+	// Weight spreads the peers admitted by several routes of the same priority across the
+	// routes in proportion to the weights. The route of each peer is selected from the routes
+	// with a positive weight by hashing the peer IP, so that a peer always takes the same route.
+	// Routes with a zero weight take only the peers not admitted by any route of the same
+	// priority with a positive weight, in the order of the cluster name. Default is 0.
+	Weight int `json:"weight,omitempty"`
+	// Match specifies the conditions for the route to apply. Default is to match all peers.
+	Match *RouteMatch `json:"match,omitempty"`
+}
+
+// RouteMatch specifies the conditions for a route to apply. All conditions must hold.
+type RouteMatch struct {
+	// PeerPorts restricts the route to peers in a port range, given as "port" or
+	// "minPort-maxPort".
+	PeerPorts string `json:"peer_ports,omitempty"`
+	// UsernamePrefix restricts the route to users whose username starts with the prefix.
+	UsernamePrefix string `json:"username_prefix,omitempty"`
+	// Realm restricts the route to the given authentication realm.
+	Realm string `json:"realm,omitempty"`
+}
+
+// Validate checks a route rule.
+func (r *RouteRule) Validate() error {
+	if r.Cluster == "" {
+		return fmt.Errorf("missing cluster name in route: %s", r.String())
+	}
+	if r.Weight < 0 {
+		return fmt.Errorf("negative weight in route: %s", r.String())
+	}
+	if r.Match != nil && r.Match.PeerPorts != "" {
+		if _, _, err := r.Match.PortRange(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PortRange returns the peer port range of a route match condition.
+func (m *RouteMatch) PortRange() (int, int, error) {
+	lo, hi, found := strings.Cut(m.PeerPorts, "-")
+	if !found {
+		hi = lo
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid peer port range %q: %w", m.PeerPorts, err)
+	}
+	endPort, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid peer port range %q: %w", m.PeerPorts, err)
+	}
+	if port <= 0 || endPort > 65535 || port > endPort {
+		return 0, 0, fmt.Errorf("invalid peer port range %q", m.PeerPorts)
+	}
+	return port, endPort, nil
+}
+
+// DeepCopy copies a route rule.
+func (r RouteRule) DeepCopy() RouteRule {
+	ret := r
+	if r.Match != nil {
+		m := *r.Match
+		ret.Match = &m
+	}
+	return ret
+}
+
+// String stringifies a route rule.
+func (r RouteRule) String() string {
+	status := []string{fmt.Sprintf("priority=%d", r.Priority), fmt.Sprintf("weight=%d", r.Weight)}
+	if r.Match != nil {
+		if r.Match.PeerPorts != "" {
+			status = append(status, fmt.Sprintf("peer-ports=%s", r.Match.PeerPorts))
+		}
+		if r.Match.UsernamePrefix != "" {
+			status = append(status, fmt.Sprintf("username-prefix=%s", r.Match.UsernamePrefix))
+		}
+		if r.Match.Realm != "" {
+			status = append(status, fmt.Sprintf("realm=%s", r.Match.Realm))
+		}
+	}
+	return fmt.Sprintf("%s(%s)", r.Cluster, strings.Join(status, ","))
+}
+
+// GetRouteRule returns the rule of the route to a cluster, if any.
+func (req *ListenerConfig) GetRouteRule(cluster string) (RouteRule, bool) {
+	for _, r := range req.RouteRules {
+		if r.Cluster == cluster {
+			return r, true
+		}
+	}
+	return RouteRule{}, false
+}
+
+// validateRouteRules checks the route rules of a listener and adds the clusters of the rules
+// missing from the routes.
+func (req *ListenerConfig) validateRouteRules() error {
+	if len(req.RouteRules) == 0 {
+		req.RouteRules = nil
+		return nil
+	}
+
+	seen := map[string]bool{}
+	for i := range req.RouteRules {
+		r := &req.RouteRules[i]
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if seen[r.Cluster] {
+			return fmt.Errorf("duplicate route to cluster %q", r.Cluster)
+		}
+		seen[r.Cluster] = true
+
+		found := false
+		for _, c := range req.Routes {
+			if c == r.Cluster {
+				found = true
+				break
+			}
+		}
+		if !found {
+			req.Routes = append(req.Routes, r.Cluster)
+		}
+	}
+
+	sort.Slice(req.RouteRules, func(i, j int) bool {
+		return req.RouteRules[i].Cluster < req.RouteRules[j].Cluster
+	})
+	return nil
+}
+
+// listenerConfigJSON is the JSON representation of a listener config, with the routes given
+// either as cluster names or as route rules.
+type listenerConfigJSON struct {
+	*listenerConfigAlias
+	Routes []json.RawMessage `json:"routes,omitempty"`
+}
+
+type listenerConfigAlias ListenerConfig
+
+// listenerStatusJSON is the JSON representation of a listener status.
+type listenerStatusJSON struct {
+	listenerConfigJSON
+	RelayAddrs     []string       `json:"relay_addresses,omitempty"`
+	RelayAddrError string         `json:"relay_address_error,omitempty"`
+	Stats          OffloadDirStat `json:"stats"`
+}
+
+// MarshalJSON encodes a listener config, with the routes with a rule given as objects.
+func (req ListenerConfig) MarshalJSON() ([]byte, error) {
+	routes, err := req.encodeRoutes()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(listenerConfigJSON{listenerConfigAlias: (*listenerConfigAlias)(&req), Routes: routes})
+}
+
+// UnmarshalJSON decodes a listener config, accepting the routes either as cluster names or as
+// route rules.
+func (req *ListenerConfig) UnmarshalJSON(b []byte) error {
+	aux := listenerConfigJSON{listenerConfigAlias: (*listenerConfigAlias)(req)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	return req.decodeRoutes(aux.Routes)
+}
+
+// MarshalJSON encodes a listener status. Overrides the encoder of the embedded listener config.
+func (req ListenerStatus) MarshalJSON() ([]byte, error) {
+	conf := ListenerConfig{}
+	if req.ListenerConfig != nil {
+		conf = *req.ListenerConfig
+	}
+	routes, err := conf.encodeRoutes()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(listenerStatusJSON{
+		listenerConfigJSON: listenerConfigJSON{listenerConfigAlias: (*listenerConfigAlias)(&conf), Routes: routes},
+		RelayAddrs:         req.RelayAddrs,
+		RelayAddrError:     req.RelayAddrError,
+		Stats:              req.Stats,
+	})
+}
+
+// UnmarshalJSON decodes a listener status. Overrides the decoder of the embedded listener config.
+func (req *ListenerStatus) UnmarshalJSON(b []byte) error {
+	conf := &ListenerConfig{}
+	aux := listenerStatusJSON{listenerConfigJSON: listenerConfigJSON{listenerConfigAlias: (*listenerConfigAlias)(conf)}}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if err := conf.decodeRoutes(aux.Routes); err != nil {
+		return err
+	}
+	req.ListenerConfig, req.Stats = conf, aux.Stats
+	req.RelayAddrs, req.RelayAddrError = aux.RelayAddrs, aux.RelayAddrError
+	return nil
+}
+
+// encodeRoutes encodes the routes of a listener, the routes with a rule as objects and the plain
+// routes as cluster names.
+func (req *ListenerConfig) encodeRoutes() ([]json.RawMessage, error) {
+	if req.Routes == nil {
+		return nil, nil
+	}
+	routes := make([]json.RawMessage, 0, len(req.Routes))
+	for _, c := range req.Routes {
+		var route any = c
+		if r, ok := req.GetRouteRule(c); ok {
+			route = r
+		}
+		raw, err := json.Marshal(route)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, raw)
+	}
+	return routes, nil
+}
+
+// decodeRoutes decodes the routes of a listener given either as cluster names or as route rules.
+func (req *ListenerConfig) decodeRoutes(raws []json.RawMessage) error {
+	req.Routes, req.RouteRules = nil, nil
+	if raws != nil {
+		req.Routes = make([]string, 0, len(raws))
+	}
+	for _, raw := range raws {
+		var c string
+		if err := json.Unmarshal(raw, &c); err == nil {
+			req.Routes = append(req.Routes, c)
+			continue
+		}
+		var r RouteRule
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return fmt.Errorf("invalid route %s: %w", string(raw), err)
+		}
+		req.Routes = append(req.Routes, r.Cluster)
+		req.RouteRules = append(req.RouteRules, r)
+	}
+	return nil
+}
@@ -45,6 +45,9 @@ func (req *StunnerConfig) Validate() error {
 			}
 			req.Listeners[i] = l
 		}
+		if err := req.validateListenerAddrs(); err != nil {
+			return err
+		}
 	}
 
 	if req.Clusters == nil {
@@ -61,6 +64,25 @@ func (req *StunnerConfig) Validate() error {
 	return nil
 }
 
+// validateListenerAddrs checks that no two listeners bind the same transport address. Listeners
+// bound to different addresses may share a port, but a listener with an unspecified address binds
+// all addresses.
+func (req *StunnerConfig) validateListenerAddrs() error {
+	for i := range req.Listeners {
+		for j := range i {
+			a, b := &req.Listeners[j], &req.Listeners[i]
+			if a.Port != b.Port || a.transport() != b.transport() {
+				continue
+			}
+			if a.bindsAll() || b.bindsAll() || a.bindAddr() == b.bindAddr() {
+				return fmt.Errorf("listeners %q and %q bind the same %s port %d",
+					a.Name, b.Name, strings.ToUpper(a.transport()), a.Port)
+			}
+		}
+	}
+	return nil
+}
+
 // Name returns the name of the object to be configured.
 func (req *StunnerConfig) ConfigName() string {
 	// Singleton root object.
@@ -195,10 +217,38 @@ func (req *StunnerConfig) Summary() string {
 	}
 	status := fmt.Sprintf("Gateway: %s (loglevel: %q)\n", req.Admin.Name, req.Admin.LogLevel)
 	if t, err := NewAuthType(req.Auth.Type); err == nil {
-		if t == AuthTypeStatic {
+		switch t {
+		case AuthTypeStatic:
 			status += fmt.Sprintf("Authentication type: static, username/password: %s/%s\n",
 				req.Auth.Credentials["username"], req.Auth.Credentials["password"])
-		} else {
+		case AuthTypeStaticMulti:
+			users := []string{}
+			for _, u := range req.Auth.Users {
+				users = append(users, u.Username+"/"+u.Password)
+			}
+			status += fmt.Sprintf("Authentication type: static-multi, users: [%s], user-file: %s\n",
+				strings.Join(users, ", "), strOrNone(req.Auth.UserFile))
+		case AuthTypeJWT:
+			keySetFile, passwordClaim := "", ""
+			if req.Auth.JWT != nil {
+				keySetFile, passwordClaim = req.Auth.JWT.KeySetFile, req.Auth.JWT.PasswordClaim
+			}
+			status += fmt.Sprintf("Authentication type: jwt, keyset-file: %s, password-claim: %s\n",
+				strOrNone(keySetFile), strOrNone(passwordClaim))
+		case AuthTypeWebhook:
+			url := ""
+			if req.Auth.Webhook != nil {
+				url = req.Auth.Webhook.URL
+			}
+			status += fmt.Sprintf("Authentication type: webhook, url: %s\n", strOrNone(url))
+		case AuthTypeOAuth:
+			server, keys := "", 0
+			if req.Auth.OAuth != nil {
+				server, keys = req.Auth.OAuth.AuthorizationServer, len(req.Auth.OAuth.Keys)
+			}
+			status += fmt.Sprintf("Authentication type: oauth, authorization-server: %s, keys: %d\n",
+				strOrNone(server), keys)
+		default:
 			status += fmt.Sprintf("Authentication type: ephemeral, shared-secret: %s\n",
 				req.Auth.Credentials["secret"])
 		}
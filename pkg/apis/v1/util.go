@@ -12,16 +12,24 @@ const (
 	AuthTypeNone AuthType = iota
 	AuthTypeStatic
 	AuthTypeEphemeral
+	AuthTypeStaticMulti
+	AuthTypeJWT
+	AuthTypeWebhook
+	AuthTypeOAuth
 )
 
 const (
-	authTypeNoneStr      = "none"
-	authTypeStaticStr    = "static"
-	authTypeEphemeralStr = "ephemeral"
-	AuthTypePlainText    = AuthTypeStatic
-	AuthTypeLongTerm     = AuthTypeEphemeral
-	authTypePlainTextStr = "plaintext"
-	authTypeLongTermStr  = "longterm"
+	authTypeNoneStr        = "none"
+	authTypeStaticStr      = "static"
+	authTypeEphemeralStr   = "ephemeral"
+	authTypeStaticMultiStr = "static-multi"
+	authTypeJWTStr         = "jwt"
+	authTypeWebhookStr     = "webhook"
+	authTypeOAuthStr       = "oauth"
+	AuthTypePlainText      = AuthTypeStatic
+	AuthTypeLongTerm       = AuthTypeEphemeral
+	authTypePlainTextStr   = "plaintext"
+	authTypeLongTermStr    = "longterm"
 )
 
 // NewAuthType parses the authentication mechanism specification.
@@ -31,6 +39,14 @@ func NewAuthType(raw string) (AuthType, error) {
 		return AuthTypeStatic, nil
 	case authTypeEphemeralStr, authTypeLongTermStr:
 		return AuthTypeEphemeral, nil
+	case authTypeStaticMultiStr:
+		return AuthTypeStaticMulti, nil
+	case authTypeJWTStr:
+		return AuthTypeJWT, nil
+	case authTypeWebhookStr:
+		return AuthTypeWebhook, nil
+	case authTypeOAuthStr:
+		return AuthTypeOAuth, nil
 	case authTypeNoneStr:
 		return AuthTypeNone, nil
 	default:
@@ -47,6 +63,14 @@ func (a AuthType) String() string {
 		return authTypeStaticStr
 	case AuthTypeEphemeral:
 		return authTypeEphemeralStr
+	case AuthTypeStaticMulti:
+		return authTypeStaticMultiStr
+	case AuthTypeJWT:
+		return authTypeJWTStr
+	case AuthTypeWebhook:
+		return authTypeWebhookStr
+	case AuthTypeOAuth:
+		return authTypeOAuthStr
 	default:
 		return "<unknown>"
 	}
@@ -133,12 +157,14 @@ type ClusterType int
 const (
 	ClusterTypeStatic ClusterType = iota + 1
 	ClusterTypeStrictDNS
+	ClusterTypeEndpointSlice
 	ClusterTypeUnknown
 )
 
 const (
-	clusterTypeStaticStr    = "STATIC"
-	clusterTypeStrictDNSStr = "STRICT_DNS"
+	clusterTypeStaticStr        = "STATIC"
+	clusterTypeStrictDNSStr     = "STRICT_DNS"
+	clusterTypeEndpointSliceStr = "ENDPOINT_SLICE"
 )
 
 func NewClusterType(raw string) (ClusterType, error) {
@@ -147,6 +173,8 @@ func NewClusterType(raw string) (ClusterType, error) {
 		return ClusterTypeStatic, nil
 	case clusterTypeStrictDNSStr:
 		return ClusterTypeStrictDNS, nil
+	case clusterTypeEndpointSliceStr:
+		return ClusterTypeEndpointSlice, nil
 	default:
 		return ClusterType(ClusterTypeUnknown),
 			fmt.Errorf("unknown cluster type: \"%s\"", raw)
@@ -159,6 +187,8 @@ func (l ClusterType) String() string {
 		return clusterTypeStaticStr
 	case ClusterTypeStrictDNS:
 		return clusterTypeStrictDNSStr
+	case ClusterTypeEndpointSlice:
+		return clusterTypeEndpointSliceStr
 	default:
 		return "<unknown>"
 	}
@@ -203,6 +233,62 @@ func (p ClusterProtocol) String() string {
 	}
 }
 
+// TopologyMode specifies the locality preference of a cluster.
+type TopologyMode int
+
+const (
+	TopologyModeNone TopologyMode = iota + 1
+	TopologyModePreferNode
+	TopologyModePreferZone
+	TopologyModeRequireNode
+	TopologyModeRequireZone
+	TopologyModeUnknown
+)
+
+const (
+	topologyModeNoneStr        = "NONE"
+	topologyModePreferNodeStr  = "PREFER_NODE"
+	topologyModePreferZoneStr  = "PREFER_ZONE"
+	topologyModeRequireNodeStr = "REQUIRE_NODE"
+	topologyModeRequireZoneStr = "REQUIRE_ZONE"
+)
+
+// NewTopologyMode parses the topology mode specification.
+func NewTopologyMode(raw string) (TopologyMode, error) {
+	switch strings.ToUpper(raw) {
+	case topologyModeNoneStr:
+		return TopologyModeNone, nil
+	case topologyModePreferNodeStr:
+		return TopologyModePreferNode, nil
+	case topologyModePreferZoneStr:
+		return TopologyModePreferZone, nil
+	case topologyModeRequireNodeStr:
+		return TopologyModeRequireNode, nil
+	case topologyModeRequireZoneStr:
+		return TopologyModeRequireZone, nil
+	default:
+		return TopologyModeUnknown, fmt.Errorf("unknown topology mode: \"%s\"", raw)
+	}
+}
+
+// String returns a string representation of a topology mode.
+func (m TopologyMode) String() string {
+	switch m {
+	case TopologyModeNone:
+		return topologyModeNoneStr
+	case TopologyModePreferNode:
+		return topologyModePreferNodeStr
+	case TopologyModePreferZone:
+		return topologyModePreferZoneStr
+	case TopologyModeRequireNode:
+		return topologyModeRequireNodeStr
+	case TopologyModeRequireZone:
+		return topologyModeRequireZoneStr
+	default:
+		return "<unknown>"
+	}
+}
+
 // OffloadEngine specifies the type of TURN offload mode.
 type OffloadMode int
 
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/pion/stun/v3"
 	"github.com/pion/turn/v5"
 )
 
@@ -82,6 +83,45 @@ func GetLongTermCredential(username string, sharedSecret string) (string, error)
 	return base64.StdEncoding.EncodeToString(password), nil
 }
 
+// MatchLongTermCredential finds the shared secret used to issue the credential of a STUN request.
+// It parses the raw message, derives the long-term credential from the username with each secret
+// in order, and returns the username and the index of the first secret whose key verifies the
+// MESSAGE-INTEGRITY-SHA256 attribute, if present, or the MESSAGE-INTEGRITY attribute otherwise,
+// or -1 if no secret matches or the message carries no integrity. This allows accepting
+// credentials issued with any secret in a rotated secret list.
+func MatchLongTermCredential(raw []byte, realm string, secrets []string) (string, int) {
+	if !stun.IsMessage(raw) {
+		return "", -1
+	}
+	msg := &stun.Message{Raw: append([]byte(nil), raw...)}
+	if err := msg.Decode(); err != nil {
+		return "", -1
+	}
+	sha256 := msg.Contains(AttrMessageIntegritySHA256)
+	if !sha256 && !msg.Contains(stun.AttrMessageIntegrity) {
+		return "", -1
+	}
+	username := stun.Username{}
+	if err := username.GetFrom(msg); err != nil {
+		return "", -1
+	}
+	u := username.String()
+	for i, secret := range secrets {
+		password, err := GetLongTermCredential(u, secret)
+		if err != nil {
+			continue
+		}
+		if sha256 {
+			if MessageIntegritySHA256(GenerateAuthKeySHA256(u, realm, password)).Check(msg) == nil {
+				return u, i
+			}
+		} else if stun.MessageIntegrity(GenerateAuthKey(u, realm, password)).Check(msg) == nil {
+			return u, i
+		}
+	}
+	return u, -1
+}
+
 // GenerateAuthKey is a convenience function to easily generate keys in the format used by
 // AuthHandler. Re-exported from `pion/turn` so that our callers will have a single import.
 func GenerateAuthKey(username, realm, password string) []byte {
@@ -0,0 +1,320 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/stun/v3"
+)
+
+const (
+	// PasswordAlgorithmMD5 is the MD5 long-term credential key derivation of RFC 5389 used with
+	// MESSAGE-INTEGRITY.
+	PasswordAlgorithmMD5 = "MD5"
+	// PasswordAlgorithmSHA256 is the SHA-256 long-term credential key derivation of RFC 8489
+	// used with MESSAGE-INTEGRITY-SHA256.
+	PasswordAlgorithmSHA256 = "SHA-256"
+
+	// AttrMessageIntegritySHA256 is the MESSAGE-INTEGRITY-SHA256 attribute (RFC 8489, Section
+	// 14.6).
+	AttrMessageIntegritySHA256 stun.AttrType = 0x001C
+
+	// NonceCookie is the prefix of the NONCE of the challenges that advertise the password
+	// algorithms: the "obMatJos2" cookie followed by the base64-encoded security feature set
+	// with only the "Password algorithms" bit set, as per RFC 8489, Section 9.2.
+	NonceCookie = "obMatJos2gAAA"
+
+	messageIntegritySHA256Size    = sha256.Size
+	messageIntegritySHA256MinSize = 16
+)
+
+// passwordAlgorithmNumbers are the IANA numbers of the password algorithms (RFC 8489, Section
+// 18.5).
+var passwordAlgorithmNumbers = map[string]uint16{
+	PasswordAlgorithmMD5:    0x0001,
+	PasswordAlgorithmSHA256: 0x0002,
+}
+
+// ErrIntegritySHA256Missing is returned when a message carries no MESSAGE-INTEGRITY-SHA256
+// attribute.
+var ErrIntegritySHA256Missing = errors.New("missing MESSAGE-INTEGRITY-SHA256")
+
+var (
+	errIntegritySHA256Mismatch = errors.New("MESSAGE-INTEGRITY-SHA256 mismatch")
+	errIntegritySHA256Size     = errors.New("invalid MESSAGE-INTEGRITY-SHA256 size")
+)
+
+// GenerateAuthKeySHA256 generates the long-term credential key SHA-256(username:realm:password)
+// used with MESSAGE-INTEGRITY-SHA256, as per RFC 8489, Section 9.2.2.
+func GenerateAuthKeySHA256(username, realm, password string) []byte {
+	h := sha256.Sum256([]byte(username + ":" + realm + ":" + password))
+	return h[:]
+}
+
+// MessageIntegritySHA256 represents the MESSAGE-INTEGRITY-SHA256 attribute keyed with a long-term
+// credential key. The API mirrors stun.MessageIntegrity.
+type MessageIntegritySHA256 []byte
+
+// AddTo adds a full-length MESSAGE-INTEGRITY-SHA256 attribute to a message. Any FINGERPRINT
+// attribute must be added after.
+func (i MessageIntegritySHA256) AddTo(m *stun.Message) error {
+	// The length in the header must include the attribute itself when the HMAC is computed.
+	length := m.Length
+	m.Length += messageIntegritySHA256Size + 4
+	m.WriteLength()
+	v := hmacSHA256(i, m.Raw)
+	m.Length = length
+	m.Add(AttrMessageIntegritySHA256, v)
+	return nil
+}
+
+// Check checks the MESSAGE-INTEGRITY-SHA256 attribute of a message. Truncated values of at least
+// 16 bytes are accepted, as per RFC 8489, Section 14.6.
+func (i MessageIntegritySHA256) Check(m *stun.Message) error {
+	v, err := m.Get(AttrMessageIntegritySHA256)
+	if err != nil {
+		return ErrIntegritySHA256Missing
+	}
+	if len(v) < messageIntegritySHA256MinSize || len(v) > messageIntegritySHA256Size || len(v)%4 != 0 {
+		return errIntegritySHA256Size
+	}
+
+	// Find the end of the attribute in the raw message: the HMAC covers everything before the
+	// attribute with the header length adjusted to end right after it.
+	offset := 0
+	for _, a := range m.Attributes {
+		if a.Type == AttrMessageIntegritySHA256 {
+			break
+		}
+		offset += 4 + nearestPaddedLength(int(a.Length))
+	}
+	end := stunHeaderSize + offset
+	if end > len(m.Raw) {
+		return errIntegritySHA256Mismatch
+	}
+	b := append([]byte(nil), m.Raw[:end]...)
+	binary.BigEndian.PutUint16(b[2:4], uint16(offset+4+len(v))) //nolint:gosec
+
+	if !hmac.Equal(hmacSHA256(i, b)[:len(v)], v) {
+		return errIntegritySHA256Mismatch
+	}
+	return nil
+}
+
+// CheckIntegritySHA256 decodes a raw STUN message and checks its MESSAGE-INTEGRITY-SHA256
+// attribute with the given key. Returns ErrIntegritySHA256Missing if the message carries no
+// MESSAGE-INTEGRITY-SHA256.
+func CheckIntegritySHA256(raw []byte, key []byte) error {
+	msg := &stun.Message{Raw: append([]byte(nil), raw...)}
+	if err := msg.Decode(); err != nil {
+		return err
+	}
+	return MessageIntegritySHA256(key).Check(msg)
+}
+
+// PasswordAlgorithms represents the PASSWORD-ALGORITHMS attribute (RFC 8489, Section 14.11), the
+// password algorithms of the server in the order of preference. Algorithms without parameters
+// only are supported, unknown algorithms are decoded by number, e.g., "0x0003".
+type PasswordAlgorithms []string
+
+// AddTo adds the PASSWORD-ALGORITHMS attribute to a message.
+func (p PasswordAlgorithms) AddTo(m *stun.Message) error {
+	v := make([]byte, 0, 4*len(p))
+	for _, a := range p {
+		n, ok := passwordAlgorithmNumbers[a]
+		if !ok {
+			return fmt.Errorf("unknown password algorithm %q", a)
+		}
+		v = binary.BigEndian.AppendUint16(v, n)
+		v = binary.BigEndian.AppendUint16(v, 0)
+	}
+	m.Add(stun.AttrPasswordAlgorithms, v)
+	return nil
+}
+
+// GetFrom decodes the PASSWORD-ALGORITHMS attribute of a message.
+func (p *PasswordAlgorithms) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrPasswordAlgorithms)
+	if err != nil {
+		return err
+	}
+	var ret PasswordAlgorithms
+	for len(v) > 0 {
+		a, rest, err := decodePasswordAlgorithm(v)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, a)
+		v = rest
+	}
+	*p = ret
+	return nil
+}
+
+// Equal reports whether two password algorithm lists are the same, in the same order.
+func (p PasswordAlgorithms) Equal(q PasswordAlgorithms) bool {
+	return strings.Join(p, ",") == strings.Join(q, ",")
+}
+
+// PasswordAlgorithm represents the PASSWORD-ALGORITHM attribute (RFC 8489, Section 14.12), the
+// password algorithm a client has selected.
+type PasswordAlgorithm string
+
+// AddTo adds the PASSWORD-ALGORITHM attribute to a message.
+func (p PasswordAlgorithm) AddTo(m *stun.Message) error {
+	n, ok := passwordAlgorithmNumbers[string(p)]
+	if !ok {
+		return fmt.Errorf("unknown password algorithm %q", string(p))
+	}
+	m.Add(stun.AttrPasswordAlgorithm, binary.BigEndian.AppendUint32(nil, uint32(n)<<16))
+	return nil
+}
+
+// GetFrom decodes the PASSWORD-ALGORITHM attribute of a message.
+func (p *PasswordAlgorithm) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrPasswordAlgorithm)
+	if err != nil {
+		return err
+	}
+	a, rest, err := decodePasswordAlgorithm(v)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("invalid PASSWORD-ALGORITHM")
+	}
+	*p = PasswordAlgorithm(a)
+	return nil
+}
+
+// decodePasswordAlgorithm decodes a password algorithm with its parameters and returns the rest of
+// the value.
+func decodePasswordAlgorithm(v []byte) (string, []byte, error) {
+	if len(v) < 4 {
+		return "", nil, errors.New("invalid password algorithm")
+	}
+	n, length := binary.BigEndian.Uint16(v[0:2]), nearestPaddedLength(int(binary.BigEndian.Uint16(v[2:4])))
+	if len(v) < 4+length {
+		return "", nil, errors.New("invalid password algorithm parameters")
+	}
+	name := fmt.Sprintf("0x%04x", n)
+	for a, num := range passwordAlgorithmNumbers {
+		if num == n {
+			name = a
+		}
+	}
+	return name, v[4+length:], nil
+}
+
+// AdvertisePasswordAlgorithms rewrites a 401 or 438 error response to advertise the password
+// algorithms: the NONCE is prefixed with NonceCookie and a PASSWORD-ALGORITHMS attribute is
+// added. The message must not carry integrity attributes.
+func AdvertisePasswordAlgorithms(raw []byte, algorithms []string) ([]byte, error) {
+	msg := &stun.Message{Raw: append([]byte(nil), raw...)}
+	if err := msg.Decode(); err != nil {
+		return nil, err
+	}
+	ret := rebuild(msg, func(a stun.RawAttribute) ([]byte, bool) {
+		if a.Type == stun.AttrNonce && !strings.HasPrefix(string(a.Value), NonceCookie) {
+			return append([]byte(NonceCookie), a.Value...), true
+		}
+		return a.Value, true
+	})
+	if err := PasswordAlgorithms(algorithms).AddTo(ret); err != nil {
+		return nil, err
+	}
+	return ret.Raw, nil
+}
+
+// ResignRequest rewrites a request whose integrity has been verified by the caller for a TURN
+// server that knows only MESSAGE-INTEGRITY: NonceCookie is removed from the NONCE, the password
+// algorithm attributes and MESSAGE-INTEGRITY-SHA256 are removed and MESSAGE-INTEGRITY is
+// recomputed with the given key.
+func ResignRequest(msg *stun.Message, key []byte) ([]byte, error) {
+	ret := rebuild(msg, func(a stun.RawAttribute) ([]byte, bool) {
+		switch a.Type {
+		case stun.AttrPasswordAlgorithm, stun.AttrPasswordAlgorithms:
+			return nil, false
+		case stun.AttrNonce:
+			return []byte(strings.TrimPrefix(string(a.Value), NonceCookie)), true
+		}
+		return a.Value, true
+	})
+	if err := stun.MessageIntegrity(key).AddTo(ret); err != nil {
+		return nil, err
+	}
+	if msg.Contains(stun.AttrFingerprint) {
+		if err := stun.Fingerprint.AddTo(ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret.Raw, nil
+}
+
+// StripIntegrity removes the integrity attributes from a request, so that the TURN server
+// challenges the client again. NonceCookie is removed from the NONCE.
+func StripIntegrity(msg *stun.Message) []byte {
+	return rebuild(msg, func(a stun.RawAttribute) ([]byte, bool) {
+		if a.Type == stun.AttrNonce {
+			return []byte(strings.TrimPrefix(string(a.Value), NonceCookie)), true
+		}
+		return a.Value, true
+	}).Raw
+}
+
+// SignResponseSHA256 replaces the MESSAGE-INTEGRITY attribute of a response with a
+// MESSAGE-INTEGRITY-SHA256 attribute keyed with the given SHA-256 long-term credential key.
+// Responses without MESSAGE-INTEGRITY are returned unchanged.
+func SignResponseSHA256(raw []byte, key []byte) ([]byte, error) {
+	msg := &stun.Message{Raw: append([]byte(nil), raw...)}
+	if err := msg.Decode(); err != nil {
+		return nil, err
+	}
+	if !msg.Contains(stun.AttrMessageIntegrity) {
+		return raw, nil
+	}
+	ret := rebuild(msg, func(a stun.RawAttribute) ([]byte, bool) { return a.Value, true })
+	if err := MessageIntegritySHA256(key).AddTo(ret); err != nil {
+		return nil, err
+	}
+	if msg.Contains(stun.AttrFingerprint) {
+		if err := stun.Fingerprint.AddTo(ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret.Raw, nil
+}
+
+// rebuild copies the attributes of a message preceding the integrity attributes to a new message,
+// replacing the value of each attribute with the value returned by edit, or dropping the
+// attribute if edit returns false. The integrity and FINGERPRINT attributes are not copied.
+func rebuild(msg *stun.Message, edit func(stun.RawAttribute) ([]byte, bool)) *stun.Message {
+	ret := &stun.Message{Type: msg.Type, TransactionID: msg.TransactionID}
+	ret.WriteHeader()
+	for _, a := range msg.Attributes {
+		if a.Type == stun.AttrMessageIntegrity || a.Type == AttrMessageIntegritySHA256 ||
+			a.Type == stun.AttrFingerprint {
+			break
+		}
+		if v, ok := edit(a); ok {
+			ret.Add(a.Type, v)
+		}
+	}
+	return ret
+}
+
+const stunHeaderSize = 20
+
+func nearestPaddedLength(l int) int {
+	return (l + 3) &^ 3
+}
+
+func hmacSHA256(key, b []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b) //nolint:errcheck
+	return mac.Sum(nil)
+}
@@ -0,0 +1,128 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/pion/stun/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageIntegritySHA256(t *testing.T) {
+	key := GenerateAuthKeySHA256("user", "realm", "pass")
+	h := sha256.Sum256([]byte("user:realm:pass"))
+	require.Equal(t, h[:], key)
+
+	build := func(setters ...stun.Setter) *stun.Message {
+		setters = append([]stun.Setter{stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			stun.NewUsername("user"), stun.NewRealm("realm")}, setters...)
+		m, err := stun.Build(setters...)
+		require.NoError(t, err)
+		return m
+	}
+
+	// Both integrity attributes followed by a fingerprint.
+	m := build(stun.MessageIntegrity(GenerateAuthKey("user", "realm", "pass")),
+		MessageIntegritySHA256(key), stun.Fingerprint)
+	require.NoError(t, CheckIntegritySHA256(m.Raw, key))
+	require.NoError(t, stun.MessageIntegrity(GenerateAuthKey("user", "realm", "pass")).Check(m))
+	require.Error(t, CheckIntegritySHA256(m.Raw, GenerateAuthKeySHA256("user", "realm", "wrong")))
+
+	// Truncated to 16 bytes.
+	m = build()
+	length := m.Length
+	m.Length += 16 + 4
+	m.WriteLength()
+	mac := hmacSHA256(key, m.Raw)[:16]
+	m.Length = length
+	m.Add(AttrMessageIntegritySHA256, mac)
+	require.NoError(t, CheckIntegritySHA256(m.Raw, key))
+
+	// Invalid size.
+	m = build()
+	m.Add(AttrMessageIntegritySHA256, make([]byte, 12))
+	require.Error(t, CheckIntegritySHA256(m.Raw, key))
+
+	// Missing.
+	m = build(stun.MessageIntegrity(GenerateAuthKey("user", "realm", "pass")))
+	require.ErrorIs(t, CheckIntegritySHA256(m.Raw, key), ErrIntegritySHA256Missing)
+}
+
+func TestPasswordAlgorithms(t *testing.T) {
+	m, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		PasswordAlgorithms{PasswordAlgorithmSHA256, PasswordAlgorithmMD5},
+		PasswordAlgorithm(PasswordAlgorithmSHA256))
+	require.NoError(t, err)
+	algorithms, selected := PasswordAlgorithms{}, PasswordAlgorithm("")
+	require.NoError(t, algorithms.GetFrom(m))
+	require.NoError(t, selected.GetFrom(m))
+	require.True(t, algorithms.Equal(PasswordAlgorithms{"SHA-256", "MD5"}))
+	require.False(t, algorithms.Equal(PasswordAlgorithms{"MD5", "SHA-256"}))
+	require.Equal(t, PasswordAlgorithm("SHA-256"), selected)
+
+	// Unknown algorithms are decoded by number, algorithm parameters are skipped.
+	m = stun.New()
+	m.Add(stun.AttrPasswordAlgorithms, []byte{0, 3, 0, 1, 0xff, 0, 0, 0, 0, 2, 0, 0})
+	m.WriteHeader()
+	require.NoError(t, algorithms.GetFrom(m))
+	require.Equal(t, PasswordAlgorithms{"0x0003", "SHA-256"}, algorithms)
+	require.Error(t, PasswordAlgorithms{"SHA-512"}.AddTo(m))
+}
+
+func TestPasswordAlgorithmsRewrite(t *testing.T) {
+	md5Key := GenerateAuthKey("user", "realm", "pass")
+	shaKey := GenerateAuthKeySHA256("user", "realm", "pass")
+
+	// Challenges advertise the password algorithms with the nonce cookie.
+	challenge, err := stun.Build(stun.TransactionID,
+		stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse),
+		&stun.ErrorCodeAttribute{Code: stun.CodeUnauthorized}, stun.NewNonce("nonce"),
+		stun.NewRealm("realm"))
+	require.NoError(t, err)
+	raw, err := AdvertisePasswordAlgorithms(challenge.Raw, []string{"SHA-256", "MD5"})
+	require.NoError(t, err)
+	m := &stun.Message{Raw: raw}
+	require.NoError(t, m.Decode())
+	nonce, algorithms := stun.Nonce{}, PasswordAlgorithms{}
+	require.NoError(t, nonce.GetFrom(m))
+	require.Equal(t, NonceCookie+"nonce", nonce.String())
+	require.NoError(t, algorithms.GetFrom(m))
+	require.Equal(t, PasswordAlgorithms{"SHA-256", "MD5"}, algorithms)
+
+	// Requests are re-signed with MESSAGE-INTEGRITY and the nonce the TURN server issued.
+	req, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewUsername("user"), stun.NewRealm("realm"), stun.NewNonce(NonceCookie+"nonce"),
+		algorithms, PasswordAlgorithm(PasswordAlgorithmSHA256), MessageIntegritySHA256(shaKey),
+		stun.Fingerprint)
+	require.NoError(t, err)
+	raw, err = ResignRequest(req, md5Key)
+	require.NoError(t, err)
+	m = &stun.Message{Raw: raw}
+	require.NoError(t, m.Decode())
+	require.NoError(t, nonce.GetFrom(m))
+	require.Equal(t, "nonce", nonce.String())
+	require.NoError(t, stun.MessageIntegrity(md5Key).Check(m))
+	require.NoError(t, stun.Fingerprint.Check(m))
+	require.False(t, m.Contains(AttrMessageIntegritySHA256))
+	require.False(t, m.Contains(stun.AttrPasswordAlgorithms))
+	require.False(t, m.Contains(stun.AttrPasswordAlgorithm))
+	require.Less(t, len(raw), len(req.Raw))
+
+	m = &stun.Message{Raw: StripIntegrity(req)}
+	require.NoError(t, m.Decode())
+	require.False(t, m.Contains(stun.AttrMessageIntegrity))
+	require.False(t, m.Contains(AttrMessageIntegritySHA256))
+
+	// Responses are signed with MESSAGE-INTEGRITY-SHA256 instead of MESSAGE-INTEGRITY.
+	resp, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+		stun.MessageIntegrity(md5Key), stun.Fingerprint)
+	require.NoError(t, err)
+	raw, err = SignResponseSHA256(resp.Raw, shaKey)
+	require.NoError(t, err)
+	require.NoError(t, CheckIntegritySHA256(raw, shaKey))
+	m = &stun.Message{Raw: raw}
+	require.NoError(t, m.Decode())
+	require.False(t, m.Contains(stun.AttrMessageIntegrity))
+	require.NoError(t, stun.Fingerprint.Check(m))
+}
@@ -0,0 +1,473 @@
+package authentication
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned for malformed JSON Web Tokens.
+	ErrInvalidToken = errors.New("invalid JSON web token")
+	// ErrTokenSignature is returned when no key of the key set verifies a token signature.
+	ErrTokenSignature = errors.New("JSON web token signature verification failed")
+	// ErrTokenExpired is returned for tokens past their "exp" time.
+	ErrTokenExpired = errors.New("JSON web token expired")
+	// ErrTokenNotYetValid is returned for tokens before their "nbf" time.
+	ErrTokenNotYetValid = errors.New("JSON web token not yet valid")
+)
+
+// minRSAKeyBits is the minimum size of the RSA keys accepted for verifying tokens (RFC 7518,
+// Section 3.3).
+const minRSAKeyBits = 2048
+
+// JWTClaims is the claim set of a verified JSON Web Token.
+type JWTClaims map[string]any
+
+// String returns a string claim, or "" if the claim is missing or not a string.
+func (c JWTClaims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a string list claim, or nil if the claim is missing or not a list of strings.
+// A single string is returned as a one-element list.
+func (c JWTClaims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		ret := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil
+			}
+			ret = append(ret, s)
+		}
+		return ret
+	}
+	return nil
+}
+
+// jwtKey is a verification key with its optional key id and algorithm constraint.
+type jwtKey struct {
+	kid, alg string
+	key      any // []byte, *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+}
+
+// KeySet is a set of keys for verifying JSON Web Tokens.
+type KeySet struct {
+	keys []jwtKey
+}
+
+// Len returns the number of keys in the key set.
+func (ks *KeySet) Len() int { return len(ks.keys) }
+
+// Merge returns a new key set holding the keys of both key sets.
+func (ks *KeySet) Merge(other *KeySet) *KeySet {
+	ret := &KeySet{}
+	if ks != nil {
+		ret.keys = append(ret.keys, ks.keys...)
+	}
+	if other != nil {
+		ret.keys = append(ret.keys, other.keys...)
+	}
+	return ret
+}
+
+// jsonWebKey is a JSON Web Key as per RFC 7517, restricted to the fields used for verification.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	// Symmetric
+	K string `json:"k,omitempty"`
+}
+
+// ParseKeySet parses a key set from a JSON Web Key Set (RFC 7517) or from a PEM bundle of public
+// keys and certificates. Keys with a "use" other than "sig" are skipped.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "-----BEGIN") {
+		return parsePEMKeySet([]byte(trimmed))
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal([]byte(trimmed), &jwks); err != nil {
+		return nil, fmt.Errorf("invalid JSON web key set: %w", err)
+	}
+
+	ks := &KeySet{}
+	for i, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON web key #%d: %w", i, err)
+		}
+		if jwk.Alg != "" && !keyAdmitsAlg(key, jwk.Alg) {
+			return nil, fmt.Errorf("invalid JSON web key #%d: algorithm %q does not match the key",
+				i, jwk.Alg)
+		}
+		ks.keys = append(ks.keys, jwtKey{kid: jwk.Kid, alg: jwk.Alg, key: key})
+	}
+	if len(ks.keys) == 0 {
+		return nil, errors.New("no usable key in JSON web key set")
+	}
+	return ks, nil
+}
+
+func parseJWK(jwk jsonWebKey) (any, error) {
+	switch jwk.Kty {
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil || len(k) == 0 {
+			return nil, errors.New("invalid symmetric key")
+		}
+		return k, nil
+
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil || len(n) == 0 {
+			return nil, errors.New("invalid RSA modulus")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if err := checkRSAKey(pub); err != nil {
+			return nil, err
+		}
+		return pub, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported elliptic curve %q", jwk.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid EC point")
+		}
+		byteLen := (curve.Params().BitSize + 7) / 8
+		if len(x) != byteLen || len(y) != byteLen {
+			return nil, errors.New("invalid EC point")
+		}
+		// Validate the point through the uncompressed encoding.
+		point := append([]byte{4}, append(x, y...)...)
+		pub, err := ecdsa.ParseUncompressedPublicKey(curve, point)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC point: %w", err)
+		}
+		return pub, nil
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported OKP curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+// checkRSAKey rejects the RSA keys too short to verify tokens and the invalid public exponents.
+func checkRSAKey(k *rsa.PublicKey) error {
+	if bits := k.N.BitLen(); bits < minRSAKeyBits {
+		return fmt.Errorf("RSA key too short (%d bits): at least %d bits are required", bits,
+			minRSAKeyBits)
+	}
+	if k.E < 3 || k.E%2 == 0 {
+		return errors.New("invalid RSA exponent")
+	}
+	return nil
+}
+
+func parsePEMKeySet(data []byte) (*KeySet, error) {
+	ks := &KeySet{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var pub any
+		switch block.Type {
+		case "PUBLIC KEY":
+			k, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PEM public key: %w", err)
+			}
+			pub = k
+		case "RSA PUBLIC KEY":
+			k, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PEM RSA public key: %w", err)
+			}
+			pub = k
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PEM certificate: %w", err)
+			}
+			pub = cert.PublicKey
+		default:
+			continue
+		}
+		switch k := pub.(type) {
+		case *rsa.PublicKey:
+			if err := checkRSAKey(k); err != nil {
+				return nil, err
+			}
+		case *ecdsa.PublicKey, ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", pub)
+		}
+		ks.keys = append(ks.keys, jwtKey{key: pub})
+	}
+	if len(ks.keys) == 0 {
+		return nil, errors.New("no public key found in PEM bundle")
+	}
+	return ks, nil
+}
+
+// JWTVerifyOptions specifies the optional claim checks performed by VerifyJWT.
+type JWTVerifyOptions struct {
+	// Issuer, if set, must match the "iss" claim.
+	Issuer string
+	// Audience, if set, must be listed in the "aud" claim.
+	Audience string
+	// Now is the time to check "exp" and "nbf" against. Default is the current time.
+	Now time.Time
+}
+
+// VerifyJWT checks the signature of a compact-serialized JSON Web Token against a key set,
+// checks the "exp" (mandatory) and "nbf" (optional) claims and, if requested, the issuer and the
+// audience, and returns the claims. The "none" algorithm is never accepted.
+func VerifyJWT(token string, ks *KeySet, opts JWTVerifyOptions) (JWTClaims, error) {
+	if ks == nil || len(ks.keys) == 0 {
+		return nil, errors.New("empty JSON web key set")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	// No header extension is understood (RFC 7515, Section 4.1.11).
+	if header.Crit != nil {
+		return nil, fmt.Errorf("%w: unsupported critical header parameters", ErrInvalidToken)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range ks.keys {
+		if header.Kid != "" && k.kid != "" && header.Kid != k.kid {
+			continue
+		}
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if verifySignature(header.Alg, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrTokenSignature
+	}
+
+	claims := JWTClaims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing \"exp\" claim", ErrInvalidToken)
+	}
+	if now.Unix() >= int64(exp) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return nil, ErrTokenNotYetValid
+	}
+	if opts.Issuer != "" && claims.String("iss") != opts.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.String("iss"))
+	}
+	if opts.Audience != "" && !hasAudience(claims["aud"], opts.Audience) {
+		return nil, fmt.Errorf("%w: audience %q not found", ErrInvalidToken, opts.Audience)
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func hasAudience(aud any, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []any:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keyAdmitsAlg reports whether a key may verify the signatures of an algorithm: HMAC algorithms
+// take symmetric keys, RSA algorithms take RSA keys of at least minRSAKeyBits, ECDSA algorithms
+// take keys on the curve of the algorithm (RFC 7518, Section 3.4), and EdDSA takes Ed25519 keys.
+func keyAdmitsAlg(key any, alg string) bool {
+	switch k := key.(type) {
+	case []byte:
+		return alg == "HS256" || alg == "HS384" || alg == "HS512"
+	case *rsa.PublicKey:
+		switch alg {
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+			return k.N.BitLen() >= minRSAKeyBits
+		}
+	case *ecdsa.PublicKey:
+		curve := k.Curve.Params().Name
+		switch alg {
+		case "ES256":
+			return curve == "P-256"
+		case "ES384":
+			return curve == "P-384"
+		case "ES512":
+			return curve == "P-521"
+		}
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+func verifySignature(alg string, key any, signed, sig []byte) bool {
+	if !keyAdmitsAlg(key, alg) {
+		return false
+	}
+
+	var hash crypto.Hash
+	switch alg {
+	case "HS256", "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "HS384", "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "HS512", "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, sig)
+	default:
+		return false
+	}
+
+	switch k := key.(type) {
+	case []byte:
+		var mac = hmac.New(sha256.New, k)
+		switch hash {
+		case crypto.SHA384:
+			mac = hmac.New(sha512.New384, k)
+		case crypto.SHA512:
+			mac = hmac.New(sha512.New, k)
+		}
+		mac.Write(signed) //nolint:errcheck
+		return hmac.Equal(mac.Sum(nil), sig)
+
+	case *rsa.PublicKey:
+		digest := digestOf(hash, signed)
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+		case "PS":
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+			return rsa.VerifyPSS(k, hash, digest, sig, opts) == nil
+		}
+
+	case *ecdsa.PublicKey:
+		byteLen := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*byteLen {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:byteLen])
+		s := new(big.Int).SetBytes(sig[byteLen:])
+		return ecdsa.Verify(k, digestOf(hash, signed), r, s)
+	}
+
+	return false
+}
+
+func digestOf(hash crypto.Hash, data []byte) []byte {
+	h := hash.New()
+	h.Write(data) //nolint:errcheck
+	return h.Sum(nil)
+}
@@ -0,0 +1,184 @@
+package authentication
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func encodeTestJWT(t *testing.T, header, claims map[string]any, sign func([]byte) []byte) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	require.NoError(t, err)
+	c, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestVerifyJWT(t *testing.T) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	now := time.Now()
+	claims := map[string]any{"sub": "user", "exp": now.Add(time.Minute).Unix()}
+
+	hsKey := []byte("hs-key")
+	hs256 := func(data []byte) []byte {
+		mac := hmac.New(sha256.New, hsKey)
+		mac.Write(data) //nolint:errcheck
+		return mac.Sum(nil)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rs256 := func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+		return sig
+	}
+
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	eddsa := func(data []byte) []byte { return ed25519.Sign(edKey, data) }
+
+	ks, err := ParseKeySet([]byte(fmt.Sprintf(`{"keys":[
+		{"kty":"oct","kid":"hs","k":%q},
+		{"kty":"RSA","kid":"rs","alg":"RS256","n":%q,"e":%q},
+		{"kty":"OKP","kid":"ed","crv":"Ed25519","x":%q},
+		{"kty":"oct","kid":"enc","use":"enc","k":"ZW5j"}]}`,
+		b64(hsKey), b64(rsaKey.N.Bytes()), b64(big.NewInt(int64(rsaKey.E)).Bytes()), b64(edPub))))
+	require.NoError(t, err)
+	require.Equal(t, 3, ks.Len())
+
+	for _, tc := range []struct {
+		name   string
+		header map[string]any
+		claims map[string]any
+		sign   func([]byte) []byte
+		opts   JWTVerifyOptions
+		err    error
+	}{
+		{name: "HS256", header: map[string]any{"alg": "HS256", "kid": "hs"}, claims: claims, sign: hs256},
+		{name: "HS256 without kid", header: map[string]any{"alg": "HS256"}, claims: claims, sign: hs256},
+		{name: "RS256", header: map[string]any{"alg": "RS256", "kid": "rs"}, claims: claims, sign: rs256},
+		{name: "EdDSA", header: map[string]any{"alg": "EdDSA"}, claims: claims, sign: eddsa},
+		{name: "kid mismatch", header: map[string]any{"alg": "HS256", "kid": "rs"}, claims: claims,
+			sign: hs256, err: ErrTokenSignature},
+		{name: "alg none", header: map[string]any{"alg": "none"}, claims: claims,
+			sign: func([]byte) []byte { return nil }, err: ErrTokenSignature},
+		{name: "wrong signature", header: map[string]any{"alg": "HS256"}, claims: claims,
+			sign: func(d []byte) []byte { return hs256(append(d, 'x')) }, err: ErrTokenSignature},
+		{name: "expired", header: map[string]any{"alg": "HS256"},
+			claims: map[string]any{"exp": now.Add(-time.Minute).Unix()}, sign: hs256, err: ErrTokenExpired},
+		{name: "no exp", header: map[string]any{"alg": "HS256"},
+			claims: map[string]any{"sub": "user"}, sign: hs256, err: ErrInvalidToken},
+		{name: "not yet valid", header: map[string]any{"alg": "HS256"},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "nbf": now.Add(time.Minute).Unix()},
+			sign:   hs256, err: ErrTokenNotYetValid},
+		{name: "issuer and audience", header: map[string]any{"alg": "HS256"},
+			claims: map[string]any{"exp": now.Add(time.Minute).Unix(), "iss": "me", "aud": "you"},
+			sign:   hs256, opts: JWTVerifyOptions{Issuer: "me", Audience: "you"}},
+		{name: "wrong audience", header: map[string]any{"alg": "HS256"},
+			claims: map[string]any{"exp": now.Add(time.Minute).Unix(), "aud": []string{"them"}},
+			sign:   hs256, opts: JWTVerifyOptions{Audience: "you"}, err: ErrInvalidToken},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := VerifyJWT(encodeTestJWT(t, tc.header, tc.claims, tc.sign), ks, tc.opts)
+			if tc.err == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tc.err)
+			}
+		})
+	}
+
+	_, err = VerifyJWT("not.a-token", ks, JWTVerifyOptions{})
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestVerifyJWTKeyConstraints(t *testing.T) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	claims := map[string]any{"sub": "user", "exp": time.Now().Add(time.Minute).Unix()}
+	ecJWK := func(k *ecdsa.PrivateKey, crv, alg string) string {
+		byteLen := (k.Curve.Params().BitSize + 7) / 8
+		x, y := make([]byte, byteLen), make([]byte, byteLen)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		return fmt.Sprintf(`{"kty":"EC","crv":%q,"alg":%q,"x":%q,"y":%q}`, crv, alg, b64(x), b64(y))
+	}
+	esSign := func(k *ecdsa.PrivateKey, hash crypto.Hash) func([]byte) []byte {
+		return func(data []byte) []byte {
+			h := hash.New()
+			h.Write(data) //nolint:errcheck
+			r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+			require.NoError(t, err)
+			byteLen := (k.Curve.Params().BitSize + 7) / 8
+			sig := make([]byte, 2*byteLen)
+			r.FillBytes(sig[:byteLen])
+			s.FillBytes(sig[byteLen:])
+			return sig
+		}
+	}
+
+	// ECDSA keys verify only the algorithm of their curve.
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	ks, err := ParseKeySet([]byte(fmt.Sprintf(`{"keys":[%s]}`, ecJWK(p384, "P-384", ""))))
+	require.NoError(t, err)
+	_, err = VerifyJWT(encodeTestJWT(t, map[string]any{"alg": "ES384"}, claims, esSign(p384, crypto.SHA384)), ks, JWTVerifyOptions{})
+	require.NoError(t, err)
+	_, err = VerifyJWT(encodeTestJWT(t, map[string]any{"alg": "ES256"}, claims, esSign(p384, crypto.SHA256)), ks, JWTVerifyOptions{})
+	require.ErrorIs(t, err, ErrTokenSignature)
+	_, err = ParseKeySet([]byte(fmt.Sprintf(`{"keys":[%s]}`, ecJWK(p256, "P-256", "ES384"))))
+	require.Error(t, err, "algorithm of the key does not match the curve")
+
+	// PSS signatures use a salt of the size of the hash.
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ks, err = ParseKeySet([]byte(fmt.Sprintf(`{"keys":[{"kty":"RSA","n":%q,"e":%q}]}`,
+		b64(rsaKey.N.Bytes()), b64(big.NewInt(int64(rsaKey.E)).Bytes()))))
+	require.NoError(t, err)
+	ps256 := func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		sig, err := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, digest[:],
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		require.NoError(t, err)
+		return sig
+	}
+	_, err = VerifyJWT(encodeTestJWT(t, map[string]any{"alg": "PS256"}, claims, ps256), ks, JWTVerifyOptions{})
+	require.NoError(t, err)
+
+	// RSA keys shorter than 2048 bits are refused.
+	short, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = ParseKeySet([]byte(fmt.Sprintf(`{"keys":[{"kty":"RSA","n":%q,"e":%q}]}`,
+		b64(short.N.Bytes()), b64(big.NewInt(int64(short.E)).Bytes()))))
+	require.ErrorContains(t, err, "too short")
+	der, err := x509.MarshalPKIXPublicKey(&short.PublicKey)
+	require.NoError(t, err)
+	_, err = ParseKeySet(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	require.ErrorContains(t, err, "too short")
+	require.False(t, verifySignature("RS256", &short.PublicKey, []byte("data"), nil))
+
+	// Tokens with critical header extensions are refused.
+	_, err = VerifyJWT(encodeTestJWT(t, map[string]any{"alg": "PS256", "crit": []string{"b64"}, "b64": false},
+		claims, ps256), ks, JWTVerifyOptions{})
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
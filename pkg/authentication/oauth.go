@@ -0,0 +1,203 @@
+package authentication
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+const (
+	// AttrAccessToken is the ACCESS-TOKEN attribute of STUN third-party authorization
+	// (RFC 7635, Section 6.2).
+	AttrAccessToken stun.AttrType = 0x001B
+	// AttrThirdPartyAuthorization is the THIRD-PARTY-AUTHORIZATION attribute of STUN
+	// third-party authorization (RFC 7635, Section 6.1), advertising the name of the
+	// authorization server in 401 challenges.
+	AttrThirdPartyAuthorization stun.AttrType = 0x802E
+)
+
+const (
+	// AccessTokenAlgorithmA256GCM selects AES-256-GCM for encrypting access tokens. This is
+	// the mandatory-to-implement algorithm of RFC 7635.
+	AccessTokenAlgorithmA256GCM = "A256GCM"
+	// AccessTokenAlgorithmA128GCM selects AES-128-GCM for encrypting access tokens.
+	AccessTokenAlgorithmA128GCM = "A128GCM"
+)
+
+// accessTokenFractions is the number of timestamp fractions per second (RFC 7635, Section 6.2).
+const accessTokenFractions = 64000
+
+// AccessToken is the self-contained token of STUN third-party authorization (RFC 7635): the
+// authorization server issues a token holding a session key (the "mac_key") to a client, encrypted
+// with a long-term key shared with the STUN server. The client presents the token in the
+// ACCESS-TOKEN attribute and uses the mac_key as the key of MESSAGE-INTEGRITY.
+type AccessToken struct {
+	// MACKey is the session key used to compute MESSAGE-INTEGRITY.
+	MACKey []byte
+	// Timestamp is the issue time of the token.
+	Timestamp time.Time
+	// Lifetime is the validity of the token from Timestamp.
+	Lifetime time.Duration
+}
+
+// EncryptAccessToken encodes and encrypts an access token with a key shared between the
+// authorization server and the STUN server, using the name of the STUN server as associated data.
+// The AES-GCM variant is selected by the size of the key.
+func EncryptAccessToken(key []byte, serverName string, token AccessToken) ([]byte, error) {
+	aead, err := newAccessTokenAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(token.MACKey) > 0xffff {
+		return nil, errors.New("mac_key too long")
+	}
+
+	block := make([]byte, 2, 2+len(token.MACKey)+12)
+	binary.BigEndian.PutUint16(block, uint16(len(token.MACKey)))
+	block = append(block, token.MACKey...)
+	block = binary.BigEndian.AppendUint64(block, encodeTimestamp(token.Timestamp))
+	block = binary.BigEndian.AppendUint32(block, uint32(token.Lifetime/time.Second))
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ret := binary.BigEndian.AppendUint16(nil, uint16(len(nonce)))
+	ret = append(ret, nonce...)
+	return aead.Seal(ret, nonce, block, []byte(serverName)), nil
+}
+
+// DecryptAccessToken decrypts and decodes an access token with a key shared between the
+// authorization server and the STUN server, using the name of the STUN server as associated data.
+// The validity of the token is not checked, see AccessToken.Check.
+func DecryptAccessToken(key []byte, serverName string, raw []byte) (AccessToken, error) {
+	aead, err := newAccessTokenAEAD(key)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	if len(raw) < 2 {
+		return AccessToken{}, errors.New("access token too short")
+	}
+	n := int(binary.BigEndian.Uint16(raw))
+	if n != aead.NonceSize() || len(raw) < 2+n {
+		return AccessToken{}, fmt.Errorf("invalid access token nonce length %d", n)
+	}
+	block, err := aead.Open(nil, raw[2:2+n], raw[2+n:], []byte(serverName))
+	if err != nil {
+		return AccessToken{}, errors.New("cannot decrypt access token")
+	}
+
+	if len(block) < 2 {
+		return AccessToken{}, errors.New("access token too short")
+	}
+	l := int(binary.BigEndian.Uint16(block))
+	if len(block) != 2+l+12 {
+		return AccessToken{}, errors.New("invalid access token length")
+	}
+	return AccessToken{
+		MACKey:    block[2 : 2+l],
+		Timestamp: decodeTimestamp(binary.BigEndian.Uint64(block[2+l:])),
+		Lifetime:  time.Duration(binary.BigEndian.Uint32(block[2+l+8:])) * time.Second,
+	}, nil
+}
+
+// Check returns an error if the access token is not valid at the given time, allowing for a clock
+// skew between the authorization server and the STUN server.
+func (t AccessToken) Check(now time.Time, skew time.Duration) error {
+	if now.Add(skew).Before(t.Timestamp) {
+		return errors.New("access token issued in the future")
+	}
+	if !now.Add(-skew).Before(t.Timestamp.Add(t.Lifetime)) {
+		return errors.New("expired access token")
+	}
+	return nil
+}
+
+// GetAccessToken returns the key ID, carried in the USERNAME attribute, and the encrypted token of
+// the ACCESS-TOKEN attribute of a raw STUN message.
+func GetAccessToken(raw []byte) (string, []byte, bool) {
+	if !stun.IsMessage(raw) {
+		return "", nil, false
+	}
+	msg := &stun.Message{Raw: append([]byte(nil), raw...)}
+	if err := msg.Decode(); err != nil {
+		return "", nil, false
+	}
+	token, err := msg.Get(AttrAccessToken)
+	if err != nil {
+		return "", nil, false
+	}
+	username := stun.Username{}
+	if err := username.GetFrom(msg); err != nil {
+		return "", nil, false
+	}
+	return username.String(), token, true
+}
+
+func newAccessTokenAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return nil, fmt.Errorf("invalid access token key size %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encodeTimestamp encodes a time in the 48.16 fixed-point format of RFC 7635.
+func encodeTimestamp(t time.Time) uint64 {
+	frac := uint64(t.Nanosecond()) * accessTokenFractions / uint64(time.Second)
+	return uint64(t.Unix())<<16 | frac
+}
+
+func decodeTimestamp(v uint64) time.Time {
+	frac := (v & 0xffff) * uint64(time.Second) / accessTokenFractions
+	return time.Unix(int64(v>>16), int64(frac))
+}
+
+// StripAccessToken removes the ACCESS-TOKEN attribute from a raw STUN request for STUN servers
+// that do not understand the attribute. The MESSAGE-INTEGRITY of the request is checked with the
+// session key of the token and recomputed after the attribute is removed, FINGERPRINT is kept.
+// Attributes following MESSAGE-INTEGRITY other than FINGERPRINT are dropped.
+func StripAccessToken(raw []byte, macKey []byte) ([]byte, error) {
+	msg := &stun.Message{Raw: append([]byte(nil), raw...)}
+	if err := msg.Decode(); err != nil {
+		return nil, err
+	}
+	if err := stun.MessageIntegrity(macKey).Check(msg); err != nil {
+		return nil, err
+	}
+
+	ret := &stun.Message{Type: msg.Type, TransactionID: msg.TransactionID}
+	ret.WriteHeader()
+	fingerprint := false
+	for _, a := range msg.Attributes {
+		switch a.Type {
+		case AttrAccessToken, stun.AttrMessageIntegrity:
+		case stun.AttrFingerprint:
+			fingerprint = true
+		default:
+			if !ret.Contains(stun.AttrMessageIntegrity) {
+				ret.Add(a.Type, a.Value)
+			}
+		}
+		if a.Type == stun.AttrMessageIntegrity {
+			if err := stun.MessageIntegrity(macKey).AddTo(ret); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if fingerprint {
+		if err := stun.Fingerprint.AddTo(ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret.Raw, nil
+}
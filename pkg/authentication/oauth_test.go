@@ -0,0 +1,73 @@
+package authentication
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessToken(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	now := time.Unix(1700000000, 500000000)
+	token := AccessToken{
+		MACKey:    bytes.Repeat([]byte{2}, 20),
+		Timestamp: now,
+		Lifetime:  time.Hour,
+	}
+
+	raw, err := EncryptAccessToken(key, "turn.example.com", token)
+	require.NoError(t, err)
+	dec, err := DecryptAccessToken(key, "turn.example.com", raw)
+	require.NoError(t, err)
+	require.Equal(t, token.MACKey, dec.MACKey)
+	require.Equal(t, token.Lifetime, dec.Lifetime)
+	require.WithinDuration(t, token.Timestamp, dec.Timestamp, time.Millisecond)
+
+	// Wrong key or server name.
+	_, err = DecryptAccessToken(bytes.Repeat([]byte{3}, 32), "turn.example.com", raw)
+	require.Error(t, err)
+	_, err = DecryptAccessToken(key, "other.example.com", raw)
+	require.Error(t, err)
+	_, err = DecryptAccessToken(key[:16], "turn.example.com", raw)
+	require.Error(t, err)
+
+	// AES-128-GCM.
+	raw128, err := EncryptAccessToken(key[:16], "turn.example.com", token)
+	require.NoError(t, err)
+	_, err = DecryptAccessToken(key[:16], "turn.example.com", raw128)
+	require.NoError(t, err)
+
+	// Lifetime and clock skew.
+	require.NoError(t, dec.Check(now, 0))
+	require.NoError(t, dec.Check(now.Add(-time.Second), 5*time.Second))
+	require.Error(t, dec.Check(now.Add(-time.Minute), 5*time.Second))
+	require.Error(t, dec.Check(now.Add(time.Hour+time.Minute), 5*time.Second))
+
+	// The token is carried in ACCESS-TOKEN, the key ID in USERNAME.
+	m, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewUsername("kid-1"), stun.RawAttribute{Type: AttrAccessToken, Value: raw})
+	require.NoError(t, err)
+	kid, tok, ok := GetAccessToken(m.Raw)
+	require.True(t, ok)
+	require.Equal(t, "kid-1", kid)
+	require.Equal(t, raw, tok)
+
+	// The token is removed and MESSAGE-INTEGRITY is recomputed.
+	m, err = stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewUsername("kid-1"), stun.RawAttribute{Type: AttrAccessToken, Value: raw},
+		stun.MessageIntegrity(token.MACKey), stun.Fingerprint)
+	require.NoError(t, err)
+	stripped, err := StripAccessToken(m.Raw, token.MACKey)
+	require.NoError(t, err)
+	s := &stun.Message{Raw: stripped}
+	require.NoError(t, s.Decode())
+	require.False(t, s.Contains(AttrAccessToken))
+	require.NoError(t, stun.MessageIntegrity(token.MACKey).Check(s))
+	require.NoError(t, stun.Fingerprint.Check(s))
+	require.Equal(t, m.TransactionID, s.TransactionID)
+	_, err = StripAccessToken(m.Raw, []byte("wrong"))
+	require.Error(t, err)
+}
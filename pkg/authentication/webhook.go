@@ -0,0 +1,219 @@
+package authentication
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"k8s.io/utils/lru"
+)
+
+const (
+	webhookCacheSize     = 4096
+	webhookMaxReplyBytes = 64 * 1024
+)
+
+// WebhookRequest is the JSON body posted to the authorization webhook.
+type WebhookRequest struct {
+	// Username is the TURN username sent by the client.
+	Username string `json:"username"`
+	// Realm is the STUN/TURN authentication realm.
+	Realm string `json:"realm"`
+	// SourceAddress is the transport address of the client.
+	SourceAddress string `json:"source_address"`
+}
+
+// WebhookResponse is the JSON body returned by the authorization webhook with status 200. A
+// status of 401 or 403 denies the user, any other status is considered a webhook failure.
+type WebhookResponse struct {
+	// UserID identifies the user in quota accounting and logs. Default is the username.
+	UserID string `json:"user_id,omitempty"`
+	// Password is the TURN password of the user.
+	Password string `json:"password,omitempty"`
+	// Key is the hex-encoded long-term credential key MD5(username:realm:password), which can
+	// be returned instead of the password.
+	Key string `json:"key,omitempty"`
+	// Clusters is the optional list of the clusters the user may access.
+	Clusters []string `json:"clusters,omitempty"`
+	// Quota optionally overrides the global allocation quota for the user.
+	Quota *int `json:"quota,omitempty"`
+}
+
+// WebhookVerdict is the result of an authorization webhook call.
+type WebhookVerdict struct {
+	// Allowed is true if the webhook accepted the user.
+	Allowed bool
+	// UserID identifies the user.
+	UserID string
+	// Key is the long-term credential key of the user.
+	Key []byte
+	// Password is the password of the user, or empty if the webhook returned only the key.
+	Password string
+	// Clusters is the list of the clusters returned for the user, if any.
+	Clusters []string
+	// Quota is the per-user allocation quota returned for the user, if any.
+	Quota *int
+}
+
+// WebhookAuthenticatorConfig configures a WebhookAuthenticator.
+type WebhookAuthenticatorConfig struct {
+	// URL is the webhook endpoint.
+	URL string
+	// BearerToken, if set, is sent to the webhook in the Authorization header.
+	BearerToken string
+	// Timeout limits the duration of a webhook call.
+	Timeout time.Duration
+	// CacheTTL is the time successful verdicts are cached for.
+	CacheTTL time.Duration
+	// NegativeCacheTTL is the time denials are cached for.
+	NegativeCacheTTL time.Duration
+	// FailOpen makes the authenticator fall back to the last successful verdict for the
+	// client, even if expired, when the webhook fails. Otherwise webhook failures deny
+	// the request.
+	FailOpen bool
+}
+
+type webhookCacheEntry struct {
+	verdict WebhookVerdict
+	expiry  time.Time
+}
+
+// WebhookAuthenticator authenticates TURN users by calling an HTTP authorization webhook and
+// caches the verdicts to keep the webhook off the TURN hot path. Safe for concurrent use.
+type WebhookAuthenticator struct {
+	config WebhookAuthenticatorConfig
+	client *http.Client
+	cache  *lru.Cache // username|realm|source IP -> *webhookCacheEntry
+	users  *lru.Cache // user ID -> WebhookVerdict
+}
+
+// NewWebhookAuthenticator creates a new authorization webhook client.
+func NewWebhookAuthenticator(config WebhookAuthenticatorConfig) *WebhookAuthenticator {
+	return &WebhookAuthenticator{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		cache:  lru.New(webhookCacheSize),
+		users:  lru.New(webhookCacheSize),
+	}
+}
+
+// Authenticate returns the verdict for a user, either from the cache or by calling the webhook.
+// An error is returned only if the webhook failed and no verdict could be established.
+func (w *WebhookAuthenticator) Authenticate(username, realm string, src net.Addr) (WebhookVerdict, error) {
+	srcIP := src.String()
+	if host, _, err := net.SplitHostPort(srcIP); err == nil {
+		srcIP = host
+	}
+	key := username + "|" + realm + "|" + srcIP
+
+	var stale *webhookCacheEntry
+	if v, ok := w.cache.Get(key); ok {
+		e := v.(*webhookCacheEntry)
+		if time.Now().Before(e.expiry) {
+			return e.verdict, nil
+		}
+		stale = e
+	}
+
+	verdict, err := w.call(username, realm, src)
+	if err != nil {
+		if w.config.FailOpen && stale != nil && stale.verdict.Allowed {
+			return stale.verdict, nil
+		}
+		return WebhookVerdict{}, err
+	}
+
+	ttl := w.config.CacheTTL
+	if !verdict.Allowed {
+		ttl = w.config.NegativeCacheTTL
+	}
+	w.cache.Add(key, &webhookCacheEntry{verdict: verdict, expiry: time.Now().Add(ttl)})
+	if verdict.Allowed {
+		w.users.Add(verdict.UserID, verdict)
+	}
+
+	return verdict, nil
+}
+
+// LookupUser returns the last successful verdict for a user ID.
+func (w *WebhookAuthenticator) LookupUser(userID string) (WebhookVerdict, bool) {
+	v, ok := w.users.Get(userID)
+	if !ok {
+		return WebhookVerdict{}, false
+	}
+	return v.(WebhookVerdict), true
+}
+
+func (w *WebhookAuthenticator) call(username, realm string, src net.Addr) (WebhookVerdict, error) {
+	body, err := json.Marshal(WebhookRequest{
+		Username:      username,
+		Realm:         realm,
+		SourceAddress: src.String(),
+	})
+	if err != nil {
+		return WebhookVerdict{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return WebhookVerdict{}, fmt.Errorf("invalid webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.config.BearerToken)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return WebhookVerdict{}, fmt.Errorf("webhook call failed: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return WebhookVerdict{Allowed: false}, nil
+	default:
+		return WebhookVerdict{}, fmt.Errorf("webhook returned unexpected status %d", resp.StatusCode)
+	}
+
+	reply := WebhookResponse{}
+	dec := json.NewDecoder(io.LimitReader(resp.Body, webhookMaxReplyBytes))
+	if err := dec.Decode(&reply); err != nil {
+		return WebhookVerdict{}, fmt.Errorf("invalid webhook response: %w", err)
+	}
+
+	verdict := WebhookVerdict{
+		Allowed:  true,
+		UserID:   reply.UserID,
+		Clusters: reply.Clusters,
+		Quota:    reply.Quota,
+	}
+	if verdict.UserID == "" {
+		verdict.UserID = username
+	}
+	switch {
+	case reply.Key != "":
+		k, err := hex.DecodeString(reply.Key)
+		if err != nil || len(k) != 16 {
+			return WebhookVerdict{}, errors.New("invalid webhook response: malformed key")
+		}
+		verdict.Key = k
+	case reply.Password != "":
+		verdict.Key = GenerateAuthKey(username, realm, reply.Password)
+		verdict.Password = reply.Password
+	default:
+		return WebhookVerdict{}, errors.New("invalid webhook response: no password or key")
+	}
+
+	return verdict, nil
+}
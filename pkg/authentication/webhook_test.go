@@ -0,0 +1,122 @@
+package authentication
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookAuthenticator(t *testing.T) {
+	var calls atomic.Int32
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		require.Equal(t, "Bearer my-token", r.Header.Get("Authorization"))
+		req := WebhookRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, "realm", req.Realm)
+		require.Equal(t, "1.2.3.4:5678", req.SourceAddress)
+
+		quota := 2
+		switch req.Username {
+		case "user-pass":
+			json.NewEncoder(w).Encode(WebhookResponse{ //nolint:errcheck
+				UserID:   "id-1",
+				Password: "pass",
+				Clusters: []string{"cluster-1"},
+				Quota:    &quota,
+			})
+		case "user-key":
+			json.NewEncoder(w).Encode(WebhookResponse{ //nolint:errcheck
+				Key: hex.EncodeToString(GenerateAuthKey("user-key", "realm", "key-pass")),
+			})
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			json.NewEncoder(w).Encode(WebhookResponse{Password: "pass"}) //nolint:errcheck
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	src := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}
+	newAuthenticator := func(failOpen bool) *WebhookAuthenticator {
+		return NewWebhookAuthenticator(WebhookAuthenticatorConfig{
+			URL:              srv.URL,
+			BearerToken:      "my-token",
+			Timeout:          50 * time.Millisecond,
+			CacheTTL:         100 * time.Millisecond,
+			NegativeCacheTTL: 100 * time.Millisecond,
+			FailOpen:         failOpen,
+		})
+	}
+
+	w := newAuthenticator(false)
+
+	// Password and attributes.
+	v, err := w.Authenticate("user-pass", "realm", src)
+	require.NoError(t, err)
+	require.True(t, v.Allowed)
+	require.Equal(t, "id-1", v.UserID)
+	require.Equal(t, GenerateAuthKey("user-pass", "realm", "pass"), v.Key)
+	require.Equal(t, []string{"cluster-1"}, v.Clusters)
+	require.Equal(t, 2, *v.Quota)
+	u, ok := w.LookupUser("id-1")
+	require.True(t, ok)
+	require.Equal(t, 2, *u.Quota)
+
+	// Successful verdicts are cached.
+	_, err = w.Authenticate("user-pass", "realm", src)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), calls.Load())
+
+	// Key instead of password, user ID defaults to the username.
+	v, err = w.Authenticate("user-key", "realm", src)
+	require.NoError(t, err)
+	require.True(t, v.Allowed)
+	require.Equal(t, "user-key", v.UserID)
+	require.Equal(t, GenerateAuthKey("user-key", "realm", "key-pass"), v.Key)
+
+	// Denials are cached too.
+	calls.Store(0)
+	for range 2 {
+		v, err = w.Authenticate("unknown", "realm", src)
+		require.NoError(t, err)
+		require.False(t, v.Allowed)
+	}
+	require.Equal(t, int32(1), calls.Load())
+
+	// Timeout.
+	_, err = w.Authenticate("slow", "realm", src)
+	require.Error(t, err)
+
+	// Fail-closed: an expired verdict is not used when the webhook fails.
+	time.Sleep(150 * time.Millisecond)
+	failing.Store(true)
+	_, err = w.Authenticate("user-pass", "realm", src)
+	require.Error(t, err)
+
+	// Fail-open: the last successful verdict is used when the webhook fails.
+	failing.Store(false)
+	w = newAuthenticator(true)
+	_, err = w.Authenticate("user-pass", "realm", src)
+	require.NoError(t, err)
+	time.Sleep(150 * time.Millisecond)
+	failing.Store(true)
+	v, err = w.Authenticate("user-pass", "realm", src)
+	require.NoError(t, err)
+	require.True(t, v.Allowed)
+	_, err = w.Authenticate("user-key", "realm", src)
+	require.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -49,3 +50,45 @@ func TestParseURI(t *testing.T) {
 	assert.Equal(t, "1.2.3.4:12345", u.Host, "file URI host")
 	assert.Equal(t, "/a/b", u.Path, "file URI path")
 }
+
+func TestParseConfigRoutes(t *testing.T) {
+	c, err := ParseConfig([]byte(`version: v1
+auth:
+  type: static
+  credentials:
+    username: user
+    password: pass
+listeners:
+  - name: udp-listener
+    routes:
+      - media
+      - cluster: media-fallback
+        priority: 1
+        match:
+          peer_ports: 10000-20000
+clusters:
+  - name: media
+    endpoints: ["10.0.0.0/8"]
+  - name: media-fallback
+    endpoints: ["0.0.0.0/0"]
+`))
+	assert.NoError(t, err, "parse")
+	assert.NoError(t, c.Validate(), "validate")
+
+	l := c.Listeners[0]
+	assert.Equal(t, []string{"media", "media-fallback"}, l.Routes, "routes")
+	r, ok := l.GetRouteRule("media-fallback")
+	assert.True(t, ok, "route rule")
+	assert.Equal(t, 1, r.Priority, "priority")
+	assert.Equal(t, "10000-20000", r.Match.PeerPorts, "peer ports")
+	_, ok = l.GetRouteRule("media")
+	assert.False(t, ok, "plain route")
+
+	// The routes survive a round trip.
+	b, err := json.Marshal(c)
+	assert.NoError(t, err, "marshal")
+	c2, err := ParseConfig(b)
+	assert.NoError(t, err, "parse again")
+	assert.NoError(t, c2.Validate(), "validate again")
+	assert.True(t, c.DeepEqual(c2), "round trip")
+}
@@ -1,9 +1,13 @@
 package stunner
 
 import (
+	"context"
 	"errors"
+	"os"
+	"slices"
 
 	"github.com/l7mp/stunner/internal/reconciler"
+	"github.com/l7mp/stunner/internal/util"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 	cdsclient "github.com/l7mp/stunner/pkg/config/client"
 )
@@ -15,6 +19,12 @@ import (
 // any objects that were bounced (safe to ignore), or a non-nil error if the config was rejected,
 // in which case the previous configuration is rolled back unless SuppressRollback is set.
 func (s *Stunner) Reconcile(req *stnrv1.StunnerConfig) error {
+	s.reconcileLock.Lock()
+	defer s.reconcileLock.Unlock()
+	return s.reconcile(req)
+}
+
+func (s *Stunner) reconcile(req *stnrv1.StunnerConfig) error {
 	err := s.reconciler.Reconcile(req, reconciler.Policy{
 		SuppressRollback: s.suppressRollback,
 		DryRun:           s.dryRun,
@@ -33,5 +43,58 @@ func (s *Stunner) Reconcile(req *stnrv1.StunnerConfig) error {
 		s.rt.SetReady(true)
 	}
 
+	if (err == nil || errors.As(err, &restarted)) && !s.dryRun && !s.rt.IsShutdown() {
+		s.watchReferences(req)
+	}
+
 	return err
 }
+
+// watchReferences watches the files referenced from a config and reconciles the config each time
+// one of the files changes, so that the objects resolving the references pick up the new content.
+// Must be called with the reconcile lock held.
+func (s *Stunner) watchReferences(req *stnrv1.StunnerConfig) {
+	s.refConf = req.DeepCopy()
+
+	files := req.ReferencedFiles()
+	if slices.Equal(files, s.refFiles) && (s.refWatch != nil || len(files) == 0) {
+		return
+	}
+	if s.refWatch != nil {
+		s.refWatch()
+		s.refWatch = nil
+	}
+	s.refFiles = files
+	if len(files) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := util.WatchFiles(ctx, files, s.reloadReferences, s.log); err != nil {
+		cancel()
+		s.log.Warnf("cannot watch referenced files: %s", err.Error())
+		return
+	}
+	s.refWatch = cancel
+}
+
+// reloadReferences reconciles the last config after a referenced file has changed.
+func (s *Stunner) reloadReferences() {
+	s.reconcileLock.Lock()
+	defer s.reconcileLock.Unlock()
+	if s.refConf == nil || s.refWatch == nil || s.rt.IsShutdown() {
+		return
+	}
+	// Writers usually truncate the file first: wait for the content.
+	for _, f := range s.refFiles {
+		if fi, err := os.Stat(f); err == nil && fi.Size() == 0 {
+			s.log.Debugf("ignoring empty referenced file %q", f)
+			return
+		}
+	}
+	s.log.Info("referenced file changed, reconciling")
+	var restarted stnrv1.ErrRestarted
+	if err := s.reconcile(s.refConf.DeepCopy()); err != nil && !errors.As(err, &restarted) {
+		s.log.Warnf("could not reconcile after referenced file change: %s", err.Error())
+	}
+}
@@ -2,15 +2,29 @@ package stunner
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 
 	// "strconv"
 	"testing"
 	"time"
 
+	"github.com/pion/dtls/v3"
+	"github.com/pion/stun/v3"
 	"github.com/pion/transport/v4/test"
 	"github.com/pion/turn/v5"
 	"github.com/stretchr/testify/assert"
@@ -19,6 +33,7 @@ import (
 	"github.com/l7mp/stunner/internal/object"
 	objectturn "github.com/l7mp/stunner/internal/object/turn"
 	"github.com/l7mp/stunner/internal/resolver"
+	"github.com/l7mp/stunner/internal/runtime"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 	a12n "github.com/l7mp/stunner/pkg/authentication"
 	"github.com/l7mp/stunner/pkg/logger"
@@ -3452,3 +3467,342 @@ func reconcileAllowRestart(t *testing.T, s *Stunner, c *stnrv1.StunnerConfig) {
 	var restarted stnrv1.ErrRestarted
 	require.True(t, errors.As(err, &restarted), "unexpected reconcile error: %v", err)
 }
+
+func TestStunnerReconcileReferences(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "password")
+	certFile := filepath.Join(dir, "tls.crt")
+	require.NoError(t, os.WriteFile(passFile, []byte("pass-1\n"), 0o600))
+	require.NoError(t, os.WriteFile(certFile, certPem, 0o600))
+	t.Setenv("STUNNER_TEST_USERNAME", "user-1")
+	t.Setenv("STUNNER_TEST_KEY", keyPem64)
+
+	s := NewStunner(Options{LogOptions: LogOptions{Level: stunnerTestLoglevel}})
+	defer s.Close()
+
+	conf := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin:      stnrv1.AdminConfig{LogLevel: stunnerTestLoglevel},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "env:STUNNER_TEST_USERNAME",
+				"password": "file://" + passFile,
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "tls",
+			Protocol: "turn-tls",
+			Addr:     "127.0.0.1",
+			Port:     23479,
+			Cert:     "file://" + certFile,
+			Key:      "env:STUNNER_TEST_KEY",
+		}},
+	}
+	assert.Contains(t, conf.Listeners[0].String(), "cert/key=file://"+certFile+"/env:STUNNER_TEST_KEY")
+	reconcileAllowRestart(t, s, &conf)
+
+	// The referenced values are used but not exported.
+	auth := s.GetAuth().ResolvedConfig()
+	assert.Equal(t, "user-1", auth.Credentials["username"])
+	assert.Equal(t, "pass-1", auth.Credentials["password"])
+	auth = s.GetAuth().GetConfig().(*stnrv1.AuthConfig)
+	assert.Equal(t, "env:STUNNER_TEST_USERNAME", auth.Credentials["username"])
+	assert.Equal(t, "file://"+passFile, auth.Credentials["password"])
+	l := s.GetListener("tls").GetConfig().(*stnrv1.ListenerConfig)
+	assert.Equal(t, "file://"+certFile, l.Cert)
+	assert.Equal(t, "env:STUNNER_TEST_KEY", l.Key)
+	status, err := json.Marshal(s.GetStatus())
+	require.NoError(t, err)
+	assert.NotContains(t, string(status), "pass-1")
+	assert.NotContains(t, string(status), "user-1")
+
+	// Referenced files are listed in a stable order.
+	assert.Equal(t, []string{passFile, certFile}, conf.ReferencedFiles())
+
+	// Reconciling the same config is a no-op.
+	require.NoError(t, s.Reconcile(&conf))
+
+	// A change in a referenced file triggers a reconcile.
+	require.NoError(t, os.WriteFile(passFile, []byte("pass-2\n"), 0o600))
+	assert.Eventually(t, func() bool {
+		return s.GetAuth().ResolvedConfig().Credentials["password"] == "pass-2"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Invalid and unresolvable references are rejected.
+	bad := conf.DeepCopy()
+	bad.Auth.Credentials["password"] = "file://relative/path"
+	assert.Error(t, bad.Validate())
+	bad = conf.DeepCopy()
+	bad.Auth.Credentials["password"] = "env:"
+	assert.Error(t, bad.Validate())
+	bad = conf.DeepCopy()
+	bad.Auth.Credentials["password"] = "file://" + filepath.Join(dir, "missing")
+	assert.Error(t, s.Reconcile(bad))
+}
+
+func TestStunnerTLSCertRotation(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert := func(name string) {
+		cert, key := newTestCertificate(t, name)
+		require.NoError(t, os.WriteFile(certFile, cert, 0o600))
+		require.NoError(t, os.WriteFile(keyFile, key, 0o600))
+	}
+	writeCert("a.example.com")
+	certSNI, keySNI := newTestCertificate(t, "sni.example.com")
+
+	s := NewStunner(Options{LogOptions: LogOptions{Level: stunnerTestLoglevel}})
+	defer s.Close()
+
+	conf := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin:      stnrv1.AdminConfig{LogLevel: stunnerTestLoglevel},
+		Auth: stnrv1.AuthConfig{
+			Type:        "static",
+			Credentials: map[string]string{"username": "user", "password": "pass"},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "tls",
+			Protocol: "turn-tls",
+			Addr:     "127.0.0.1",
+			Port:     23479,
+			Cert:     "file://" + certFile,
+			Key:      "file://" + keyFile,
+			Certificates: []stnrv1.CertificateConfig{{
+				Cert: base64.StdEncoding.EncodeToString(certSNI),
+				Key:  base64.StdEncoding.EncodeToString(keySNI),
+			}},
+		}},
+	}
+	reconcileAllowRestart(t, s, &conf)
+
+	dial := func(sni string) (*tls.Conn, string) {
+		conn, err := tls.Dial("tcp", "127.0.0.1:23479", &tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: true, //nolint:gosec
+		})
+		require.NoError(t, err)
+		return conn, conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	binding := func(conn net.Conn) error {
+		req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+		require.NoError(t, err)
+		if _, err := conn.Write(req.Raw); err != nil {
+			return err
+		}
+		buf := make([]byte, 1500)
+		_, err = conn.Read(buf)
+		return err
+	}
+
+	conn, name := dial("a.example.com")
+	defer conn.Close() //nolint:errcheck
+	assert.Equal(t, "a.example.com", name)
+	sniConn, name := dial("sni.example.com")
+	sniConn.Close() //nolint:errcheck
+	assert.Equal(t, "sni.example.com", name)
+
+	// A renewed cert is picked up by new connections without restarting the listener.
+	writeCert("b.example.com")
+	assert.Eventually(t, func() bool {
+		c, name := dial("")
+		c.Close() //nolint:errcheck
+		return name == "b.example.com"
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.NoError(t, binding(conn), "connection survives the rotation")
+}
+
+// newTestCertificate returns a PEM-encoded self-signed cert and key for a DNS name.
+func newTestCertificate(t *testing.T, name string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestStunnerTLSClientAuth(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	certPEM, keyPEM := newTestCertificate(t, "stunner.example.com")
+	caPEM, issue := newTestClientCA(t)
+	clientAuth := &stnrv1.ClientAuthConfig{
+		CA:          base64.StdEncoding.EncodeToString(caPEM),
+		AllowedSANs: []string{"*.devices.example.com"},
+		Identity:    "common-name",
+	}
+
+	s := NewStunner(Options{LogOptions: LogOptions{Level: stunnerTestLoglevel}})
+	defer s.Close()
+
+	conf := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin:      stnrv1.AdminConfig{LogLevel: stunnerTestLoglevel, PeerDenyList: &[]string{}},
+		Auth: stnrv1.AuthConfig{
+			Type:         "static",
+			Credentials:  map[string]string{"username": "user", "password": "pass"},
+			UserClusters: map[string][]string{"user": {"tenant"}},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:       "tls",
+			Protocol:   "turn-tls",
+			Addr:       "127.0.0.1",
+			Port:       23479,
+			Cert:       base64.StdEncoding.EncodeToString(certPEM),
+			Key:        base64.StdEncoding.EncodeToString(keyPEM),
+			ClientAuth: clientAuth,
+			Routes:     []string{"tenant", "other"},
+		}, {
+			Name:       "dtls",
+			Protocol:   "turn-dtls",
+			Addr:       "127.0.0.1",
+			Port:       23480,
+			Cert:       base64.StdEncoding.EncodeToString(certPEM),
+			Key:        base64.StdEncoding.EncodeToString(keyPEM),
+			ClientAuth: clientAuth.DeepCopy(),
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "tenant",
+			Endpoints: []string{"127.0.0.2"},
+		}, {
+			Name:      "other",
+			Endpoints: []string{"127.0.0.3"},
+		}},
+	}
+	reconcileAllowRestart(t, s, &conf)
+
+	dialTLS := func(certs ...tls.Certificate) net.Conn {
+		conn, err := tls.Dial("tcp", "127.0.0.1:23479", &tls.Config{
+			Certificates:       certs,
+			InsecureSkipVerify: true, //nolint:gosec
+		})
+		require.NoError(t, err)
+		return conn
+	}
+	dialDTLS := func(certs ...tls.Certificate) net.Conn {
+		conn, err := dtls.Dial("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23480},
+			&dtls.Config{Certificates: certs, InsecureSkipVerify: true}) //nolint:gosec
+		require.NoError(t, err)
+		return conn
+	}
+	binding := func(conn net.Conn) error {
+		defer conn.Close() //nolint:errcheck
+		require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+		req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+		require.NoError(t, err)
+		if _, err := conn.Write(req.Raw); err != nil {
+			return err
+		}
+		buf := make([]byte, 1500)
+		_, err = conn.Read(buf)
+		return err
+	}
+
+	device := issue("a.devices.example.com")
+	selfSigned, err := tls.X509KeyPair(newTestCertificate(t, "b.devices.example.com"))
+	require.NoError(t, err)
+
+	for _, dial := range []func(...tls.Certificate) net.Conn{dialTLS, dialDTLS} {
+		assert.Error(t, binding(dial()), "no client cert")
+		assert.Error(t, binding(dial(issue("rogue.example.com"))), "SAN not allowed")
+		assert.Error(t, binding(dial(selfSigned)), "unknown CA")
+		assert.NoError(t, binding(dial(device)), "valid client cert")
+	}
+
+	// The identity in the client cert is used for quota and logging only: the user of the TURN
+	// credentials is authorized.
+	conn := dialTLS(device)
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: "127.0.0.1:23479",
+		TURNServerAddr: "127.0.0.1:23479",
+		Username:       "user",
+		Password:       "pass",
+		Conn:           turn.NewSTUNConn(conn),
+		LoggerFactory:  logger.NewLoggerFactory(stunnerTestLoglevel),
+	})
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	defer client.Close()
+	require.NoError(t, client.Listen())
+	relay, err := client.Allocate()
+	require.NoError(t, err)
+	defer relay.Close() //nolint:errcheck
+	o, ok := s.rt.Registry.Get(runtime.TypeListenerServer, "tls")
+	require.True(t, ok)
+	user, ok := o.(*object.ListenerServer).ClientUser(conn.LocalAddr())
+	assert.True(t, ok)
+	assert.Equal(t, "user", user)
+	_, err = relay.WriteTo([]byte("Hello"), &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5678})
+	assert.NoError(t, err, "cluster of the user")
+	_, err = relay.WriteTo([]byte("Hello"), &net.UDPAddr{IP: net.ParseIP("127.0.0.3"), Port: 5678})
+	assert.Error(t, err, "cluster of another user")
+
+	// A new CA is picked up without restarting the listener.
+	newCA, reissue := newTestClientCA(t)
+	conf.Listeners[0].ClientAuth.CA = base64.StdEncoding.EncodeToString(newCA)
+	require.NoError(t, s.Reconcile(&conf))
+	assert.Error(t, binding(dialTLS(device)), "old CA")
+	assert.NoError(t, binding(dialTLS(reissue("a.devices.example.com"))), "new CA")
+	_, err = client.SendBindingRequest()
+	assert.NoError(t, err, "connection survives the CA rotation")
+}
+
+// newTestClientCA returns a PEM-encoded CA cert and a function to issue client certs signed by
+// the CA.
+func newTestClientCA(t *testing.T) ([]byte, func(name string) tls.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err = x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	issue := func(name string) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), issue
+}
@@ -72,7 +72,8 @@ func RunBenchmarkServer(b *testing.B, proto string, udpThreadNum int) {
 	err := stunner.Reconcile(&stnrv1.StunnerConfig{
 		ApiVersion: stnrv1.ApiVersion,
 		Admin: stnrv1.AdminConfig{
-			LogLevel: stunnerTestLoglevel,
+			LogLevel:     stunnerTestLoglevel,
+			PeerDenyList: &[]string{},
 		},
 		Auth: stnrv1.AuthConfig{
 			Type: "plaintext",
@@ -2,8 +2,10 @@
 package stunner
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/pion/logging"
@@ -11,6 +13,7 @@ import (
 	"github.com/pion/transport/v4/stdnet"
 	"golang.org/x/time/rate"
 
+	"github.com/l7mp/stunner/internal/endpointslice"
 	"github.com/l7mp/stunner/internal/object"
 	"github.com/l7mp/stunner/internal/offload"
 	"github.com/l7mp/stunner/internal/quota"
@@ -58,11 +61,20 @@ type Stunner struct {
 	// Subsystems shared across object factories.
 	reconciler      *reconciler.Reconciler
 	resolver        resolver.DnsResolver
+	endpoints       endpointslice.Watcher
 	telemetry       *telemetry.Telemetry
 	offloadReporter *offload.StatsReporter
 	rt              *runtime.Runtime
 	net             transport.Net
 
+	// reconcileLock serializes reconciliations triggered by the caller and by the watcher of
+	// the files referenced from the config (refWatch), which reconciles the last config
+	// (refConf) each time a referenced file (refFiles) changes.
+	reconcileLock sync.Mutex
+	refConf       *stnrv1.StunnerConfig
+	refFiles      []string
+	refWatch      context.CancelFunc
+
 	// Logging.
 	logRateLimit rate.Limit
 	logBurst     int
@@ -87,7 +99,12 @@ func NewStunner(options Options) *Stunner {
 
 	r := options.Resolver
 	if r == nil {
-		r = resolver.NewDnsResolver("dns-resolver", logFactory)
+		r = resolver.NewDnsResolver("dns-resolver", resolver.Config{Nameserver: options.Nameserver}, logFactory)
+	}
+
+	w := options.EndpointWatcher
+	if w == nil {
+		w = endpointslice.NewWatcher("endpointslice-watcher", nil, logFactory)
 	}
 
 	var vnet transport.Net
@@ -135,6 +152,7 @@ func NewStunner(options Options) *Stunner {
 		suppressRollback: options.SuppressRollback,
 		dryRun:           options.DryRun,
 		resolver:         r,
+		endpoints:        w,
 		udpThreadNum:     udpThreadNum,
 		node:             options.NodeName,
 		forceReady:       options.ForceReadyDuringTermination,
@@ -151,6 +169,15 @@ func NewStunner(options Options) *Stunner {
 	// callback reads the running value after Listeners exist.
 	telemetryCallbacks := telemetry.Callbacks{
 		GetAllocationCount: func() int64 { return s.GetActiveConnections() },
+		GetBanCount: func() int64 {
+			if s.rt == nil {
+				return 0
+			}
+			if a := s.GetAuth(); a != nil {
+				return int64(a.BanCount())
+			}
+			return 0
+		},
 	}
 	t, err := telemetry.New(telemetryCallbacks, s.dryRun, logFactory.NewLogger("metrics"))
 	if err != nil {
@@ -173,11 +200,14 @@ func NewStunner(options Options) *Stunner {
 		Logger:        s.logger,
 		DryRun:        s.dryRun,
 		Resolver:      s.resolver,
+		Endpoints:     s.endpoints,
 		Telemetry:     s.telemetry,
 		License:       licenseMgr,
 		OffloadEngine: offloadEngine,
 		UdpThreadNum:  s.udpThreadNum,
 		Net:           s.net,
+		NodeName:      s.node,
+		Zone:          options.Zone,
 	})
 	rt.Router = router.NewRouter(rt)
 	rt.QuotaHandler = quota.New(rt)
@@ -224,6 +254,7 @@ func NewStunner(options Options) *Stunner {
 
 	if !s.dryRun {
 		s.resolver.Start()
+		s.endpoints.Start()
 		s.offloadReporter.Start()
 	}
 
@@ -278,6 +309,12 @@ func (s *Stunner) GetStatus() stnrv1.Status {
 // Close stops the STUNner daemon, cleans up any internal state, and closes all connections.
 func (s *Stunner) Close() {
 	s.log.Info("closing STUNner")
+	s.reconcileLock.Lock()
+	if s.refWatch != nil {
+		s.refWatch()
+		s.refWatch = nil
+	}
+	s.reconcileLock.Unlock()
 	if s.reconciler != nil {
 		_ = s.reconciler.Shutdown()
 	}
@@ -297,6 +334,9 @@ func (s *Stunner) Close() {
 	if s.resolver != nil {
 		s.resolver.Close()
 	}
+	if s.endpoints != nil {
+		s.endpoints.Close()
+	}
 }
 
 // GetActiveConnections returns the number of active downstream (listener-side) TURN allocations.
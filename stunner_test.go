@@ -30,6 +30,7 @@ import (
 
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 	stnrv1a1 "github.com/l7mp/stunner/pkg/apis/v1alpha1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
 	cfgclient "github.com/l7mp/stunner/pkg/config/client"
 )
 
@@ -619,6 +620,89 @@ var TestStunnerConfigsWithLocalhost = []TestStunnerConfigCase{
 		},
 		uri: "turns:1.2.3.4:3478?transport=tcp",
 	},
+	{
+		config: stnrv1.StunnerConfig{
+			// udp, ephemeral with a rotated secret: credentials are issued with the old secret
+			ApiVersion: stnrv1.ApiVersion,
+			Admin: stnrv1.AdminConfig{
+				LogLevel: stunnerTestLoglevel,
+			},
+			Auth: stnrv1.AuthConfig{
+				Type:    "ephemeral",
+				Secrets: []string{"new-secret", "my-secret"},
+			},
+			Listeners: []stnrv1.ListenerConfig{{
+				Name:       "udp",
+				Protocol:   "turn-udp",
+				Addr:       "127.0.0.1",
+				Port:       23478,
+				PublicAddr: "1.2.3.4",
+				PublicPort: 3478,
+				Routes:     []string{"allow-any"},
+			}},
+			Clusters: []stnrv1.ClusterConfig{{
+				Name:      "allow-any",
+				Endpoints: []string{"0.0.0.0/0"},
+			}},
+		},
+		uri: "turn:1.2.3.4:3478?transport=udp",
+	},
+	{
+		config: stnrv1.StunnerConfig{
+			// tcp, ephemeral with a rotated secret: credentials are issued with the old secret
+			ApiVersion: stnrv1.ApiVersion,
+			Admin: stnrv1.AdminConfig{
+				LogLevel: stunnerTestLoglevel,
+			},
+			Auth: stnrv1.AuthConfig{
+				Type:    "ephemeral",
+				Secrets: []string{"new-secret", "my-secret"},
+			},
+			Listeners: []stnrv1.ListenerConfig{{
+				Name:       "tcp",
+				Protocol:   "turn-tcp",
+				Addr:       "127.0.0.1",
+				Port:       23478,
+				PublicAddr: "1.2.3.4",
+				PublicPort: 3478,
+				Routes:     []string{"allow-any"},
+			}},
+			Clusters: []stnrv1.ClusterConfig{{
+				Name:      "allow-any",
+				Endpoints: []string{"0.0.0.0/0"},
+			}},
+		},
+		uri: "turn:1.2.3.4:3478?transport=tcp",
+	},
+	{
+		config: stnrv1.StunnerConfig{
+			// tls, ephemeral with a rotated secret: credentials are issued with the old secret
+			ApiVersion: stnrv1.ApiVersion,
+			Admin: stnrv1.AdminConfig{
+				LogLevel: stunnerTestLoglevel,
+			},
+			Auth: stnrv1.AuthConfig{
+				Type:    "ephemeral",
+				Secrets: []string{"new-secret", "my-secret"},
+			},
+			Listeners: []stnrv1.ListenerConfig{{
+				Name:       "tls",
+				Protocol:   "turn-tls",
+				Addr:       "127.0.0.1",
+				Port:       23478,
+				PublicAddr: "1.2.3.4",
+				PublicPort: 3478,
+				Cert:       certPem64,
+				Key:        keyPem64,
+				Routes:     []string{"allow-any"},
+			}},
+			Clusters: []stnrv1.ClusterConfig{{
+				Name:      "allow-any",
+				Endpoints: []string{"0.0.0.0/0"},
+			}},
+		},
+		uri: "turns:1.2.3.4:3478?transport=tcp",
+	},
 	{
 		config: stnrv1.StunnerConfig{
 			// dtls, static
@@ -725,6 +809,8 @@ func testStunnerLocalhost(t *testing.T, udpThreadNum int, tests []TestStunnerCon
 			assert.False(t, stunner.IsReady(), "lifecycle 1: not-ready")
 
 			log.Debug("starting stunnerd")
+			// The peers are on localhost: lift the default peer deny-list.
+			c.Admin.PeerDenyList = &[]string{}
 			assert.NoError(t, stunner.Reconcile(&c), "starting server")
 
 			assert.False(t, stunner.rt.IsShutdown(), "lifecycle 2: alive")
@@ -798,6 +884,382 @@ func testStunnerLocalhost(t *testing.T, udpThreadNum int, tests []TestStunnerCon
 	}
 }
 
+// TestStunnerListenerAddress runs two listeners on the same port bound to different loopback
+// addresses and checks that the relayed traffic is sourced from the address of the listener.
+func TestStunnerListenerAddress(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	listener := func(name, addr string) stnrv1.ListenerConfig {
+		return stnrv1.ListenerConfig{
+			Name:     name,
+			Protocol: "turn-udp",
+			Addr:     addr,
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}
+	}
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:     stunnerTestLoglevel,
+			PeerDenyList: &[]string{},
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{listener("udp-1", "127.0.0.1"), listener("udp-2", "127.0.0.2")},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogOptions:       LogOptions{Level: stunnerTestLoglevel},
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	stdnet, _ := stdnet.NewNet()
+	for _, addr := range []string{"127.0.0.1", "127.0.0.2"} {
+		lconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err, "cannot create UDP client socket")
+		stunnerEchoTest(echoTestConfig{t, stdnet, stdnet, stunner,
+			net.JoinHostPort(addr, "23478"), lconn, "user1", "passwd1", net.IPv4(127, 0, 0, 1),
+			"127.0.0.1:25678", true, true, true, loggerFactory, ""})
+		assert.NoError(t, lconn.Close(), "cannot close TURN client connection")
+	}
+
+	// Listeners bound to all addresses conflict with listeners on the same port.
+	c.Listeners = append(c.Listeners, listener("udp-any", "0.0.0.0"))
+	assert.Error(t, c.Validate(), "conflicting listeners")
+	c.Listeners[2].Protocol = "turn-tcp"
+	assert.NoError(t, c.Validate(), "different transports")
+}
+
+// TestStunnerTCPConnectSmallPayloads relays small payloads one at a time over an RFC 6062 TURN-TCP
+// data connection and checks that each is echoed back without waiting for more data, including
+// payloads that look like the start of a STUN message or a ChannelData frame. Run with -race to
+// check the concurrent reads of the data connection.
+func TestStunnerTCPConnectSmallPayloads(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:     stunnerTestLoglevel,
+			PeerDenyList: &[]string{},
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "tcp",
+			Protocol: "turn-tcp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Protocol:  "tcp",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogOptions:       LogOptions{Level: stunnerTestLoglevel},
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+	require.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	echoLn, err := net.Listen("tcp", "127.0.0.1:25678")
+	require.NoError(t, err, "creating TCP echo listener")
+	defer echoLn.Close()
+	go func() {
+		ec, aerr := echoLn.Accept()
+		if aerr != nil {
+			return
+		}
+		defer ec.Close()
+		buf := make([]byte, 1600)
+		for {
+			n, rerr := ec.Read(buf)
+			if n > 0 {
+				if _, werr := ec.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if rerr != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:23478")
+	require.NoError(t, err, "cannot create TCP client socket")
+	lconn := turn.NewSTUNConn(conn)
+	defer lconn.Close()
+
+	stdnet, _ := stdnet.NewNet()
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr:         "127.0.0.1:23478",
+		TURNServerAddr:         "127.0.0.1:23478",
+		Username:               "user1",
+		Password:               "passwd1",
+		Conn:                   lconn,
+		RequestedAddressFamily: turn.RequestedAddressFamilyIPv4,
+		Net:                    stdnet,
+		LoggerFactory:          loggerFactory,
+	})
+	require.NoError(t, err, "cannot create TURN client")
+	defer client.Close()
+	require.NoError(t, client.Listen(), "cannot listen on TURN client")
+
+	alloc, err := client.AllocateTCP()
+	require.NoError(t, err, "TCP allocation")
+	defer alloc.Close() //nolint:errcheck
+
+	peerAddr, err := net.ResolveTCPAddr("tcp4", "127.0.0.1:25678")
+	require.NoError(t, err, "resolve echo address")
+	require.NoError(t, client.CreatePermission(peerAddr), "create permission")
+	dataConn, err := alloc.Dial("tcp4", "127.0.0.1:25678")
+	require.NoError(t, err, "TCP connect through relay")
+	defer dataConn.Close()
+
+	buf := make([]byte, 1600)
+	for _, payload := range [][]byte{
+		{0x00, 0x10},             // STUN-like header announcing a 16-byte body
+		{0x00},                   // a single byte
+		[]byte("Hi"),             // text
+		{0x40, 0x00, 0x00, 0x20}, // ChannelData-like header
+		{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}, // STUN header with magic cookie
+		{0x80, 0xff},
+	} {
+		_, err := dataConn.Write(payload)
+		require.NoError(t, err, "write to relay")
+		require.NoError(t, dataConn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		n := 0
+		for n < len(payload) {
+			m, err := dataConn.Read(buf[n:])
+			require.NoError(t, err, "read %x from relay", payload)
+			n += m
+		}
+		assert.Equal(t, payload, buf[:n], "echoed payload")
+	}
+}
+
+func TestStunnerRelayPortRange(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:     stunnerTestLoglevel,
+			PeerDenyList: &[]string{},
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:         "udp",
+			Protocol:     "turn-udp",
+			Addr:         "127.0.0.1",
+			Port:         23478,
+			MinRelayPort: 31000,
+			MaxRelayPort: 31001,
+			Routes:       []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogOptions:       LogOptions{Level: stunnerTestLoglevel},
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	stdnet, _ := stdnet.NewNet()
+	allocate := func() (net.PacketConn, func(), error) {
+		lconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err, "cannot create UDP client socket")
+		client, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: "127.0.0.1:23478",
+			TURNServerAddr: "127.0.0.1:23478",
+			Username:       "user1",
+			Password:       "passwd1",
+			Conn:           lconn,
+			Net:            stdnet,
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err, "cannot create TURN client")
+		assert.NoError(t, client.Listen(), "cannot listen on TURN client")
+		conn, err := client.Allocate()
+		return conn, func() {
+			if conn != nil {
+				conn.Close() //nolint:errcheck
+			}
+			client.Close()
+			lconn.Close() //nolint:errcheck
+		}, err
+	}
+
+	// Relay addresses are allocated from the port range until it is exhausted.
+	ports := map[int]bool{}
+	for range 2 {
+		conn, cleanup, err := allocate()
+		defer cleanup()
+		if !assert.NoError(t, err, "allocate") {
+			return
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		assert.True(t, port == 31000 || port == 31001, "relay port out of range: %d", port)
+		assert.False(t, ports[port], "relay port reused")
+		ports[port] = true
+	}
+	_, cleanup, err := allocate()
+	assert.Error(t, err, "port range exhausted")
+	cleanup()
+
+	// Invalid port ranges are rejected.
+	c.Listeners[0].MinRelayPort = 32000
+	assert.Error(t, c.Validate(), "invalid port range")
+}
+
+func TestStunnerRelayAddress(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:     stunnerTestLoglevel,
+			PeerDenyList: &[]string{},
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:      "fixed",
+			Protocol:  "turn-udp",
+			Addr:      "127.0.0.1",
+			Port:      23478,
+			RelayAddr: "1.1.1.1, 2.2.2.2",
+			Routes:    []string{"allow-any"},
+		}, {
+			// Discovers the public IP at the other listener, which reports 127.0.0.1.
+			Name:                       "auto",
+			Protocol:                   "turn-udp",
+			Addr:                       "0.0.0.0",
+			Port:                       23479,
+			RelayAddr:                  "auto",
+			RelayAddrDiscoveryServer:   "127.0.0.1:23478",
+			RelayAddrDiscoveryInterval: "100ms",
+			Routes:                     []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogOptions:       LogOptions{Level: stunnerTestLoglevel},
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	stdnet, _ := stdnet.NewNet()
+	allocate := func(server string) (net.Addr, func(), error) {
+		lconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err, "cannot create UDP client socket")
+		client, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: server,
+			TURNServerAddr: server,
+			Username:       "user1",
+			Password:       "passwd1",
+			Conn:           lconn,
+			Net:            stdnet,
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err, "cannot create TURN client")
+		assert.NoError(t, client.Listen(), "cannot listen on TURN client")
+		conn, err := client.Allocate()
+		var addr net.Addr
+		if conn != nil {
+			addr = conn.LocalAddr()
+		}
+		return addr, func() {
+			if conn != nil {
+				conn.Close() //nolint:errcheck
+			}
+			client.Close()
+			lconn.Close() //nolint:errcheck
+		}, err
+	}
+
+	// Fixed relay addresses are advertised in a round-robin fashion.
+	addrs := map[string]bool{}
+	for range 2 {
+		addr, cleanup, err := allocate("127.0.0.1:23478")
+		defer cleanup()
+		if !assert.NoError(t, err, "allocate") {
+			return
+		}
+		addrs[addr.(*net.UDPAddr).IP.String()] = true
+	}
+	assert.Equal(t, map[string]bool{"1.1.1.1": true, "2.2.2.2": true}, addrs)
+	status := stunner.GetListener("fixed").Status().(*stnrv1.ListenerStatus)
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, status.RelayAddrs)
+
+	// The discovered public IP is advertised and reported in the status.
+	assert.Eventually(t, func() bool {
+		status := stunner.GetListener("auto").Status().(*stnrv1.ListenerStatus)
+		return len(status.RelayAddrs) == 1 && status.RelayAddrs[0] == "127.0.0.1"
+	}, 5*time.Second, 50*time.Millisecond)
+	addr, cleanup, err := allocate("127.0.0.1:23479")
+	defer cleanup()
+	assert.NoError(t, err, "allocate")
+	assert.Equal(t, "127.0.0.1", addr.(*net.UDPAddr).IP.String())
+
+	// Invalid relay addresses are rejected.
+	c.Listeners[0].RelayAddr = "1.1.1.1,0.0.0.0"
+	assert.Error(t, c.Validate(), "invalid relay address")
+}
+
 // *****************
 // Cluster tests with VNet
 // *****************
@@ -2118,6 +2580,82 @@ func TestStunnerLifecycle(t *testing.T) {
 	assert.Error(t, err, "readiness test before close: not running")
 }
 
+func TestStunnerCredentialEndpoint(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	s := NewStunner(Options{LogOptions: LogOptions{Level: stunnerTestLoglevel}})
+	defer s.Close()
+
+	hc := "http://127.0.0.1:18086"
+	conf := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:            stunnerTestLoglevel,
+			HealthCheckEndpoint: &hc,
+			CredentialEndpoint:  &stnrv1.CredentialEndpointConfig{Token: "my-token", MaxTTL: "48h"},
+		},
+		Auth: stnrv1.AuthConfig{
+			Type:        stnrv1.AuthTypeEphemeral.String(),
+			Credentials: map[string]string{"secret": "my-secret"},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:       "udp",
+			Protocol:   "turn-udp",
+			Addr:       "127.0.0.1",
+			Port:       23478,
+			PublicAddr: "1.2.3.4",
+			PublicPort: 3478,
+		}},
+	}
+	require.NoError(t, s.Reconcile(&conf))
+
+	get := func(query string, header http.Header) (int, map[string]any) {
+		req, err := http.NewRequest(http.MethodGet, hc+"/turn?"+query, nil)
+		require.NoError(t, err)
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close() //nolint:errcheck
+		reply := map[string]any{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&reply))
+		return resp.StatusCode, reply
+	}
+
+	// Unauthorized.
+	code, _ := get("service=turn&username=user", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = get("service=turn&username=user&key=wrong", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// API key in the query, default TTL.
+	code, reply := get("service=turn&username=user&key=my-token", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(86400), reply["ttl"])
+	assert.Equal(t, []any{"turn:1.2.3.4:3478?transport=udp"}, reply["uris"])
+	username := reply["username"].(string)
+	userID, err := a12n.CheckTimeWindowedUsername(username)
+	require.NoError(t, err)
+	assert.Equal(t, "user", userID)
+	password, err := a12n.GetLongTermCredential(username, "my-secret")
+	require.NoError(t, err)
+	assert.Equal(t, password, reply["password"])
+
+	// Bearer token, TTL capped at the max TTL.
+	code, reply = get("ttl=1000000", http.Header{"Authorization": []string{"Bearer my-token"}})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(48*3600), reply["ttl"])
+	assert.NotContains(t, reply["username"], ":")
+
+	// Disabled.
+	conf.Admin.CredentialEndpoint = nil
+	require.NoError(t, s.Reconcile(&conf))
+	code, _ = get("key=my-token", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
 /********************************************
  *
  *  metric server tests
@@ -2310,7 +2848,7 @@ var testConfigsV1Alpha1 = []TestConfigV1Alpha1{
 	},
 	{
 		testName:       "longterm endpoint with multiple routes ok",
-		config:         []byte(`{"version":"v1alpha1","admin":{"loglevel":"all:ERROR"},"auth":{"type":"longterm","credentials":{"secret":"my-secret"}},"listeners":[{"name":"udp","protocol":"turn-udp","public_address":"1.2.3.4","public_port":3478,"address":"127.0.0.1","port":3478,"routes":["allow-any"]}],"clusters":[{"name":"allow-any","endpoints":["0.0.0.0/0"]}]}`),
+		config:         []byte(`{"version":"v1alpha1","admin":{"loglevel":"all:ERROR"},"auth":{"type":"longterm","credentials":{"secret":"my-secret"}},"listeners":[{"name":"udp","protocol":"turn-udp","public_address":"1.2.3.4","public_port":3478,"address":"1.2.3.4","port":3478,"routes":["allow-any"]}],"clusters":[{"name":"allow-any","endpoints":["0.0.0.0/0"]}]}`),
 		echoServerAddr: "1.2.3.5:5678",
 		result:         true,
 	},
@@ -117,6 +117,7 @@ func TestTurncatPlaintext(t *testing.T) {
 		Admin: stnrv1.AdminConfig{
 			LogLevel:        turncatTestLoglevel,
 			MetricsEndpoint: "",
+			PeerDenyList:    &[]string{},
 		},
 		Auth: stnrv1.AuthConfig{
 			Type: "plaintext",
@@ -231,7 +232,8 @@ func TestTurncatLongterm(t *testing.T) {
 	err := stunner.Reconcile(&stnrv1.StunnerConfig{
 		ApiVersion: stnrv1.ApiVersion,
 		Admin: stnrv1.AdminConfig{
-			LogLevel: turncatTestLoglevel,
+			LogLevel:     turncatTestLoglevel,
+			PeerDenyList: &[]string{},
 		},
 		Auth: stnrv1.AuthConfig{
 			Type: "ephemeral",